@@ -35,42 +35,48 @@ var (
 	cliUserAgentRe = regexp.MustCompile("(?i)(lib)?curl|wget")
 )
 
-func checkAccessKey(r *http.Request, metadata *backends.Metadata) (accessKeySource, error) {
-	key := metadata.AccessKey
-	if key == "" {
-		return accessKeySourceNone, nil
+// Returns the access key the request provided once it's known to be valid,
+// since the one in the metadata may only be its hash
+func checkAccessKey(r *http.Request, fileName string, metadata *backends.Metadata) (accessKeySource, string, error) {
+	if metadata.AccessKey == "" {
+		return accessKeySourceNone, "", nil
+	}
+
+	matches := func(provided string) bool {
+		ok, err := storageBackend.CheckAccessKey(r.Context(), fileName, provided)
+		return err == nil && ok
 	}
 
 	cookieKey, err := r.Cookie(accessKeyHeaderName)
 	if err == nil {
-		if cookieKey.Value == key {
-			return accessKeySourceCookie, nil
+		if matches(cookieKey.Value) {
+			return accessKeySourceCookie, cookieKey.Value, nil
 		}
-		return accessKeySourceCookie, errInvalidAccessKey
+		return accessKeySourceCookie, "", errInvalidAccessKey
 	}
 
 	headerKey := r.Header.Get(accessKeyHeaderName)
-	if headerKey == key {
-		return accessKeySourceHeader, nil
-	} else if headerKey != "" {
-		return accessKeySourceHeader, errInvalidAccessKey
+	if headerKey != "" {
+		if matches(headerKey) {
+			return accessKeySourceHeader, headerKey, nil
+		}
+		return accessKeySourceHeader, "", errInvalidAccessKey
 	}
 
 	formKey := r.PostFormValue(accessKeyParamName)
-	if formKey == key {
-		return accessKeySourceForm, nil
-	} else if formKey != "" {
-		return accessKeySourceForm, errInvalidAccessKey
+	if formKey != "" {
+		if matches(formKey) {
+			return accessKeySourceForm, formKey, nil
+		}
+		return accessKeySourceForm, "", errInvalidAccessKey
 	}
 
 	queryKey := r.URL.Query().Get(accessKeyParamName)
-	if queryKey == key {
-		return accessKeySourceQuery, nil
-	} else if formKey != "" {
-		return accessKeySourceQuery, errInvalidAccessKey
+	if queryKey != "" && matches(queryKey) {
+		return accessKeySourceQuery, queryKey, nil
 	}
 
-	return accessKeySourceNone, errInvalidAccessKey
+	return accessKeySourceNone, "", errInvalidAccessKey
 }
 
 func setAccessKeyCookies(w http.ResponseWriter, siteURL, fileName, value string, expires time.Time) {
@@ -103,7 +109,7 @@ func fileAccessHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	fileName := c.URLParams["name"]
 
-	metadata, err := checkFile(fileName)
+	metadata, err := checkFile(r.Context(), fileName)
 	if err == backends.NotFoundErr {
 		notFoundHandler(c, w, r)
 		return
@@ -112,7 +118,8 @@ func fileAccessHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if src, err := checkAccessKey(r, &metadata); err != nil {
+	src, accessKey, err := checkAccessKey(r, fileName, &metadata)
+	if err != nil {
 		// remove invalid cookie
 		if src == accessKeySourceCookie {
 			setAccessKeyCookies(w, getSiteURL(r), fileName, "", time.Unix(0, 0))
@@ -135,13 +142,28 @@ func fileAccessHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if metadata.AccessKey != "" {
+	if accessKey != "" {
 		var expiry time.Time
 		if Config.accessKeyCookieExpiry != 0 {
 			expiry = time.Now().Add(time.Duration(Config.accessKeyCookieExpiry) * time.Second)
 		}
-		setAccessKeyCookies(w, getSiteURL(r), fileName, metadata.AccessKey, expiry)
+		setAccessKeyCookies(w, getSiteURL(r), fileName, accessKey, expiry)
 	}
 
 	fileDisplayHandler(c, w, r, fileName, metadata)
 }
+
+// Redirect a link by public ID to the file's page under whatever key it's
+// currently stored under. The redirect isn't permanent, as the key can change.
+func publicIDHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	key, err := metaStorageBackend.GetByPublicID(r.Context(), c.URLParams["id"])
+	if err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Could not look up file.")
+		return
+	}
+
+	http.Redirect(w, r, Config.sitePath+key, http.StatusFound)
+}
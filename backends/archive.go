@@ -0,0 +1,319 @@
+package backends
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var ArchiveFormatErr = errors.New("Archive format must be zip or tar.")
+
+// Size of the blocks zip archives are read in by ServeArchiveEntry, each
+// with one GetRange
+const archiveBlockSize = 64 * 1024
+
+// Write a zip or tar archive of the files under keys to w, reading each
+// one through Get as it's written. Entries are named after the files'
+// original names, or their keys if they have none, numbered when several
+// share a name. Keys that aren't found are skipped and returned, so that
+// callers can report them; any other error stops the archive.
+func StreamArchive(ctx context.Context, b StorageBackend, keys []string, format string, w io.Writer) (skipped []string, err error) {
+	var aw archiveWriter
+	switch format {
+	case "zip":
+		aw = zipArchiveWriter{zip.NewWriter(w)}
+	case "tar":
+		aw = tarArchiveWriter{tar.NewWriter(w)}
+	default:
+		return nil, ArchiveFormatErr
+	}
+
+	names := make(map[string]bool)
+	for _, key := range keys {
+		m, f, err := b.Get(ctx, key)
+		if err == NotFoundErr {
+			skipped = append(skipped, key)
+			continue
+		} else if err != nil {
+			return skipped, err
+		}
+
+		err = aw.add(archiveEntryName(key, m, names), m, f)
+		f.Close()
+		if err != nil {
+			return skipped, err
+		}
+	}
+
+	return skipped, aw.Close()
+}
+
+// A name for the entry of key that isn't in names yet, which it's added to.
+// Only the last element of the original name is kept, so that entries
+// can't be extracted outside of the archive's directory.
+func archiveEntryName(key string, m Metadata, names map[string]bool) string {
+	name := path.Base(strings.ReplaceAll(m.OriginalName, "\\", "/"))
+	if m.OriginalName == "" || name == "." || name == ".." || name == "/" {
+		name = key
+	}
+
+	unique := name
+	ext := path.Ext(name)
+	for i := 2; names[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	names[unique] = true
+	return unique
+}
+
+type archiveWriter interface {
+	add(name string, m Metadata, r io.Reader) error
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (z zipArchiveWriter) add(name string, m Metadata, r io.Reader) error {
+	fw, err := z.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: m.Uploaded,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (t tarArchiveWriter) add(name string, m Metadata, r io.Reader) error {
+	err := t.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     m.Size,
+		ModTime:  m.Uploaded,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The header promised m.Size bytes, so a shorter file can't be
+	// written as it is
+	_, err = io.CopyN(t, r, m.Size)
+	return err
+}
+
+// Serve the file at entryPath inside the archive stored under key, with
+// the mimetype of its extension, or sniffed from its content if it has
+// none. The entry is decompressed as it's sent, without reading the rest
+// of the archive: zip archives are read a block at a time with GetRange,
+// tar archives sequentially up to the entry. Returns NotFoundErr if
+// entryPath isn't a file in the archive's ArchiveFiles, and
+// NotSupportedErr for entries of archives nested in it, or of formats
+// other than zip and tar.
+func ServeArchiveEntry(b StorageBackend, key string, entryPath string, w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	entry, nested := findArchiveEntry(m.ArchiveFiles, entryPath)
+	if entry == nil {
+		return NotFoundErr
+	} else if nested {
+		return NotSupportedErr
+	}
+
+	content, size, err := openArchiveEntry(ctx, b, key, m, entryPath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	br := bufio.NewReader(content)
+	mimetype := mime.TypeByExtension(path.Ext(entryPath))
+	if mimetype == "" {
+		sniffed, _ := br.Peek(512)
+		mimetype = http.DetectContentType(sniffed)
+	}
+
+	// The entry is served as a file of its own, so it gets the policies
+	// of its own mimetype and an ETag of its own
+	em := Metadata{
+		Mimetype:     mimetype,
+		OriginalName: path.Base(entryPath),
+		ModTime:      entry.Modified,
+	}
+	if m.ETag != "" {
+		sum := sha256.Sum256([]byte(entryPath))
+		em.ETag = strings.TrimSuffix(m.ETag, "\"") + "-" + hex.EncodeToString(sum[:8]) + "\""
+	}
+	SetServeHeaders(w, r, key, em)
+	w = ThrottleDownload(w, r, m)
+	w.Header().Set("Content-Type", mimetype)
+	if CheckPreconditions(w, r, em) {
+		return nil
+	}
+
+	return ServeReader(w, r, br, size, mimetype)
+}
+
+// Open the file entry called name in the archive stored under key, whose
+// metadata is m, returning it along with its uncompressed size
+func openArchiveEntry(ctx context.Context, b StorageBackend, key string, m Metadata, name string) (io.ReadCloser, int64, error) {
+	switch mimetype, _, _ := strings.Cut(m.Mimetype, ";"); strings.TrimSpace(mimetype) {
+	case "application/zip":
+		zr, err := zip.NewReader(&rangeReaderAt{ctx: ctx, b: b, key: key, size: m.Size}, m.Size)
+		if err != nil {
+			return nil, 0, err
+		}
+		zf := findZipFile(zr, name)
+		if zf == nil {
+			return nil, 0, NotFoundErr
+		}
+		f, err := zf.Open()
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, int64(zf.UncompressedSize64), nil
+	case "application/x-tar", "application/x-gzip", "application/x-bzip":
+		_, f, err := b.Get(ctx, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		content, size, err := openTarEntry(f, m.Mimetype, name)
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{content, f}, size, nil
+	default:
+		return nil, 0, NotSupportedErr
+	}
+}
+
+// The file entry at name, and whether it's inside a nested archive, whose
+// own entry precedes it in name
+func findArchiveEntry(files []ArchiveEntry, name string) (entry *ArchiveEntry, nested bool) {
+	for i := range files {
+		if files[i].Name == name && !files[i].IsDir {
+			entry = &files[i]
+		}
+	}
+	if entry == nil {
+		return
+	}
+
+	for _, f := range files {
+		if !f.IsDir && strings.HasPrefix(name, f.Name+"/") {
+			return entry, true
+		}
+	}
+	return entry, false
+}
+
+func findZipFile(zr *zip.Reader, name string) *zip.File {
+	for _, f := range zr.File {
+		if f.Name == name && !f.FileInfo().IsDir() {
+			return f
+		}
+	}
+	return nil
+}
+
+// Read the tar archive in r, compressed as mimetype says, up to the file
+// entry called name
+func openTarEntry(r io.Reader, mimetype string, name string) (io.Reader, int64, error) {
+	switch {
+	case strings.HasPrefix(mimetype, "application/x-gzip"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		r = gz
+	case strings.HasPrefix(mimetype, "application/x-bzip"):
+		r = bzip2.NewReader(r)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, 0, NotFoundErr
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if hdr.Name == name && hdr.Typeflag == tar.TypeReg {
+			return tr, hdr.Size, nil
+		}
+	}
+}
+
+// An io.ReaderAt over a stored file, reading it with GetRange a block at a
+// time and keeping the last block read, as reading a zip archive takes many
+// small reads
+type rangeReaderAt struct {
+	ctx  context.Context
+	b    StorageBackend
+	key  string
+	size int64
+
+	block       []byte
+	blockOffset int64
+}
+
+func (ra *rangeReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= ra.size {
+			return n, io.EOF
+		}
+		if ra.block == nil || pos < ra.blockOffset || pos >= ra.blockOffset+int64(len(ra.block)) {
+			if err := ra.load(pos - pos%archiveBlockSize); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], ra.block[pos-ra.blockOffset:])
+	}
+	return n, nil
+}
+
+func (ra *rangeReaderAt) load(offset int64) error {
+	length := min(archiveBlockSize, ra.size-offset)
+	rc, err := ra.b.GetRange(ra.ctx, ra.key, offset, length)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	block := make([]byte, length)
+	if _, err := io.ReadFull(rc, block); err != nil {
+		return err
+	}
+	ra.block, ra.blockOffset = block, offset
+	return nil
+}
@@ -0,0 +1,174 @@
+package backends
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serves fixed files, whose content is their key
+type archiveBackend struct {
+	StorageBackend
+	names map[string]string
+}
+
+func (b archiveBackend) Get(ctx context.Context, key string) (Metadata, io.ReadCloser, error) {
+	name, ok := b.names[key]
+	if !ok {
+		return Metadata{}, nil, NotFoundErr
+	}
+	return Metadata{OriginalName: name, Size: int64(len(key))}, io.NopCloser(strings.NewReader(key)), nil
+}
+
+func TestStreamArchive(t *testing.T) {
+	b := archiveBackend{names: map[string]string{
+		"a": "photo.jpg",
+		"b": "photo.jpg",
+		"c": "../../etc/passwd",
+		"d": "",
+	}}
+	keys := []string{"a", "b", "missing", "c", "d"}
+	want := "photo.jpg:a,photo (2).jpg:b,passwd:c,d:d"
+
+	for _, format := range []string{"zip", "tar"} {
+		var buf bytes.Buffer
+		skipped, err := StreamArchive(context.Background(), b, keys, format, &buf)
+		if err != nil || len(skipped) != 1 || skipped[0] != "missing" {
+			t.Fatalf("Streaming %s returned %v, %v", format, skipped, err)
+		}
+
+		var entries []string
+		if format == "zip" {
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range zr.File {
+				rc, _ := f.Open()
+				content, _ := io.ReadAll(rc)
+				entries = append(entries, f.Name+":"+string(content))
+			}
+		} else {
+			tr := tar.NewReader(&buf)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				content, _ := io.ReadAll(tr)
+				entries = append(entries, hdr.Name+":"+string(content))
+			}
+		}
+
+		if got := strings.Join(entries, ","); got != want {
+			t.Errorf("%s archive had %s instead of %s", format, got, want)
+		}
+	}
+
+	if _, err := StreamArchive(context.Background(), b, keys, "rar", io.Discard); err != ArchiveFormatErr {
+		t.Errorf("Unknown format returned %v", err)
+	}
+}
+
+// Stores a single archive
+type storedArchiveBackend struct {
+	StorageBackend
+	m    Metadata
+	data []byte
+}
+
+func (b storedArchiveBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	return b.m, nil
+}
+
+func (b storedArchiveBackend) Get(ctx context.Context, key string) (Metadata, io.ReadCloser, error) {
+	return b.m, io.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+func (b storedArchiveBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return io.NopCloser(io.NewSectionReader(bytes.NewReader(b.data), offset, length)), nil
+}
+
+func TestServeArchiveEntry(t *testing.T) {
+	page := "<html>" + strings.Repeat("x", 3*archiveBlockSize) + "</html>"
+	files := []struct{ name, content string }{
+		{"site/index.html", page},
+		{"site/README", "plain text"},
+		{"inner.zip", "not listed any further"},
+	}
+	listing := []ArchiveEntry{
+		{Name: "site/", IsDir: true},
+		{Name: "site/index.html", Size: int64(len(page))},
+		{Name: "site/README", Size: 10},
+		{Name: "inner.zip", Size: 22},
+		{Name: "inner.zip/nested.txt", Size: 4},
+	}
+
+	var zipped, tarred bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	tw := tar.NewWriter(&tarred)
+	for _, f := range files {
+		fw, _ := zw.Create(f.name)
+		fw.Write([]byte(f.content))
+		tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content))})
+		tw.Write([]byte(f.content))
+	}
+	zw.Close()
+	tw.Close()
+
+	for _, archive := range []struct {
+		mimetype string
+		data     []byte
+	}{
+		{"application/zip", zipped.Bytes()},
+		{"application/x-tar", tarred.Bytes()},
+	} {
+		b := storedArchiveBackend{
+			m:    Metadata{Mimetype: archive.mimetype, Size: int64(len(archive.data)), ArchiveFiles: listing, ETag: "\"sum\""},
+			data: archive.data,
+		}
+
+		w := httptest.NewRecorder()
+		if err := ServeArchiveEntry(b, "key", "site/index.html", w, httptest.NewRequest("GET", "/key/site/index.html", nil)); err != nil {
+			t.Fatal(err)
+		}
+		if w.Body.String() != page || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("%s entry was served as %q with %d bytes", archive.mimetype, w.Header().Get("Content-Type"), w.Body.Len())
+		}
+		if etag := w.Header().Get("Etag"); etag == b.m.ETag || !strings.HasPrefix(etag, "\"sum-") {
+			t.Errorf("%s entry has ETag %s", archive.mimetype, etag)
+		}
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/key/site/README", nil)
+		r.Header.Set("Range", "bytes=6-")
+		if err := ServeArchiveEntry(b, "key", "site/README", w, r); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 206 || w.Body.String() != "text" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("%s range was %d %q as %q", archive.mimetype, w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+		}
+
+		for entry, want := range map[string]error{
+			"site/missing":         NotFoundErr,
+			"site/":                NotFoundErr,
+			"inner.zip/nested.txt": NotSupportedErr,
+		} {
+			if err := ServeArchiveEntry(b, "key", entry, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); err != want {
+				t.Errorf("%s entry %s returned %v instead of %v", archive.mimetype, entry, err, want)
+			}
+		}
+	}
+
+	b := storedArchiveBackend{m: Metadata{Mimetype: "application/x-7z-compressed", ArchiveFiles: listing}}
+	if err := ServeArchiveEntry(b, "key", "site/README", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); err != NotSupportedErr {
+		t.Errorf("7-Zip entry returned %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A read-only file system of the entries of an archive stored under key,
+// for http.FileServer, fs.WalkDir and the like. Its directories are built
+// from the archive's ArchiveFiles, including the parents of entries the
+// archive doesn't list itself, and files are only read from the stored
+// archive once they're read from, as ServeArchiveEntry would. Archives
+// nested in it are files of their own rather than directories, and a
+// truncated listing only has the entries that were listed. Returns
+// NotSupportedErr for formats other than zip and tar. Entries are read
+// without a context, as fs.FS has none to pass on.
+func ArchiveFS(b StorageBackend, key string) (fs.FS, error) {
+	ctx := context.Background()
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mimetype, _, _ := strings.Cut(m.Mimetype, ";"); strings.TrimSpace(mimetype) {
+	case "application/zip", "application/x-tar", "application/x-gzip", "application/x-bzip":
+	default:
+		return nil, NotSupportedErr
+	}
+
+	a := &archiveFS{
+		ctx:   ctx,
+		b:     b,
+		key:   key,
+		m:     m,
+		nodes: map[string]*archiveNode{".": {name: ".", dir: true, modified: m.ModTime}},
+	}
+
+	files := make(map[string]bool)
+	for _, entry := range m.ArchiveFiles {
+		if !entry.IsDir {
+			files[entry.Name] = true
+		}
+	}
+
+	for _, entry := range m.ArchiveFiles {
+		name := path.Clean(strings.TrimSuffix(entry.Name, "/"))
+		if !fs.ValidPath(name) || name == "." || (entry.IsDir && files[name]) || a.inFile(name, files) {
+			continue
+		}
+
+		n := a.node(name, entry.IsDir)
+		if n == nil {
+			continue
+		}
+		n.entry, n.size, n.modified = entry.Name, entry.Size, entry.Modified
+	}
+
+	for _, n := range a.nodes {
+		slices.SortFunc(n.children, func(x, y *archiveNode) int {
+			return strings.Compare(x.name, y.name)
+		})
+	}
+	return a, nil
+}
+
+type archiveFS struct {
+	ctx   context.Context
+	b     StorageBackend
+	key   string
+	m     Metadata
+	nodes map[string]*archiveNode
+}
+
+// Whether a parent of name is a file, such as a nested archive
+func (a *archiveFS) inFile(name string, files map[string]bool) bool {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if files[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// The node at name, added along with any of its parent directories that
+// aren't there yet, or nil if it's already there as the other of a file
+// or a directory
+func (a *archiveFS) node(name string, dir bool) *archiveNode {
+	if n, ok := a.nodes[name]; ok {
+		if n.dir != dir {
+			return nil
+		}
+		return n
+	}
+
+	parent := a.node(path.Dir(name), true)
+	if parent == nil {
+		return nil
+	}
+	n := &archiveNode{name: path.Base(name), dir: dir}
+	parent.children = append(parent.children, n)
+	a.nodes[name] = n
+	return n
+}
+
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n, ok := a.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if n.dir {
+		return &archiveDir{archiveNode: n}, nil
+	}
+	return &archiveFile{a: a, archiveNode: n, path: name}, nil
+}
+
+// A file or directory of an archiveFS, which is its own fs.FileInfo
+type archiveNode struct {
+	name     string
+	dir      bool
+	size     int64
+	modified time.Time
+	// Name of the entry in the archive, which is empty for directories
+	// the archive doesn't list
+	entry    string
+	children []*archiveNode
+}
+
+func (n *archiveNode) Name() string {
+	return n.name
+}
+
+func (n *archiveNode) Size() int64 {
+	if n.dir {
+		return 0
+	}
+	return n.size
+}
+
+func (n *archiveNode) Mode() fs.FileMode {
+	if n.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (n *archiveNode) ModTime() time.Time {
+	return n.modified
+}
+
+func (n *archiveNode) IsDir() bool {
+	return n.dir
+}
+
+func (n *archiveNode) Sys() any {
+	return nil
+}
+
+type archiveDir struct {
+	*archiveNode
+	read int
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) {
+	return d.archiveNode, nil
+}
+
+func (d *archiveDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *archiveDir) Close() error {
+	return nil
+}
+
+func (d *archiveDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := d.children[d.read:]
+	if count > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > 0 && count < len(remaining) {
+		remaining = remaining[:count]
+	}
+
+	entries := make([]fs.DirEntry, len(remaining))
+	for i, n := range remaining {
+		entries[i] = fs.FileInfoToDirEntry(n)
+	}
+	d.read += len(remaining)
+	return entries, nil
+}
+
+// An entry opened from an archiveFS, which isn't read from the stored
+// archive until it's read from. Seeking back reads it again from its
+// start, and seeking forward skips over it, as entries can only be read
+// sequentially.
+type archiveFile struct {
+	*archiveNode
+	a    *archiveFS
+	path string
+
+	r      io.ReadCloser
+	offset int64
+	// Where r is in the entry
+	position int64
+	closed   bool
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) {
+	return f.archiveNode, nil
+}
+
+func (f *archiveFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: fs.ErrClosed}
+	}
+
+	if f.r != nil && f.position > f.offset {
+		f.r.Close()
+		f.r = nil
+	}
+	if f.r == nil {
+		r, _, err := openArchiveEntry(f.a.ctx, f.a.b, f.a.key, f.a.m, f.entry)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.path, Err: err}
+		}
+		f.r, f.position = r, 0
+	}
+	if f.position < f.offset {
+		skipped, err := io.CopyN(io.Discard, f.r, f.offset-f.position)
+		f.position += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.r.Read(p)
+	f.position += int64(n)
+	f.offset = f.position
+	return n, err
+}
+
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *archiveFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.path, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package backends
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestArchiveFS(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := []struct{ name, content string }{
+		{"site/index.html", "<html>" + strings.Repeat("x", 3*archiveBlockSize) + "</html>"},
+		{"site/img/logo.svg", "<svg></svg>"},
+		{"notes", "first line\nsecond line"},
+		{"inner.zip", "not listed any further"},
+	}
+	listing := []ArchiveEntry{
+		{Name: "site/", IsDir: true, Modified: modified},
+		{Name: "site/index.html", Size: int64(len(files[0].content)), Modified: modified},
+		{Name: "site/img/logo.svg", Size: 11},
+		{Name: "notes", Size: 22},
+		{Name: "inner.zip", Size: 22},
+		{Name: "inner.zip/nested.txt", Size: 4},
+		{Name: "../escaped", Size: 1},
+	}
+
+	var zipped, tarred bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	tw := tar.NewWriter(&tarred)
+	for _, f := range files {
+		fw, _ := zw.Create(f.name)
+		fw.Write([]byte(f.content))
+		tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content))})
+		tw.Write([]byte(f.content))
+	}
+	zw.Close()
+	tw.Close()
+
+	for _, archive := range []struct {
+		mimetype string
+		data     []byte
+	}{
+		{"application/zip", zipped.Bytes()},
+		{"application/x-tar", tarred.Bytes()},
+	} {
+		b := storedArchiveBackend{
+			m:    Metadata{Mimetype: archive.mimetype, Size: int64(len(archive.data)), ArchiveFiles: listing},
+			data: archive.data,
+		}
+		fsys, err := ArchiveFS(b, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fstest.TestFS(fsys, "site/index.html", "site/img/logo.svg", "notes", "inner.zip"); err != nil {
+			t.Fatalf("%s: %v", archive.mimetype, err)
+		}
+
+		var walked []string
+		fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			walked = append(walked, path)
+			return err
+		})
+		if got := strings.Join(walked, " "); got != ". inner.zip notes site site/img site/img/logo.svg site/index.html" {
+			t.Errorf("%s walked %s", archive.mimetype, got)
+		}
+
+		if info, err := fs.Stat(fsys, "site"); err != nil || !info.ModTime().Equal(modified) {
+			t.Errorf("%s directory was %v, %v", archive.mimetype, info, err)
+		}
+		if content, err := fs.ReadFile(fsys, "site/index.html"); err != nil || string(content) != files[0].content {
+			t.Errorf("%s entry read %d bytes, %v", archive.mimetype, len(content), err)
+		}
+
+		server := http.FileServer(http.FS(fsys))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/notes", nil)
+		r.Header.Set("Range", "bytes=11-")
+		server.ServeHTTP(w, r)
+		if w.Code != 206 || w.Body.String() != "second line" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("%s range was %d %q as %q", archive.mimetype, w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+		}
+
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/site/", nil))
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "<html>xxx") {
+			t.Errorf("%s directory index was %d with %d bytes", archive.mimetype, w.Code, w.Body.Len())
+		}
+	}
+
+	b := storedArchiveBackend{m: Metadata{Mimetype: "application/x-7z-compressed", ArchiveFiles: listing}}
+	if _, err := ArchiveFS(b, "key"); err != NotSupportedErr {
+		t.Errorf("7-Zip archive returned %v", err)
+	}
+}
+
+func TestArchiveFileSeek(t *testing.T) {
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	fw, _ := zw.Create("digits")
+	fw.Write([]byte("0123456789"))
+	zw.Close()
+
+	b := storedArchiveBackend{
+		m:    Metadata{Mimetype: "application/zip", Size: int64(zipped.Len()), ArchiveFiles: []ArchiveEntry{{Name: "digits", Size: 10}}},
+		data: zipped.Bytes(),
+	}
+	fsys, err := ArchiveFS(b, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.Open("digits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rs := f.(io.ReadSeeker)
+
+	p := make([]byte, 3)
+	for _, seek := range []struct {
+		offset int64
+		whence int
+		want   string
+	}{
+		{6, io.SeekStart, "678"},
+		{2, io.SeekStart, "234"},
+		{1, io.SeekCurrent, "678"},
+		{-2, io.SeekEnd, "89"},
+	} {
+		if _, err := rs.Seek(seek.offset, seek.whence); err != nil {
+			t.Fatal(err)
+		}
+		n, _ := io.ReadFull(rs, p)
+		if string(p[:n]) != seek.want {
+			t.Errorf("Seeking to %d from %d read %q", seek.offset, seek.whence, p[:n])
+		}
+	}
+	if _, err := rs.Seek(-11, io.SeekEnd); err == nil {
+		t.Error("Seeking before the start succeeded")
+	}
+}
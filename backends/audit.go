@@ -0,0 +1,194 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Records why and by whom files were deleted
+type AuditLogger interface {
+	LogDelete(key, reason, actor string) error
+}
+
+type deleteReasonKey struct{}
+
+type deleteReason struct {
+	reason, actor string
+}
+
+// Returns a context that has deletes through an AuditedBackend record
+// reason and actor, as Delete has no arguments for them
+func WithDeleteReason(ctx context.Context, reason, actor string) context.Context {
+	return context.WithValue(ctx, deleteReasonKey{}, deleteReason{reason, actor})
+}
+
+// The reason and actor ctx was given by WithDeleteReason, if any
+func DeleteReason(ctx context.Context) (reason, actor string) {
+	r, _ := ctx.Value(deleteReasonKey{}).(deleteReason)
+	return r.reason, r.actor
+}
+
+// Delete key from b, recording reason and actor if it's audited
+func DeleteWithReason(ctx context.Context, b StorageBackend, key, reason, actor string) error {
+	return b.Delete(WithDeleteReason(ctx, reason, actor), key)
+}
+
+// Wraps a StorageBackend, recording each file it deletes with the reason
+// and actor of the context it was deleted with. A delete that can't be
+// recorded still happens, but returns AuditLogErr.
+type AuditedBackend struct {
+	StorageBackend
+	logger AuditLogger
+}
+
+func NewAuditedBackend(b StorageBackend, logger AuditLogger) AuditedBackend {
+	return AuditedBackend{b, logger}
+}
+
+func (b AuditedBackend) Delete(ctx context.Context, key string) error {
+	if err := b.StorageBackend.Delete(ctx, key); err != nil {
+		return err
+	}
+	return b.logDelete(ctx, key)
+}
+
+func (b AuditedBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	deleted, errs := b.StorageBackend.BatchDelete(ctx, keys)
+	for _, key := range deleted {
+		if err := b.logDelete(ctx, key); err != nil {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[key] = err
+		}
+	}
+	return deleted, errs
+}
+
+func (b AuditedBackend) logDelete(ctx context.Context, key string) error {
+	reason, actor := DeleteReason(ctx)
+	if err := b.logger.LogDelete(key, reason, actor); err != nil {
+		return fmt.Errorf("%w: %w", AuditLogErr, err)
+	}
+	return nil
+}
+
+type AuditedMetaBackend struct {
+	AuditedBackend
+	metaForwarder
+}
+
+func NewAuditedMetaBackend(b MetaStorageBackend, logger AuditLogger) AuditedMetaBackend {
+	return AuditedMetaBackend{NewAuditedBackend(b, logger), metaForwarder{b}}
+}
+
+// A line of an audit log. Prev is the sha256sum of the line before it, so
+// that removing or changing a line breaks the chain after it.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Key    string    `json:"key"`
+	Reason string    `json:"reason,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Prev   string    `json:"prev"`
+}
+
+// An AuditLogger appending an AuditEntry per delete to a file, as JSON lines
+type FileAuditLogger struct {
+	mu   *sync.Mutex
+	f    *os.File
+	prev *string
+}
+
+// Open the audit log at path for appending, creating it if it doesn't
+// exist. The last line is read to continue the chain from.
+func NewFileAuditLogger(path string) (FileAuditLogger, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return FileAuditLogger{}, err
+	}
+
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return FileAuditLogger{}, err
+	}
+
+	prev := ""
+	if len(last) > 0 {
+		prev = lineSum(last)
+	}
+	return FileAuditLogger{&sync.Mutex{}, f, &prev}, nil
+}
+
+func (l FileAuditLogger) LogDelete(key, reason, actor string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	line, err := json.Marshal(AuditEntry{
+		Time:   time.Now().UTC(),
+		Action: "delete",
+		Key:    key,
+		Reason: reason,
+		Actor:  actor,
+		Prev:   *l.prev,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	*l.prev = lineSum(line)
+	return nil
+}
+
+func (l FileAuditLogger) Close() error {
+	return l.f.Close()
+}
+
+// Check that each entry of an audit log follows the one before it,
+// returning how many there are, or AuditLogTamperedErr with the first
+// entry that doesn't
+func VerifyAuditLog(r io.Reader) (entries int, err error) {
+	prev := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil || entry.Prev != prev {
+			return entries, fmt.Errorf("%w: entry %d", AuditLogTamperedErr, entries+1)
+		}
+		prev = lineSum(line)
+		entries++
+	}
+	return entries, scanner.Err()
+}
+
+func lineSum(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,60 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditedBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	logger, err := NewFileAuditLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewAuditedBackend(&memBackend{files: map[string]string{"a": "1", "b": "2"}}, logger)
+
+	ctx := context.Background()
+	if err := DeleteWithReason(ctx, b, "a", "abuse report", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, "missing"); err != NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+	logger.Close()
+
+	// Reopening continues the chain
+	logger, err = NewFileAuditLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	if err := NewAuditedBackend(b.StorageBackend, logger).Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := VerifyAuditLog(bytes.NewReader(data)); err != nil || n != 2 {
+		t.Fatalf("Expected 2 valid entries, got %d and %v", n, err)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	var entry AuditEntry
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Key != "a" || entry.Reason != "abuse report" || entry.Actor != "admin" || entry.Action != "delete" {
+		t.Fatalf("Unexpected entry %+v", entry)
+	}
+
+	if _, err := VerifyAuditLog(bytes.NewReader(lines[1])); !errors.Is(err, AuditLogTamperedErr) {
+		t.Fatalf("Expected a removed entry to be found, got %v", err)
+	}
+}
@@ -0,0 +1,1001 @@
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/dchest/uniuri"
+)
+
+type AzureBackend struct {
+	container *container.Client
+	cred      *container.SharedKeyCredential
+	name      string
+	sasExpiry time.Duration
+	scanner   backends.Scanner
+	files     *backends.FileCounter
+}
+
+type AzureOptions struct {
+	// Blob service endpoint, such as http://127.0.0.1:10000/devstoreaccount1
+	// for Azurite. Defaults to https://<account>.blob.core.windows.net/
+	ServiceURL string
+
+	AccountName string
+	AccountKey  string
+
+	// When set, ServeFile redirects to a SAS URL valid for this long
+	// instead of proxying the blob through linx-server
+	SASExpiry time.Duration
+
+	// Scan new files with this before uploading them, if set
+	Scanner backends.Scanner
+}
+
+// Blob metadata is limited to 8 KiB in total, so archive listings are cut
+// short to fit in this once encoded
+const maxArchiveFilesSize = 4096
+
+var copyFailedErr = errors.New("Blob copy did not succeed.")
+
+// Most sub-requests the service accepts in a single batch
+const maxBatchSize = 256
+
+// How many blobs HeadMany reads at the same time, as batches can't read
+// properties
+const headManyWorkers = 16
+
+// How often to check on a copy the service didn't finish synchronously
+const copyPollInterval = 500 * time.Millisecond
+
+func (b AzureBackend) blob(key string) *blockblob.Client {
+	return b.container.NewBlockBlobClient(key)
+}
+
+func isNotFound(err error) bool {
+	return bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound)
+}
+
+// Uploads in progress would have to be kept somewhere every instance can
+// reach, so they aren't supported
+func (b AzureBackend) Append(ctx context.Context, key string, r io.Reader, offset int64) (int64, error) {
+	return 0, backends.NotSupportedErr
+}
+
+func (b AzureBackend) PurgeUploads(ctx context.Context, olderThan time.Duration) error {
+	return backends.NotSupportedErr
+}
+
+func (b AzureBackend) Capabilities() backends.Caps {
+	return backends.Caps{
+		SupportsPresign: true,
+		SupportsRange:   true,
+		SupportsCopy:    true,
+		SupportsList:    true,
+	}
+}
+
+func (b AzureBackend) CheckAccessKey(ctx context.Context, key, provided string) (bool, error) {
+	return backends.CheckAccessKey(ctx, b, key, provided)
+}
+
+func (b AzureBackend) CheckDeleteKey(ctx context.Context, key, provided string) (bool, error) {
+	return backends.CheckDeleteKey(ctx, b, key, provided)
+}
+
+func (b AzureBackend) Copy(ctx context.Context, srcKey, dstKey string) (m backends.Metadata, err error) {
+	if err = backends.ValidateKey(dstKey); err != nil {
+		return
+	}
+	m, err = b.Head(ctx, srcKey)
+	if err != nil {
+		return
+	}
+	// If-None-Match on the copy refuses a blob that shows up after this
+	var exists bool
+	if exists, err = b.Exists(ctx, dstKey); err != nil {
+		return
+	} else if exists {
+		return m, backends.KeyExistsErr
+	}
+	done, err := b.files.Check(ctx, b, dstKey)
+	if err != nil {
+		return
+	}
+	defer done(false)
+
+	m.PublicID = backends.NewPublicID()
+	m.DeleteKey = uniuri.NewLen(30)
+	m.Uploaded = time.Now()
+
+	err = b.copyBlob(ctx, srcKey, dstKey, &blob.StartCopyFromURLOptions{
+		Metadata: mapMetadata(m),
+		BlobTags: m.Tags,
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{
+				IfNoneMatch: to.Ptr(azcore.ETagAny),
+			},
+		},
+	})
+	if bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+		return m, backends.KeyExistsErr
+	} else if err == nil {
+		done(true)
+	}
+	return
+}
+
+// Copy a blob within the container and wait for the copy to complete
+func (b AzureBackend) copyBlob(ctx context.Context, srcKey, dstKey string, options *blob.StartCopyFromURLOptions) error {
+	dst := b.blob(dstKey).BlobClient()
+	resp, err := dst.StartCopyFromURL(ctx, b.blob(srcKey).URL(), options)
+	if isNotFound(err) {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return err
+	}
+
+	// Copies within an account normally complete right away, but may
+	// also finish asynchronously
+	status := resp.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		time.Sleep(copyPollInterval)
+
+		props, err := dst.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		status = props.CopyStatus
+	}
+	if status != nil && *status != blob.CopyStatusTypeSuccess {
+		return copyFailedErr
+	}
+
+	return nil
+}
+
+func (b AzureBackend) Delete(ctx context.Context, key string) error {
+	if err := backends.ValidateKey(key); err != nil {
+		return err
+	}
+	_, err := b.blob(key).Delete(ctx, nil)
+	if isNotFound(err) {
+		return backends.NotFoundErr
+	} else if err == nil {
+		b.files.Add(-1)
+	}
+	return err
+}
+
+func (b AzureBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	results := make([]error, len(keys))
+
+	for start := 0; start < len(keys); start += maxBatchSize {
+		end := min(start+maxBatchSize, len(keys))
+		b.submitDeleteBatch(ctx, keys[start:end], results[start:end])
+	}
+
+	deleted, errs := backends.BatchResults(keys, results)
+	b.files.Add(-int64(len(deleted)))
+	return deleted, errs
+}
+
+// Delete keys with a single batch request, storing the result of each in
+// the matching element of results
+func (b AzureBackend) submitDeleteBatch(ctx context.Context, keys []string, results []error) {
+	fail := func(err error) {
+		for i := range results {
+			results[i] = err
+		}
+	}
+
+	bb, err := b.container.NewBatchBuilder()
+	if err != nil {
+		fail(err)
+		return
+	}
+	for _, key := range keys {
+		if err := bb.Delete(key, nil); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	resp, err := b.container.SubmitBatch(ctx, bb, nil)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	for _, item := range resp.Responses {
+		if item.ContentID == nil || *item.ContentID < 0 || *item.ContentID >= len(keys) {
+			continue
+		}
+		if isNotFound(item.Error) {
+			results[*item.ContentID] = backends.NotFoundErr
+		} else {
+			results[*item.ContentID] = item.Error
+		}
+	}
+}
+
+func (b AzureBackend) Exists(ctx context.Context, key string) (bool, error) {
+	if err := backends.ValidateKey(key); err != nil {
+		return false, err
+	}
+	_, err := b.blob(key).GetProperties(ctx, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b AzureBackend) HealthCheck(ctx context.Context) error {
+	_, err := b.container.GetProperties(ctx, nil)
+	return err
+}
+
+func (b AzureBackend) Head(ctx context.Context, key string) (metadata backends.Metadata, err error) {
+	if err = backends.ValidateKey(key); err != nil {
+		return
+	}
+	props, err := b.blob(key).GetProperties(ctx, nil)
+	if isNotFound(err) {
+		return metadata, backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
+	metadata, err = unmapMetadata(props.Metadata)
+	if err != nil {
+		return
+	}
+	if props.ContentType != nil {
+		metadata.Mimetype = *props.ContentType
+	}
+	if props.ContentLength != nil {
+		metadata.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		metadata.ModTime = *props.LastModified
+	}
+	if props.TagCount != nil && *props.TagCount > 0 {
+		if metadata.Tags, err = b.tags(ctx, key); err != nil {
+			return
+		}
+	}
+
+	// Blobs uploaded before this was recorded fall back to their creation
+	// time, which a rename resets
+	if metadata.Uploaded.IsZero() && props.CreationTime != nil {
+		metadata.Uploaded = *props.CreationTime
+	}
+	metadata.ETag = backends.ETag(metadata.Sha256sum)
+
+	return
+}
+
+func (b AzureBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (backends.Metadata, error) {
+	return backends.Metadata{}, backends.NotSupportedErr
+}
+
+// Deleted objects can be kept with the storage account's blob soft delete instead, so
+// there is no trash to manage
+func (b AzureBackend) GetDeleted(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	return backends.Metadata{}, nil, backends.NotSupportedErr
+}
+
+func (b AzureBackend) PurgeTrash(ctx context.Context, olderThan time.Duration) error {
+	return backends.NotSupportedErr
+}
+
+func (b AzureBackend) Restore(ctx context.Context, key string) error {
+	return backends.NotSupportedErr
+}
+
+func (b AzureBackend) Get(ctx context.Context, key string) (metadata backends.Metadata, r io.ReadCloser, err error) {
+	metadata, err = b.Head(ctx, key)
+	if err != nil {
+		return
+	}
+
+	resp, err := b.blob(key).DownloadStream(ctx, nil)
+	if isNotFound(err) {
+		return metadata, nil, backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
+	return metadata, resp.Body, nil
+}
+
+func (b AzureBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err = backends.RangeLength(m.Size, offset, length)
+	if err != nil {
+		return nil, err
+	} else if length == 0 {
+		// A count of 0 would read to the end instead
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	resp, err := b.blob(key).DownloadStream(ctx, &blob.DownloadStreamOptions{
+		Range: blob.HTTPRange{Offset: offset, Count: length},
+	})
+	if isNotFound(err) {
+		return nil, backends.NotFoundErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (b AzureBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
+	metadata, err := b.Head(r.Context(), key)
+	if err != nil {
+		return
+	}
+
+	backends.SetServeHeaders(w, r, key, metadata)
+	w = backends.ThrottleDownload(w, r, metadata)
+
+	// Blobs served from SAS URLs are sent as they are stored
+	if b.sasExpiry == 0 {
+		var finish func() error
+		w, finish = backends.GzipText(w, r, &metadata)
+		defer finish()
+	}
+
+	if backends.CheckPreconditions(w, r, metadata) {
+		return nil
+	}
+
+	// Fall back to proxying the blob when a SAS URL can't be signed
+	if b.sasExpiry > 0 {
+		u, err := b.sasURL(key, w.Header().Get("Content-Disposition"), b.sasExpiry)
+		if err == nil {
+			// The headers set for the file itself don't apply to the
+			// redirect
+			w.Header().Del("Content-Length")
+			http.Redirect(w, r, u, http.StatusFound)
+			return nil
+		}
+	}
+
+	rd := &backends.RangeReader{
+		Open: func(offset int64) (io.ReadCloser, error) {
+			resp, err := b.blob(key).DownloadStream(r.Context(), &blob.DownloadStreamOptions{
+				Range: blob.HTTPRange{Offset: offset},
+			})
+			if isNotFound(err) {
+				return nil, backends.NotFoundErr
+			} else if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		},
+		Size: metadata.Size,
+	}
+	defer rd.Close()
+
+	return backends.ServeReader(w, r, rd, metadata.Size, metadata.Mimetype)
+}
+
+func (b AzureBackend) ServeThumbnail(key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error {
+	return backends.ServeThumbnail(b, key, w, r, maxWidth, maxHeight)
+}
+
+func (b AzureBackend) ServeImageVariant(key string, w http.ResponseWriter, r *http.Request) error {
+	return backends.ServeImageVariant(b, key, w, r)
+}
+
+func (b AzureBackend) ServeArchiveEntry(key string, entryPath string, w http.ResponseWriter, r *http.Request) error {
+	return backends.ServeArchiveEntry(b, key, entryPath, w, r)
+}
+
+func (b AzureBackend) ArchiveFS(key string) (fs.FS, error) {
+	return backends.ArchiveFS(b, key)
+}
+
+func (b AzureBackend) Preview(ctx context.Context, key string, maxBytes int) (string, bool, error) {
+	return backends.Preview(ctx, b, key, maxBytes)
+}
+
+func (b AzureBackend) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	metadata, err := b.Head(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	return b.sasURL(key, backends.PresignDisposition(metadata), ttl)
+}
+
+func (b AzureBackend) sasURL(key string, disposition string, ttl time.Duration) (string, error) {
+	params, err := sas.BlobSignatureValues{
+		ExpiryTime:         time.Now().UTC().Add(ttl),
+		Permissions:        (&sas.BlobPermissions{Read: true}).String(),
+		ContainerName:      b.name,
+		BlobName:           key,
+		ContentDisposition: disposition,
+	}.SignWithSharedKey(b.cred)
+	if err != nil {
+		return "", err
+	}
+
+	return b.blob(key).URL() + "?" + params.Encode(), nil
+}
+
+func (b AzureBackend) Put(ctx context.Context, key string, r io.Reader, expiryTime time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (m backends.Metadata, err error) {
+	if err = backends.ValidateKey(key); err != nil {
+		return
+	}
+	if err = backends.CheckCustom(o.Custom); err != nil {
+		return
+	}
+	if err = backends.CheckTags(o.Tags); err != nil {
+		return
+	}
+	if expiryTime, err = backends.AllowedExpiry(expiryTime); err != nil {
+		return
+	}
+	done, err := b.files.Check(ctx, b, key)
+	if err != nil {
+		return
+	}
+	defer done(false)
+
+	// Checked before reading r so that the caller can still retry with
+	// another key, the upload itself is conditional in case of a race
+	var conditions *blob.AccessConditions
+	if !o.Overwrite {
+		if exists, _ := b.Exists(ctx, key); exists {
+			return m, backends.KeyConflictErr
+		}
+		conditions = &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{
+				IfNoneMatch: to.Ptr(azcore.ETagAny),
+			},
+		}
+	}
+
+	// The metadata has to be known before the upload starts, so buffer
+	// the file on disk first
+	tmpDst, err := os.CreateTemp("", "linx-server-upload")
+	if err != nil {
+		return
+	}
+	defer tmpDst.Close()
+	defer os.Remove(tmpDst.Name())
+
+	// Stop buffering once the file reaches MaxSize, rather than filling
+	// the disk before rejecting it
+	src := backends.MinRateReader(helpers.NewContextReader(ctx, r), backends.Limits.MinUploadRate, backends.Limits.MinUploadRateWindow)
+	bytes, err := io.Copy(tmpDst, backends.LimitedReader(src, backends.Limits.MaxSize))
+	if err != nil {
+		return m, err
+	} else if bytes == 0 {
+		return m, backends.FileEmptyError
+	}
+
+	_, err = tmpDst.Seek(0, 0)
+	if err != nil {
+		return
+	}
+
+	if o.Encryption.Scheme != "" {
+		m, err = helpers.GenerateOpaqueMetadata(tmpDst)
+	} else {
+		m, err = helpers.GenerateMetadata(tmpDst)
+		m.Mimetype = helpers.RefineMimetype(m.Mimetype, originalName, key)
+	}
+	if err != nil {
+		return
+	}
+	if err = backends.CheckMimeSize(m.Mimetype, bytes); err != nil {
+		return
+	}
+	if err = backends.CheckSha256(o.ExpectedSha256, m.Sha256sum); err != nil {
+		return
+	}
+
+	if _, err = tmpDst.Seek(0, 0); err != nil {
+		return
+	}
+	if err = backends.ScanFile(b.scanner, tmpDst); err != nil {
+		return
+	}
+
+	m.Expiry = backends.FileExpiry(expiryTime, bytes)
+	m.DeleteKey = deleteKey
+	m.AccessKey = accessKey
+	m.SrcIp = srcIp
+	m.PublicID = backends.NewPublicID()
+	m.OriginalName, m.Custom = backends.SanitizeOriginalName(originalName, o.Custom)
+	m.Tags = o.Tags
+	m.Encryption = o.Encryption
+	m.Uploaded = time.Now()
+	m.ArchiveFiles, m.ArchiveTruncated, m.ArchiveOmitted, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, tmpDst)
+
+	_, err = tmpDst.Seek(0, 0)
+	if err != nil {
+		return
+	}
+
+	_, err = b.blob(key).UploadFile(ctx, tmpDst, &blockblob.UploadFileOptions{
+		HTTPHeaders:      &blob.HTTPHeaders{BlobContentType: &m.Mimetype},
+		Metadata:         mapMetadata(m),
+		Tags:             m.Tags,
+		AccessConditions: conditions,
+	})
+	if bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+		return m, backends.KeyConflictErr
+	} else if err == nil {
+		done(true)
+	}
+	return
+}
+
+func (b AzureBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) (err error) {
+	if err = backends.CheckCustom(m.Custom); err != nil {
+		return
+	}
+	if err = backends.CheckTags(m.Tags); err != nil {
+		return
+	}
+
+	_, err = b.blob(key).SetMetadata(ctx, mapMetadata(m), nil)
+	if isNotFound(err) {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
+	_, err = b.blob(key).SetHTTPHeaders(ctx, blob.HTTPHeaders{BlobContentType: &m.Mimetype}, nil)
+	if err != nil {
+		return
+	}
+
+	// Head leaves Tags nil for untagged blobs, so that updating their
+	// metadata doesn't take another request
+	if m.Tags != nil {
+		_, err = b.blob(key).SetTags(ctx, m.Tags, nil)
+	}
+	return
+}
+
+// The blob index tags of a blob, which its properties only count
+func (b AzureBackend) tags(ctx context.Context, key string) (map[string]string, error) {
+	resp, err := b.blob(key).GetTags(ctx, nil)
+	if isNotFound(err) {
+		return nil, backends.NotFoundErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(resp.BlobTagSet))
+	for _, tag := range resp.BlobTagSet {
+		if tag.Key != nil && tag.Value != nil {
+			tags[*tag.Key] = *tag.Value
+		}
+	}
+	return tags, nil
+}
+
+// Blobs can't be renamed, so this copies the blob along with its metadata,
+// refusing to replace an existing one, and deletes the original
+func (b AzureBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	if err := backends.ValidateKey(newKey); err != nil {
+		return err
+	}
+	// Copies don't carry tags over by themselves
+	tags, err := b.tags(ctx, oldKey)
+	if err != nil {
+		return err
+	}
+	err = b.copyBlob(ctx, oldKey, newKey, &blob.StartCopyFromURLOptions{
+		BlobTags: tags,
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{
+				IfNoneMatch: to.Ptr(azcore.ETagAny),
+			},
+		},
+	})
+	if bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+		return backends.KeyExistsErr
+	} else if err != nil {
+		return err
+	}
+
+	return b.Delete(ctx, oldKey)
+}
+
+func (b AzureBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	props, err := b.blob(key).GetProperties(ctx, nil)
+	if isNotFound(err) {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return err
+	}
+
+	var size int64
+	if props.ContentLength != nil {
+		size = *props.ContentLength
+	}
+	if err := backends.CheckExpiry(size, newExpiry); err != nil {
+		return err
+	}
+
+	// Setting metadata replaces all of it, so carry over the rest as is
+	metadata := make(map[string]*string)
+	for k, v := range props.Metadata {
+		if !strings.EqualFold(k, "expiry") {
+			metadata[k] = v
+		}
+	}
+	ts := strconv.FormatInt(newExpiry.Unix(), 10)
+	metadata["expiry"] = &ts
+
+	_, err = b.blob(key).SetMetadata(ctx, metadata, nil)
+	return err
+}
+
+func (b AzureBackend) Touch(ctx context.Context, key string, extend time.Duration) error {
+	return backends.Touch(ctx, b, key, extend)
+}
+
+func (b AzureBackend) GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error {
+	return backends.GrantAccess(ctx, b, key, accessKey, until)
+}
+
+func (b AzureBackend) Size(ctx context.Context, key string) (int64, error) {
+	props, err := b.blob(key).GetProperties(ctx, nil)
+	if isNotFound(err) {
+		return 0, backends.NotFoundErr
+	} else if err != nil {
+		return 0, err
+	}
+
+	if props.ContentLength == nil {
+		return 0, nil
+	}
+	return *props.ContentLength, nil
+}
+
+// Call fn for every blob in the container. The pager follows the
+// NextMarker of each page until the listing is exhausted.
+func (b AzureBackend) eachBlob(ctx context.Context, withMetadata bool, fn func(name string, metadata map[string]*string)) error {
+	pager := b.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Include: container.ListBlobsInclude{Metadata: withMetadata},
+	})
+
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			if item.Name != nil {
+				fn(*item.Name, item.Metadata)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b AzureBackend) VerifyChecksum(ctx context.Context, key string) (bool, string, error) {
+	return backends.VerifyChecksum(ctx, b, key)
+}
+
+func (b AzureBackend) Stats(ctx context.Context) (backends.Stats, error) {
+	return backends.ComputeStats(ctx, b)
+}
+
+func (b AzureBackend) Query(ctx context.Context, filter backends.ListFilter) ([]string, error) {
+	return backends.Query(ctx, b, filter)
+}
+
+func (b AzureBackend) GetByPublicID(ctx context.Context, id string) (string, error) {
+	return backends.FindByPublicID(ctx, b, id)
+}
+
+func (b AzureBackend) FindBySha256(ctx context.Context, sum string) (string, bool, error) {
+	return backends.ScanBySha256(ctx, b, sum)
+}
+
+func (b AzureBackend) HeadMany(ctx context.Context, keys []string) (map[string]backends.Metadata, map[string]error) {
+	return backends.HeadEach(ctx, keys, headManyWorkers, b.Head)
+}
+
+func (b AzureBackend) List(ctx context.Context) ([]string, error) {
+	var output []string
+
+	err := b.eachBlob(ctx, false, func(name string, _ map[string]*string) {
+		output = append(output, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// The cursor is the service's continuation marker, so pages end wherever the
+// service ends them and never have to be cut short
+func (b AzureBackend) ListPaginated(ctx context.Context, cursor string, limit int) (keys []string, nextCursor string, err error) {
+	marker := cursor
+	for {
+		options := &container.ListBlobsFlatOptions{}
+		if marker != "" {
+			options.Marker = &marker
+		}
+		if limit > 0 {
+			remaining := int32(limit - len(keys))
+			options.MaxResults = &remaining
+		}
+
+		page, err := b.container.NewListBlobsFlatPager(options).NextPage(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			if item.Name != nil {
+				keys = append(keys, *item.Name)
+			}
+		}
+
+		marker = ""
+		if page.NextMarker != nil {
+			marker = *page.NextMarker
+		}
+		if marker == "" || (limit > 0 && len(keys) >= limit) {
+			return keys, marker, nil
+		}
+	}
+}
+
+func (b AzureBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	type expiring struct {
+		key    string
+		expiry int64
+	}
+	var found []expiring
+
+	err := b.eachBlob(ctx, true, func(name string, metadata map[string]*string) {
+		ts, err := strconv.ParseInt(metadataValue(metadata, "expiry"), 10, 64)
+		if err != nil || ts == expiry.NeverExpire.Unix() {
+			return
+		}
+
+		if time.Unix(ts, 0).Before(before) {
+			found = append(found, expiring{name, ts})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].expiry < found[j].expiry
+	})
+
+	output := make([]string, len(found))
+	for i, f := range found {
+		output[i] = f.key
+	}
+
+	return output, nil
+}
+
+// Metadata is sent as x-ms-meta-* headers, so values are limited to ASCII:
+// the original name and encryption details are URL-escaped and the archive
+// files are a base64 encoded JSON list. Empty values are left out.
+func mapMetadata(m backends.Metadata) map[string]*string {
+	values := map[string]string{
+		"expiry":            strconv.FormatInt(m.Expiry.Unix(), 10),
+		"publicid":          m.PublicID,
+		"deletekey":         m.DeleteKey,
+		"accesskey":         m.AccessKey,
+		"sha256sum":         m.Sha256sum,
+		"srcip":             m.SrcIp,
+		"originalname":      url.QueryEscape(m.OriginalName),
+		"encryptionscheme":  url.QueryEscape(m.Encryption.Scheme),
+		"encryptionnonce":   url.QueryEscape(m.Encryption.Nonce),
+		"encryptionkeyhint": url.QueryEscape(m.Encryption.KeyHint),
+	}
+
+	if !m.Uploaded.IsZero() {
+		values["uploaded"] = strconv.FormatInt(m.Uploaded.Unix(), 10)
+	}
+
+	if !m.AccessKeyExpiry.IsZero() {
+		values["accesskeyexpiry"] = strconv.FormatInt(m.AccessKeyExpiry.Unix(), 10)
+	}
+
+	if m.DownloadRate != 0 {
+		values["downloadrate"] = strconv.FormatInt(m.DownloadRate, 10)
+	}
+
+	// Listings that don't fit once base64 encoded are cut short to what
+	// does
+	files, omitted := backends.FitArchiveFiles(m.ArchiveFiles, maxArchiveFilesSize/4*3)
+	if len(files) > 0 {
+		archiveFiles, err := json.Marshal(files)
+		if err == nil {
+			values["archivefiles"] = base64.StdEncoding.EncodeToString(archiveFiles)
+		}
+	}
+
+	if m.ArchiveTruncated || omitted > 0 {
+		values["archivetruncated"] = "true"
+	}
+	if m.ArchiveOmitted+omitted > 0 {
+		values["archiveomitted"] = strconv.Itoa(m.ArchiveOmitted + omitted)
+	}
+
+	// Encoded like the archive listing, as metadata values must be ASCII
+	if len(m.Custom) > 0 {
+		custom, err := json.Marshal(m.Custom)
+		if err == nil {
+			values["custom"] = base64.StdEncoding.EncodeToString(custom)
+		}
+	}
+
+	// Hex-encoded already, so the JSON is plain ASCII
+	if len(m.Checksums) > 0 {
+		checksums, err := json.Marshal(m.Checksums)
+		if err == nil {
+			values["checksums"] = string(checksums)
+		}
+	}
+
+	metadata := make(map[string]*string)
+	for k, v := range values {
+		if v != "" {
+			v := v
+			metadata[k] = &v
+		}
+	}
+
+	return metadata
+}
+
+// Header names aren't case sensitive, and the keys don't necessarily come
+// back in the case they were set in
+func metadataValue(metadata map[string]*string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v
+		}
+	}
+	return ""
+}
+
+func unmapMetadata(metadata map[string]*string) (m backends.Metadata, err error) {
+	expiry, err := strconv.ParseInt(metadataValue(metadata, "expiry"), 10, 64)
+	if err != nil {
+		return m, backends.BadMetadata
+	}
+
+	m.Expiry = time.Unix(expiry, 0)
+	m.PublicID = metadataValue(metadata, "publicid")
+	m.DeleteKey = metadataValue(metadata, "deletekey")
+	m.AccessKey = metadataValue(metadata, "accesskey")
+	if accessKeyExpiry, err := strconv.ParseInt(metadataValue(metadata, "accesskeyexpiry"), 10, 64); err == nil {
+		m.AccessKeyExpiry = time.Unix(accessKeyExpiry, 0)
+	}
+	m.Sha256sum = metadataValue(metadata, "sha256sum")
+	m.SrcIp = metadataValue(metadata, "srcip")
+
+	if uploaded, err := strconv.ParseInt(metadataValue(metadata, "uploaded"), 10, 64); err == nil {
+		m.Uploaded = time.Unix(uploaded, 0)
+	}
+
+	m.OriginalName, err = url.QueryUnescape(metadataValue(metadata, "originalname"))
+	if err != nil {
+		return m, backends.BadMetadata
+	}
+
+	if archiveFiles := metadataValue(metadata, "archivefiles"); archiveFiles != "" {
+		decoded, err := base64.StdEncoding.DecodeString(archiveFiles)
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+		if err := json.Unmarshal(decoded, &m.ArchiveFiles); err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	m.ArchiveTruncated = metadataValue(metadata, "archivetruncated") == "true"
+	m.ArchiveOmitted, _ = strconv.Atoi(metadataValue(metadata, "archiveomitted"))
+	m.DownloadRate, _ = strconv.ParseInt(metadataValue(metadata, "downloadrate"), 10, 64)
+
+	for _, field := range []struct {
+		key   string
+		value *string
+	}{
+		{"encryptionscheme", &m.Encryption.Scheme},
+		{"encryptionnonce", &m.Encryption.Nonce},
+		{"encryptionkeyhint", &m.Encryption.KeyHint},
+	} {
+		if *field.value, err = url.QueryUnescape(metadataValue(metadata, field.key)); err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	if custom := metadataValue(metadata, "custom"); custom != "" {
+		decoded, err := base64.StdEncoding.DecodeString(custom)
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+		if err := json.Unmarshal(decoded, &m.Custom); err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	if checksums := metadataValue(metadata, "checksums"); checksums != "" {
+		if err := json.Unmarshal([]byte(checksums), &m.Checksums); err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	return
+}
+
+func NewAzureBackend(containerName string, o AzureOptions) (AzureBackend, error) {
+	b := AzureBackend{
+		name:      containerName,
+		sasExpiry: o.SASExpiry,
+		scanner:   o.Scanner,
+		files:     backends.NewFileCounter(),
+	}
+
+	serviceURL := o.ServiceURL
+	if serviceURL == "" {
+		serviceURL = "https://" + o.AccountName + ".blob.core.windows.net/"
+	}
+	if !strings.HasSuffix(serviceURL, "/") {
+		serviceURL += "/"
+	}
+
+	cred, err := container.NewSharedKeyCredential(o.AccountName, o.AccountKey)
+	if err != nil {
+		return b, err
+	}
+	b.cred = cred
+
+	b.container, err = container.NewClientWithSharedKeyCredential(serviceURL+containerName, cred, nil)
+	if err != nil {
+		return b, err
+	}
+
+	return b, nil
+}
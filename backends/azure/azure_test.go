@@ -0,0 +1,478 @@
+//go:build azurite
+
+// Run against a local Azurite emulator with:
+//
+//	azurite-blob --inMemoryPersistence &
+//	go test -tags azurite ./backends/azure/
+package azure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/dchest/uniuri"
+)
+
+// Azurite's well-known development account
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+var ctx = context.Background()
+
+func newTestBackend(t *testing.T) AzureBackend {
+	serviceURL := os.Getenv("AZURITE_BLOB_URL")
+	if serviceURL == "" {
+		serviceURL = "http://127.0.0.1:10000/" + azuriteAccount
+	}
+
+	backends.Limits.MaxSize = 1024 * 1024
+
+	b, err := NewAzureBackend("linx-test-"+strings.ToLower(uniuri.NewLen(8)), AzureOptions{
+		ServiceURL:  serviceURL,
+		AccountName: azuriteAccount,
+		AccountKey:  azuriteKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.container.Create(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.container.Delete(ctx, nil)
+	})
+
+	return b
+}
+
+func TestAzurePutHeadGet(t *testing.T) {
+	b := newTestBackend(t)
+
+	m, err := b.Put(ctx, "test.txt", strings.NewReader("hello, world"), time.Hour, "delkey", "acckey", "127.0.0.1", "héllo.txt", backends.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head(ctx, "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head.DeleteKey != "delkey" || head.AccessKey != "acckey" || head.SrcIp != "127.0.0.1" {
+		t.Fatalf("Keys weren't stored: %+v", head)
+	}
+	if head.OriginalName != "héllo.txt" {
+		t.Fatalf("Original name was %q", head.OriginalName)
+	}
+	if head.Sha256sum != m.Sha256sum || head.Size != 12 || head.Expiry.Unix() != m.Expiry.Unix() {
+		t.Fatalf("Metadata %+v doesn't match %+v", head, m)
+	}
+	if head.Uploaded.Unix() != m.Uploaded.Unix() {
+		t.Fatalf("Uploaded at %v instead of %v", head.Uploaded, m.Uploaded)
+	}
+
+	_, r, err := b.Get(ctx, "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	content, _ := io.ReadAll(r)
+	if string(content) != "hello, world" {
+		t.Fatalf("Content was %q", content)
+	}
+}
+
+func TestAzureNotFound(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Head(ctx, "missing"); err != backends.NotFoundErr {
+		t.Fatalf("Head returned %v instead of NotFoundErr", err)
+	}
+	if exists, err := b.Exists(ctx, "missing"); exists || err != nil {
+		t.Fatalf("Exists returned %v, %v", exists, err)
+	}
+	if err := b.Delete(ctx, "missing"); err != backends.NotFoundErr {
+		t.Fatalf("Delete returned %v instead of NotFoundErr", err)
+	}
+}
+
+func TestAzureCopyAndPutMetadata(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "src", strings.NewReader("copy me"), 0, "delkey", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := b.Copy(ctx, "src", "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.DeleteKey == "delkey" {
+		t.Fatal("Copy kept the source delete key")
+	}
+
+	copied.AccessKey = "newkey"
+	if err := b.PutMetadata(ctx, "dst", copied); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head(ctx, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.AccessKey != "newkey" || head.DeleteKey != copied.DeleteKey || head.Size != 7 {
+		t.Fatalf("Copied metadata was %+v", head)
+	}
+}
+
+func TestAzureCopyExisting(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, key := range []string{"src", "dst"} {
+		if _, err := b.Put(ctx, key, strings.NewReader(key), 0, "delkey-"+key, "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := b.Copy(ctx, "src", "dst"); err != backends.KeyExistsErr {
+		t.Fatalf("Copying onto an existing key returned %v", err)
+	}
+	head, err := b.Head(ctx, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.DeleteKey != "delkey-dst" || head.Size != 3 {
+		t.Fatalf("Existing file was replaced: %+v", head)
+	}
+}
+
+func TestAzureListPagination(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := b.Put(ctx, key, strings.NewReader(key), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "a,b,c" {
+		t.Fatalf("Listed %v instead of [a b c]", keys)
+	}
+}
+
+func TestAzureListExpired(t *testing.T) {
+	b := newTestBackend(t)
+
+	for key, expiry := range map[string]time.Duration{"soon": time.Second, "later": time.Hour, "never": 0} {
+		if _, err := b.Put(ctx, key, strings.NewReader(key), expiry, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := b.ListExpired(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "soon" {
+		t.Fatalf("Listed %v instead of [soon]", keys)
+	}
+}
+
+func TestAzureServeFileRange(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "range.txt", strings.NewReader("0123456789"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/range.txt", nil)
+	req.Header.Set("Range", "bytes=3-5")
+	w := httptest.NewRecorder()
+	if err := b.ServeFile("range.txt", w, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusPartialContent || w.Body.String() != "345" {
+		t.Fatalf("Got %d %q instead of 206 \"345\"", w.Code, w.Body.String())
+	}
+}
+
+func TestAzureServeFileSAS(t *testing.T) {
+	b := newTestBackend(t)
+	b.sasExpiry = time.Minute
+
+	if _, err := b.Put(ctx, "sas.txt", strings.NewReader("signed"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/sas.txt", nil)
+	w := httptest.NewRecorder()
+	if err := b.ServeFile("sas.txt", w, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("Status code was %d instead of 302", w.Code)
+	}
+
+	resp, err := http.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	content, _ := io.ReadAll(resp.Body)
+	if string(content) != "signed" {
+		t.Fatalf("SAS URL served %q", content)
+	}
+}
+
+func TestAzureSetExpiry(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "test.txt", strings.NewReader("extend me"), time.Hour, "delkey", "", "", "orig.txt", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	newExpiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	if err := b.SetExpiry(ctx, "test.txt", newExpiry); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head(ctx, "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !head.Expiry.Equal(newExpiry) {
+		t.Fatalf("Expiry was %v instead of %v", head.Expiry, newExpiry)
+	}
+	if head.DeleteKey != "delkey" || head.OriginalName != "orig.txt" {
+		t.Fatalf("Other metadata was lost: %+v", head)
+	}
+}
+
+func TestAzureBatchDelete(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := b.Put(ctx, key, strings.NewReader(key), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, errs := b.BatchDelete(ctx, []string{"a", "missing", "b"})
+	if strings.Join(deleted, ",") != "a,b" {
+		t.Fatalf("Deleted %v instead of [a b]", deleted)
+	}
+	if len(errs) != 1 || errs["missing"] != backends.NotFoundErr {
+		t.Fatalf("Errors were %v", errs)
+	}
+
+	if exists, _ := b.Exists(ctx, "a"); exists {
+		t.Fatal("Deleted blob still exists")
+	}
+}
+
+func TestAzureListPaginated(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := b.Put(ctx, key, strings.NewReader(key), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var pages []string
+	cursor := ""
+	for {
+		keys, next, err := b.ListPaginated(ctx, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, strings.Join(keys, ","))
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if strings.Join(pages, "|") != "a,b|c,d|e" {
+		t.Fatalf("Listed pages %q instead of a,b|c,d|e", pages)
+	}
+}
+
+func TestAzureRename(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, key := range []string{"old", "taken"} {
+		if _, err := b.Put(ctx, key, strings.NewReader(key), 0, "delkey-"+key, "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Rename(ctx, "old", "taken"); err != backends.KeyExistsErr {
+		t.Fatalf("Renaming onto an existing key returned %v", err)
+	}
+	if err := b.Rename(ctx, "missing", "new"); err != backends.NotFoundErr {
+		t.Fatalf("Renaming a missing key returned %v", err)
+	}
+
+	if err := b.Rename(ctx, "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := b.Exists(ctx, "old"); exists {
+		t.Fatal("Old key still exists")
+	}
+
+	head, err := b.Head(ctx, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.DeleteKey != "delkey-old" || head.Size != 3 {
+		t.Fatalf("Renamed metadata was %+v", head)
+	}
+}
+
+func TestAzureGetRange(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "range.txt", strings.NewReader("0123456789"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := b.GetRange(ctx, "range.txt", 7, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	content, _ := io.ReadAll(r)
+	if string(content) != "789" {
+		t.Fatalf("Range was %q instead of \"789\"", content)
+	}
+
+	if _, err := b.GetRange(ctx, "range.txt", 11, 1); err != backends.RangeNotSatisfiableErr {
+		t.Fatalf("Range past the end returned %v", err)
+	}
+}
+
+func TestAzurePresignGet(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "presign.txt", strings.NewReader("presigned"), 0, "", "", "", "héllo.txt", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := b.PresignGet(ctx, "presign.txt", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	content, _ := io.ReadAll(resp.Body)
+	if string(content) != "presigned" {
+		t.Fatalf("Presigned URL served %q", content)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); cd != backends.AttachmentDisposition("héllo.txt") {
+		t.Fatalf("Content-Disposition was %q", cd)
+	}
+}
+
+func TestAzureHealthCheck(t *testing.T) {
+	b := newTestBackend(t)
+
+	if err := b.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	b.container.Delete(ctx, nil)
+	if err := b.HealthCheck(ctx); err == nil {
+		t.Fatal("Missing container passed the health check")
+	}
+}
+
+func TestAzureCustomMetadata(t *testing.T) {
+	b := newTestBackend(t)
+
+	custom := map[string]string{"gallery": "42", "uploader": "zoë"}
+	if _, err := b.Put(ctx, "custom.txt", strings.NewReader("custom"), 0, "", "", "", "", backends.PutOptions{Custom: custom}); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head(ctx, "custom.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Custom["gallery"] != "42" || head.Custom["uploader"] != "zoë" {
+		t.Fatalf("Custom metadata was %v", head.Custom)
+	}
+
+	head.Custom["tags"] = strings.Repeat("x", backends.MaxCustomSize)
+	if err := b.PutMetadata(ctx, "custom.txt", head); err != backends.CustomTooLargeErr {
+		t.Fatalf("Oversized custom metadata returned %v", err)
+	}
+}
+
+func TestAzureTags(t *testing.T) {
+	b := newTestBackend(t)
+
+	tags := map[string]string{"expiry": "7d"}
+	if _, err := b.Put(ctx, "tagged.txt", strings.NewReader("tagged"), 0, "", "", "", "", backends.PutOptions{Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head(ctx, "tagged.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Tags["expiry"] != "7d" {
+		t.Fatalf("Tags were %v", head.Tags)
+	}
+
+	head.Tags["expiry"] = "30d"
+	if err := b.PutMetadata(ctx, "tagged.txt", head); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Rename(ctx, "tagged.txt", "renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if head, err = b.Head(ctx, "renamed.txt"); err != nil || head.Tags["expiry"] != "30d" {
+		t.Fatalf("Tags after renaming were %v, %v", head.Tags, err)
+	}
+}
+
+func TestAzurePutExclusive(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "taken.txt", strings.NewReader("first"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(ctx, "taken.txt", strings.NewReader("second"), 0, "", "", "", "", backends.PutOptions{}); err != backends.KeyConflictErr {
+		t.Fatalf("Put over an existing blob returned %v", err)
+	}
+
+	m, err := b.Put(ctx, "taken.txt", strings.NewReader("third"), 0, "", "", "", "", backends.PutOptions{Overwrite: true})
+	if err != nil || m.Size != 5 {
+		t.Fatalf("Overwriting Put returned %v, %v", m, err)
+	}
+}
@@ -0,0 +1,86 @@
+package backends
+
+import (
+	"context"
+	"sync"
+)
+
+// Delete keys one at a time with del, using up to workers concurrent calls,
+// for backends without a bulk delete API. Keys are returned in the order
+// they were given, with the error of each key that failed in errs.
+func DeleteEach(ctx context.Context, keys []string, workers int, del func(ctx context.Context, key string) error) (deleted []string, errs map[string]error) {
+	results := eachKey(ctx, keys, workers, func(i int, key string) error {
+		return del(ctx, key)
+	})
+	return BatchResults(keys, results)
+}
+
+// Head keys one at a time with head, using up to workers concurrent calls,
+// for backends to implement HeadMany with. The metadata of each key found
+// is in found, and the error of each that wasn't in errs.
+func HeadEach(ctx context.Context, keys []string, workers int, head func(ctx context.Context, key string) (Metadata, error)) (found map[string]Metadata, errs map[string]error) {
+	metadata := make([]Metadata, len(keys))
+	results := eachKey(ctx, keys, workers, func(i int, key string) (err error) {
+		metadata[i], err = head(ctx, key)
+		return
+	})
+
+	found = make(map[string]Metadata, len(keys))
+	for i, key := range keys {
+		if results[i] == nil {
+			found[key] = metadata[i]
+		}
+	}
+	_, errs = BatchResults(keys, results)
+	return
+}
+
+// Call fn for each key with up to workers at a time, returning the error
+// of each in the order keys were given. Once ctx is done, the keys left are
+// given its error.
+func eachKey(ctx context.Context, keys []string, workers int, fn func(i int, key string) error) []error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]error, len(keys))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			results[i] = err
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = fn(i, key)
+		}(i, key)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Split the per-key results of a batch delete into the deleted keys and a
+// map of the errors of the rest
+func BatchResults(keys []string, results []error) (deleted []string, errs map[string]error) {
+	for i, key := range keys {
+		if results[i] == nil {
+			deleted = append(deleted, key)
+			continue
+		}
+
+		if errs == nil {
+			errs = make(map[string]error)
+		}
+		errs[key] = results[i]
+	}
+	return
+}
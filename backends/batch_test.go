@@ -0,0 +1,57 @@
+package backends
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDeleteEach(t *testing.T) {
+	keys := []string{"a", "missing", "b", "c", "missing-too"}
+
+	deleted, errs := DeleteEach(context.Background(), keys, 2, func(ctx context.Context, key string) error {
+		if strings.HasPrefix(key, "missing") {
+			return NotFoundErr
+		}
+		return nil
+	})
+
+	if strings.Join(deleted, ",") != "a,b,c" {
+		t.Fatalf("Deleted %v instead of [a b c]", deleted)
+	}
+	if len(errs) != 2 || errs["missing"] != NotFoundErr || errs["missing-too"] != NotFoundErr {
+		t.Fatalf("Errors were %v", errs)
+	}
+}
+
+func TestDeleteEachCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	deleted, errs := DeleteEach(ctx, []string{"a", "b"}, 1, func(ctx context.Context, key string) error {
+		t.Fatal("Deleted after the context was cancelled")
+		return nil
+	})
+
+	if len(deleted) != 0 || errs["a"] != context.Canceled || errs["b"] != context.Canceled {
+		t.Fatalf("Returned %v, %v", deleted, errs)
+	}
+}
+
+func TestHeadEach(t *testing.T) {
+	keys := []string{"a", "missing", "b"}
+
+	found, errs := HeadEach(context.Background(), keys, 2, func(ctx context.Context, key string) (Metadata, error) {
+		if key == "missing" {
+			return Metadata{}, NotFoundErr
+		}
+		return Metadata{OriginalName: key + ".txt"}, nil
+	})
+
+	if len(found) != 2 || found["a"].OriginalName != "a.txt" || found["b"].OriginalName != "b.txt" {
+		t.Fatalf("Found %v", found)
+	}
+	if len(errs) != 1 || errs["missing"] != NotFoundErr {
+		t.Fatalf("Errors were %v", errs)
+	}
+}
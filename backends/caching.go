@@ -0,0 +1,231 @@
+package backends
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Wraps a StorageBackend, caching the Metadata returned by Head for up to
+// ttl and keeping at most maxEntries of them, evicting the least recently
+// used first. Entries are invalidated by any change made through the
+// CachingBackend, but not by changes made to the wrapped backend directly.
+// Reads invalidate too, since serving a file can change its metadata, such
+// as a sliding expiry or a download count.
+type CachingBackend struct {
+	StorageBackend
+
+	ttl        time.Duration
+	maxEntries int
+
+	mu      *sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	m       Metadata
+	expires time.Time
+}
+
+func NewCachingBackend(b StorageBackend, ttl time.Duration, maxEntries int) CachingBackend {
+	return CachingBackend{
+		StorageBackend: b,
+		ttl:            ttl,
+		maxEntries:     maxEntries,
+		mu:             &sync.Mutex{},
+		entries:        make(map[string]*list.Element),
+		lru:            list.New(),
+	}
+}
+
+func (c CachingBackend) lookup(key string) (Metadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return Metadata{}, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return Metadata{}, false
+	}
+
+	c.lru.MoveToFront(el)
+	return entry.m, true
+}
+
+func (c CachingBackend) store(key string, m Metadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key, m, time.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c CachingBackend) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c CachingBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	if m, ok := c.lookup(key); ok {
+		return m, nil
+	}
+
+	m, err := c.StorageBackend.Head(ctx, key)
+	if err != nil {
+		return m, err
+	}
+
+	c.store(key, m)
+	return m, nil
+}
+
+func (c CachingBackend) Get(ctx context.Context, key string) (Metadata, io.ReadCloser, error) {
+	defer c.invalidate(key)
+	return c.StorageBackend.Get(ctx, key)
+}
+
+func (c CachingBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	defer c.invalidate(key)
+	return c.StorageBackend.GetRange(ctx, key, offset, length)
+}
+
+func (c CachingBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.ServeFile(key, w, r)
+}
+
+func (c CachingBackend) ServeThumbnail(key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.ServeThumbnail(key, w, r, maxWidth, maxHeight)
+}
+
+func (c CachingBackend) ServeImageVariant(key string, w http.ResponseWriter, r *http.Request) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.ServeImageVariant(key, w, r)
+}
+
+func (c CachingBackend) ServeArchiveEntry(key string, entryPath string, w http.ResponseWriter, r *http.Request) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.ServeArchiveEntry(key, entryPath, w, r)
+}
+
+func (c CachingBackend) Copy(ctx context.Context, srcKey, dstKey string) (Metadata, error) {
+	defer c.invalidate(dstKey)
+	return c.StorageBackend.Copy(ctx, srcKey, dstKey)
+}
+
+func (c CachingBackend) Delete(ctx context.Context, key string) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.Delete(ctx, key)
+}
+
+func (c CachingBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	defer func() {
+		for _, key := range keys {
+			c.invalidate(key)
+		}
+	}()
+	return c.StorageBackend.BatchDelete(ctx, keys)
+}
+
+func (c CachingBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	defer c.invalidate(key)
+	return c.StorageBackend.Finalize(ctx, key, expiry, deleteKey, accessKey, srcIp, originalName, o)
+}
+
+func (c CachingBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	defer c.invalidate(key)
+	return c.StorageBackend.Put(ctx, key, r, expiry, deleteKey, accessKey, srcIp, originalName, o)
+}
+
+func (c CachingBackend) PutMetadata(ctx context.Context, key string, m Metadata) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.PutMetadata(ctx, key, m)
+}
+
+func (c CachingBackend) Restore(ctx context.Context, key string) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.Restore(ctx, key)
+}
+
+func (c CachingBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	defer c.invalidate(oldKey)
+	defer c.invalidate(newKey)
+	return c.StorageBackend.Rename(ctx, oldKey, newKey)
+}
+
+func (c CachingBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.SetExpiry(ctx, key, newExpiry)
+}
+
+func (c CachingBackend) Touch(ctx context.Context, key string, extend time.Duration) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.Touch(ctx, key, extend)
+}
+
+func (c CachingBackend) GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error {
+	defer c.invalidate(key)
+	return c.StorageBackend.GrantAccess(ctx, key, accessKey, until)
+}
+
+// A CachingBackend around a MetaStorageBackend, so that deleting expired
+// files through it also invalidates their cached metadata
+type CachingMetaBackend struct {
+	CachingBackend
+	metaForwarder
+}
+
+func NewCachingMetaBackend(b MetaStorageBackend, ttl time.Duration, maxEntries int) CachingMetaBackend {
+	return CachingMetaBackend{NewCachingBackend(b, ttl, maxEntries), metaForwarder{b}}
+}
+
+// Only the keys that aren't cached are read from the wrapped backend
+func (c CachingMetaBackend) HeadMany(ctx context.Context, keys []string) (map[string]Metadata, map[string]error) {
+	found := make(map[string]Metadata, len(keys))
+	var missing []string
+	for _, key := range keys {
+		if m, ok := c.lookup(key); ok {
+			found[key] = m
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	read, errs := c.meta.HeadMany(ctx, missing)
+	for key, m := range read {
+		c.store(key, m)
+		found[key] = m
+	}
+	return found, errs
+}
@@ -0,0 +1,104 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Counts the Head calls that reach the backend, leaving every other method
+// unimplemented
+type countingBackend struct {
+	StorageBackend
+	mu    sync.Mutex
+	heads map[string]int
+}
+
+func (b *countingBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if key == "missing" {
+		return Metadata{}, NotFoundErr
+	}
+	b.heads[key]++
+	return Metadata{Size: int64(b.heads[key])}, nil
+}
+
+func (b *countingBackend) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+func (b *countingBackend) PutMetadata(ctx context.Context, key string, m Metadata) error {
+	return nil
+}
+
+func TestCachingBackend(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingBackend{heads: make(map[string]int)}
+	c := NewCachingBackend(inner, time.Hour, 2)
+
+	for i := 0; i < 3; i++ {
+		if m, err := c.Head(ctx, "a"); err != nil || m.Size != 1 {
+			t.Fatalf("Head returned %+v, %v", m, err)
+		}
+	}
+	if inner.heads["a"] != 1 {
+		t.Fatalf("Backend was called %d times instead of once", inner.heads["a"])
+	}
+
+	if _, err := c.Head(ctx, "missing"); err != NotFoundErr {
+		t.Fatalf("Head of missing key returned %v", err)
+	}
+
+	c.Delete(ctx, "a")
+	if m, _ := c.Head(ctx, "a"); m.Size != 2 {
+		t.Fatal("Delete didn't invalidate the cached metadata")
+	}
+
+	c.PutMetadata(ctx, "a", Metadata{})
+	if m, _ := c.Head(ctx, "a"); m.Size != 3 {
+		t.Fatal("PutMetadata didn't invalidate the cached metadata")
+	}
+
+	// b and c push out a, the least recently used
+	c.Head(ctx, "b")
+	c.Head(ctx, "c")
+	if m, _ := c.Head(ctx, "a"); m.Size != 4 {
+		t.Fatal("Least recently used entry wasn't evicted")
+	}
+}
+
+func TestCachingBackendTTL(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingBackend{heads: make(map[string]int)}
+	c := NewCachingBackend(inner, time.Millisecond, 0)
+
+	c.Head(ctx, "a")
+	time.Sleep(5 * time.Millisecond)
+	if m, _ := c.Head(ctx, "a"); m.Size != 2 {
+		t.Fatal("Expired entry was served from the cache")
+	}
+}
+
+func TestCachingBackendConcurrent(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingBackend{heads: make(map[string]int)}
+	c := NewCachingBackend(inner, time.Hour, 10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := string(rune('a' + i%15))
+			for j := 0; j < 100; j++ {
+				c.Head(ctx, key)
+				if j%10 == 0 {
+					c.Delete(ctx, key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
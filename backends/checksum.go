@@ -0,0 +1,72 @@
+package backends
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"sort"
+
+	"github.com/minio/sha256-simd"
+	"github.com/zeebo/blake3"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+}
+
+// The names of the algorithms Limits.Checksums can list, sorted
+func ChecksumAlgorithms() []string {
+	var names []string
+	for name := range checksumAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func IsChecksumAlgorithm(name string) bool {
+	_, ok := checksumAlgorithms[name]
+	return ok
+}
+
+// Hashes everything written to it with each of the algorithms in
+// Limits.Checksums at once, so that content only has to be read once
+type Checksummer struct {
+	hashes map[string]hash.Hash
+}
+
+func NewChecksummer() *Checksummer {
+	c := &Checksummer{hashes: make(map[string]hash.Hash, len(Limits.Checksums))}
+	for _, name := range Limits.Checksums {
+		if newHash, ok := checksumAlgorithms[name]; ok {
+			c.hashes[name] = newHash()
+		}
+	}
+	return c
+}
+
+func (c *Checksummer) Write(p []byte) (int, error) {
+	for _, h := range c.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// The hex-encoded checksums of what was written, keyed by algorithm, or
+// nil if none are enabled
+func (c *Checksummer) Sums() map[string]string {
+	if len(c.hashes) == 0 {
+		return nil
+	}
+	sums := make(map[string]string, len(c.hashes))
+	for name, h := range c.hashes {
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
@@ -0,0 +1,28 @@
+package backends
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChecksummer(t *testing.T) {
+	if sums := NewChecksummer().Sums(); sums != nil {
+		t.Fatalf("Expected no checksums by default, got %v", sums)
+	}
+
+	Limits.Checksums = []string{"md5", "blake3"}
+	defer func() { Limits.Checksums = nil }()
+
+	c := NewChecksummer()
+	io.Copy(c, strings.NewReader("hello"))
+	sums := c.Sums()
+	if len(sums) != 2 || sums["md5"] != "5d41402abc4b2a76b9719d911017c592" ||
+		sums["blake3"] != "ea8f163db38682925e4491c5e58d4bb3506ef8c14eb78a86e908c5624a67200f" {
+		t.Fatalf("Unexpected checksums %v", sums)
+	}
+
+	if !IsChecksumAlgorithm("sha512") || IsChecksumAlgorithm("crc32") {
+		t.Fatal("Unexpected algorithms", ChecksumAlgorithms())
+	}
+}
@@ -0,0 +1,94 @@
+package clamav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const chunkSize = 64 * 1024
+
+var errUnexpectedReply = errors.New("Unexpected reply from clamd.")
+
+// Scans files with a clamd daemon over TCP, streaming them with its
+// INSTREAM command so that they don't have to be readable by clamd
+type Scanner struct {
+	// Address of clamd's TCP socket, such as localhost:3310
+	address string
+	timeout time.Duration
+}
+
+// Scan with the clamd listening at address, giving up on a scan that takes
+// longer than timeout, or never with a timeout of 0
+func NewScanner(address string, timeout time.Duration) Scanner {
+	return Scanner{address, timeout}
+}
+
+func (s Scanner) Scan(r io.Reader) (clean bool, signature string, err error) {
+	conn, err := net.DialTimeout("tcp", s.address, s.dialTimeout())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if s.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return
+	}
+
+	// The content is sent in chunks, each prefixed by its length, ending
+	// with an empty chunk
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return false, "", rerr
+		}
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return
+	}
+	return parseReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+func (s Scanner) dialTimeout() time.Duration {
+	if s.timeout > 0 {
+		return s.timeout
+	}
+	return 10 * time.Second
+}
+
+// Replies are "stream: OK", "stream: <signature> FOUND" or
+// "<reason> ERROR"
+func parseReply(reply string) (clean bool, signature string, err error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return true, "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return false, strings.TrimSuffix(result, " FOUND"), nil
+	case strings.HasSuffix(result, " ERROR"):
+		return false, "", errors.New("clamd: " + strings.TrimSuffix(result, " ERROR"))
+	}
+	return false, "", errUnexpectedReply
+}
@@ -0,0 +1,78 @@
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Answers INSTREAM commands like clamd, finding malware in any stream
+// containing EICAR
+func fakeClamd(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			r := bufio.NewReader(conn)
+			if cmd, _ := r.ReadString(0); cmd != "zINSTREAM\x00" {
+				conn.Close()
+				continue
+			}
+
+			var content bytes.Buffer
+			for {
+				var size uint32
+				if binary.Read(r, binary.BigEndian, &size) != nil || size == 0 {
+					break
+				}
+				io.CopyN(&content, r, int64(size))
+			}
+
+			if strings.Contains(content.String(), "EICAR") {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestScan(t *testing.T) {
+	s := NewScanner(fakeClamd(t), 5*time.Second)
+
+	clean, signature, err := s.Scan(strings.NewReader(strings.Repeat("a", 3*chunkSize+1)))
+	if err != nil || !clean || signature != "" {
+		t.Errorf("Clean file was scanned as %v, %q, %v", clean, signature, err)
+	}
+
+	clean, signature, err = s.Scan(strings.NewReader(strings.Repeat("a", chunkSize) + "EICAR"))
+	if err != nil || clean || signature != "Eicar-Test-Signature" {
+		t.Errorf("Infected file was scanned as %v, %q, %v", clean, signature, err)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	if _, _, err := parseReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("Error reply wasn't returned as an error")
+	}
+	if _, _, err := parseReply("garbage"); err != errUnexpectedReply {
+		t.Errorf("Unexpected reply returned %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Writes to a primary StorageBackend and mirrors the writes to a secondary
+// one, reading from the primary and falling back to the secondary for files
+// the primary can't serve, such as those stored before a migration. Only
+// the primary's errors are returned from writes, the secondary's are passed
+// to OnSecondaryError if set. Every method not mirrored here, such as
+// Append, goes to the primary alone.
+type CompositeBackend struct {
+	StorageBackend
+	secondary StorageBackend
+
+	OnSecondaryError func(key string, err error)
+}
+
+func NewCompositeBackend(primary, secondary StorageBackend) CompositeBackend {
+	return CompositeBackend{StorageBackend: primary, secondary: secondary}
+}
+
+func (c CompositeBackend) secondaryFailed(key string, err error) {
+	if err != nil && c.OnSecondaryError != nil {
+		c.OnSecondaryError(key, err)
+	}
+}
+
+// Store the file under key in the primary again in the secondary, reading
+// it back as the file being stored can only be read once
+func (c CompositeBackend) mirror(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) {
+	_, f, err := c.StorageBackend.Get(ctx, key)
+	if err != nil {
+		c.secondaryFailed(key, err)
+		return
+	}
+	defer f.Close()
+
+	// Whatever the secondary has under key is stale
+	o.Overwrite = true
+	_, err = c.secondary.Put(ctx, key, f, expiry, deleteKey, accessKey, srcIp, originalName, o)
+	c.secondaryFailed(key, err)
+}
+
+func (c CompositeBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	m, err := c.StorageBackend.Put(ctx, key, r, expiry, deleteKey, accessKey, srcIp, originalName, o)
+	if err != nil {
+		return m, err
+	}
+
+	c.mirror(ctx, key, expiry, deleteKey, accessKey, srcIp, originalName, o)
+	return m, nil
+}
+
+func (c CompositeBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	m, err := c.StorageBackend.Finalize(ctx, key, expiry, deleteKey, accessKey, srcIp, originalName, o)
+	if err != nil {
+		return m, err
+	}
+
+	c.mirror(ctx, key, expiry, deleteKey, accessKey, srcIp, originalName, o)
+	return m, nil
+}
+
+func (c CompositeBackend) PutMetadata(ctx context.Context, key string, m Metadata) error {
+	if err := c.StorageBackend.PutMetadata(ctx, key, m); err != nil {
+		return err
+	}
+
+	c.secondaryFailed(key, c.secondary.PutMetadata(ctx, key, m))
+	return nil
+}
+
+func (c CompositeBackend) Copy(ctx context.Context, srcKey, dstKey string) (Metadata, error) {
+	m, err := c.StorageBackend.Copy(ctx, srcKey, dstKey)
+	if err != nil {
+		return m, err
+	}
+
+	_, err = c.secondary.Copy(ctx, srcKey, dstKey)
+	c.secondaryFailed(dstKey, err)
+	return m, nil
+}
+
+// A file only the secondary has, such as one stored before a migration,
+// is deleted from the secondary alone, as the primary never had it
+func (c CompositeBackend) Delete(ctx context.Context, key string) error {
+	if err := c.StorageBackend.Delete(ctx, key); err == NotFoundErr {
+		return c.secondary.Delete(ctx, key)
+	} else if err != nil {
+		return err
+	}
+
+	if err := c.secondary.Delete(ctx, key); err != NotFoundErr {
+		c.secondaryFailed(key, err)
+	}
+	return nil
+}
+
+func (c CompositeBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	deleted, errs := c.StorageBackend.BatchDelete(ctx, keys)
+	if len(deleted) > 0 {
+		_, secondaryErrs := c.secondary.BatchDelete(ctx, deleted)
+		for key, err := range secondaryErrs {
+			if err != NotFoundErr {
+				c.secondaryFailed(key, err)
+			}
+		}
+	}
+
+	var missing []string
+	for key, err := range errs {
+		if err == NotFoundErr {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		secondaryDeleted, secondaryErrs := c.secondary.BatchDelete(ctx, missing)
+		for _, key := range secondaryDeleted {
+			delete(errs, key)
+		}
+		for key, err := range secondaryErrs {
+			errs[key] = err
+		}
+		deleted = append(deleted, secondaryDeleted...)
+	}
+	return deleted, errs
+}
+
+func (c CompositeBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	if err := c.StorageBackend.Rename(ctx, oldKey, newKey); err != nil {
+		return err
+	}
+
+	c.secondaryFailed(newKey, c.secondary.Rename(ctx, oldKey, newKey))
+	return nil
+}
+
+func (c CompositeBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	if err := c.StorageBackend.SetExpiry(ctx, key, newExpiry); err != nil {
+		return err
+	}
+
+	c.secondaryFailed(key, c.secondary.SetExpiry(ctx, key, newExpiry))
+	return nil
+}
+
+func (c CompositeBackend) Touch(ctx context.Context, key string, extend time.Duration) error {
+	if err := c.StorageBackend.Touch(ctx, key, extend); err != nil {
+		return err
+	}
+
+	c.secondaryFailed(key, c.secondary.Touch(ctx, key, extend))
+	return nil
+}
+
+func (c CompositeBackend) GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error {
+	if err := c.StorageBackend.GrantAccess(ctx, key, accessKey, until); err != nil {
+		return err
+	}
+
+	c.secondaryFailed(key, c.secondary.GrantAccess(ctx, key, accessKey, until))
+	return nil
+}
+
+func (c CompositeBackend) CheckAccessKey(ctx context.Context, key, provided string) (bool, error) {
+	ok, err := c.StorageBackend.CheckAccessKey(ctx, key, provided)
+	if err != nil {
+		return c.secondary.CheckAccessKey(ctx, key, provided)
+	}
+	return ok, nil
+}
+
+func (c CompositeBackend) CheckDeleteKey(ctx context.Context, key, provided string) (bool, error) {
+	ok, err := c.StorageBackend.CheckDeleteKey(ctx, key, provided)
+	if err != nil {
+		return c.secondary.CheckDeleteKey(ctx, key, provided)
+	}
+	return ok, nil
+}
+
+func (c CompositeBackend) Exists(ctx context.Context, key string) (bool, error) {
+	if ok, err := c.StorageBackend.Exists(ctx, key); err == nil && ok {
+		return true, nil
+	}
+	return c.secondary.Exists(ctx, key)
+}
+
+func (c CompositeBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	m, err := c.StorageBackend.Head(ctx, key)
+	if err != nil {
+		return c.secondary.Head(ctx, key)
+	}
+	return m, nil
+}
+
+func (c CompositeBackend) Get(ctx context.Context, key string) (Metadata, io.ReadCloser, error) {
+	m, f, err := c.StorageBackend.Get(ctx, key)
+	if err != nil {
+		return c.secondary.Get(ctx, key)
+	}
+	return m, f, nil
+}
+
+func (c CompositeBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := c.StorageBackend.GetRange(ctx, key, offset, length)
+	if err != nil && err != RangeNotSatisfiableErr {
+		return c.secondary.GetRange(ctx, key, offset, length)
+	}
+	return f, err
+}
+
+func (c CompositeBackend) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if _, err := c.StorageBackend.Head(ctx, key); err != nil {
+		return c.secondary.PresignGet(ctx, key, ttl)
+	}
+	return c.StorageBackend.PresignGet(ctx, key, ttl)
+}
+
+// Once a backend starts serving a file it can't be served by the other, so
+// the primary only serves the files it has metadata for
+func (c CompositeBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	if _, err := c.StorageBackend.Head(r.Context(), key); err != nil {
+		return c.secondary.ServeFile(key, w, r)
+	}
+	return c.StorageBackend.ServeFile(key, w, r)
+}
+
+func (c CompositeBackend) ServeThumbnail(key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error {
+	return ServeThumbnail(c, key, w, r, maxWidth, maxHeight)
+}
+
+func (c CompositeBackend) ServeImageVariant(key string, w http.ResponseWriter, r *http.Request) error {
+	return ServeImageVariant(c, key, w, r)
+}
+
+func (c CompositeBackend) ServeArchiveEntry(key string, entryPath string, w http.ResponseWriter, r *http.Request) error {
+	return ServeArchiveEntry(c, key, entryPath, w, r)
+}
+
+func (c CompositeBackend) Size(ctx context.Context, key string) (int64, error) {
+	size, err := c.StorageBackend.Size(ctx, key)
+	if err != nil {
+		return c.secondary.Size(ctx, key)
+	}
+	return size, nil
+}
@@ -0,0 +1,123 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keeps files in memory, failing every write once broken is set
+type memBackend struct {
+	StorageBackend
+	files  map[string]string
+	broken bool
+}
+
+var errBroken = errors.New("Broken.")
+
+func (b *memBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	if b.broken {
+		return Metadata{}, errBroken
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	b.files[key] = string(data)
+	return Metadata{Size: int64(len(data))}, nil
+}
+
+func (b *memBackend) Get(ctx context.Context, key string) (Metadata, io.ReadCloser, error) {
+	data, ok := b.files[key]
+	if !ok {
+		return Metadata{}, nil, NotFoundErr
+	}
+	return Metadata{Size: int64(len(data))}, io.NopCloser(strings.NewReader(data)), nil
+}
+
+func (b *memBackend) Delete(ctx context.Context, key string) error {
+	if b.broken {
+		return errBroken
+	}
+	if _, ok := b.files[key]; !ok {
+		return NotFoundErr
+	}
+	delete(b.files, key)
+	return nil
+}
+
+func (b *memBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	return DeleteEach(ctx, keys, 1, b.Delete)
+}
+
+func TestCompositeBackend(t *testing.T) {
+	ctx := context.Background()
+	primary := &memBackend{files: map[string]string{}}
+	secondary := &memBackend{files: map[string]string{"old": "migrated"}}
+	c := NewCompositeBackend(primary, secondary)
+
+	var failed []string
+	c.OnSecondaryError = func(key string, err error) {
+		failed = append(failed, key)
+	}
+
+	if _, err := c.Put(ctx, "a", strings.NewReader("hello"), 0, "", "", "", "", PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if primary.files["a"] != "hello" || secondary.files["a"] != "hello" {
+		t.Fatalf("Put wasn't mirrored, primary has %q and secondary %q", primary.files["a"], secondary.files["a"])
+	}
+
+	_, f, err := c.Get(ctx, "old")
+	if err != nil {
+		t.Fatalf("Get didn't fall back to the secondary: %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	if string(data) != "migrated" {
+		t.Fatalf("Got %q from the secondary", data)
+	}
+
+	secondary.broken = true
+	if _, err := c.Put(ctx, "b", strings.NewReader("world"), 0, "", "", "", "", PutOptions{}); err != nil {
+		t.Fatalf("Secondary failure failed the Put: %v", err)
+	}
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatalf("Secondary failure failed the Delete: %v", err)
+	}
+	if len(failed) != 2 || failed[0] != "b" || failed[1] != "a" {
+		t.Fatalf("Secondary failures reported for %v", failed)
+	}
+
+	primary.broken = true
+	if _, err := c.Put(ctx, "c", strings.NewReader("!"), 0, "", "", "", "", PutOptions{}); err != errBroken {
+		t.Fatalf("Primary failure returned %v", err)
+	}
+}
+
+func TestCompositeBackendDeleteSecondaryOnly(t *testing.T) {
+	ctx := context.Background()
+	primary := &memBackend{files: map[string]string{"both": "new"}}
+	secondary := &memBackend{files: map[string]string{"old": "migrated", "older": "migrated", "both": "new"}}
+	c := NewCompositeBackend(primary, secondary)
+
+	if err := c.Delete(ctx, "old"); err != nil {
+		t.Fatalf("Deleting a file only the secondary has returned %v", err)
+	}
+	if _, _, err := c.Get(ctx, "old"); err != NotFoundErr {
+		t.Fatalf("Get of the deleted file returned %v", err)
+	}
+	if err := c.Delete(ctx, "missing"); err != NotFoundErr {
+		t.Fatalf("Deleting a file neither has returned %v", err)
+	}
+
+	deleted, errs := c.BatchDelete(ctx, []string{"older", "both", "missing"})
+	if len(deleted) != 2 || len(errs) != 1 || errs["missing"] != NotFoundErr {
+		t.Fatalf("BatchDelete deleted %v with errors %v", deleted, errs)
+	}
+	if len(primary.files) != 0 || len(secondary.files) != 0 {
+		t.Fatalf("Files were left behind, primary has %v and secondary %v", primary.files, secondary.files)
+	}
+}
@@ -0,0 +1,159 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// One line of exported metadata, in the same format localfs stores it in
+// along with the file's key. ETag and ModTime aren't exported, as backends
+// derive them from the file itself.
+type exportedMetadata struct {
+	Key              string            `json:"key"`
+	PublicID         string            `json:"public_id,omitempty"`
+	DeleteKey        string            `json:"delete_key"`
+	AccessKey        string            `json:"access_key,omitempty"`
+	AccessKeyExpiry  int64             `json:"access_key_expiry,omitempty"`
+	Sha256sum        string            `json:"sha256sum"`
+	Checksums        map[string]string `json:"checksums,omitempty"`
+	Mimetype         string            `json:"mimetype"`
+	Size             int64             `json:"size"`
+	Expiry           int64             `json:"expiry"`
+	SrcIp            string            `json:"srcip,omitempty"`
+	OriginalName     string            `json:"original_name,omitempty"`
+	ArchiveFiles     []ArchiveEntry    `json:"archive_files,omitempty"`
+	ArchiveTruncated bool              `json:"archive_truncated,omitempty"`
+	ArchiveOmitted   int               `json:"archive_omitted,omitempty"`
+	Nonce            string            `json:"nonce,omitempty"`
+	Encryption       *Encryption       `json:"encryption,omitempty"`
+	Downloads        int64             `json:"downloads,omitempty"`
+	MaxDownloads     int64             `json:"max_downloads,omitempty"`
+	Compression      string            `json:"compression,omitempty"`
+	RetainUntil      int64             `json:"retain_until,omitempty"`
+	Uploaded         int64             `json:"uploaded,omitempty"`
+	Custom           map[string]string `json:"custom,omitempty"`
+	Tags             map[string]string `json:"tags,omitempty"`
+}
+
+// Write the metadata of every file in b to w as JSON Lines, one file per
+// line, so that it can be backed up or moved to another backend separately
+// from the files themselves. Files deleted while exporting are left out.
+func ExportMetadata(ctx context.Context, b MetaStorageBackend, w io.Writer) error {
+	keys, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for _, key := range keys {
+		m, err := b.Head(ctx, key)
+		if err == NotFoundErr {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		e := exportedMetadata{
+			Key:              key,
+			PublicID:         m.PublicID,
+			DeleteKey:        m.DeleteKey,
+			AccessKey:        m.AccessKey,
+			Sha256sum:        m.Sha256sum,
+			Checksums:        m.Checksums,
+			Mimetype:         m.Mimetype,
+			Size:             m.Size,
+			Expiry:           m.Expiry.Unix(),
+			SrcIp:            m.SrcIp,
+			OriginalName:     m.OriginalName,
+			ArchiveFiles:     m.ArchiveFiles,
+			ArchiveTruncated: m.ArchiveTruncated,
+			ArchiveOmitted:   m.ArchiveOmitted,
+			Nonce:            m.Nonce,
+			Downloads:        m.Downloads,
+			MaxDownloads:     m.MaxDownloads,
+			Compression:      m.Compression,
+			Custom:           m.Custom,
+			Tags:             m.Tags,
+		}
+		if m.Encryption.Scheme != "" {
+			e.Encryption = &m.Encryption
+		}
+		if !m.RetainUntil.IsZero() {
+			e.RetainUntil = m.RetainUntil.Unix()
+		}
+		if !m.AccessKeyExpiry.IsZero() {
+			e.AccessKeyExpiry = m.AccessKeyExpiry.Unix()
+		}
+		if !m.Uploaded.IsZero() {
+			e.Uploaded = m.Uploaded.Unix()
+		}
+
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read metadata written by ExportMetadata from r and store it in b with
+// PutMetadata, returning how many files' metadata was imported. Importing
+// stops at the first error.
+func ImportMetadata(ctx context.Context, b StorageBackend, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	imported := 0
+	for {
+		var e exportedMetadata
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return imported, nil
+		} else if err != nil {
+			return imported, err
+		}
+
+		if err := ValidateKey(e.Key); err != nil {
+			return imported, fmt.Errorf("%q: %w", e.Key, err)
+		}
+
+		m := Metadata{
+			PublicID:         e.PublicID,
+			DeleteKey:        e.DeleteKey,
+			AccessKey:        e.AccessKey,
+			Sha256sum:        e.Sha256sum,
+			Checksums:        e.Checksums,
+			Mimetype:         e.Mimetype,
+			Size:             e.Size,
+			Expiry:           time.Unix(e.Expiry, 0),
+			SrcIp:            e.SrcIp,
+			OriginalName:     e.OriginalName,
+			ArchiveFiles:     e.ArchiveFiles,
+			ArchiveTruncated: e.ArchiveTruncated,
+			ArchiveOmitted:   e.ArchiveOmitted,
+			Nonce:            e.Nonce,
+			Downloads:        e.Downloads,
+			MaxDownloads:     e.MaxDownloads,
+			Compression:      e.Compression,
+			Custom:           e.Custom,
+			Tags:             e.Tags,
+		}
+		if e.Encryption != nil {
+			m.Encryption = *e.Encryption
+		}
+		if e.RetainUntil != 0 {
+			m.RetainUntil = time.Unix(e.RetainUntil, 0)
+		}
+		if e.AccessKeyExpiry != 0 {
+			m.AccessKeyExpiry = time.Unix(e.AccessKeyExpiry, 0)
+		}
+		if e.Uploaded != 0 {
+			m.Uploaded = time.Unix(e.Uploaded, 0)
+		}
+
+		if err := b.PutMetadata(ctx, e.Key, m); err != nil {
+			return imported, fmt.Errorf("%s: %w", e.Key, err)
+		}
+		imported++
+	}
+}
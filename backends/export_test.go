@@ -0,0 +1,88 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+// Keeps metadata in memory, without any files
+type metadataBackend struct {
+	MetaStorageBackend
+	files map[string]Metadata
+}
+
+func (b *metadataBackend) List(ctx context.Context) ([]string, error) {
+	keys := []string{"gone"}
+	for key := range b.files {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (b *metadataBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	m, ok := b.files[key]
+	if !ok {
+		return m, NotFoundErr
+	}
+	return m, nil
+}
+
+func (b *metadataBackend) PutMetadata(ctx context.Context, key string, m Metadata) error {
+	b.files[key] = m
+	return nil
+}
+
+func TestExportImportMetadata(t *testing.T) {
+	ctx := context.Background()
+	src := &metadataBackend{files: map[string]Metadata{
+		"a.txt": {
+			DeleteKey:    "delete",
+			Sha256sum:    "abc",
+			Mimetype:     "text/plain",
+			Size:         5,
+			Expiry:       time.Unix(1700000000, 0),
+			OriginalName: "a.txt",
+			Uploaded:     time.Unix(1600000000, 0),
+			Custom:       map[string]string{"k": "v"},
+		},
+		"b.zip": {
+			Mimetype:     "application/zip",
+			Expiry:       expiry.NeverExpire,
+			ArchiveFiles: []ArchiveEntry{{Name: "c", Size: 1}},
+		},
+	}}
+
+	var buf bytes.Buffer
+	if err := ExportMetadata(ctx, src, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Fatalf("Exported %d lines instead of 2", lines)
+	}
+
+	dst := &metadataBackend{files: map[string]Metadata{}}
+	imported, err := ImportMetadata(ctx, dst, &buf)
+	if err != nil || imported != 2 {
+		t.Fatalf("Imported %d files, %v", imported, err)
+	}
+	for key, want := range src.files {
+		got := dst.files[key]
+		if !got.Expiry.Equal(want.Expiry) || !got.Uploaded.Equal(want.Uploaded) {
+			t.Fatalf("%s was imported with times %v and %v", key, got.Expiry, got.Uploaded)
+		}
+		got.Expiry, got.Uploaded = want.Expiry, want.Uploaded
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s was imported as %+v instead of %+v", key, got, want)
+		}
+	}
+
+	if _, err := ImportMetadata(ctx, dst, strings.NewReader(`{"key":"../a"}`)); err == nil {
+		t.Fatal("Invalid key was imported")
+	}
+}
@@ -0,0 +1,80 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How long a count of files is trusted for, with the files stored and
+// deleted since added to it, before listing them again
+const fileRecountInterval = time.Minute
+
+// Counts the files of a backend to enforce Limits.MaxFiles, without
+// listing them for every new file
+type FileCounter struct {
+	mu       sync.Mutex
+	count    int64
+	reserved int64
+	counted  time.Time
+}
+
+func NewFileCounter() *FileCounter {
+	return &FileCounter{}
+}
+
+// Reserve a slot for key, returning TooManyFilesError if Limits.MaxFiles
+// files are already stored or being stored, unless key is one of them and
+// would only be overwritten. done counts the file once it's stored or gives
+// the slot back, only its first call counts so that done(false) can be
+// deferred.
+func (c *FileCounter) Check(ctx context.Context, b MetaStorageBackend, key string) (done func(stored bool), err error) {
+	if Limits.MaxFiles <= 0 {
+		return func(bool) {}, nil
+	}
+
+	// Held while listing so that concurrent checks can't all pass on the
+	// same count
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.counted) > fileRecountInterval {
+		keys, err := b.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.count = int64(len(keys))
+		c.counted = time.Now()
+	}
+
+	if c.count+c.reserved >= Limits.MaxFiles {
+		if exists, err := b.Exists(ctx, key); err == nil && exists {
+			return func(bool) {}, nil
+		}
+		return nil, TooManyFilesError
+	}
+
+	c.reserved++
+	var once sync.Once
+	return func(stored bool) {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			c.reserved--
+			if stored {
+				c.count++
+			}
+		})
+	}, nil
+}
+
+// Count files stored without a slot from Check, or deleted if n is
+// negative, since the last count. Files overwritten under the limit are
+// counted again until the next count corrects it.
+func (c *FileCounter) Add(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.count += n
+}
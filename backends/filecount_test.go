@@ -0,0 +1,117 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Lists a fixed set of files, counting how often it's listed
+type listBackend struct {
+	MetaStorageBackend
+	keys  []string
+	lists int
+}
+
+func (b *listBackend) List(ctx context.Context) ([]string, error) {
+	b.lists++
+	return b.keys, nil
+}
+
+func (b *listBackend) Exists(ctx context.Context, key string) (bool, error) {
+	for _, k := range b.keys {
+		if k == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestFileCounter(t *testing.T) {
+	ctx := context.Background()
+	b := &listBackend{keys: []string{"a", "b"}}
+	c := NewFileCounter()
+
+	if _, err := c.Check(ctx, b, "c"); err != nil || b.lists != 0 {
+		t.Fatalf("Unlimited check returned %v after %d lists", err, b.lists)
+	}
+
+	Limits.MaxFiles = 3
+	defer func() {
+		Limits.MaxFiles = 0
+	}()
+
+	done, err := c.Check(ctx, b, "c")
+	if err != nil {
+		t.Fatalf("Check under the limit returned %v", err)
+	}
+	if _, err := c.Check(ctx, b, "d"); err != TooManyFilesError {
+		t.Fatalf("Check with the last slot reserved returned %v", err)
+	}
+	done(false)
+	if done, err = c.Check(ctx, b, "c"); err != nil {
+		t.Fatalf("Check after giving the slot back returned %v", err)
+	}
+	done(true)
+	done(false)
+	if _, err := c.Check(ctx, b, "d"); err != TooManyFilesError {
+		t.Fatalf("Check at the limit returned %v", err)
+	}
+	if _, err := c.Check(ctx, b, "a"); err != nil {
+		t.Fatalf("Overwriting at the limit returned %v", err)
+	}
+	if b.lists != 1 {
+		t.Fatalf("Files were listed %d times instead of once", b.lists)
+	}
+
+	c.Add(-1)
+	if _, err := c.Check(ctx, b, "d"); err != nil {
+		t.Fatalf("Check after a delete returned %v", err)
+	}
+}
+
+func TestFileCounterConcurrent(t *testing.T) {
+	ctx := context.Background()
+	b := &listBackend{keys: []string{"a", "b"}}
+	c := NewFileCounter()
+	Limits.MaxFiles = 5
+	defer func() {
+		Limits.MaxFiles = 0
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			done, err := c.Check(ctx, b, fmt.Sprintf("new-%d", i))
+			if err == nil {
+				// Storing the file takes a while, letting the other
+				// checks through if the slot isn't taken yet
+				time.Sleep(time.Millisecond)
+				done(true)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	stored := 0
+	for err := range errs {
+		if err == nil {
+			stored++
+		} else if err != TooManyFilesError {
+			t.Error(err)
+		}
+	}
+	if stored != 3 {
+		t.Errorf("%d files were let in with room for 3", stored)
+	}
+	if b.lists != 1 {
+		t.Errorf("Files were listed %d times instead of once", b.lists)
+	}
+}
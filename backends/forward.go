@@ -0,0 +1,54 @@
+package backends
+
+import (
+	"context"
+	"io/fs"
+	"time"
+)
+
+// Forwards the methods a MetaStorageBackend has on top of a StorageBackend
+// to meta, for wrappers to embed alongside the StorageBackend they wrap so
+// that they only implement the methods they change
+type metaForwarder struct {
+	meta MetaStorageBackend
+}
+
+func (f metaForwarder) List(ctx context.Context) ([]string, error) {
+	return f.meta.List(ctx)
+}
+
+func (f metaForwarder) ListPaginated(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	return f.meta.ListPaginated(ctx, cursor, limit)
+}
+
+func (f metaForwarder) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	return f.meta.ListExpired(ctx, before)
+}
+
+func (f metaForwarder) VerifyChecksum(ctx context.Context, key string) (bool, string, error) {
+	return f.meta.VerifyChecksum(ctx, key)
+}
+
+func (f metaForwarder) Stats(ctx context.Context) (Stats, error) {
+	return f.meta.Stats(ctx)
+}
+
+func (f metaForwarder) Query(ctx context.Context, filter ListFilter) ([]string, error) {
+	return f.meta.Query(ctx, filter)
+}
+
+func (f metaForwarder) GetByPublicID(ctx context.Context, id string) (string, error) {
+	return f.meta.GetByPublicID(ctx, id)
+}
+
+func (f metaForwarder) FindBySha256(ctx context.Context, sum string) (string, bool, error) {
+	return f.meta.FindBySha256(ctx, sum)
+}
+
+func (f metaForwarder) HeadMany(ctx context.Context, keys []string) (map[string]Metadata, map[string]error) {
+	return f.meta.HeadMany(ctx, keys)
+}
+
+func (f metaForwarder) ArchiveFS(key string) (fs.FS, error) {
+	return f.meta.ArchiveFS(key)
+}
@@ -0,0 +1,847 @@
+package googlecloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/dchest/uniuri"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+type GoogleCloudBackend struct {
+	bucket          string
+	client          *storage.Client
+	signedURLExpiry time.Duration
+	scanner         backends.Scanner
+	files           *backends.FileCounter
+}
+
+type GoogleCloudOptions struct {
+	// Service account JSON key file. Application default credentials are
+	// used when empty.
+	CredentialsFile string
+
+	// When set, ServeFile redirects to a signed URL valid for this long
+	// instead of streaming the object through linx-server
+	SignedURLExpiry time.Duration
+
+	// Scan new files with this before uploading them, if set
+	Scanner backends.Scanner
+}
+
+// Custom metadata is limited to 8 KiB per object, so archive listings are
+// cut short to fit in this
+const maxArchiveFilesSize = 4096
+
+// How many objects BatchDelete deletes and HeadMany reads at the same time
+const batchWorkers = 16
+
+func (b GoogleCloudBackend) object(key string) *storage.ObjectHandle {
+	return b.client.Bucket(b.bucket).Object(key)
+}
+
+// Uploads in progress would have to be kept somewhere every instance can
+// reach, so they aren't supported
+func (b GoogleCloudBackend) Append(ctx context.Context, key string, r io.Reader, offset int64) (int64, error) {
+	return 0, backends.NotSupportedErr
+}
+
+func (b GoogleCloudBackend) PurgeUploads(ctx context.Context, olderThan time.Duration) error {
+	return backends.NotSupportedErr
+}
+
+func (b GoogleCloudBackend) Capabilities() backends.Caps {
+	return backends.Caps{
+		SupportsPresign: true,
+		SupportsRange:   true,
+		SupportsCopy:    true,
+		SupportsList:    true,
+	}
+}
+
+func (b GoogleCloudBackend) CheckAccessKey(ctx context.Context, key, provided string) (bool, error) {
+	return backends.CheckAccessKey(ctx, b, key, provided)
+}
+
+func (b GoogleCloudBackend) CheckDeleteKey(ctx context.Context, key, provided string) (bool, error) {
+	return backends.CheckDeleteKey(ctx, b, key, provided)
+}
+
+func (b GoogleCloudBackend) Copy(ctx context.Context, srcKey, dstKey string) (m backends.Metadata, err error) {
+	if err = backends.ValidateKey(dstKey); err != nil {
+		return
+	}
+	m, err = b.Head(ctx, srcKey)
+	if err != nil {
+		return
+	}
+	// Checked before reserving a slot against MaxFiles; the DoesNotExist
+	// condition still covers an object created in the meantime
+	var exists bool
+	if exists, err = b.Exists(ctx, dstKey); err != nil {
+		return
+	} else if exists {
+		return m, backends.KeyExistsErr
+	}
+	done, err := b.files.Check(ctx, b, dstKey)
+	if err != nil {
+		return
+	}
+	defer done(false)
+
+	m.PublicID = backends.NewPublicID()
+	m.DeleteKey = uniuri.NewLen(30)
+	m.Uploaded = time.Now()
+
+	dst := b.object(dstKey).If(storage.Conditions{DoesNotExist: true})
+	copier := dst.CopierFrom(b.object(srcKey))
+	copier.ContentType = m.Mimetype
+	copier.Metadata = mapMetadata(m)
+	copier.CustomTime = customTime(m.Expiry)
+
+	_, err = copier.Run(ctx)
+	var apiErr *googleapi.Error
+	if err == storage.ErrObjectNotExist || (errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound) {
+		return m, backends.NotFoundErr
+	} else if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return m, backends.KeyExistsErr
+	} else if err == nil {
+		done(true)
+	}
+	return
+}
+
+func (b GoogleCloudBackend) Delete(ctx context.Context, key string) error {
+	if err := backends.ValidateKey(key); err != nil {
+		return err
+	}
+	err := b.object(key).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return backends.NotFoundErr
+	} else if err == nil {
+		b.files.Add(-1)
+	}
+	return err
+}
+
+// The Go client doesn't expose the JSON API's batch requests, so objects
+// are deleted with concurrent requests instead
+func (b GoogleCloudBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	return backends.DeleteEach(ctx, keys, batchWorkers, b.Delete)
+}
+
+func (b GoogleCloudBackend) Exists(ctx context.Context, key string) (bool, error) {
+	if err := backends.ValidateKey(key); err != nil {
+		return false, err
+	}
+	_, err := b.object(key).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Listing a single object only needs the permissions the backend already
+// uses, unlike reading the bucket's attributes
+func (b GoogleCloudBackend) HealthCheck(ctx context.Context) error {
+	it := b.client.Bucket(b.bucket).Objects(ctx, nil)
+	it.PageInfo().MaxSize = 1
+
+	_, err := it.Next()
+	if err == iterator.Done {
+		return nil
+	}
+	return err
+}
+
+func (b GoogleCloudBackend) Head(ctx context.Context, key string) (metadata backends.Metadata, err error) {
+	if err = backends.ValidateKey(key); err != nil {
+		return
+	}
+	attrs, err := b.object(key).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return metadata, backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
+	return unmapMetadata(attrs)
+}
+
+func (b GoogleCloudBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (backends.Metadata, error) {
+	return backends.Metadata{}, backends.NotSupportedErr
+}
+
+// Deleted objects can be kept with the bucket's soft delete policy instead, so
+// there is no trash to manage
+func (b GoogleCloudBackend) GetDeleted(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	return backends.Metadata{}, nil, backends.NotSupportedErr
+}
+
+func (b GoogleCloudBackend) PurgeTrash(ctx context.Context, olderThan time.Duration) error {
+	return backends.NotSupportedErr
+}
+
+func (b GoogleCloudBackend) Restore(ctx context.Context, key string) error {
+	return backends.NotSupportedErr
+}
+
+func (b GoogleCloudBackend) Get(ctx context.Context, key string) (metadata backends.Metadata, r io.ReadCloser, err error) {
+	metadata, err = b.Head(ctx, key)
+	if err != nil {
+		return
+	}
+
+	r, err = b.object(key).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return metadata, nil, backends.NotFoundErr
+	}
+	return
+}
+
+func (b GoogleCloudBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err = backends.RangeLength(m.Size, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := b.object(key).NewRangeReader(ctx, offset, length)
+	if err == storage.ErrObjectNotExist {
+		return nil, backends.NotFoundErr
+	}
+	return r, err
+}
+
+func (b GoogleCloudBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
+	metadata, err := b.Head(r.Context(), key)
+	if err != nil {
+		return
+	}
+
+	backends.SetServeHeaders(w, r, key, metadata)
+	w = backends.ThrottleDownload(w, r, metadata)
+
+	// Objects served from signed URLs are sent as they are stored
+	if b.signedURLExpiry == 0 {
+		var finish func() error
+		w, finish = backends.GzipText(w, r, &metadata)
+		defer finish()
+	}
+
+	if backends.CheckPreconditions(w, r, metadata) {
+		return nil
+	}
+
+	if b.signedURLExpiry > 0 {
+		u, err := b.signedURL(key, w.Header().Get("Content-Disposition"), b.signedURLExpiry)
+		if err != nil {
+			return err
+		}
+
+		// The headers set for the file itself don't apply to the redirect
+		w.Header().Del("Content-Length")
+		http.Redirect(w, r, u, http.StatusFound)
+		return nil
+	}
+
+	rd := &backends.RangeReader{
+		Open: func(offset int64) (io.ReadCloser, error) {
+			return b.object(key).NewRangeReader(r.Context(), offset, -1)
+		},
+		Size: metadata.Size,
+	}
+	defer rd.Close()
+
+	return backends.ServeReader(w, r, rd, metadata.Size, metadata.Mimetype)
+}
+
+func (b GoogleCloudBackend) ServeThumbnail(key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error {
+	return backends.ServeThumbnail(b, key, w, r, maxWidth, maxHeight)
+}
+
+func (b GoogleCloudBackend) ServeImageVariant(key string, w http.ResponseWriter, r *http.Request) error {
+	return backends.ServeImageVariant(b, key, w, r)
+}
+
+func (b GoogleCloudBackend) ServeArchiveEntry(key string, entryPath string, w http.ResponseWriter, r *http.Request) error {
+	return backends.ServeArchiveEntry(b, key, entryPath, w, r)
+}
+
+func (b GoogleCloudBackend) ArchiveFS(key string) (fs.FS, error) {
+	return backends.ArchiveFS(b, key)
+}
+
+func (b GoogleCloudBackend) Preview(ctx context.Context, key string, maxBytes int) (string, bool, error) {
+	return backends.Preview(ctx, b, key, maxBytes)
+}
+
+func (b GoogleCloudBackend) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	metadata, err := b.Head(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	return b.signedURL(key, backends.PresignDisposition(metadata), ttl)
+}
+
+func (b GoogleCloudBackend) signedURL(key string, disposition string, ttl time.Duration) (string, error) {
+	params := url.Values{}
+	if disposition != "" {
+		params.Set("response-content-disposition", disposition)
+	}
+
+	return b.client.Bucket(b.bucket).SignedURL(key, &storage.SignedURLOptions{
+		Scheme:          storage.SigningSchemeV4,
+		Method:          "GET",
+		Expires:         time.Now().Add(ttl),
+		QueryParameters: params,
+	})
+}
+
+func (b GoogleCloudBackend) Put(ctx context.Context, key string, r io.Reader, expiryTime time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (m backends.Metadata, err error) {
+	if err = backends.ValidateKey(key); err != nil {
+		return
+	}
+	if err = backends.CheckCustom(o.Custom); err != nil {
+		return
+	}
+	if err = backends.CheckTags(o.Tags); err != nil {
+		return
+	}
+	if expiryTime, err = backends.AllowedExpiry(expiryTime); err != nil {
+		return
+	}
+	done, err := b.files.Check(ctx, b, key)
+	if err != nil {
+		return
+	}
+	defer done(false)
+
+	// Checked before reading r so that the caller can still retry with
+	// another key, the upload itself is conditional in case of a race
+	if !o.Overwrite {
+		if exists, _ := b.Exists(ctx, key); exists {
+			return m, backends.KeyConflictErr
+		}
+	}
+
+	// The metadata has to be known before the upload starts, so buffer
+	// the file on disk first
+	tmpDst, err := os.CreateTemp("", "linx-server-upload")
+	if err != nil {
+		return
+	}
+	defer tmpDst.Close()
+	defer os.Remove(tmpDst.Name())
+
+	// Stop buffering once the file reaches MaxSize, rather than filling
+	// the disk before rejecting it
+	src := backends.MinRateReader(helpers.NewContextReader(ctx, r), backends.Limits.MinUploadRate, backends.Limits.MinUploadRateWindow)
+	bytes, err := io.Copy(tmpDst, backends.LimitedReader(src, backends.Limits.MaxSize))
+	if err != nil {
+		return m, err
+	} else if bytes == 0 {
+		return m, backends.FileEmptyError
+	}
+
+	_, err = tmpDst.Seek(0, 0)
+	if err != nil {
+		return
+	}
+
+	if o.Encryption.Scheme != "" {
+		m, err = helpers.GenerateOpaqueMetadata(tmpDst)
+	} else {
+		m, err = helpers.GenerateMetadata(tmpDst)
+		m.Mimetype = helpers.RefineMimetype(m.Mimetype, originalName, key)
+	}
+	if err != nil {
+		return
+	}
+	if err = backends.CheckMimeSize(m.Mimetype, bytes); err != nil {
+		return
+	}
+	if err = backends.CheckSha256(o.ExpectedSha256, m.Sha256sum); err != nil {
+		return
+	}
+
+	if _, err = tmpDst.Seek(0, 0); err != nil {
+		return
+	}
+	if err = backends.ScanFile(b.scanner, tmpDst); err != nil {
+		return
+	}
+
+	m.Expiry = backends.FileExpiry(expiryTime, bytes)
+	m.DeleteKey = deleteKey
+	m.AccessKey = accessKey
+	m.SrcIp = srcIp
+	m.PublicID = backends.NewPublicID()
+	m.OriginalName, m.Custom = backends.SanitizeOriginalName(originalName, o.Custom)
+	m.Tags = o.Tags
+	m.Encryption = o.Encryption
+	m.Uploaded = time.Now()
+	m.ArchiveFiles, m.ArchiveTruncated, m.ArchiveOmitted, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, tmpDst)
+
+	_, err = tmpDst.Seek(0, 0)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	obj := b.object(key)
+	if !o.Overwrite {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+
+	w := obj.NewWriter(ctx)
+	w.ContentType = m.Mimetype
+	w.Metadata = mapMetadata(m)
+	w.CustomTime = customTime(m.Expiry)
+
+	if _, err = io.Copy(w, tmpDst); err != nil {
+		// Cancelling the context aborts the upload
+		return
+	}
+	err = w.Close()
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return m, backends.KeyConflictErr
+	} else if err == nil {
+		done(true)
+	}
+	return
+}
+
+func (b GoogleCloudBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) (err error) {
+	if err = backends.ValidateKey(key); err != nil {
+		return
+	}
+	if err = backends.CheckCustom(m.Custom); err != nil {
+		return
+	}
+	if err = backends.CheckTags(m.Tags); err != nil {
+		return
+	}
+
+	obj := b.object(key)
+
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
+	update := storage.ObjectAttrsToUpdate{
+		ContentType: m.Mimetype,
+		Metadata:    mapMetadata(m),
+	}
+
+	// A custom time can only ever be moved forward
+	if t := customTime(m.Expiry); t.After(attrs.CustomTime) {
+		update.CustomTime = t
+	}
+
+	_, err = obj.Update(ctx, update)
+	return
+}
+
+// Objects can't be renamed, so this copies the object along with its
+// metadata, refusing to replace an existing one, and deletes the original
+func (b GoogleCloudBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	if err := backends.ValidateKey(oldKey); err != nil {
+		return err
+	}
+	if err := backends.ValidateKey(newKey); err != nil {
+		return err
+	}
+	dst := b.object(newKey).If(storage.Conditions{DoesNotExist: true})
+	_, err := dst.CopierFrom(b.object(oldKey)).Run(ctx)
+
+	// Copies report a missing source as a plain 404 rather than
+	// storage.ErrObjectNotExist
+	var apiErr *googleapi.Error
+	if err == storage.ErrObjectNotExist || (errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound) {
+		return backends.NotFoundErr
+	} else if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return backends.KeyExistsErr
+	} else if err != nil {
+		return err
+	}
+
+	return b.object(oldKey).Delete(ctx)
+}
+
+func (b GoogleCloudBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	if err := backends.ValidateKey(key); err != nil {
+		return err
+	}
+	obj := b.object(key)
+
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return err
+	}
+
+	if err := backends.CheckExpiry(attrs.Size, newExpiry); err != nil {
+		return err
+	}
+
+	// Updated metadata is merged into the existing metadata, so this
+	// leaves the other keys alone
+	update := storage.ObjectAttrsToUpdate{
+		Metadata: map[string]string{
+			"expiry": strconv.FormatInt(newExpiry.Unix(), 10),
+		},
+	}
+	if t := customTime(newExpiry); t.After(attrs.CustomTime) {
+		update.CustomTime = t
+	}
+
+	_, err = obj.Update(ctx, update)
+	return err
+}
+
+func (b GoogleCloudBackend) Touch(ctx context.Context, key string, extend time.Duration) error {
+	return backends.Touch(ctx, b, key, extend)
+}
+
+func (b GoogleCloudBackend) GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error {
+	return backends.GrantAccess(ctx, b, key, accessKey, until)
+}
+
+func (b GoogleCloudBackend) Size(ctx context.Context, key string) (int64, error) {
+	if err := backends.ValidateKey(key); err != nil {
+		return 0, err
+	}
+	attrs, err := b.object(key).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return 0, backends.NotFoundErr
+	} else if err != nil {
+		return 0, err
+	}
+
+	return attrs.Size, nil
+}
+
+func (b GoogleCloudBackend) VerifyChecksum(ctx context.Context, key string) (bool, string, error) {
+	return backends.VerifyChecksum(ctx, b, key)
+}
+
+func (b GoogleCloudBackend) Stats(ctx context.Context) (backends.Stats, error) {
+	return backends.ComputeStats(ctx, b)
+}
+
+func (b GoogleCloudBackend) Query(ctx context.Context, filter backends.ListFilter) ([]string, error) {
+	return backends.Query(ctx, b, filter)
+}
+
+func (b GoogleCloudBackend) GetByPublicID(ctx context.Context, id string) (string, error) {
+	return backends.FindByPublicID(ctx, b, id)
+}
+
+func (b GoogleCloudBackend) FindBySha256(ctx context.Context, sum string) (string, bool, error) {
+	return backends.ScanBySha256(ctx, b, sum)
+}
+
+func (b GoogleCloudBackend) HeadMany(ctx context.Context, keys []string) (map[string]backends.Metadata, map[string]error) {
+	return backends.HeadEach(ctx, keys, batchWorkers, b.Head)
+}
+
+func (b GoogleCloudBackend) List(ctx context.Context) ([]string, error) {
+	var output []string
+
+	query := &storage.Query{}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+
+	it := b.client.Bucket(b.bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		output = append(output, attrs.Name)
+	}
+
+	return output, nil
+}
+
+// Objects are listed in name order, so the cursor is the last key of the
+// previous page
+func (b GoogleCloudBackend) ListPaginated(ctx context.Context, cursor string, limit int) (keys []string, nextCursor string, err error) {
+	query := &storage.Query{}
+	if cursor != "" {
+		// StartOffset is inclusive, and no name sorts between the cursor
+		// and the cursor followed by a NUL
+		query.StartOffset = cursor + "\x00"
+	}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, "", err
+	}
+
+	it := b.client.Bucket(b.bucket).Objects(ctx, query)
+	if limit > 0 {
+		// One more than asked for shows whether there is another page
+		it.PageInfo().MaxSize = limit + 1
+	}
+
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return keys, "", nil
+		} else if err != nil {
+			return nil, "", err
+		}
+
+		if limit > 0 && len(keys) == limit {
+			return keys, keys[len(keys)-1], nil
+		}
+		keys = append(keys, attrs.Name)
+	}
+}
+
+func (b GoogleCloudBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	type expiring struct {
+		key    string
+		expiry int64
+	}
+	var found []expiring
+
+	query := &storage.Query{}
+	if err := query.SetAttrSelection([]string{"Name", "Metadata"}); err != nil {
+		return nil, err
+	}
+
+	it := b.client.Bucket(b.bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		ts, err := strconv.ParseInt(attrs.Metadata["expiry"], 10, 64)
+		if err != nil || ts == expiry.NeverExpire.Unix() {
+			continue
+		}
+
+		if time.Unix(ts, 0).Before(before) {
+			found = append(found, expiring{attrs.Name, ts})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].expiry < found[j].expiry
+	})
+
+	output := make([]string, len(found))
+	for i, f := range found {
+		output[i] = f.key
+	}
+
+	return output, nil
+}
+
+// Objects carry their expiry as their custom time, so that a bucket
+// lifecycle rule on daysSinceCustomTime can delete them once expired
+func customTime(t time.Time) time.Time {
+	if t == expiry.NeverExpire {
+		return time.Time{}
+	}
+	return t
+}
+
+func mapMetadata(m backends.Metadata) map[string]string {
+	metadata := map[string]string{
+		"expiry":              strconv.FormatInt(m.Expiry.Unix(), 10),
+		"public_id":           m.PublicID,
+		"delete_key":          m.DeleteKey,
+		"access_key":          m.AccessKey,
+		"access_key_expiry":   "",
+		"sha256sum":           m.Sha256sum,
+		"srcip":               m.SrcIp,
+		"original_name":       m.OriginalName,
+		"archive_files":       "",
+		"uploaded":            "",
+		"archive_truncated":   "",
+		"archive_omitted":     "",
+		"encryption_scheme":   m.Encryption.Scheme,
+		"encryption_nonce":    m.Encryption.Nonce,
+		"encryption_key_hint": m.Encryption.KeyHint,
+		"custom":              "",
+		"checksums":           "",
+		"tags":                "",
+		"download_rate":       "",
+	}
+
+	if !m.Uploaded.IsZero() {
+		metadata["uploaded"] = strconv.FormatInt(m.Uploaded.Unix(), 10)
+	}
+
+	if !m.AccessKeyExpiry.IsZero() {
+		metadata["access_key_expiry"] = strconv.FormatInt(m.AccessKeyExpiry.Unix(), 10)
+	}
+
+	if m.DownloadRate != 0 {
+		metadata["download_rate"] = strconv.FormatInt(m.DownloadRate, 10)
+	}
+
+	// Listings that don't fit are cut short to what does
+	files, omitted := backends.FitArchiveFiles(m.ArchiveFiles, maxArchiveFilesSize)
+	if len(files) > 0 {
+		archiveFiles, err := json.Marshal(files)
+		if err == nil {
+			metadata["archive_files"] = string(archiveFiles)
+		}
+	}
+
+	if m.ArchiveTruncated || omitted > 0 {
+		metadata["archive_truncated"] = "true"
+	}
+	if m.ArchiveOmitted+omitted > 0 {
+		metadata["archive_omitted"] = strconv.Itoa(m.ArchiveOmitted + omitted)
+	}
+
+	if len(m.Custom) > 0 {
+		custom, err := json.Marshal(m.Custom)
+		if err == nil {
+			metadata["custom"] = string(custom)
+		}
+	}
+
+	if len(m.Checksums) > 0 {
+		checksums, err := json.Marshal(m.Checksums)
+		if err == nil {
+			metadata["checksums"] = string(checksums)
+		}
+	}
+
+	// Objects have no tags of their own, so they're kept with the rest
+	if len(m.Tags) > 0 {
+		tags, err := json.Marshal(m.Tags)
+		if err == nil {
+			metadata["tags"] = string(tags)
+		}
+	}
+
+	return metadata
+}
+
+func unmapMetadata(attrs *storage.ObjectAttrs) (m backends.Metadata, err error) {
+	expiry, err := strconv.ParseInt(attrs.Metadata["expiry"], 10, 64)
+	if err != nil {
+		return m, backends.BadMetadata
+	}
+
+	m.Expiry = time.Unix(expiry, 0)
+	m.PublicID = attrs.Metadata["public_id"]
+	m.DeleteKey = attrs.Metadata["delete_key"]
+	m.AccessKey = attrs.Metadata["access_key"]
+	if accessKeyExpiry, err := strconv.ParseInt(attrs.Metadata["access_key_expiry"], 10, 64); err == nil {
+		m.AccessKeyExpiry = time.Unix(accessKeyExpiry, 0)
+	}
+	m.Sha256sum = attrs.Metadata["sha256sum"]
+	m.SrcIp = attrs.Metadata["srcip"]
+	m.OriginalName = attrs.Metadata["original_name"]
+	m.Mimetype = attrs.ContentType
+	m.Size = attrs.Size
+	m.ETag = backends.ETag(m.Sha256sum)
+	m.ModTime = attrs.Updated
+
+	// Objects uploaded before this was recorded fall back to their
+	// creation time, which a rename resets
+	m.Uploaded = attrs.Created
+	if uploaded, err := strconv.ParseInt(attrs.Metadata["uploaded"], 10, 64); err == nil {
+		m.Uploaded = time.Unix(uploaded, 0)
+	}
+
+	if archiveFiles := attrs.Metadata["archive_files"]; archiveFiles != "" {
+		if err := json.Unmarshal([]byte(archiveFiles), &m.ArchiveFiles); err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	m.ArchiveTruncated = attrs.Metadata["archive_truncated"] == "true"
+	m.ArchiveOmitted, _ = strconv.Atoi(attrs.Metadata["archive_omitted"])
+	m.Encryption = backends.Encryption{
+		Scheme:  attrs.Metadata["encryption_scheme"],
+		Nonce:   attrs.Metadata["encryption_nonce"],
+		KeyHint: attrs.Metadata["encryption_key_hint"],
+	}
+
+	if custom := attrs.Metadata["custom"]; custom != "" {
+		if err := json.Unmarshal([]byte(custom), &m.Custom); err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	if checksums := attrs.Metadata["checksums"]; checksums != "" {
+		if err := json.Unmarshal([]byte(checksums), &m.Checksums); err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	if tags := attrs.Metadata["tags"]; tags != "" {
+		if err := json.Unmarshal([]byte(tags), &m.Tags); err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	m.DownloadRate, _ = strconv.ParseInt(attrs.Metadata["download_rate"], 10, 64)
+
+	return
+}
+
+func NewGoogleCloudBackend(bucket string, o GoogleCloudOptions) (GoogleCloudBackend, error) {
+	b := GoogleCloudBackend{
+		bucket:          bucket,
+		signedURLExpiry: o.SignedURLExpiry,
+		scanner:         o.Scanner,
+		files:           backends.NewFileCounter(),
+	}
+
+	var opts []option.ClientOption
+	if o.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(o.CredentialsFile))
+	}
+
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return b, err
+	}
+	b.client = client
+
+	return b, nil
+}
@@ -0,0 +1,339 @@
+//go:build fakegcs
+
+// Run against a local fake-gcs-server with:
+//
+//	fake-gcs-server -scheme http -port 4443 -backend memory -public-host 127.0.0.1:4443 &
+//	STORAGE_EMULATOR_HOST=127.0.0.1:4443 go test -tags fakegcs ./backends/googlecloud/
+package googlecloud
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/dchest/uniuri"
+	"google.golang.org/api/iterator"
+)
+
+var ctx = context.Background()
+
+func newTestBackend(t *testing.T) GoogleCloudBackend {
+	// The client talks to the emulator instead of Google Cloud, without
+	// credentials, when this is set
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		os.Setenv("STORAGE_EMULATOR_HOST", "127.0.0.1:4443")
+	}
+
+	backends.Limits.MaxSize = 1024 * 1024
+
+	b, err := NewGoogleCloudBackend("linx-test-"+strings.ToLower(uniuri.NewLen(8)), GoogleCloudOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := b.client.Bucket(b.bucket)
+	if err := bucket.Create(ctx, "linx-test", nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		it := bucket.Objects(ctx, nil)
+		for {
+			attrs, err := it.Next()
+			if err != nil {
+				break
+			}
+			bucket.Object(attrs.Name).Delete(ctx)
+		}
+		bucket.Delete(ctx)
+	})
+
+	return b
+}
+
+func TestGoogleCloudPutHeadGet(t *testing.T) {
+	b := newTestBackend(t)
+
+	m, err := b.Put(ctx, "test.txt", strings.NewReader("hello, world"), time.Hour, "delkey", "acckey", "127.0.0.1", "héllo.txt", backends.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head(ctx, "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head.DeleteKey != "delkey" || head.AccessKey != "acckey" || head.SrcIp != "127.0.0.1" {
+		t.Fatalf("Keys weren't stored: %+v", head)
+	}
+	if head.OriginalName != "héllo.txt" {
+		t.Fatalf("Original name was %q", head.OriginalName)
+	}
+	if head.Sha256sum != m.Sha256sum || head.Size != 12 || head.Expiry.Unix() != m.Expiry.Unix() {
+		t.Fatalf("Metadata %+v doesn't match %+v", head, m)
+	}
+
+	_, r, err := b.Get(ctx, "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	content, _ := io.ReadAll(r)
+	if string(content) != "hello, world" {
+		t.Fatalf("Content was %q", content)
+	}
+
+	if size, err := b.Size(ctx, "test.txt"); err != nil || size != 12 {
+		t.Fatalf("Size returned %d, %v", size, err)
+	}
+}
+
+func TestGoogleCloudNotFound(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Head(ctx, "missing"); err != backends.NotFoundErr {
+		t.Fatalf("Head returned %v instead of NotFoundErr", err)
+	}
+	if exists, err := b.Exists(ctx, "missing"); exists || err != nil {
+		t.Fatalf("Exists returned %v, %v", exists, err)
+	}
+	if err := b.Delete(ctx, "missing"); err != backends.NotFoundErr {
+		t.Fatalf("Delete returned %v instead of NotFoundErr", err)
+	}
+	if _, err := b.Size(ctx, "missing"); err != backends.NotFoundErr {
+		t.Fatalf("Size returned %v instead of NotFoundErr", err)
+	}
+}
+
+func TestGoogleCloudInvalidKeys(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "valid", strings.NewReader("valid"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	head, err := b.Head(ctx, "valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "..", "a/b", "a\\b"} {
+		if err := b.PutMetadata(ctx, key, head); err != backends.InvalidKeyErr {
+			t.Errorf("PutMetadata(%q) returned %v", key, err)
+		}
+		if err := b.Rename(ctx, key, "renamed"); err != backends.InvalidKeyErr {
+			t.Errorf("Rename(%q) returned %v", key, err)
+		}
+		if err := b.SetExpiry(ctx, key, time.Now().Add(time.Hour)); err != backends.InvalidKeyErr {
+			t.Errorf("SetExpiry(%q) returned %v", key, err)
+		}
+		if _, err := b.Size(ctx, key); err != backends.InvalidKeyErr {
+			t.Errorf("Size(%q) returned %v", key, err)
+		}
+	}
+
+	it := b.client.Bucket(b.bucket).Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Name != "valid" {
+			t.Errorf("Object %q was created", attrs.Name)
+		}
+	}
+}
+
+func TestGoogleCloudCopyAndPutMetadata(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "src", strings.NewReader("copy me"), 0, "delkey", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := b.Copy(ctx, "src", "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.DeleteKey == "delkey" {
+		t.Fatal("Copy kept the source delete key")
+	}
+
+	copied.AccessKey = "newkey"
+	if err := b.PutMetadata(ctx, "dst", copied); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head(ctx, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.AccessKey != "newkey" || head.DeleteKey != copied.DeleteKey || head.Size != 7 {
+		t.Fatalf("Copied metadata was %+v", head)
+	}
+}
+
+func TestGoogleCloudCopyExisting(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, key := range []string{"src", "dst"} {
+		if _, err := b.Put(ctx, key, strings.NewReader(key), 0, "delkey-"+key, "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := b.Copy(ctx, "src", "dst"); err != backends.KeyExistsErr {
+		t.Fatalf("Copying onto an existing key returned %v", err)
+	}
+	head, err := b.Head(ctx, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.DeleteKey != "delkey-dst" || head.Size != 3 {
+		t.Fatalf("Existing file was replaced: %+v", head)
+	}
+}
+
+func TestGoogleCloudSetExpiry(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "test.txt", strings.NewReader("extend me"), time.Hour, "delkey", "", "", "orig.txt", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	newExpiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	if err := b.SetExpiry(ctx, "test.txt", newExpiry); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head(ctx, "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !head.Expiry.Equal(newExpiry) {
+		t.Fatalf("Expiry was %v instead of %v", head.Expiry, newExpiry)
+	}
+	if head.DeleteKey != "delkey" || head.OriginalName != "orig.txt" {
+		t.Fatalf("Other metadata was lost: %+v", head)
+	}
+}
+
+func TestGoogleCloudListExpired(t *testing.T) {
+	b := newTestBackend(t)
+
+	for key, expiry := range map[string]time.Duration{"soon": time.Second, "later": time.Hour, "never": 0} {
+		if _, err := b.Put(ctx, key, strings.NewReader(key), expiry, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := b.ListExpired(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "soon" {
+		t.Fatalf("Listed %v instead of [soon]", keys)
+	}
+}
+
+func TestGoogleCloudListPaginated(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := b.Put(ctx, key, strings.NewReader(key), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var pages []string
+	cursor := ""
+	for {
+		keys, next, err := b.ListPaginated(ctx, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, strings.Join(keys, ","))
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if strings.Join(pages, "|") != "a,b|c,d|e" {
+		t.Fatalf("Listed pages %q instead of a,b|c,d|e", pages)
+	}
+}
+
+func TestGoogleCloudRename(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "old", strings.NewReader("old"), 0, "delkey-old", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// fake-gcs-server ignores the conditions copies are made on, so
+	// renaming onto an existing key is only refused by Google Cloud
+	if err := b.Rename(ctx, "missing", "new"); err != backends.NotFoundErr {
+		t.Fatalf("Renaming a missing key returned %v", err)
+	}
+
+	if err := b.Rename(ctx, "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := b.Exists(ctx, "old"); exists {
+		t.Fatal("Old key still exists")
+	}
+
+	head, err := b.Head(ctx, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.DeleteKey != "delkey-old" || head.Size != 3 {
+		t.Fatalf("Renamed metadata was %+v", head)
+	}
+}
+
+func TestGoogleCloudGetRange(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "range.txt", strings.NewReader("0123456789"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := b.GetRange(ctx, "range.txt", 7, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	content, _ := io.ReadAll(r)
+	if string(content) != "789" {
+		t.Fatalf("Range was %q instead of \"789\"", content)
+	}
+
+	if _, err := b.GetRange(ctx, "range.txt", 11, 1); err != backends.RangeNotSatisfiableErr {
+		t.Fatalf("Range past the end returned %v", err)
+	}
+}
+
+func TestGoogleCloudPutExclusive(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "taken.txt", strings.NewReader("first"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(ctx, "taken.txt", strings.NewReader("second"), 0, "", "", "", "", backends.PutOptions{}); err != backends.KeyConflictErr {
+		t.Fatalf("Put over an existing object returned %v", err)
+	}
+
+	m, err := b.Put(ctx, "taken.txt", strings.NewReader("third"), 0, "", "", "", "", backends.PutOptions{Overwrite: true})
+	if err != nil || m.Size != 5 {
+		t.Fatalf("Overwriting Put returned %v, %v", m, err)
+	}
+}
@@ -0,0 +1,109 @@
+package backends
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Mimetypes outside of text/ that are text, and worth gzipping on the fly
+var textMimetypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/yaml":       true,
+	"application/toml":       true,
+	"application/x-sh":       true,
+	"image/svg+xml":          true,
+}
+
+func isText(mimetype string) bool {
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	mimetype = strings.TrimSpace(mimetype)
+	return strings.HasPrefix(mimetype, "text/") || textMimetypes[mimetype] ||
+		strings.HasSuffix(mimetype, "+json") || strings.HasSuffix(mimetype, "+xml")
+}
+
+// Whether a request's Accept-Encoding allows a gzipped response
+func AcceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// The ETag of the gzipped representation of a file, which has to differ
+// from the ETag of the file itself
+func GzipETag(etag string) string {
+	if etag == "" {
+		return ""
+	}
+	return strings.TrimSuffix(etag, "\"") + "-gzip\""
+}
+
+// For ServeFile to gzip text files on the fly for clients that accept it,
+// wrapping w so that a 200 response is gzipped and giving m the ETag of the
+// gzipped representation. Range requests are served as they are, since
+// ranges are of the file itself. The returned func must be called once the
+// response has been written.
+func GzipText(w http.ResponseWriter, r *http.Request, m *Metadata) (http.ResponseWriter, func() error) {
+	if !IsTextContent(m.Mimetype, nil) {
+		return w, func() error { return nil }
+	}
+
+	if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Accept-Encoding") {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if !AcceptsGzip(r) || r.Header.Get("Range") != "" {
+		return w, func() error { return nil }
+	}
+
+	m.ETag = GzipETag(m.ETag)
+	// Set up front so that nothing sets a Content-Length for the file
+	w.Header().Set("Content-Encoding", "gzip")
+
+	gw := &gzipResponseWriter{ResponseWriter: w}
+	return gw, gw.close
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// Only the file itself is gzipped, not errors or redirects
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	if code == http.StatusOK {
+		g.Header().Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	} else {
+		g.Header().Del("Content-Encoding")
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(p)
+	}
+	return g.gz.Write(p)
+}
+
+func (g *gzipResponseWriter) close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
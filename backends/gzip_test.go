@@ -0,0 +1,63 @@
+package backends
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipText(t *testing.T) {
+	serve := func(mimetype string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+
+		m := Metadata{Mimetype: mimetype, Size: 11, ETag: ETag("abc")}
+		gw, finish := GzipText(w, r, &m)
+		if !CheckPreconditions(gw, r, m) {
+			ServeReader(gw, r, strings.NewReader("hello world"), m.Size, m.Mimetype)
+		}
+		finish()
+		return w
+	}
+
+	w := serve("text/plain; charset=utf-8", "Accept-Encoding", "gzip, deflate")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" {
+		t.Fatalf("Text was served with headers %v", w.Header())
+	}
+	if w.Header().Get("Etag") != `"abc-gzip"` {
+		t.Fatalf("Gzipped text has ETag %s", w.Header().Get("Etag"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(gz); string(data) != "hello world" {
+		t.Fatalf("Gzipped text was %q", data)
+	}
+
+	w = serve("text/plain", "Accept-Encoding", "gzip", "If-None-Match", `"abc-gzip"`)
+	if w.Code != http.StatusNotModified || w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 0 {
+		t.Fatalf("Conditional request returned %d with headers %v", w.Code, w.Header())
+	}
+
+	for _, headers := range [][]string{
+		{"Accept-Encoding", "gzip;q=0"},
+		{"Accept-Encoding", "gzip", "Range", "bytes=0-4"},
+	} {
+		w = serve("text/plain", headers...)
+		if w.Header().Get("Content-Encoding") != "" || !strings.HasPrefix("hello world", w.Body.String()) {
+			t.Fatalf("Request with %v was served %q with headers %v", headers, w.Body.String(), w.Header())
+		}
+	}
+
+	w = serve("image/png", "Accept-Encoding", "gzip")
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "" {
+		t.Fatalf("Image was served with headers %v", w.Header())
+	}
+}
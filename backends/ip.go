@@ -0,0 +1,32 @@
+package backends
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Zero the last octet of IPv4 addresses and the last 80 bits of IPv6 ones,
+// so that a source IP only identifies a network. A list of addresses, as
+// in X-Forwarded-For, has each one anonymized, and anything that isn't an
+// address is left out.
+func AnonymizeIP(srcIp string) string {
+	var anonymized []string
+	for _, s := range strings.Split(srcIp, ",") {
+		addr, err := netip.ParseAddr(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+
+		bits := 48
+		if addr.Is4() || addr.Is4In6() {
+			addr, bits = addr.Unmap(), 24
+		}
+
+		prefix, err := addr.WithZone("").Prefix(bits)
+		if err != nil {
+			continue
+		}
+		anonymized = append(anonymized, prefix.Addr().String())
+	}
+	return strings.Join(anonymized, ", ")
+}
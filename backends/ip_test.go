@@ -0,0 +1,22 @@
+package backends
+
+import "testing"
+
+func TestAnonymizeIP(t *testing.T) {
+	for _, tc := range []struct {
+		srcIp      string
+		anonymized string
+	}{
+		{"", ""},
+		{"203.0.113.195", "203.0.113.0"},
+		{"::ffff:203.0.113.195", "203.0.113.0"},
+		{"2001:db8:85a3:1234:5678:8a2e:370:7334", "2001:db8:85a3::"},
+		{"fe80::1%eth0", "fe80::"},
+		{"203.0.113.195, 2001:db8::1", "203.0.113.0, 2001:db8::"},
+		{"unknown, 198.51.100.7", "198.51.100.0"},
+	} {
+		if anonymized := AnonymizeIP(tc.srcIp); anonymized != tc.anonymized {
+			t.Errorf("%q was anonymized to %q instead of %q", tc.srcIp, anonymized, tc.anonymized)
+		}
+	}
+}
@@ -0,0 +1,851 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/dchest/uniuri"
+)
+
+// Stores files on an IPFS node through its RPC API. Content on IPFS can't
+// be changed once added, so the metadata of each file, along with the CID
+// of its content, is kept in a directory on the local filesystem instead.
+type IPFSBackend struct {
+	apiURL   string
+	metaPath string
+	client   *http.Client
+	scanner  backends.Scanner
+	files    *backends.FileCounter
+}
+
+type IPFSOptions struct {
+	// Address of the node's RPC API, such as http://127.0.0.1:5001
+	APIURL string
+
+	// Client to make requests to the API with, http.DefaultClient if nil
+	Client *http.Client
+
+	// Scan new files with this before adding them, if set
+	Scanner backends.Scanner
+}
+
+type MetadataJSON struct {
+	CID              string                  `json:"cid"`
+	PublicID         string                  `json:"public_id,omitempty"`
+	DeleteKey        string                  `json:"delete_key"`
+	AccessKey        string                  `json:"access_key,omitempty"`
+	AccessKeyExpiry  int64                   `json:"access_key_expiry,omitempty"`
+	Sha256sum        string                  `json:"sha256sum"`
+	Checksums        map[string]string       `json:"checksums,omitempty"`
+	Mimetype         string                  `json:"mimetype"`
+	Size             int64                   `json:"size"`
+	Expiry           int64                   `json:"expiry"`
+	SrcIp            string                  `json:"srcip,omitempty"`
+	OriginalName     string                  `json:"original_name,omitempty"`
+	ArchiveFiles     []backends.ArchiveEntry `json:"archive_files,omitempty"`
+	ArchiveTruncated bool                    `json:"archive_truncated,omitempty"`
+	ArchiveOmitted   int                     `json:"archive_omitted,omitempty"`
+	Encryption       *backends.Encryption    `json:"encryption,omitempty"`
+	RetainUntil      int64                   `json:"retain_until,omitempty"`
+	Uploaded         int64                   `json:"uploaded,omitempty"`
+	Custom           map[string]string       `json:"custom,omitempty"`
+	Tags             map[string]string       `json:"tags,omitempty"`
+	DownloadRate     int64                   `json:"download_rate,omitempty"`
+}
+
+// How many files BatchDelete deletes and HeadMany reads at the same time
+const batchWorkers = 8
+
+const tempPrefix = ".tmp-"
+
+// An error returned by the node's API
+type apiError struct {
+	Command string
+	Message string
+}
+
+func (e apiError) Error() string {
+	return fmt.Sprintf("IPFS %s failed: %s", e.Command, e.Message)
+}
+
+// Make a request for an API command, returning the response if the node
+// accepted it. Every command is a POST, with its arguments in the query.
+func (b IPFSBackend) call(ctx context.Context, command string, args url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	u := b.apiURL + "/api/v0/" + command
+	if len(args) > 0 {
+		u += "?" + args.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		var e struct{ Message string }
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+			e.Message = resp.Status
+		}
+		return nil, apiError{command, e.Message}
+	}
+	return resp, nil
+}
+
+// Add r to the node and pin it, returning its CID
+func (b IPFSBackend) add(ctx context.Context, r io.Reader) (string, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		part, err := mw.CreateFormFile("file", "file")
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	args := url.Values{"pin": {"true"}, "cid-version": {"1"}}
+	resp, err := b.call(ctx, "add", args, pr, mw.FormDataContentType())
+	pr.Close()
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var added struct{ Hash string }
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		return "", err
+	}
+	if added.Hash == "" {
+		return "", apiError{"add", "no CID returned"}
+	}
+	return added.Hash, nil
+}
+
+// Read length bytes of the content of cid from offset, or all of the rest
+// of it if length is negative
+func (b IPFSBackend) cat(ctx context.Context, cid string, offset, length int64) (io.ReadCloser, error) {
+	args := url.Values{"arg": {cid}}
+	if offset > 0 {
+		args.Set("offset", strconv.FormatInt(offset, 10))
+	}
+	if length >= 0 {
+		args.Set("length", strconv.FormatInt(length, 10))
+	}
+
+	resp, err := b.call(ctx, "cat", args, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Unpin cid so that the node can garbage collect it, unless another file
+// still refers to it. Identical content always has the same CID, and pins
+// aren't counted, so unpinning content another file shares would lose it.
+func (b IPFSBackend) release(ctx context.Context, cid string) error {
+	if cid == "" {
+		return nil
+	}
+
+	inUse, err := b.cidInUse(cid)
+	if err != nil || inUse {
+		return err
+	}
+
+	resp, err := b.call(ctx, "pin/rm", url.Values{"arg": {cid}}, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b IPFSBackend) cidInUse(cid string) (bool, error) {
+	keys, err := b.metadataKeys()
+	if err != nil {
+		return false, err
+	}
+
+	for _, key := range keys {
+		if _, stored, err := b.readMetadata(key); err == nil && stored == cid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b IPFSBackend) metaFile(key string) (string, error) {
+	if err := backends.ValidateKey(key); err != nil {
+		return "", err
+	}
+	return path.Join(b.metaPath, key), nil
+}
+
+func (b IPFSBackend) metadataKeys() ([]string, error) {
+	entries, err := os.ReadDir(b.metaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), tempPrefix) {
+			keys = append(keys, entry.Name())
+		}
+	}
+	return keys, nil
+}
+
+func (b IPFSBackend) readMetadata(key string) (m backends.Metadata, cid string, err error) {
+	metaFile, err := b.metaFile(key)
+	if err != nil {
+		return
+	}
+
+	f, err := os.Open(metaFile)
+	if os.IsNotExist(err) {
+		return m, "", backends.NotFoundErr
+	} else if err != nil {
+		return m, "", backends.BadMetadata
+	}
+	defer f.Close()
+
+	var mjson MetadataJSON
+	if err := json.NewDecoder(f).Decode(&mjson); err != nil {
+		return m, "", backends.BadMetadata
+	}
+
+	m.PublicID = mjson.PublicID
+	m.DeleteKey = mjson.DeleteKey
+	m.AccessKey = mjson.AccessKey
+	m.Sha256sum = mjson.Sha256sum
+	m.Checksums = mjson.Checksums
+	m.Mimetype = mjson.Mimetype
+	m.Size = mjson.Size
+	m.Expiry = time.Unix(mjson.Expiry, 0)
+	m.SrcIp = mjson.SrcIp
+	m.OriginalName = mjson.OriginalName
+	m.ArchiveFiles = mjson.ArchiveFiles
+	m.ArchiveTruncated = mjson.ArchiveTruncated
+	m.ArchiveOmitted = mjson.ArchiveOmitted
+	m.Custom = mjson.Custom
+	m.Tags = mjson.Tags
+	m.DownloadRate = mjson.DownloadRate
+	m.ETag = backends.ETag(mjson.Sha256sum)
+	if mjson.Encryption != nil {
+		m.Encryption = *mjson.Encryption
+	}
+	if mjson.AccessKeyExpiry != 0 {
+		m.AccessKeyExpiry = time.Unix(mjson.AccessKeyExpiry, 0)
+	}
+	if mjson.RetainUntil != 0 {
+		m.RetainUntil = time.Unix(mjson.RetainUntil, 0)
+	}
+	if mjson.Uploaded != 0 {
+		m.Uploaded = time.Unix(mjson.Uploaded, 0)
+	}
+
+	// Content can't change without getting a new CID, so it was last
+	// modified when it was uploaded
+	m.ModTime = m.Uploaded
+
+	return m, mjson.CID, nil
+}
+
+// Write the metadata of key. Unless overwrite is set, this fails with
+// KeyConflictErr if key already has metadata, otherwise it returns the CID
+// the metadata it replaced referred to, if any.
+func (b IPFSBackend) writeMetadata(key string, m backends.Metadata, cid string, overwrite bool) (replaced string, err error) {
+	metaFile, err := b.metaFile(key)
+	if err != nil {
+		return
+	}
+
+	mjson := MetadataJSON{
+		CID:              cid,
+		PublicID:         m.PublicID,
+		DeleteKey:        m.DeleteKey,
+		AccessKey:        m.AccessKey,
+		Sha256sum:        m.Sha256sum,
+		Checksums:        m.Checksums,
+		Mimetype:         m.Mimetype,
+		Size:             m.Size,
+		Expiry:           m.Expiry.Unix(),
+		SrcIp:            m.SrcIp,
+		OriginalName:     m.OriginalName,
+		ArchiveFiles:     m.ArchiveFiles,
+		ArchiveTruncated: m.ArchiveTruncated,
+		ArchiveOmitted:   m.ArchiveOmitted,
+		Custom:           m.Custom,
+		Tags:             m.Tags,
+		DownloadRate:     m.DownloadRate,
+	}
+	if m.Encryption.Scheme != "" {
+		mjson.Encryption = &m.Encryption
+	}
+	if !m.AccessKeyExpiry.IsZero() {
+		mjson.AccessKeyExpiry = m.AccessKeyExpiry.Unix()
+	}
+	if !m.RetainUntil.IsZero() {
+		mjson.RetainUntil = m.RetainUntil.Unix()
+	}
+	if !m.Uploaded.IsZero() {
+		mjson.Uploaded = m.Uploaded.Unix()
+	}
+
+	tmp, err := os.CreateTemp(b.metaPath, tempPrefix)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err = json.NewEncoder(tmp).Encode(mjson); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+
+	if !overwrite {
+		// Linking fails if the key is taken, unlike renaming
+		if err = os.Link(tmp.Name(), metaFile); os.IsExist(err) {
+			return "", backends.KeyConflictErr
+		}
+		return "", err
+	}
+
+	if _, old, err := b.readMetadata(key); err == nil {
+		replaced = old
+	}
+	return replaced, os.Rename(tmp.Name(), metaFile)
+}
+
+// Return RetentionLockedErr if key exists and is under a retention lock
+func (b IPFSBackend) checkRetention(ctx context.Context, key string) error {
+	if m, err := b.Head(ctx, key); err == nil && m.RetentionLocked() {
+		return backends.RetentionLockedErr
+	}
+	return nil
+}
+
+// Uploads in progress can't be appended to once added to IPFS, so they
+// aren't supported
+func (b IPFSBackend) Append(ctx context.Context, key string, r io.Reader, offset int64) (int64, error) {
+	return 0, backends.NotSupportedErr
+}
+
+func (b IPFSBackend) PurgeUploads(ctx context.Context, olderThan time.Duration) error {
+	return backends.NotSupportedErr
+}
+
+func (b IPFSBackend) Capabilities() backends.Caps {
+	return backends.Caps{
+		SupportsRange:     true,
+		SupportsCopy:      true,
+		SupportsList:      true,
+		SupportsRetention: true,
+	}
+}
+
+func (b IPFSBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (backends.Metadata, error) {
+	return backends.Metadata{}, backends.NotSupportedErr
+}
+
+func (b IPFSBackend) CheckAccessKey(ctx context.Context, key, provided string) (bool, error) {
+	return backends.CheckAccessKey(ctx, b, key, provided)
+}
+
+func (b IPFSBackend) CheckDeleteKey(ctx context.Context, key, provided string) (bool, error) {
+	return backends.CheckDeleteKey(ctx, b, key, provided)
+}
+
+// Copies share the content of the original, only the metadata is copied
+func (b IPFSBackend) Copy(ctx context.Context, srcKey, dstKey string) (m backends.Metadata, err error) {
+	m, cid, err := b.readMetadata(srcKey)
+	if err != nil {
+		return
+	}
+	if err = b.checkRetention(ctx, dstKey); err != nil {
+		return
+	}
+	done, err := b.files.Check(ctx, b, dstKey)
+	if err != nil {
+		return
+	}
+	defer done(false)
+
+	m.PublicID = backends.NewPublicID()
+	m.DeleteKey = uniuri.NewLen(30)
+	m.Uploaded = time.Now()
+	m.ModTime = m.Uploaded
+	m.RetainUntil = time.Time{}
+
+	replaced, err := b.writeMetadata(dstKey, m, cid, true)
+	if err != nil {
+		return
+	}
+	done(replaced == "")
+	if replaced != "" && replaced != cid {
+		err = b.release(ctx, replaced)
+	}
+	return
+}
+
+// The metadata is removed before the content is unpinned, so that a failure
+// to unpin leaves content behind rather than metadata without content
+func (b IPFSBackend) Delete(ctx context.Context, key string) error {
+	metaFile, err := b.metaFile(key)
+	if err != nil {
+		return err
+	}
+	if err := b.checkRetention(ctx, key); err != nil {
+		return err
+	}
+
+	_, cid, err := b.readMetadata(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(metaFile); os.IsNotExist(err) {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return err
+	}
+	b.files.Add(-1)
+
+	return b.release(ctx, cid)
+}
+
+func (b IPFSBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	return backends.DeleteEach(ctx, keys, batchWorkers, b.Delete)
+}
+
+func (b IPFSBackend) Exists(ctx context.Context, key string) (bool, error) {
+	metaFile, err := b.metaFile(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(metaFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b IPFSBackend) HealthCheck(ctx context.Context) error {
+	if _, err := os.Stat(b.metaPath); err != nil {
+		return err
+	}
+
+	resp, err := b.call(ctx, "version", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b IPFSBackend) Head(ctx context.Context, key string) (backends.Metadata, error) {
+	m, _, err := b.readMetadata(key)
+	return m, err
+}
+
+// Files go straight to the node when deleted, which can garbage collect
+// them whenever it likes, so there is no trash
+func (b IPFSBackend) GetDeleted(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	return backends.Metadata{}, nil, backends.NotSupportedErr
+}
+
+func (b IPFSBackend) PurgeTrash(ctx context.Context, olderThan time.Duration) error {
+	return backends.NotSupportedErr
+}
+
+func (b IPFSBackend) Restore(ctx context.Context, key string) error {
+	return backends.NotSupportedErr
+}
+
+func (b IPFSBackend) Get(ctx context.Context, key string) (m backends.Metadata, r io.ReadCloser, err error) {
+	m, cid, err := b.readMetadata(key)
+	if err != nil {
+		return
+	}
+
+	r, err = b.cat(ctx, cid, 0, -1)
+	return
+}
+
+func (b IPFSBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	m, cid, err := b.readMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err = backends.RangeLength(m.Size, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.cat(ctx, cid, offset, length)
+}
+
+func (b IPFSBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
+	metadata, cid, err := b.readMetadata(key)
+	if err != nil {
+		return
+	}
+
+	backends.SetServeHeaders(w, r, key, metadata)
+	w = backends.ThrottleDownload(w, r, metadata)
+
+	w, finish := backends.GzipText(w, r, &metadata)
+	defer finish()
+
+	if backends.CheckPreconditions(w, r, metadata) {
+		return nil
+	}
+
+	rd := &backends.RangeReader{
+		Open: func(offset int64) (io.ReadCloser, error) {
+			return b.cat(r.Context(), cid, offset, -1)
+		},
+		Size: metadata.Size,
+	}
+	defer rd.Close()
+
+	return backends.ServeReader(w, r, rd, metadata.Size, metadata.Mimetype)
+}
+
+func (b IPFSBackend) ServeThumbnail(key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error {
+	return backends.ServeThumbnail(b, key, w, r, maxWidth, maxHeight)
+}
+
+func (b IPFSBackend) ServeImageVariant(key string, w http.ResponseWriter, r *http.Request) error {
+	return backends.ServeImageVariant(b, key, w, r)
+}
+
+func (b IPFSBackend) ServeArchiveEntry(key string, entryPath string, w http.ResponseWriter, r *http.Request) error {
+	return backends.ServeArchiveEntry(b, key, entryPath, w, r)
+}
+
+func (b IPFSBackend) ArchiveFS(key string) (fs.FS, error) {
+	return backends.ArchiveFS(b, key)
+}
+
+func (b IPFSBackend) Preview(ctx context.Context, key string, maxBytes int) (string, bool, error) {
+	return backends.Preview(ctx, b, key, maxBytes)
+}
+
+// Files can be fetched from any gateway by their CID, but not with the
+// access controls linx-server applies, so there are no presigned URLs
+func (b IPFSBackend) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", backends.NotSupportedErr
+}
+
+func (b IPFSBackend) Put(ctx context.Context, key string, r io.Reader, expiryTime time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (m backends.Metadata, err error) {
+	if _, err = b.metaFile(key); err != nil {
+		return
+	}
+	if err = backends.CheckCustom(o.Custom); err != nil {
+		return
+	}
+	if err = backends.CheckTags(o.Tags); err != nil {
+		return
+	}
+	if expiryTime, err = backends.AllowedExpiry(expiryTime); err != nil {
+		return
+	}
+	if err = b.checkRetention(ctx, key); err != nil {
+		return
+	}
+	done, err := b.files.Check(ctx, b, key)
+	if err != nil {
+		return
+	}
+	defer done(false)
+
+	// Checked before reading r so that the caller can still retry with
+	// another key, writing the metadata is exclusive in case of a race
+	if !o.Overwrite {
+		if exists, _ := b.Exists(ctx, key); exists {
+			return m, backends.KeyConflictErr
+		}
+	}
+
+	// The file is checked in full before it's added to the node, so
+	// buffer it on disk first
+	tmpDst, err := os.CreateTemp("", "linx-server-upload")
+	if err != nil {
+		return
+	}
+	defer tmpDst.Close()
+	defer os.Remove(tmpDst.Name())
+
+	src := backends.MinRateReader(helpers.NewContextReader(ctx, r), backends.Limits.MinUploadRate, backends.Limits.MinUploadRateWindow)
+	bytes, err := io.Copy(tmpDst, backends.LimitedReader(src, backends.Limits.MaxSize))
+	if err != nil {
+		return m, err
+	} else if bytes == 0 {
+		return m, backends.FileEmptyError
+	}
+
+	if _, err = tmpDst.Seek(0, 0); err != nil {
+		return
+	}
+	if o.Encryption.Scheme != "" {
+		m, err = helpers.GenerateOpaqueMetadata(tmpDst)
+	} else {
+		m, err = helpers.GenerateMetadata(tmpDst)
+		m.Mimetype = helpers.RefineMimetype(m.Mimetype, originalName, key)
+	}
+	if err != nil {
+		return
+	}
+	if err = backends.CheckMimeSize(m.Mimetype, bytes); err != nil {
+		return
+	}
+	if err = backends.CheckSha256(o.ExpectedSha256, m.Sha256sum); err != nil {
+		return
+	}
+
+	if _, err = tmpDst.Seek(0, 0); err != nil {
+		return
+	}
+	if err = backends.ScanFile(b.scanner, tmpDst); err != nil {
+		return
+	}
+
+	m.Expiry = backends.FileExpiry(expiryTime, bytes)
+	m.DeleteKey = deleteKey
+	m.AccessKey = accessKey
+	m.SrcIp = srcIp
+	m.PublicID = backends.NewPublicID()
+	m.OriginalName, m.Custom = backends.SanitizeOriginalName(originalName, o.Custom)
+	m.Tags = o.Tags
+	m.Encryption = o.Encryption
+	m.Uploaded = time.Now()
+	m.ModTime = m.Uploaded
+	m.RetainUntil = o.RetainUntil
+	m.ArchiveFiles, m.ArchiveTruncated, m.ArchiveOmitted, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, tmpDst)
+
+	if _, err = tmpDst.Seek(0, 0); err != nil {
+		return
+	}
+	cid, err := b.add(ctx, tmpDst)
+	if err != nil {
+		return
+	}
+
+	replaced, err := b.writeMetadata(key, m, cid, o.Overwrite)
+	if err != nil {
+		// Nothing refers to the content if the metadata couldn't be
+		// written, unless another file has the same content
+		b.release(ctx, cid)
+		return
+	}
+
+	done(replaced == "")
+	if replaced != "" && replaced != cid {
+		err = b.release(ctx, replaced)
+	}
+	return
+}
+
+func (b IPFSBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	if err := backends.CheckCustom(m.Custom); err != nil {
+		return err
+	}
+	if err := backends.CheckTags(m.Tags); err != nil {
+		return err
+	}
+	if err := b.checkRetention(ctx, key); err != nil {
+		return err
+	}
+
+	_, cid, err := b.readMetadata(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.writeMetadata(key, m, cid, true)
+	return err
+}
+
+func (b IPFSBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	oldFile, err := b.metaFile(oldKey)
+	if err != nil {
+		return err
+	}
+	newFile, err := b.metaFile(newKey)
+	if err != nil {
+		return err
+	}
+	if err := b.checkRetention(ctx, oldKey); err != nil {
+		return err
+	}
+
+	// Linking fails if newKey is taken, unlike renaming
+	err = os.Link(oldFile, newFile)
+	if os.IsNotExist(err) {
+		return backends.NotFoundErr
+	} else if os.IsExist(err) {
+		return backends.KeyExistsErr
+	} else if err != nil {
+		return err
+	}
+
+	return os.Remove(oldFile)
+}
+
+func (b IPFSBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	if err := b.checkRetention(ctx, key); err != nil {
+		return err
+	}
+	m, cid, err := b.readMetadata(key)
+	if err != nil {
+		return err
+	}
+
+	if err := backends.CheckExpiry(m.Size, newExpiry); err != nil {
+		return err
+	}
+
+	m.Expiry = newExpiry
+	_, err = b.writeMetadata(key, m, cid, true)
+	return err
+}
+
+func (b IPFSBackend) Touch(ctx context.Context, key string, extend time.Duration) error {
+	return backends.Touch(ctx, b, key, extend)
+}
+
+func (b IPFSBackend) GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error {
+	return backends.GrantAccess(ctx, b, key, accessKey, until)
+}
+
+func (b IPFSBackend) Size(ctx context.Context, key string) (int64, error) {
+	m, _, err := b.readMetadata(key)
+	return m.Size, err
+}
+
+func (b IPFSBackend) VerifyChecksum(ctx context.Context, key string) (bool, string, error) {
+	return backends.VerifyChecksum(ctx, b, key)
+}
+
+func (b IPFSBackend) Stats(ctx context.Context) (backends.Stats, error) {
+	return backends.ComputeStats(ctx, b)
+}
+
+func (b IPFSBackend) Query(ctx context.Context, filter backends.ListFilter) ([]string, error) {
+	return backends.Query(ctx, b, filter)
+}
+
+func (b IPFSBackend) GetByPublicID(ctx context.Context, id string) (string, error) {
+	return backends.FindByPublicID(ctx, b, id)
+}
+
+func (b IPFSBackend) FindBySha256(ctx context.Context, sum string) (string, bool, error) {
+	return backends.ScanBySha256(ctx, b, sum)
+}
+
+func (b IPFSBackend) HeadMany(ctx context.Context, keys []string) (map[string]backends.Metadata, map[string]error) {
+	return backends.HeadEach(ctx, keys, batchWorkers, b.Head)
+}
+
+func (b IPFSBackend) List(ctx context.Context) ([]string, error) {
+	return b.metadataKeys()
+}
+
+func (b IPFSBackend) ListPaginated(ctx context.Context, cursor string, limit int) (keys []string, nextCursor string, err error) {
+	all, err := b.metadataKeys()
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(all)
+
+	for _, key := range all {
+		if key <= cursor {
+			continue
+		}
+		if limit > 0 && len(keys) == limit {
+			return keys, keys[len(keys)-1], nil
+		}
+		keys = append(keys, key)
+	}
+	return keys, "", nil
+}
+
+func (b IPFSBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	keys, err := b.metadataKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	expiries := map[string]time.Time{}
+	for _, key := range keys {
+		m, _, err := b.readMetadata(key)
+		if err != nil || m.Expiry == expiry.NeverExpire {
+			continue
+		}
+
+		if m.Expiry.Before(before) {
+			found = append(found, key)
+			expiries[key] = m.Expiry
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return expiries[found[i]].Before(expiries[found[j]])
+	})
+
+	return found, nil
+}
+
+func NewIPFSBackend(metaPath string, o IPFSOptions) (IPFSBackend, error) {
+	b := IPFSBackend{
+		apiURL:   strings.TrimSuffix(o.APIURL, "/"),
+		metaPath: metaPath,
+		client:   o.Client,
+		scanner:  o.Scanner,
+		files:    backends.NewFileCounter(),
+	}
+	if b.client == nil {
+		b.client = http.DefaultClient
+	}
+
+	if _, err := url.Parse(b.apiURL); err != nil || b.apiURL == "" {
+		return b, fmt.Errorf("Invalid IPFS API URL %q.", o.APIURL)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,283 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+var ctx = context.Background()
+
+// Implements the few API commands the backend uses, with the sha256sum of
+// content standing in for its CID
+type fakeNode struct {
+	mu      sync.Mutex
+	content map[string][]byte
+	pinned  map[string]bool
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fail := func(message string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"Message": message, "Type": "error"})
+	}
+
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/api/v0/add":
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		data, _ := io.ReadAll(f)
+		sum := sha256.Sum256(data)
+		cid := hex.EncodeToString(sum[:])
+		n.content[cid] = data
+		n.pinned[cid] = q.Get("pin") == "true"
+		json.NewEncoder(w).Encode(map[string]string{"Name": "file", "Hash": cid})
+	case "/api/v0/cat":
+		data, ok := n.content[q.Get("arg")]
+		if !ok {
+			fail("block not found")
+			return
+		}
+		offset, _ := strconv.Atoi(q.Get("offset"))
+		data = data[offset:]
+		if length, err := strconv.Atoi(q.Get("length")); err == nil && length < len(data) {
+			data = data[:length]
+		}
+		w.Write(data)
+	case "/api/v0/pin/rm":
+		if !n.pinned[q.Get("arg")] {
+			fail("not pinned or pinned indirectly")
+			return
+		}
+		delete(n.pinned, q.Get("arg"))
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": {q.Get("arg")}})
+	case "/api/v0/version":
+		json.NewEncoder(w).Encode(map[string]string{"Version": "0.0.0"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestBackend(t *testing.T) (IPFSBackend, *fakeNode) {
+	backends.Limits.MaxSize = 1024 * 1024
+
+	node := &fakeNode{content: map[string][]byte{}, pinned: map[string]bool{}}
+	server := httptest.NewServer(node)
+	t.Cleanup(server.Close)
+
+	b, err := NewIPFSBackend(t.TempDir(), IPFSOptions{APIURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, node
+}
+
+func TestIPFSPutHeadGet(t *testing.T) {
+	b, node := newTestBackend(t)
+
+	if err := b.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := b.Put(ctx, "file.txt", strings.NewReader("hello world"), 0, "del", "", "127.0.0.1", "file.txt", backends.PutOptions{Tags: map[string]string{"tier": "hot"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.pinned) != 1 {
+		t.Fatalf("Expected the content to be pinned, got %v", node.pinned)
+	}
+
+	head, err := b.Head(ctx, "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Sha256sum != m.Sha256sum || head.Size != 11 || head.DeleteKey != "del" || head.Tags["tier"] != "hot" {
+		t.Fatalf("Unexpected metadata %+v", head)
+	}
+	if exists, _ := b.Exists(ctx, "file.txt"); !exists {
+		t.Fatal("Expected the file to exist")
+	}
+
+	_, r, err := b.Get(ctx, "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello world" {
+		t.Fatalf("Get returned %q", data)
+	}
+
+	r, err = b.GetRange(ctx, "file.txt", 6, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(r)
+	r.Close()
+	if string(data) != "wor" {
+		t.Fatalf("GetRange returned %q", data)
+	}
+
+	if _, err := b.Put(ctx, "file.txt", strings.NewReader("again"), 0, "del", "", "", "", backends.PutOptions{}); err != backends.KeyConflictErr {
+		t.Fatalf("Expected KeyConflictErr, got %v", err)
+	}
+
+	if _, err := b.Head(ctx, "missing"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+}
+
+func TestIPFSClientEncrypted(t *testing.T) {
+	b, _ := newTestBackend(t)
+
+	enc := backends.Encryption{Scheme: "aes-256-gcm", Nonce: "0a1b2c", KeyHint: "paste"}
+	m, err := b.Put(ctx, "paste.txt", strings.NewReader("plain text lookalike"), 0, "del", "", "", "", backends.PutOptions{Encryption: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Mimetype != "application/octet-stream" {
+		t.Fatalf("Expected encrypted content to be opaque, got %q", m.Mimetype)
+	}
+
+	head, err := b.Head(ctx, "paste.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Encryption != enc || head.Mimetype != m.Mimetype {
+		t.Fatalf("Unexpected metadata %+v", head)
+	}
+}
+
+func TestIPFSCapabilities(t *testing.T) {
+	b, _ := newTestBackend(t)
+
+	caps := b.Capabilities()
+	if !caps.SupportsRange || !caps.SupportsCopy || !caps.SupportsList {
+		t.Fatalf("Expected ranges, copies and listing to be supported, got %+v", caps)
+	}
+	if caps.SupportsPresign || caps.SupportsAppend || caps.SupportsTrash {
+		t.Fatalf("Expected no presigning, appending or trash, got %+v", caps)
+	}
+	if _, err := b.PresignGet(ctx, "file", time.Minute); err != backends.NotSupportedErr {
+		t.Fatalf("Expected NotSupportedErr, got %v", err)
+	}
+}
+
+func TestIPFSServeFile(t *testing.T) {
+	b, _ := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "file.bin", strings.NewReader("0123456789"), 0, "del", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/file.bin", nil)
+	r.Header.Set("Range", "bytes=2-4")
+	w := httptest.NewRecorder()
+	if err := b.ServeFile("file.bin", w, r); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Fatalf("ServeFile returned %d, %q", w.Code, w.Body.String())
+	}
+}
+
+func TestIPFSDeleteSharedContent(t *testing.T) {
+	b, node := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "a", strings.NewReader("same"), 0, "del", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Copy(ctx, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.pinned) != 1 {
+		t.Fatal("Expected the content to stay pinned while b refers to it")
+	}
+
+	if err := b.Rename(ctx, "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.pinned) != 0 {
+		t.Fatalf("Expected the content to be unpinned, got %v", node.pinned)
+	}
+
+	if err := b.Delete(ctx, "c"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+	if keys, _ := b.List(ctx); len(keys) != 0 {
+		t.Fatalf("Expected no files left, got %v", keys)
+	}
+}
+
+func TestIPFSSetExpiry(t *testing.T) {
+	b, _ := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "file", strings.NewReader("content"), time.Hour, "del", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := b.SetExpiry(ctx, "file", past); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := b.ListExpired(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "file" {
+		t.Fatalf("Expected file to have expired, got %v", keys)
+	}
+}
+
+func TestIPFSRetention(t *testing.T) {
+	b, _ := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "locked", strings.NewReader("keep"), time.Hour, "del", "", "", "", backends.PutOptions{RetainUntil: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := b.Head(ctx, "locked")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.RetainUntil = time.Time{}
+	if err := b.PutMetadata(ctx, "locked", m); err != backends.RetentionLockedErr {
+		t.Fatalf("Expected PutMetadata to be refused, got %v", err)
+	}
+	if err := b.SetExpiry(ctx, "locked", time.Now().Add(time.Minute)); err != backends.RetentionLockedErr {
+		t.Fatalf("Expected SetExpiry to be refused, got %v", err)
+	}
+	if err := b.Delete(ctx, "locked"); err != backends.RetentionLockedErr {
+		t.Fatalf("Expected Delete to be refused, got %v", err)
+	}
+
+	if head, err := b.Head(ctx, "locked"); err != nil || !head.RetentionLocked() || !head.Expiry.Equal(m.Expiry) {
+		t.Fatalf("Expected the metadata to be unchanged, got %+v, %v", head, err)
+	}
+}
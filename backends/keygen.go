@@ -0,0 +1,91 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+const Base62Charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// Comes up with keys to store new files under, giving another one each time
+// the last is taken
+type KeyGenerator interface {
+	Generate() string
+}
+
+// Generates random keys of Length characters from Charset, base62 if it's
+// empty
+type RandomKeyGenerator struct {
+	Length  int
+	Charset string
+}
+
+func (g RandomKeyGenerator) Generate() string {
+	charset := g.Charset
+	if charset == "" {
+		charset = Base62Charset
+	}
+	return uniuri.NewLenChars(max(1, g.Length), []byte(charset))
+}
+
+// Generates keys from the start of a file's hex sha256sum, so that the same
+// content gets the same key. Each key is a character longer than the last,
+// with a counter added once the whole sum is used.
+type HashPrefixKeyGenerator struct {
+	sum    string
+	length int
+	n      int
+}
+
+func NewHashPrefixKeyGenerator(sum string, length int) *HashPrefixKeyGenerator {
+	return &HashPrefixKeyGenerator{sum: sum, length: max(1, length)}
+}
+
+func (g *HashPrefixKeyGenerator) Generate() string {
+	length := g.length + g.n
+	g.n++
+	if length <= len(g.sum) {
+		return g.sum[:length]
+	}
+	return g.sum + "-" + strconv.Itoa(length-len(g.sum))
+}
+
+// Put a file under key, or a key from gen if it's empty, trying up to
+// attempts keys from gen for as long as Put returns KeyConflictErr before
+// any of r is read. Returns the key the file was stored under.
+func PutGenerated(ctx context.Context, b StorageBackend, key string, gen KeyGenerator, attempts int, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (string, Metadata, error) {
+	if key == "" {
+		key = gen.Generate()
+	}
+
+	src := &readTracker{r: r}
+	for attempt := 1; ; attempt++ {
+		m, err := b.Put(ctx, key, src, expiry, deleteKey, accessKey, srcIp, originalName, o)
+
+		// Nothing was stored, so another key can be tried as long as
+		// none of the file has been read yet
+		if err != KeyConflictErr || src.read || attempt >= attempts {
+			return key, m, err
+		}
+		key = gen.Generate()
+	}
+}
+
+// Records whether anything was read, to know if the reader can still be
+// used to retry a Put from the start
+type readTracker struct {
+	r    io.Reader
+	read bool
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.read = true
+	}
+	return n, err
+}
@@ -0,0 +1,48 @@
+package backends
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRandomKeyGenerator(t *testing.T) {
+	key := RandomKeyGenerator{Length: 12}.Generate()
+	if len(key) != 12 || strings.Trim(key, Base62Charset) != "" {
+		t.Fatalf("Expected 12 base62 characters, got %q", key)
+	}
+
+	key = RandomKeyGenerator{Length: 6, Charset: "ab"}.Generate()
+	if len(key) != 6 || strings.Trim(key, "ab") != "" {
+		t.Fatalf("Expected 6 characters from the charset, got %q", key)
+	}
+}
+
+func TestHashPrefixKeyGenerator(t *testing.T) {
+	gen := NewHashPrefixKeyGenerator("abcdef", 4)
+	for _, expected := range []string{"abcd", "abcde", "abcdef", "abcdef-1", "abcdef-2"} {
+		if key := gen.Generate(); key != expected {
+			t.Fatalf("Expected %q, got %q", expected, key)
+		}
+	}
+}
+
+func TestPutGenerated(t *testing.T) {
+	ctx := context.Background()
+	mem := &memBackend{files: map[string]string{"abcd": "taken", "abcde": "taken"}}
+	b := quotaMemBackend{mem: mem}
+
+	key, _, err := PutGenerated(ctx, b, "", NewHashPrefixKeyGenerator("abcdef", 4), 3, strings.NewReader("content"), 0, "", "", "", "", PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "abcdef" || mem.files["abcdef"] != "content" {
+		t.Fatalf("Expected the file to be stored under abcdef, got %q", key)
+	}
+
+	// Gives up once out of attempts
+	_, _, err = PutGenerated(ctx, b, "abcd", NewHashPrefixKeyGenerator("abcdef", 5), 2, strings.NewReader("content"), 0, "", "", "", "", PutOptions{})
+	if err != KeyConflictErr {
+		t.Fatalf("Expected KeyConflictErr, got %v", err)
+	}
+}
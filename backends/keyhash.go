@@ -0,0 +1,123 @@
+package backends
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Delete and access keys are hashed with scrypt and a random salt, and
+// stored as scrypt$<salt>$<hash> with both parts base64 encoded
+const (
+	keyHashPrefix = "scrypt$"
+	keyHashN      = 16384
+	keyHashR      = 8
+	keyHashP      = 1
+	keyHashLen    = 32
+	keySaltLen    = 16
+)
+
+// Hash a delete or access key for storage in metadata. Empty keys and keys
+// that are already hashed are returned as they are.
+func HashKey(key string) (string, error) {
+	if key == "" || IsHashedKey(key) {
+		return key, nil
+	}
+
+	salt := make([]byte, keySaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash, err := scrypt.Key([]byte(key), salt, keyHashN, keyHashR, keyHashP, keyHashLen)
+	if err != nil {
+		return "", err
+	}
+
+	return keyHashPrefix + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(hash), nil
+}
+
+// Whether stored is a hash made by HashKey rather than a plaintext key
+func IsHashedKey(stored string) bool {
+	_, _, ok := parseKeyHash(stored)
+	return ok
+}
+
+func parseKeyHash(stored string) (salt []byte, hash []byte, ok bool) {
+	rest, found := strings.CutPrefix(stored, keyHashPrefix)
+	if !found {
+		return nil, nil, false
+	}
+
+	encodedSalt, encodedHash, found := strings.Cut(rest, "$")
+	if !found {
+		return nil, nil, false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(encodedSalt)
+	if err != nil || len(salt) != keySaltLen {
+		return nil, nil, false
+	}
+	hash, err = base64.RawStdEncoding.DecodeString(encodedHash)
+	if err != nil || len(hash) != keyHashLen {
+		return nil, nil, false
+	}
+
+	return salt, hash, true
+}
+
+// Whether provided matches the stored key, which is either hashed or, for
+// metadata written without hashing, the plaintext key
+func CheckKey(stored, provided string) (bool, error) {
+	salt, hash, ok := parseKeyHash(stored)
+	if !ok {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(provided)) == 1, nil
+	}
+
+	computed, err := scrypt.Key([]byte(provided), salt, keyHashN, keyHashR, keyHashP, keyHashLen)
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(computed, hash) == 1, nil
+}
+
+// Check provided against the access key in a file's metadata, rejecting
+// it once the access key has expired
+func CheckAccessKey(ctx context.Context, b StorageBackend, key, provided string) (bool, error) {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if m.AccessKeyExpired() {
+		return false, nil
+	}
+	return CheckKey(m.AccessKey, provided)
+}
+
+// Set the access key of a file and when it stops being accepted, for
+// backends to implement GrantAccess with
+func GrantAccess(ctx context.Context, b StorageBackend, key, accessKey string, until time.Time) error {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	m.AccessKey = accessKey
+	m.AccessKeyExpiry = until
+	return b.PutMetadata(ctx, key, m)
+}
+
+// Check provided against the delete key in a file's metadata
+func CheckDeleteKey(ctx context.Context, b StorageBackend, key, provided string) (bool, error) {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return CheckKey(m.DeleteKey, provided)
+}
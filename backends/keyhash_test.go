@@ -0,0 +1,79 @@
+package backends
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashKey(t *testing.T) {
+	hashed, err := HashKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, "scrypt$") || !IsHashedKey(hashed) {
+		t.Fatalf("Hash %q isn't recognized as one", hashed)
+	}
+
+	if rehashed, _ := HashKey(hashed); rehashed != hashed {
+		t.Fatal("An already hashed key was hashed again")
+	}
+	if empty, _ := HashKey(""); empty != "" {
+		t.Fatalf("Empty key was hashed to %q", empty)
+	}
+	if other, _ := HashKey("secret"); other == hashed {
+		t.Fatal("Hashes of the same key share a salt")
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	hashed, _ := HashKey("secret")
+
+	for _, tt := range []struct {
+		stored, provided string
+		ok               bool
+	}{
+		{hashed, "secret", true},
+		{hashed, "wrong", false},
+		{hashed, hashed, false},
+		{"secret", "secret", true},
+		{"secret", "wrong", false},
+		{"", "", true},
+		{"scrypt$notbase64$x", "scrypt$notbase64$x", true},
+	} {
+		ok, err := CheckKey(tt.stored, tt.provided)
+		if err != nil || ok != tt.ok {
+			t.Errorf("CheckKey(%q, %q) returned %v, %v", tt.stored, tt.provided, ok, err)
+		}
+	}
+}
+
+func TestGrantAccess(t *testing.T) {
+	ctx := context.Background()
+	b := &metadataBackend{files: map[string]Metadata{"a.txt": {AccessKey: "old"}}}
+
+	if err := GrantAccess(ctx, b, "a.txt", "new", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := CheckAccessKey(ctx, b, "a.txt", "old"); ok {
+		t.Fatal("The replaced access key was accepted")
+	}
+	if ok, _ := CheckAccessKey(ctx, b, "a.txt", "new"); !ok {
+		t.Fatal("The granted access key was rejected")
+	}
+
+	GrantAccess(ctx, b, "a.txt", "new", time.Now().Add(-time.Second))
+	if ok, _ := CheckAccessKey(ctx, b, "a.txt", "new"); ok {
+		t.Fatal("An expired access key was accepted")
+	}
+
+	GrantAccess(ctx, b, "a.txt", "new", time.Time{})
+	if ok, _ := CheckAccessKey(ctx, b, "a.txt", "new"); !ok {
+		t.Fatal("An access key without an expiry was rejected")
+	}
+
+	if err := GrantAccess(ctx, b, "missing", "new", time.Time{}); err != NotFoundErr {
+		t.Fatalf("Granting access to a missing file returned %v", err)
+	}
+}
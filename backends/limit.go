@@ -0,0 +1,179 @@
+package backends
+
+import (
+	"io"
+	"time"
+)
+
+// Read at most max bytes from r, failing with FileTooLargeError as soon as
+// there's more rather than only once all of it was read. Limit uploads with
+// Limits.MaxSize.
+func LimitedReader(r io.Reader, max int64) io.Reader {
+	return &limitedReader{r: r, left: max}
+}
+
+type limitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.left < 0 {
+		return 0, FileTooLargeError
+	}
+	// Read one byte more than is left to tell content of exactly max
+	// bytes from more, leaving that byte out of what's returned
+	if int64(len(p)) > r.left+1 {
+		p = p[:r.left+1]
+	}
+	n, err := r.r.Read(p)
+	if int64(n) > r.left {
+		n = int(r.left)
+		r.left = -1
+		return n, FileTooLargeError
+	}
+	r.left -= int64(n)
+	return n, err
+}
+
+// Reads closer together than a window over this are recorded as one, so
+// that fast uploads don't keep a sample for each read
+const minRateSamples = 32
+
+// Fail reading from r with UploadTooSlowErr once fewer than minRate bytes
+// per second came in on average over the last window, from the end of the
+// first window on. Reads happen in the background, so that one that never
+// returns fails too rather than holding on to the upload. That read is
+// abandoned, so r should be closed afterwards, as the HTTP server does with
+// request bodies. Limit uploads with Limits.MinUploadRate over
+// Limits.MinUploadRateWindow. r is returned as it is if either is 0.
+func MinRateReader(r io.Reader, minRate int64, window time.Duration) io.Reader {
+	if minRate <= 0 || window <= 0 {
+		return r
+	}
+
+	now := time.Now()
+	return &minRateReader{
+		r:       r,
+		need:    float64(minRate) * window.Seconds(),
+		window:  window,
+		start:   now,
+		samples: []rateSample{{now, 0}},
+	}
+}
+
+type rateSample struct {
+	t     time.Time
+	total int64
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+type minRateReader struct {
+	r      io.Reader
+	need   float64
+	window time.Duration
+	start  time.Time
+	total  int64
+	// Totals read by increasing times, going back a window
+	samples []rateSample
+	// Reads happen into buf, as a read that's given up on still writes
+	// to it once it returns
+	buf []byte
+	err error
+}
+
+func (r *minRateReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if len(r.buf) < len(p) {
+		r.buf = make([]byte, len(p))
+	}
+	buf := r.buf[:len(p)]
+	result := make(chan readResult, 1)
+	go func() {
+		n, err := r.r.Read(buf)
+		result <- readResult{n, err}
+	}()
+
+	timer := time.NewTimer(time.Until(r.deadline()))
+	defer timer.Stop()
+
+	select {
+	case res := <-result:
+		n := copy(p, buf[:res.n])
+		r.record(time.Now(), n)
+		if res.err == nil && r.tooSlow(time.Now()) {
+			r.err = UploadTooSlowErr
+			return n, r.err
+		}
+		return n, res.err
+	case <-timer.C:
+		r.err = UploadTooSlowErr
+		r.buf = nil
+		return 0, r.err
+	}
+}
+
+func (r *minRateReader) record(now time.Time, n int) {
+	r.total += int64(n)
+
+	// The newest sample is moved forward rather than another added if
+	// the one before it is recent enough. Every sample is still a total
+	// that was read at its time, only fewer of them are kept.
+	last := len(r.samples) - 1
+	if last > 0 && now.Sub(r.samples[last-1].t) < r.window/minRateSamples {
+		r.samples[last] = rateSample{now, r.total}
+	} else {
+		r.samples = append(r.samples, rateSample{now, r.total})
+	}
+
+	// Keep the newest sample from before the window, which is what was
+	// read by the time it starts
+	cutoff := now.Add(-r.window)
+	drop := 0
+	for drop+1 < len(r.samples) && !r.samples[drop+1].t.After(cutoff) {
+		drop++
+	}
+	r.samples = r.samples[drop:]
+}
+
+// Whether less than needed was read over the window up to now
+func (r *minRateReader) tooSlow(now time.Time) bool {
+	if now.Sub(r.start) < r.window {
+		return false
+	}
+
+	cutoff := now.Add(-r.window)
+	var before int64
+	for _, s := range r.samples {
+		if s.t.After(cutoff) {
+			break
+		}
+		before = s.total
+	}
+	return float64(r.total-before) < r.need
+}
+
+// When the upload is too slow if nothing more is read by then: a window
+// after the read it would take to still have enough in the window
+func (r *minRateReader) deadline() time.Time {
+	for _, s := range r.samples {
+		if float64(r.total-s.total) < r.need {
+			deadline := s.t.Add(r.window)
+			if first := r.start.Add(r.window); deadline.Before(first) {
+				return first
+			}
+			return deadline
+		}
+	}
+	return r.samples[len(r.samples)-1].t.Add(r.window)
+}
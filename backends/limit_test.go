@@ -0,0 +1,83 @@
+package backends
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitedReader(t *testing.T) {
+	data, err := io.ReadAll(LimitedReader(strings.NewReader("1234"), 4))
+	if err != nil || string(data) != "1234" {
+		t.Fatalf("Content of exactly the limit returned %q, %v", data, err)
+	}
+
+	data, err = io.ReadAll(LimitedReader(strings.NewReader("12345"), 4))
+	if err != FileTooLargeError || string(data) != "1234" {
+		t.Fatalf("Content over the limit returned %q, %v", data, err)
+	}
+
+	// Nothing past the byte over the limit is read
+	src := strings.NewReader(strings.Repeat("x", 1000))
+	if _, err := io.Copy(io.Discard, LimitedReader(src, 10)); err != FileTooLargeError {
+		t.Fatalf("Expected FileTooLargeError, got %v", err)
+	}
+	if src.Len() != 1000-11 {
+		t.Fatalf("Expected 11 bytes to be read, got %d", 1000-src.Len())
+	}
+
+	if n, err := io.Copy(io.Discard, LimitedReader(strings.NewReader(""), 0)); n != 0 || err != nil {
+		t.Fatalf("Empty content returned %d, %v", n, err)
+	}
+}
+
+// Returns a byte every interval
+type tricklingReader struct {
+	interval time.Duration
+}
+
+func (r tricklingReader) Read(p []byte) (int, error) {
+	time.Sleep(r.interval)
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestMinRateReader(t *testing.T) {
+	src := strings.NewReader("1234")
+	if MinRateReader(src, 0, time.Second) != src {
+		t.Error("Reader without a minimum rate was wrapped")
+	}
+
+	data, err := io.ReadAll(MinRateReader(strings.NewReader(strings.Repeat("x", 100000)), 1000, 50*time.Millisecond))
+	if err != nil || len(data) != 100000 {
+		t.Fatalf("Fast reader returned %d bytes, %v", len(data), err)
+	}
+
+	// Fast enough at first, but then not enough comes in over a window
+	started := time.Now()
+	n, err := io.Copy(io.Discard, MinRateReader(io.MultiReader(strings.NewReader(strings.Repeat("x", 10000)), tricklingReader{5 * time.Millisecond}), 10000, 100*time.Millisecond))
+	if err != UploadTooSlowErr {
+		t.Fatalf("Trickling reader returned %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Trickling reader failed after %v", elapsed)
+	}
+
+	// Reads that never return fail once the window is over
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("12345"))
+	r := MinRateReader(pr, 1000, 50*time.Millisecond)
+	started = time.Now()
+	data, err = io.ReadAll(r)
+	if err != UploadTooSlowErr || string(data) != "12345" {
+		t.Fatalf("Stalled reader returned %q, %v", data, err)
+	}
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Stalled reader failed after %v", elapsed)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != UploadTooSlowErr {
+		t.Errorf("Reading after failing returned %d, %v", n, err)
+	}
+}
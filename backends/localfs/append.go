@@ -0,0 +1,243 @@
+package localfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+)
+
+// Uploads in progress are written as they arrive to a file per key in
+// this directory of the files directory, and only stored as blobs once
+// finalized, so they can be encrypted, compressed and deduplicated like
+// any other upload
+const partialDir = ".partial"
+
+func (b LocalfsBackend) partialPath(key string) string {
+	return path.Join(b.filesPath, partialDir, key)
+}
+
+// Locks held per key, so that Append and Finalize of an upload take turns
+// while those of other uploads don't wait on them
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	// Callers holding or waiting for the lock, which is dropped once
+	// there are none
+	users int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[string]*keyLock)}
+}
+
+func (l *keyLocks) lock(key string) (unlock func()) {
+	l.mu.Lock()
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.users++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+
+		l.mu.Lock()
+		kl.users--
+		if kl.users == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Uploads in progress count towards Limits.MaxFiles and
+// Limits.MaxTotalSize along with stored files, as QuotaBackend only sees
+// them once finalized. Returns how many more bytes the upload under key
+// may grow past offset by, or -1 for no limit.
+func (b LocalfsBackend) uploadRoom(ctx context.Context, key string, offset int64) (int64, error) {
+	if backends.Limits.MaxFiles <= 0 && backends.Limits.MaxTotalSize <= 0 {
+		return -1, nil
+	}
+
+	stats, err := b.Stats(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir(path.Join(b.filesPath, partialDir))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	uploads, uploadBytes, resumed := int64(0), int64(0), false
+	for _, entry := range entries {
+		if entry.Name() == key {
+			resumed = true
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			uploads++
+			uploadBytes += info.Size()
+		}
+	}
+
+	if !resumed && backends.Limits.MaxFiles > 0 && stats.FileCount+uploads >= backends.Limits.MaxFiles {
+		return 0, backends.TooManyFilesError
+	}
+	if backends.Limits.MaxTotalSize <= 0 {
+		return -1, nil
+	}
+	room := backends.Limits.MaxTotalSize - stats.TotalBytes - uploadBytes - offset
+	if room <= 0 {
+		return 0, backends.QuotaExceededErr
+	}
+	return room, nil
+}
+
+func (b LocalfsBackend) Append(ctx context.Context, key string, r io.Reader, offset int64) (int64, error) {
+	if err := b.checkPaths(key); err != nil {
+		return 0, err
+	}
+
+	unlock := b.uploadLocks.lock(key)
+	defer unlock()
+
+	room, err := b.uploadRoom(ctx, key, offset)
+	if err != nil {
+		return 0, err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+
+	f, err := os.OpenFile(b.partialPath(key), flags, 0600)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(path.Join(b.filesPath, partialDir), 0700)
+		if err != nil {
+			return 0, err
+		}
+		f, err = os.OpenFile(b.partialPath(key), flags, 0600)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 || offset > fileInfo.Size() {
+		return fileInfo.Size(), backends.InvalidOffsetErr
+	}
+
+	// Drop whatever a chunk that failed partway left past offset
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	src := backends.MinRateReader(helpers.NewContextReader(ctx, r), backends.Limits.MinUploadRate, backends.Limits.MinUploadRateWindow)
+	src = backends.LimitedReader(src, backends.Limits.MaxSize-offset)
+	if room >= 0 {
+		// One byte more than there's room for shows it didn't fit
+		src = io.LimitReader(src, room+1)
+	}
+	written, err := io.Copy(f, src)
+	size := offset + written
+	if err != nil {
+		return size, err
+	}
+	if room >= 0 && written > room {
+		f.Truncate(offset)
+		return offset, backends.QuotaExceededErr
+	}
+
+	return size, nil
+}
+
+// The upload in progress is kept if it can't be stored, so that it can be
+// finalized again
+func (b LocalfsBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (m backends.Metadata, err error) {
+	if err = b.checkPaths(key); err != nil {
+		return
+	}
+
+	unlock := b.uploadLocks.lock(key)
+	defer unlock()
+
+	f, err := os.Open(b.partialPath(key))
+	if os.IsNotExist(err) {
+		return m, backends.FileEmptyError
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+
+	m, err = b.Put(ctx, key, f, expiry, deleteKey, accessKey, srcIp, originalName, o)
+	if err != nil {
+		return
+	}
+
+	os.Remove(b.partialPath(key))
+	return
+}
+
+// Uploads are only ever written by Append, so their modification time is
+// when they were last appended to. Failing to remove one doesn't stop the
+// others from being removed, such errors are joined together.
+func (b LocalfsBackend) PurgeUploads(ctx context.Context, olderThan time.Duration) error {
+	entries, err := os.ReadDir(path.Join(b.filesPath, partialDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	appendedBefore := time.Now().Add(-olderThan)
+	var errs []error
+	for _, entry := range entries {
+		if err := b.purgeUpload(entry.Name(), appendedBefore); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Checked again with the lock held, as the upload may have been appended
+// to since it was listed
+func (b LocalfsBackend) purgeUpload(key string, appendedBefore time.Time) error {
+	unlock := b.uploadLocks.lock(key)
+	defer unlock()
+
+	info, err := os.Stat(b.partialPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() || !info.ModTime().Before(appendedBefore) {
+		return nil
+	}
+
+	err = os.Remove(b.partialPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package localfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Reads a few bytes at a time with a pause in between, so that concurrent
+// appends interleave if nothing keeps them apart
+type tricklingReader struct {
+	r io.Reader
+}
+
+func (t tricklingReader) Read(p []byte) (int, error) {
+	if len(p) > 256 {
+		p = p[:256]
+	}
+	time.Sleep(100 * time.Microsecond)
+	return t.r.Read(p)
+}
+
+func TestAppendConcurrent(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(c byte) {
+			defer wg.Done()
+			chunk := bytes.Repeat([]byte{c}, 4096)
+			if _, err := b.Append(ctx, "upload.bin", tricklingReader{bytes.NewReader(chunk)}, 0); err != nil {
+				t.Error(err)
+			}
+		}('a' + byte(i))
+	}
+	wg.Wait()
+
+	content, err := os.ReadFile(b.partialPath("upload.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 4096 || !bytes.Equal(content, bytes.Repeat(content[:1], 4096)) {
+		t.Fatalf("Concurrent appends left %d mixed bytes", len(content))
+	}
+	if len(b.uploadLocks.locks) != 0 {
+		t.Errorf("%d locks were left behind", len(b.uploadLocks.locks))
+	}
+}
+
+func TestAppendLimits(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{})
+	backends.Limits.MaxFiles = 2
+	backends.Limits.MaxTotalSize = 30
+	defer func() {
+		backends.Limits.MaxFiles = 0
+		backends.Limits.MaxTotalSize = 0
+	}()
+
+	if _, err := b.Put(ctx, "stored.txt", strings.NewReader("0123456789"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Append(ctx, "first.txt", strings.NewReader("0123456789"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Append(ctx, "second.txt", strings.NewReader("0"), 0); err != backends.TooManyFilesError {
+		t.Errorf("Starting an upload past MaxFiles returned %v", err)
+	}
+	if size, err := b.Append(ctx, "first.txt", strings.NewReader("0123456789x"), 10); err != backends.QuotaExceededErr || size != 10 {
+		t.Errorf("Appending past MaxTotalSize returned %d, %v", size, err)
+	}
+	if size, err := b.Append(ctx, "first.txt", strings.NewReader("0123456789"), 10); err != nil || size != 20 {
+		t.Errorf("Appending up to MaxTotalSize returned %d, %v", size, err)
+	}
+}
+
+func TestPurgeUploads(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{})
+
+	for _, key := range []string{"abandoned.txt", "active.txt"} {
+		if _, err := b.Append(ctx, key, strings.NewReader("partial"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastAppended := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(b.partialPath("abandoned.txt"), lastAppended, lastAppended); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.PurgeUploads(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Finalize(ctx, "abandoned.txt", 0, "", "", "", "", backends.PutOptions{}); err != backends.FileEmptyError {
+		t.Errorf("Finalizing a purged upload returned %v", err)
+	}
+	if m, err := b.Finalize(ctx, "active.txt", 0, "", "", "", "", backends.PutOptions{}); err != nil || m.Size != 7 {
+		t.Errorf("Finalizing the active upload returned %v, %v", m, err)
+	}
+}
@@ -0,0 +1,90 @@
+package localfs
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+var errUnknownCompression = errors.New("Unknown compression codec, must be gzip or zstd.")
+
+// Mimetypes whose content is already compressed, so compressing it again
+// would only cost CPU time
+var compressedMimetypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/pdf":              true,
+	"application/epub+zip":         true,
+	"application/jar":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+func compressible(mimetype string) bool {
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+
+	if mimetype == "image/svg+xml" {
+		return true
+	}
+	if helpers.IsImage(mimetype) || strings.HasPrefix(mimetype, "video/") || strings.HasPrefix(mimetype, "audio/") {
+		return false
+	}
+	return !compressedMimetypes[mimetype]
+}
+
+func newCompressWriter(w io.Writer, codec string) (io.WriteCloser, error) {
+	switch codec {
+	case compressionGzip:
+		return gzip.NewWriter(w), nil
+	case compressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, errUnknownCompression
+}
+
+// Decompresses a blob, closing the blob itself along with the decompressor
+type decompressedFile struct {
+	io.Reader
+	close func()
+	f     io.Closer
+}
+
+func (d decompressedFile) Close() error {
+	d.close()
+	return d.f.Close()
+}
+
+func newDecompressedFile(f io.ReadCloser, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case compressionGzip:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return decompressedFile{gz, func() { gz.Close() }, f}, nil
+	case compressionZstd:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return decompressedFile{zr, zr.Close, f}, nil
+	}
+	return nil, errUnknownCompression
+}
@@ -0,0 +1,110 @@
+package localfs
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	content := strings.Repeat("compress me ", 1000)
+	png := "\x89PNG\r\n\x1a\n" + content
+
+	for _, codec := range []string{compressionGzip, compressionZstd} {
+		plain := newTestBackend(t, LocalfsOptions{})
+		if _, err := plain.Put(ctx, "old.txt", strings.NewReader(content), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := NewLocalfsBackendWithOptions(plain.metaPath, plain.filesPath, LocalfsOptions{Compression: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, data := range map[string]string{"new.txt": content, "image.png": png} {
+			if _, err := b.Put(ctx, key, strings.NewReader(data), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for key, want := range map[string]string{"old.txt": "", "new.txt": codec, "image.png": ""} {
+			m, err := b.Head(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Compression != want {
+				t.Errorf("%s: %s stored with compression %q", codec, key, m.Compression)
+			}
+		}
+		if info, err := os.Stat(b.blobPath("new.txt")); err != nil || info.Size() >= int64(len(content)) {
+			t.Errorf("%s: blob wasn't compressed: %v, %v", codec, info.Size(), err)
+		}
+
+		for key, want := range map[string]string{"old.txt": content, "new.txt": content, "image.png": png} {
+			if got := read(t, b, key); got != want {
+				t.Errorf("%s: %s read as %d bytes instead of %d", codec, key, len(got), len(want))
+			}
+
+			r, err := b.GetRange(ctx, key, 100, 24)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(r)
+			r.Close()
+			if string(got) != want[100:124] {
+				t.Errorf("%s: range of %s read as %q", codec, key, got)
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/"+key, nil)
+			req.Header.Set("Range", "bytes=100-123")
+			if err := b.ServeFile(key, w, req); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusPartialContent || w.Body.String() != want[100:124] {
+				t.Errorf("%s: range of %s served as %d, %q", codec, key, w.Code, w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			if err := b.ServeFile(key, w, httptest.NewRequest("GET", "/"+key, nil)); err != nil {
+				t.Fatal(err)
+			}
+			if w.Body.String() != want {
+				t.Errorf("%s: %s served as %d bytes instead of %d", codec, key, w.Body.Len(), len(want))
+			}
+		}
+	}
+}
+
+func TestCompressionGzipPassthrough(t *testing.T) {
+	b := newTestBackend(t, LocalfsOptions{Compression: compressionGzip})
+	content := strings.Repeat("compress me ", 1000)
+	if _, err := b.Put(context.Background(), "new.txt", strings.NewReader(content), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/new.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := b.ServeFile("new.txt", w, req); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Gzip blob was served with Content-Encoding %q", w.Header().Get("Content-Encoding"))
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(gz); string(got) != content {
+		t.Fatalf("Gzip blob served as %d bytes instead of %d", len(got), len(content))
+	}
+}
@@ -0,0 +1,375 @@
+package localfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+const dedupIndexDir = ".sha256"
+
+// Index entry for a sha256sum, listing every key whose blob is a hardlink
+// of the same content. The reference count is the number of keys.
+type dedupEntry struct {
+	Keys []string `json:"keys"`
+}
+
+func (b LocalfsBackend) dedupEntryPath(sum string) string {
+	return path.Join(b.metaPath, dedupIndexDir, sum)
+}
+
+func (b LocalfsBackend) readDedupEntry(sum string) (entry dedupEntry, err error) {
+	f, err := os.Open(b.dedupEntryPath(sum))
+	if os.IsNotExist(err) {
+		return entry, nil
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&entry)
+	return
+}
+
+func (b LocalfsBackend) writeDedupEntry(sum string, entry dedupEntry) error {
+	entryPath := b.dedupEntryPath(sum)
+
+	if len(entry.Keys) == 0 {
+		err := os.Remove(entryPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	dst, err := createTemp(path.Join(b.metaPath, dedupIndexDir))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	err = json.NewEncoder(dst).Encode(entry)
+	if err == nil {
+		err = dst.Close()
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), entryPath)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
+
+// Link the blob for key at filePath to an existing blob with the same
+// sha256sum, if there is one, and record key as a reference either way. When linked, the
+// metadata of the blob linked to is returned, since how the blob is stored
+// on disk (such as its encryption nonce) now comes from it.
+func (b LocalfsBackend) dedupBlob(ctx context.Context, key string, filePath string, sum string) (canonical backends.Metadata, linked bool, err error) {
+	b.dedupLock.Lock()
+	defer b.dedupLock.Unlock()
+
+	entry, err := b.readDedupEntry(sum)
+	if err != nil {
+		return
+	}
+
+	referenced := false
+	for _, k := range entry.Keys {
+		// The key is already referenced when it's overwritten with the
+		// same content, but its new blob still has to be linked
+		if k == key {
+			referenced = true
+			continue
+		}
+		if linked {
+			continue
+		}
+
+		m, err := b.Head(ctx, k)
+		if err != nil || m.Sha256sum != sum {
+			continue
+		}
+
+		// Link next to the freshly written blob and swap it in, so the
+		// key never points at a missing file
+		tmpPath := path.Join(b.filesPath, tempPrefix+key)
+		if err := os.Link(b.blobPath(k), tmpPath); err != nil {
+			continue
+		}
+		if err := os.Rename(tmpPath, filePath); err != nil {
+			os.Remove(tmpPath)
+			continue
+		}
+
+		canonical, linked = m, true
+	}
+
+	if !referenced {
+		entry.Keys = append(entry.Keys, key)
+		err = b.writeDedupEntry(sum, entry)
+	}
+	return
+}
+
+// Add key as a reference to sum without touching its blob
+func (b LocalfsBackend) dedupRef(key string, sum string) error {
+	b.dedupLock.Lock()
+	defer b.dedupLock.Unlock()
+
+	return b.addDedupRef(key, sum)
+}
+
+// Must be called with the dedup lock held
+func (b LocalfsBackend) addDedupRef(key string, sum string) error {
+	entry, err := b.readDedupEntry(sum)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range entry.Keys {
+		if k == key {
+			return nil
+		}
+	}
+
+	entry.Keys = append(entry.Keys, key)
+	return b.writeDedupEntry(sum, entry)
+}
+
+// Drop key as a reference to sum, removing the index entry once the last
+// reference is gone
+func (b LocalfsBackend) dedupUnref(key string, sum string) error {
+	b.dedupLock.Lock()
+	defer b.dedupLock.Unlock()
+
+	entry, err := b.readDedupEntry(sum)
+	if err != nil {
+		return err
+	}
+
+	keys := entry.Keys[:0]
+	for _, k := range entry.Keys {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	entry.Keys = keys
+
+	return b.writeDedupEntry(sum, entry)
+}
+
+// Files are looked up in the dedup index when dedup is enabled, and by the
+// metadata of every file otherwise
+func (b LocalfsBackend) FindBySha256(ctx context.Context, sum string) (string, bool, error) {
+	if !b.dedup {
+		return backends.ScanBySha256(ctx, b, sum)
+	}
+	if !backends.IsSha256(sum) {
+		return "", false, nil
+	}
+
+	entry, err := b.readDedupEntry(sum)
+	if err != nil {
+		return "", false, err
+	}
+
+	// The index can lag behind a file that was just deleted or changed
+	for _, key := range entry.Keys {
+		m, err := b.Head(ctx, key)
+		if err == nil && m.Sha256sum == sum && !expiry.IsTsExpired(m.Expiry) {
+			return key, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Find files stored more than once with the same contents, such as those
+// uploaded before dedup was enabled, and replace all but one of their blobs
+// with hardlinks to it. Returns how many bytes on disk that reclaimed and
+// how many blobs were replaced. Blobs already linked together are left as
+// they are, so running it again merges nothing. Files can be stored and
+// served while it runs: each blob is compared byte for byte and checked
+// right before it's replaced, and one that changed meanwhile is skipped.
+func (b LocalfsBackend) Deduplicate(ctx context.Context) (freedBytes int64, merged int, err error) {
+	if b.singleFile {
+		return 0, 0, errSingleFileDedup
+	}
+	defer b.stats.Invalidate()
+
+	keys, err := b.metadataKeys()
+	if err != nil {
+		return
+	}
+
+	// Encrypted and compressed blobs are only identical on disk if they
+	// were stored the same way
+	type blobKind struct{ sum, nonce, compression string }
+	groups := make(map[blobKind][]string)
+	for _, key := range keys {
+		m, err := b.Head(ctx, key)
+		if err != nil || m.Sha256sum == "" {
+			continue
+		}
+		kind := blobKind{m.Sha256sum, m.Nonce, m.Compression}
+		groups[kind] = append(groups[kind], key)
+	}
+
+	for kind, group := range groups {
+		if ctx.Err() != nil {
+			return freedBytes, merged, ctx.Err()
+		}
+		if len(group) < 2 {
+			continue
+		}
+		sort.Strings(group)
+
+		freed, n, err := b.mergeBlobs(group, kind.sum)
+		if err != nil {
+			return freedBytes, merged, err
+		}
+		freedBytes += freed
+		merged += n
+	}
+	return
+}
+
+// Replace the blobs of keys, which all have the same contents, with
+// hardlinks to the first that's still there
+func (b LocalfsBackend) mergeBlobs(keys []string, sum string) (freedBytes int64, merged int, err error) {
+	b.dedupLock.Lock()
+	defer b.dedupLock.Unlock()
+
+	var canonical os.FileInfo
+	var canonicalPath string
+	var linked []string
+	// Blobs replaced by a link, and those that are still there
+	var replaced, kept []os.FileInfo
+	for _, key := range keys {
+		blobPath := b.blobPath(key)
+		fi, err := os.Lstat(blobPath)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if canonical == nil {
+			canonical, canonicalPath = fi, blobPath
+			kept = append(kept, fi)
+			linked = append(linked, key)
+			continue
+		}
+		if os.SameFile(fi, canonical) {
+			linked = append(linked, key)
+			continue
+		}
+
+		if fi.Size() != canonical.Size() {
+			kept = append(kept, fi)
+			continue
+		}
+		same, err := sameContents(canonicalPath, blobPath)
+		if err != nil || !same {
+			kept = append(kept, fi)
+			continue
+		}
+
+		if !b.linkOver(canonicalPath, blobPath, key, fi) {
+			kept = append(kept, fi)
+			continue
+		}
+		replaced = append(replaced, fi)
+		linked = append(linked, key)
+		merged++
+	}
+
+	// A replaced blob only frees space once no key is left pointing at it,
+	// and blobs that were already linked together only free it once
+	var freed []os.FileInfo
+	for _, fi := range replaced {
+		if containsFile(kept, fi) || containsFile(freed, fi) {
+			continue
+		}
+		freed = append(freed, fi)
+		freedBytes += fi.Size()
+	}
+
+	if b.dedup {
+		for _, key := range linked {
+			if err = b.addDedupRef(key, sum); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Swap the blob of key at blobPath, which was last seen as fi, for a
+// hardlink to canonicalPath, unless it's been replaced or removed since
+func (b LocalfsBackend) linkOver(canonicalPath, blobPath, key string, fi os.FileInfo) bool {
+	tmpPath := path.Join(b.filesPath, tempPrefix+key)
+	if err := os.Link(canonicalPath, tmpPath); err != nil {
+		return false
+	}
+
+	current, err := os.Lstat(blobPath)
+	if err != nil || !os.SameFile(current, fi) {
+		os.Remove(tmpPath)
+		return false
+	}
+	if err := os.Rename(tmpPath, blobPath); err != nil {
+		os.Remove(tmpPath)
+		return false
+	}
+	return true
+}
+
+// Whether the files at a and b have the same contents
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !endA {
+			return false, errA
+		}
+		if errB != nil && !endB {
+			return false, errB
+		}
+		if endA || endB {
+			return endA == endB, nil
+		}
+	}
+}
+
+func containsFile(files []os.FileInfo, fi os.FileInfo) bool {
+	for _, f := range files {
+		if os.SameFile(f, fi) {
+			return true
+		}
+	}
+	return false
+}
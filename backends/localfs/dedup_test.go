@@ -0,0 +1,214 @@
+package localfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Whether the blobs of two keys are hardlinks to the same file
+func linked(t *testing.T, b LocalfsBackend, a, other string) bool {
+	t.Helper()
+	fa, err := os.Stat(b.blobPath(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fo, err := os.Stat(b.blobPath(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(fa, fo)
+}
+
+func TestDedupReferences(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{Dedup: true})
+
+	var shared backends.Metadata
+	for _, key := range []string{"a", "b"} {
+		m, err := b.Put(ctx, key, strings.NewReader("shared content"), 0, "", "", "", "", backends.PutOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		shared = m
+	}
+	if !linked(t, b, "a", "b") {
+		t.Fatal("Identical files weren't linked")
+	}
+	if entry, _ := b.readDedupEntry(shared.Sha256sum); len(entry.Keys) != 2 {
+		t.Fatalf("Index references %v", entry.Keys)
+	}
+
+	// Overwriting with the same content keeps a single reference and the
+	// link to the other copy
+	if _, err := b.Put(ctx, "a", strings.NewReader("shared content"), 0, "", "", "", "", backends.PutOptions{Overwrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := b.readDedupEntry(shared.Sha256sum); len(entry.Keys) != 2 || !linked(t, b, "a", "b") {
+		t.Fatalf("Overwriting with the same content left references %v", entry.Keys)
+	}
+
+	changed, err := b.Put(ctx, "a", strings.NewReader("new content"), 0, "", "", "", "", backends.PutOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := b.readDedupEntry(shared.Sha256sum); len(entry.Keys) != 1 || entry.Keys[0] != "b" {
+		t.Fatalf("Overwritten key is still referenced: %v", entry.Keys)
+	}
+	if entry, _ := b.readDedupEntry(changed.Sha256sum); len(entry.Keys) != 1 || entry.Keys[0] != "a" {
+		t.Fatalf("New content is referenced by %v", entry.Keys)
+	}
+	if got := read(t, b, "b"); got != "shared content" {
+		t.Fatalf("Other copy was changed to %q", got)
+	}
+
+	if err := b.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(b.dedupEntryPath(shared.Sha256sum)); !os.IsNotExist(err) {
+		t.Fatalf("Index entry of the last deleted reference is left: %v", err)
+	}
+	if _, found, err := b.FindBySha256(ctx, shared.Sha256sum); found || err != nil {
+		t.Fatalf("Deleted content was found: %v, %v", found, err)
+	}
+}
+
+func TestDedupFailedOverwrite(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{Dedup: true})
+
+	m, err := b.Put(ctx, "a", strings.NewReader("kept"), 0, "", "", "", "", backends.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends.Limits.MaxSize = 8
+	_, err = b.Put(ctx, "a", strings.NewReader("far too large"), 0, "", "", "", "", backends.PutOptions{Overwrite: true})
+	backends.Limits.MaxSize = 1024 * 1024
+	if err != backends.FileTooLargeError {
+		t.Fatalf("Overwriting with a file too large returned %v", err)
+	}
+
+	if got := read(t, b, "a"); got != "kept" {
+		t.Fatalf("Content was changed to %q", got)
+	}
+	if key, found, err := b.FindBySha256(ctx, m.Sha256sum); key != "a" || !found || err != nil {
+		t.Fatalf("Kept file wasn't found in the index: %q, %v, %v", key, found, err)
+	}
+
+	// A file with the same content still links to it
+	if _, err := b.Put(ctx, "b", strings.NewReader("kept"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !linked(t, b, "a", "b") {
+		t.Fatal("Identical file wasn't linked to the kept one")
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	ctx := context.Background()
+	plain := newTestBackend(t, LocalfsOptions{})
+	content := strings.Repeat("duplicated ", 100)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := plain.Put(ctx, key, strings.NewReader(content), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := plain.Put(ctx, "other", strings.NewReader("other content"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// b and c already share a blob, which only frees its space once
+	if err := os.Remove(plain.blobPath("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(plain.blobPath("b"), plain.blobPath("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Identical content stored another way isn't identical on disk
+	compressed, err := NewLocalfsBackendWithOptions(plain.metaPath, plain.filesPath, LocalfsOptions{Compression: compressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compressed.Put(ctx, "gzipped", strings.NewReader(content), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewLocalfsBackendWithOptions(plain.metaPath, plain.filesPath, LocalfsOptions{Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	freed, merged, err := b.Deduplicate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged != 2 || freed != int64(len(content)) {
+		t.Fatalf("Merged %d blobs freeing %d bytes instead of 2 and %d", merged, freed, len(content))
+	}
+	if !linked(t, b, "a", "b") || !linked(t, b, "a", "c") || linked(t, b, "a", "gzipped") {
+		t.Fatal("Blobs weren't linked as expected")
+	}
+	m, _ := b.Head(ctx, "a")
+	if entry, _ := b.readDedupEntry(m.Sha256sum); len(entry.Keys) != 3 {
+		t.Fatalf("Index references %v", entry.Keys)
+	}
+	for _, key := range []string{"a", "b", "c", "gzipped"} {
+		if got := read(t, b, key); got != content {
+			t.Errorf("%s read as %d bytes after merging", key, len(got))
+		}
+	}
+
+	if freed, merged, err := b.Deduplicate(ctx); freed != 0 || merged != 0 || err != nil {
+		t.Fatalf("Running again merged %d blobs freeing %d bytes, %v", merged, freed, err)
+	}
+}
+
+func TestDeduplicateChanged(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{})
+
+	var m backends.Metadata
+	for _, key := range []string{"a", "b"} {
+		var err error
+		if m, err = b.Put(ctx, key, strings.NewReader("same size"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Replaced after the metadata was read, but before the blobs were
+	// compared
+	if err := os.WriteFile(b.blobPath("b"), []byte("different"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if freed, merged, err := b.mergeBlobs([]string{"a", "b"}, m.Sha256sum); freed != 0 || merged != 0 || err != nil {
+		t.Fatalf("Merging a changed blob merged %d freeing %d bytes, %v", merged, freed, err)
+	}
+
+	// Replaced after they were compared, right before the link
+	stale, err := os.Lstat(b.blobPath("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written before the old blob is gone, so it can't reuse its inode
+	replacement := path.Join(t.TempDir(), "b")
+	if err := os.WriteFile(replacement, []byte("replaced!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, b.blobPath("b")); err != nil {
+		t.Fatal(err)
+	}
+	if b.linkOver(b.blobPath("a"), b.blobPath("b"), "b", stale) {
+		t.Fatal("A blob replaced since it was compared was linked over")
+	}
+	if content, _ := os.ReadFile(b.blobPath("b")); string(content) != "replaced!" {
+		t.Fatalf("Replaced blob was changed to %q", content)
+	}
+	if entries, _ := os.ReadDir(b.filesPath); len(entries) != 2 {
+		t.Fatalf("Temporary links were left behind: %v", entries)
+	}
+}
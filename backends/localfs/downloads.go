@@ -0,0 +1,93 @@
+package localfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Downloads are counted in a sidecar file per key, which grows by a byte
+// on every download. Appending is atomic, so serving a file never needs to
+// rewrite its metadata. The count is folded into the metadata whenever that
+// is written anyway.
+const downloadsDir = ".downloads"
+
+func (b LocalfsBackend) downloadsPath(key string) string {
+	return path.Join(b.metaPath, downloadsDir, key)
+}
+
+func (b LocalfsBackend) countDownload(key string) error {
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+
+	f, err := os.OpenFile(b.downloadsPath(key), flags, 0600)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(path.Join(b.metaPath, downloadsDir), 0700)
+		if err != nil {
+			return err
+		}
+		f, err = os.OpenFile(b.downloadsPath(key), flags, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte{'.'})
+	return err
+}
+
+// Downloads counted since the metadata was last written
+func (b LocalfsBackend) pendingDownloads(key string) int64 {
+	fileInfo, err := os.Stat(b.downloadsPath(key))
+	if err != nil {
+		return 0
+	}
+
+	return fileInfo.Size()
+}
+
+func (b LocalfsBackend) resetDownloads(key string) error {
+	err := os.Remove(b.downloadsPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Count a download of key unless it was already served as many times as it
+// can be, in which case it returns NotFoundErr, and report whether it was
+// the last one it could be served
+func (b LocalfsBackend) takeDownload(ctx context.Context, key string) (last bool, err error) {
+	b.downloadsLock.Lock()
+	defer b.downloadsLock.Unlock()
+
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return
+	}
+	if m.DownloadsExhausted() {
+		return false, backends.NotFoundErr
+	}
+
+	// Counting is best effort for files that can be served any number of
+	// times
+	if err = b.countDownload(key); m.MaxDownloads == 0 {
+		return false, nil
+	}
+	return m.Downloads+1 >= m.MaxDownloads, err
+}
+
+// Expire key once its last download is done, for it to be deleted like any
+// other expired file. Files under a retention lock stay until it's lifted,
+// but are still refused.
+func (b LocalfsBackend) expireNow(ctx context.Context, key string) {
+	m, err := b.Head(ctx, key)
+	if err != nil || m.RetentionLocked() {
+		return
+	}
+	m.Expiry = time.Now()
+	b.writeMetadata(key, m)
+}
@@ -0,0 +1,29 @@
+package localfs
+
+import (
+	"os"
+)
+
+// With Durable set, flush what was written to f to disk, so that it's
+// there once f is renamed into place
+func (b LocalfsBackend) syncFile(f *os.File) error {
+	if !b.durable {
+		return nil
+	}
+	return f.Sync()
+}
+
+// With Durable set, flush the entries of dir to disk, so that a file just
+// created in or renamed into it survives a crash
+func (b LocalfsBackend) syncDir(dir string) error {
+	if !b.durable {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,240 @@
+package localfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Encrypted blobs are a sequence of independently sealed AES-GCM chunks of
+// encryptionChunkSize plaintext bytes (the last one shorter, possibly
+// empty), so that any offset can be decrypted without reading what comes
+// before it. The last chunk is sealed with finalChunkData as additional
+// data, so that a blob cut short at a chunk boundary doesn't pass for a
+// shorter one.
+const encryptionChunkSize = 64 * 1024
+
+var finalChunkData = []byte("final")
+
+var errEncryptedNoKey = errors.New("File is encrypted but no encryption key is configured.")
+var errChunkCorrupted = errors.New("Encrypted chunk failed authentication.")
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("Encryption key must be 32 bytes for AES-256.")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func newNonce(aead cipher.AEAD) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// Each chunk is sealed with the base nonce XORed with its index
+func chunkNonce(base []byte, chunk int64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+
+	var idx [8]byte
+	binary.BigEndian.PutUint64(idx[:], uint64(chunk))
+	for i := range idx {
+		nonce[len(nonce)-8+i] ^= idx[i]
+	}
+
+	return nonce
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	chunk int64
+}
+
+func newEncryptWriter(w io.Writer, aead cipher.AEAD, nonce []byte) *encryptWriter {
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, 0, encryptionChunkSize),
+	}
+}
+
+func (e *encryptWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+
+		if len(e.buf) == cap(e.buf) {
+			if err = e.flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Full chunks are sealed as they fill up, so only the one Close seals is
+// the final one
+func (e *encryptWriter) flush() error {
+	return e.seal(nil)
+}
+
+func (e *encryptWriter) seal(additionalData []byte) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.nonce, e.chunk), e.buf, additionalData)
+	e.buf = e.buf[:0]
+	e.chunk++
+
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Close seals the final chunk, which is sealed even if it's empty. It
+// doesn't close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(finalChunkData)
+}
+
+// Decrypts an encrypted blob at arbitrary offsets
+type decrypter struct {
+	r     io.ReaderAt
+	aead  cipher.AEAD
+	nonce []byte
+	size  int64
+
+	// The most recently decrypted chunk, as sequential reads usually
+	// come in smaller pieces than a chunk
+	mu         sync.Mutex
+	cached     int64
+	cachedData []byte
+}
+
+func (d *decrypter) openChunk(chunk int64) ([]byte, error) {
+	if d.cachedData != nil && d.cached == chunk {
+		return d.cachedData, nil
+	}
+
+	plainLen := d.size - chunk*encryptionChunkSize
+	if plainLen > encryptionChunkSize {
+		plainLen = encryptionChunkSize
+	}
+
+	sealed := make([]byte, plainLen+int64(d.aead.Overhead()))
+	_, err := d.r.ReadAt(sealed, chunk*int64(encryptionChunkSize+d.aead.Overhead()))
+	if err == io.EOF {
+		// The size is worked out from the blob, so a chunk can only be
+		// missing bytes if the blob lost its final one
+		err = errChunkCorrupted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var additionalData []byte
+	if chunk == d.size/encryptionChunkSize {
+		additionalData = finalChunkData
+	}
+	plain, err := d.aead.Open(sealed[:0], chunkNonce(d.nonce, chunk), sealed, additionalData)
+	if err != nil {
+		return nil, errChunkCorrupted
+	}
+
+	d.cached = chunk
+	d.cachedData = plain
+	return plain, nil
+}
+
+func (d *decrypter) ReadAt(p []byte, off int64) (n int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for n < len(p) && off < d.size {
+		chunk := off / encryptionChunkSize
+		plain, err := d.openChunk(chunk)
+		if err != nil {
+			return n, err
+		}
+
+		c := copy(p[n:], plain[off-chunk*encryptionChunkSize:])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// Every chunk adds overhead bytes of authentication tag to the plaintext,
+// including the final one when it's empty
+func plaintextSize(encryptedSize int64, overhead int) int64 {
+	sealedChunk := int64(encryptionChunkSize + overhead)
+	chunks := (encryptedSize + sealedChunk - 1) / sealedChunk
+	return encryptedSize - chunks*int64(overhead)
+}
+
+// The plaintext view of an encrypted blob
+type decryptedFile struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (d decryptedFile) Close() error {
+	return d.f.Close()
+}
+
+// The encrypted blob starts offset bytes into f
+func (b LocalfsBackend) newDecryptedFile(f *os.File, offset int64, m backends.Metadata) (decryptedFile, error) {
+	if b.aead == nil {
+		return decryptedFile{}, errEncryptedNoKey
+	}
+
+	nonce, err := hex.DecodeString(m.Nonce)
+	if err != nil || len(nonce) != b.aead.NonceSize() {
+		return decryptedFile{}, backends.BadMetadata
+	}
+
+	// The plaintext isn't necessarily m.Size long, as it may have been
+	// compressed before encrypting it, so work it out from the blob
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return decryptedFile{}, err
+	}
+	size := plaintextSize(fileInfo.Size()-offset, b.aead.Overhead())
+
+	d := &decrypter{
+		r:     io.NewSectionReader(f, offset, fileInfo.Size()-offset),
+		aead:  b.aead,
+		nonce: nonce,
+		size:  size,
+	}
+
+	// Reads may never get to the final chunk, or it may be empty, so it's
+	// checked up front that the blob wasn't cut short
+	if _, err := d.openChunk(size / encryptionChunkSize); err != nil {
+		return decryptedFile{}, err
+	}
+
+	return decryptedFile{io.NewSectionReader(d, 0, size), f}, nil
+}
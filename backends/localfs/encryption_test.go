@@ -0,0 +1,133 @@
+package localfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+func newEncryptedBackend(t *testing.T) LocalfsBackend {
+	backends.Limits.MaxSize = 1024 * 1024
+
+	dir := t.TempDir()
+	for _, sub := range []string{"meta", "files"} {
+		if err := os.Mkdir(path.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := NewLocalfsBackendWithOptions(path.Join(dir, "meta"), path.Join(dir, "files"), LocalfsOptions{
+		EncryptionKey: bytes.Repeat([]byte{7}, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEncryptedGetRange(t *testing.T) {
+	ctx := context.Background()
+	b := newEncryptedBackend(t)
+
+	// A few chunks and a partial one, as random bytes so that it isn't
+	// compressed or detected as anything
+	plain := make([]byte, 3*encryptionChunkSize+1234)
+	rand.New(rand.NewSource(1)).Read(plain)
+	if _, err := b.Put(ctx, "video.bin", bytes.NewReader(plain), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := os.ReadFile(b.blobPath("video.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, plain[:64]) {
+		t.Fatal("Expected the blob to be stored encrypted")
+	}
+
+	size := int64(len(plain))
+	for _, r := range []struct{ offset, length int64 }{
+		{0, 10},
+		{0, size},
+		{encryptionChunkSize - 5, 10},
+		{encryptionChunkSize, encryptionChunkSize},
+		{encryptionChunkSize + 1, 2*encryptionChunkSize + 100},
+		{size - 1, 1},
+		{size - 2000, 5000},
+	} {
+		f, err := b.GetRange(ctx, "video.bin", r.offset, r.length)
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d) returned %v", r.offset, r.length, err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := plain[r.offset:min(r.offset+r.length, size)]
+		if !bytes.Equal(got, want) {
+			t.Errorf("GetRange(%d, %d) returned %d bytes that don't match the plaintext", r.offset, r.length, len(got))
+		}
+	}
+}
+
+func TestEncryptedServeFileRange(t *testing.T) {
+	ctx := context.Background()
+	b := newEncryptedBackend(t)
+
+	plain := make([]byte, 2*encryptionChunkSize+10)
+	rand.New(rand.NewSource(2)).Read(plain)
+	if _, err := b.Put(ctx, "video.bin", bytes.NewReader(plain), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	start, end := int64(encryptionChunkSize-3), int64(encryptionChunkSize+3)
+	r := httptest.NewRequest("GET", "/video.bin", nil)
+	r.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10))
+	w := httptest.NewRecorder()
+	if err := b.ServeFile("video.bin", w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("Expected a partial response, got %d", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), plain[start:end+1]) {
+		t.Fatalf("Served %d bytes that don't match the plaintext", w.Body.Len())
+	}
+}
+
+func TestEncryptedTruncated(t *testing.T) {
+	ctx := context.Background()
+	sealedChunk := int64(encryptionChunkSize + 16)
+
+	for _, size := range []int{2*encryptionChunkSize + 100, 2 * encryptionChunkSize} {
+		b := newEncryptedBackend(t)
+		plain := make([]byte, size)
+		rand.New(rand.NewSource(3)).Read(plain)
+		if _, err := b.Put(ctx, "video.bin", bytes.NewReader(plain), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Cut off everything after the first two chunks
+		if err := os.Truncate(b.blobPath("video.bin"), 2*sealedChunk); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Get(ctx, "video.bin"); err != errChunkCorrupted {
+			t.Errorf("Get of a %d byte file cut at a chunk boundary returned %v", size, err)
+		}
+		if _, err := b.GetRange(ctx, "video.bin", 0, 10); err != errChunkCorrupted {
+			t.Errorf("GetRange of a %d byte file cut at a chunk boundary returned %v", size, err)
+		}
+	}
+}
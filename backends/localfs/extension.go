@@ -0,0 +1,129 @@
+package localfs
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+)
+
+// The path of a blob stored with an extension is recorded in its metadata,
+// which the single file layout doesn't keep apart from the blob
+var errSingleFileBlobExtensions = errors.New("Blob extensions can't be used with the single file layout.")
+
+// Extensions for mimetypes that mime.ExtensionsByType lists several for,
+// which it sorts alphabetically rather than by how common they are
+var preferredExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/tiff":      ".tif",
+	"text/plain":      ".txt",
+	"text/html":       ".html",
+	"audio/mpeg":      ".mp3",
+	"video/mpeg":      ".mpg",
+	"video/quicktime": ".mov",
+}
+
+// Extension to store the blob of key with for mimetype, or "" if key
+// already has one or the mimetype doesn't have any
+func blobExtension(key, mimetype string) string {
+	if path.Ext(key) != "" {
+		return ""
+	}
+
+	kind, _, _ := strings.Cut(mimetype, ";")
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if kind == "" || kind == helpers.OpaqueMimetype {
+		return ""
+	}
+	if ext, ok := preferredExtensions[kind]; ok {
+		return ext
+	}
+
+	exts, err := mime.ExtensionsByType(kind)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
+}
+
+// Where a new blob for key with mimetype goes, and the path relative to
+// filesPath to record in its metadata if that's not where blobPath looks
+// for it. A blob is left without an extension if that's the blob of
+// another key, such as abcd1234.png for abcd1234.
+func (b LocalfsBackend) newBlobPath(key, mimetype string) (dst string, recorded string) {
+	dst = b.shardedPath(key)
+	if !b.extensions {
+		return
+	}
+	ext := blobExtension(key, mimetype)
+	if ext == "" {
+		return
+	}
+	if _, err := os.Lstat(dst + ext); err == nil && dst+ext != b.blobPath(key) {
+		return
+	}
+
+	dst += ext
+	recorded, _ = filepath.Rel(b.filesPath, dst)
+	return dst, filepath.ToSlash(recorded)
+}
+
+// The blob path recorded in the metadata of key, if it was stored with an
+// extension
+func (b LocalfsBackend) recordedBlob(key string) string {
+	return b.recordedBlobAt(path.Join(b.metaPath, key))
+}
+
+func (b LocalfsBackend) recordedBlobAt(metaFile string) string {
+	if b.singleFile {
+		return ""
+	}
+
+	f, err := os.Open(metaFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var mjson struct {
+		Blob string `json:"blob"`
+	}
+	if err := json.NewDecoder(f).Decode(&mjson); err != nil {
+		return ""
+	}
+
+	// Metadata mustn't point outside of filesPath
+	if !filepath.IsLocal(mjson.Blob) {
+		return ""
+	}
+	return mjson.Blob
+}
+
+// Record the blob path relative to filesPath in the metadata of key,
+// leaving everything else as it is
+func (b LocalfsBackend) recordBlob(key string, recorded string) error {
+	f, err := os.Open(path.Join(b.metaPath, key))
+	if os.IsNotExist(err) {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mjson := MetadataJSON{}
+	if err := json.NewDecoder(f).Decode(&mjson); err != nil {
+		return backends.BadMetadata
+	}
+	if mjson.Blob == recorded {
+		return nil
+	}
+
+	mjson.Blob = recorded
+	return b.writeMetadataFile(key, mjson)
+}
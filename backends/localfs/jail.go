@@ -0,0 +1,56 @@
+package localfs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Entries localfs keeps alongside files in metaPath and filesPath, besides
+// temporary files
+var reservedNames = []string{partialDir, trashDir, dedupIndexDir, downloadsDir, publicIndexDir}
+
+// Reject keys whose paths could end up outside of metaPath and filesPath,
+// that are symlinks, or that are localfs's own entries, whatever validation
+// the caller did or didn't do
+func (b LocalfsBackend) checkPaths(key string) error {
+	if err := backends.ValidateKey(key); err != nil {
+		return err
+	}
+	if slices.Contains(reservedNames, key) || isTemp(key) {
+		return backends.InvalidKeyErr
+	}
+
+	for _, p := range []struct{ root, path string }{
+		{b.metaPath, path.Join(b.metaPath, key)},
+		{b.filesPath, path.Join(b.filesPath, key)},
+		{b.filesPath, b.shardedPath(key)},
+	} {
+		if !within(p.root, p.path) {
+			return backends.InvalidKeyErr
+		}
+		if fileInfo, err := os.Lstat(p.path); err == nil && fileInfo.Mode()&os.ModeSymlink != 0 {
+			return backends.InvalidKeyErr
+		}
+	}
+	return nil
+}
+
+// Whether p resolves to a path below root
+func within(root, p string) bool {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(absRoot, absPath)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,48 @@
+package localfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+func TestCheckPaths(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{Dedup: true})
+
+	outside := path.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, path.Join(b.filesPath, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", ".", "..", "../secret", "a/b", "link", ".trash", ".partial", ".sha256", ".downloads", ".public", ".tmp-abc"} {
+		if err := b.checkPaths(key); err != backends.InvalidKeyErr {
+			t.Errorf("Key %q returned %v", key, err)
+		}
+	}
+	for _, key := range []string{"file.txt", ".hidden", "..dots"} {
+		if err := b.checkPaths(key); err != nil {
+			t.Errorf("Key %q returned %v", key, err)
+		}
+	}
+
+	if _, err := b.Put(ctx, ".sha256", strings.NewReader("x"), 0, "", "", "", "", backends.PutOptions{}); err != backends.InvalidKeyErr {
+		t.Errorf("Put to the dedup index returned %v", err)
+	}
+	if err := b.Delete(ctx, ".sha256"); err != backends.InvalidKeyErr {
+		t.Errorf("Delete of the dedup index returned %v", err)
+	}
+	if _, err := os.Stat(path.Join(b.metaPath, dedupIndexDir)); err != nil {
+		t.Errorf("Dedup index is gone: %v", err)
+	}
+	if _, _, err := b.Get(ctx, "link"); err != backends.InvalidKeyErr {
+		t.Errorf("Get through a symlink returned %v", err)
+	}
+}
@@ -1,245 +1,1586 @@
 package localfs
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
-	"encoding/hex"
 
 	"github.com/andreimarcu/linx-server/backends"
-	"github.com/andreimarcu/linx-server/helpers"
 	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/andreimarcu/linx-server/httputil"
+	"github.com/dchest/uniuri"
 	"github.com/minio/sha256-simd"
-	"github.com/gabriel-vasile/mimetype"
 )
 
 type LocalfsBackend struct {
-	metaPath  string
-	filesPath string
+	metaPath       string
+	filesPath      string
+	dedup          bool
+	dedupLock      *sync.Mutex
+	downloadsLock  *sync.Mutex
+	uploadLocks    *keyLocks
+	aead           cipher.AEAD
+	shardDepth     int
+	compression    string
+	hashKeys       bool
+	presignKey     []byte
+	presignURL     string
+	softDelete     bool
+	scanner        backends.Scanner
+	anonymizeIP    bool
+	sliding        time.Duration
+	singleFile     bool
+	extensions     bool
+	sendfile       string
+	sendfilePrefix string
+	fileMode       os.FileMode
+	dirMode        os.FileMode
+	durable        bool
+	readOnly       bool
+	stats          *backends.StatsCache
+	files          *backends.FileCounter
+}
+
+type LocalfsOptions struct {
+	// Store uploads with identical content only once, hardlinking blobs
+	// that share a sha256sum
+	Dedup bool
+
+	// 32 byte key to encrypt new blobs at rest with AES-256-GCM. Blobs
+	// stored without encryption remain readable.
+	EncryptionKey []byte
+
+	// Store blobs under this many levels of two character directories
+	// taken from the start of their key, such as ab/cd/abcd1234 for a
+	// depth of 2. Blobs stored flat before remain readable.
+	ShardDepth int
+
+	// Compress new blobs with gzip or zstd, except for content that is
+	// already compressed such as images, video and archives
+	Compression string
+
+	// Store scrypt hashes of delete and access keys instead of the keys
+	// themselves. Plaintext keys written before are hashed the next time
+	// they are checked successfully, or when metadata from before versions
+	// were recorded is upgraded.
+	HashKeys bool
+
+	// Secret to sign the URLs returned by PresignGet with, which are
+	// PresignURL followed by the key. Without it PresignGet isn't
+	// supported.
+	PresignKey []byte
+	PresignURL string
+
+	// Move deleted files into a trash directory instead of removing them,
+	// so that they can be restored until PurgeTrash removes them for good
+	SoftDelete bool
+
+	// Scan new files with this before storing them, if set
+	Scanner backends.Scanner
+
+	// Store only the network part of source IPs, zeroing the last octet
+	// of IPv4 addresses and the last 80 bits of IPv6 ones. Metadata
+	// stored before isn't rewritten for this.
+	AnonymizeIP bool
+
+	// Move the expiry of files to this long after they were last served,
+	// by ServeFile and the other Serve methods or by Get with a context
+	// from backends.WithServing, if set. Files that never expire are left
+	// alone.
+	SlidingExpiry time.Duration
+
+	// Store the metadata of each file in a header at the start of its
+	// blob rather than in a file of its own in metaPath, which then only
+	// holds download counts. This halves the number of files, at the cost
+	// of rewriting the whole blob whenever its metadata changes. Files
+	// stored with the other layout aren't readable, and this can't be
+	// combined with Dedup.
+	SingleFile bool
+
+	// Store new blobs with an extension for their mimetype, such as
+	// abcd1234.png, so that the files directory can be browsed with other
+	// tools. Keys are left alone, and keys that already have an extension
+	// aren't given another. The blob's path is recorded in its metadata,
+	// so this can be turned off again without losing files, but it can't
+	// be combined with SingleFile.
+	BlobExtensions bool
+
+	// Permissions to give new blobs and metadata files, and the
+	// directories they're sharded into, regardless of the umask. Unset,
+	// files get 0666 and directories 0755, less the umask. Files stored
+	// before keep the permissions they have.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// Flush new blobs and metadata, and the directories they're renamed
+	// into, to disk before Put and PutMetadata return, so that a stored
+	// file survives a power loss. This costs throughput.
+	Durable bool
+
+	// Have ServeFile answer with this header, X-Accel-Redirect for nginx
+	// or X-Sendfile for Apache and lighttpd, pointing the reverse proxy
+	// at the blob to serve instead of sending it from Go. The blob's path,
+	// relative to filesPath, follows SendfilePrefix, which defaults to
+	// /<files directory name>/ for X-Accel-Redirect and the absolute
+	// filesPath for X-Sendfile. Blobs that are encrypted, compressed or
+	// stored with the single file layout are still served from Go, as
+	// the proxy can't serve them as they are.
+	Sendfile       string
+	SendfilePrefix string
+
+	// Keep reads from writing to metaPath and filesPath, as they otherwise
+	// do to count downloads, slide expiries, hash plaintext keys and
+	// upgrade metadata. Files limited to a number of downloads aren't
+	// served, as their downloads can't be counted. Set by
+	// NewReadOnlyMetaBackend.
+	ReadOnly bool
 }
 
 type MetadataJSON struct {
-	DeleteKey    string   `json:"delete_key"`
-	AccessKey    string   `json:"access_key,omitempty"`
-	Sha256sum    string   `json:"sha256sum"`
-	Mimetype     string   `json:"mimetype"`
-	Size         int64    `json:"size"`
-	Expiry       int64    `json:"expiry"`
-	SrcIp        string   `json:"srcip,omitempty"`
-  OriginalName string   `json:"original_name,omitempty"`
-	ArchiveFiles []string `json:"archive_files,omitempty"`
+	PublicID         string                  `json:"public_id,omitempty"`
+	DeleteKey        string                  `json:"delete_key"`
+	AccessKey        string                  `json:"access_key,omitempty"`
+	AccessKeyExpiry  int64                   `json:"access_key_expiry,omitempty"`
+	Sha256sum        string                  `json:"sha256sum"`
+	Checksums        map[string]string       `json:"checksums,omitempty"`
+	Mimetype         string                  `json:"mimetype"`
+	Size             int64                   `json:"size"`
+	Expiry           int64                   `json:"expiry"`
+	SrcIp            string                  `json:"srcip,omitempty"`
+	OriginalName     string                  `json:"original_name,omitempty"`
+	ArchiveFiles     []backends.ArchiveEntry `json:"archive_files,omitempty"`
+	ArchiveTruncated bool                    `json:"archive_truncated,omitempty"`
+	ArchiveOmitted   int                     `json:"archive_omitted,omitempty"`
+	Nonce            string                  `json:"nonce,omitempty"`
+	Encryption       *backends.Encryption    `json:"encryption,omitempty"`
+	Downloads        int64                   `json:"downloads,omitempty"`
+	MaxDownloads     int64                   `json:"max_downloads,omitempty"`
+	Compression      string                  `json:"compression,omitempty"`
+	RetainUntil      int64                   `json:"retain_until,omitempty"`
+	Uploaded         int64                   `json:"uploaded,omitempty"`
+	Custom           map[string]string       `json:"custom,omitempty"`
+	Tags             map[string]string       `json:"tags,omitempty"`
+	DownloadRate     int64                   `json:"download_rate,omitempty"`
+	Blob             string                  `json:"blob,omitempty"`
+	Version          int                     `json:"version,omitempty"`
+}
+
+func (b LocalfsBackend) Capabilities() backends.Caps {
+	return backends.Caps{
+		SupportsPresign:      len(b.presignKey) > 0,
+		SupportsRange:        true,
+		SupportsCopy:         true,
+		SupportsList:         true,
+		SupportsAppend:       true,
+		SupportsTrash:        b.softDelete,
+		SupportsRetention:    true,
+		SupportsMaxDownloads: true,
+		SupportsEncryption:   b.aead != nil,
+	}
+}
+
+func (b LocalfsBackend) CheckAccessKey(ctx context.Context, key, provided string) (bool, error) {
+	return b.checkKey(ctx, key, provided, func(m backends.Metadata) (string, bool) {
+		return m.AccessKey, !m.AccessKeyExpired()
+	})
+}
+
+func (b LocalfsBackend) CheckDeleteKey(ctx context.Context, key, provided string) (bool, error) {
+	return b.checkKey(ctx, key, provided, func(m backends.Metadata) (string, bool) {
+		return m.DeleteKey, true
+	})
+}
+
+// stored returns the key to check against and whether it's still accepted
+func (b LocalfsBackend) checkKey(ctx context.Context, key, provided string, stored func(backends.Metadata) (string, bool)) (bool, error) {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	storedKey, valid := stored(m)
+	if !valid {
+		return false, nil
+	}
+
+	ok, err := backends.CheckKey(storedKey, provided)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	// Now that the key is known to be right, hash plaintext keys left
+	// from before hashing was enabled. writeMetadata hashes both, and if
+	// it fails the key is simply hashed on a later check.
+	if b.hashKeys && !b.readOnly && storedKey != "" && !backends.IsHashedKey(storedKey) {
+		b.writeMetadata(key, m)
+	}
+	return true, nil
 }
 
-func (b LocalfsBackend) Delete(key string) (err error) {
-	err = os.Remove(path.Join(b.filesPath, key))
+func (b LocalfsBackend) Copy(ctx context.Context, srcKey, dstKey string) (m backends.Metadata, err error) {
+	if err = b.checkPaths(dstKey); err != nil {
+		return
+	}
+	defer b.stats.Invalidate()
+
+	m, err = b.Head(ctx, srcKey)
+	if err != nil {
+		return
+	}
+	// Replacing a file would leave its dedup reference and public ID
+	// behind, so it has to be deleted first, as with Rename
+	if _, err = os.Lstat(path.Join(b.metaPath, dstKey)); err == nil {
+		return m, backends.KeyExistsErr
+	}
+	if _, err = os.Lstat(b.blobPath(dstKey)); err == nil {
+		return m, backends.KeyExistsErr
+	}
+	done, err := b.files.Check(ctx, b, dstKey)
+	if err != nil {
+		return
+	}
+	defer done(false)
+
+	srcPath := b.blobPath(srcKey)
+	dstPath, recorded := b.newBlobPath(dstKey, m.Mimetype)
+
+	if _, err = os.Stat(srcPath); os.IsNotExist(err) {
+		return m, backends.OrphanedMetadataErr
+	} else if err != nil {
+		return
+	}
+
+	if err = b.mkdirAll(path.Dir(dstPath)); err != nil {
+		return
+	}
+
+	// Prefer a hardlink, falling back to a full copy when the files
+	// directory doesn't support them
+	if err = os.Link(srcPath, dstPath); err != nil {
+		err = b.copyFile(srcPath, dstPath)
+		if err != nil {
+			return
+		}
+	}
+	if err = b.syncDir(path.Dir(dstPath)); err != nil {
+		return
+	}
+
+	// The copy is a new file, so it isn't bound by the original's lock
+	m.PublicID = backends.NewPublicID()
+	m.DeleteKey = uniuri.NewLen(30)
+	m.Downloads = 0
+	m.RetainUntil = time.Time{}
+	m.Uploaded = time.Now()
+
+	err = b.writeBlobMetadata(dstKey, m, recorded)
 	if err != nil {
+		os.Remove(dstPath)
 		return
 	}
-	err = os.Remove(path.Join(b.metaPath, key))
+
+	done(true)
+	if b.dedup {
+		err = b.dedupRef(dstKey, m.Sha256sum)
+	}
+
+	return
+}
+
+// Return RetentionLockedErr if key exists and is under a retention lock
+func (b LocalfsBackend) checkRetention(ctx context.Context, key string) error {
+	if m, err := b.Head(ctx, key); err == nil && m.RetentionLocked() {
+		return backends.RetentionLockedErr
+	}
+	return nil
+}
+
+func (b LocalfsBackend) Delete(ctx context.Context, key string) (err error) {
+	if err = b.checkPaths(key); err != nil {
+		return
+	}
+	if err = b.checkRetention(ctx, key); err != nil {
+		return
+	}
+	defer b.stats.Invalidate()
+
+	// Read what's needed to drop key from the indexes before it's gone
+	m, _ := b.Head(ctx, key)
+
+	if b.softDelete {
+		err = b.trash(key)
+		if err != nil {
+			return
+		}
+	} else {
+		err = b.remove(key)
+		if err != nil {
+			return
+		}
+		// Trashed files keep their entry, for when they're restored
+		b.unindexPublicID(m.PublicID, key)
+	}
+	b.files.Add(-1)
+	b.resetDownloads(key)
+
+	if b.dedup && m.Sha256sum != "" {
+		err = b.dedupUnref(key, m.Sha256sum)
+	}
 	return
 }
 
-func (b LocalfsBackend) Exists(key string) (bool, error) {
-	_, err := os.Stat(path.Join(b.filesPath, key))
+// Remove both the blob and the metadata of key, even if removing one of
+// them fails, treating either already being gone as removed. Removing only
+// one of them returns PartialDeleteErr along with why the other failed, so
+// that the caller can retry.
+func (b LocalfsBackend) remove(key string) error {
+	// With dedup enabled this only drops one hardlink, the underlying blob
+	// goes away with its last reference
+	blobErr := os.Remove(b.blobPath(key))
+	metaErr := os.Remove(path.Join(b.metaPath, key))
+	if os.IsNotExist(blobErr) && os.IsNotExist(metaErr) {
+		return backends.NotFoundErr
+	}
+	if os.IsNotExist(blobErr) {
+		blobErr = nil
+	}
+	if os.IsNotExist(metaErr) {
+		metaErr = nil
+	}
+
+	if blobErr != nil {
+		blobErr = fmt.Errorf("removing file: %w", blobErr)
+	}
+	if metaErr != nil {
+		metaErr = fmt.Errorf("removing metadata: %w", metaErr)
+	}
+	if (blobErr == nil) != (metaErr == nil) {
+		return errors.Join(backends.PartialDeleteErr, blobErr, metaErr)
+	}
+	return errors.Join(blobErr, metaErr)
+}
+
+func (b LocalfsBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	return backends.DeleteEach(ctx, keys, 1, b.Delete)
+}
+
+// Metadata files are small, so reading many at a time only helps on slow
+// disks
+func (b LocalfsBackend) HeadMany(ctx context.Context, keys []string) (map[string]backends.Metadata, map[string]error) {
+	return backends.HeadEach(ctx, keys, 4, b.Head)
+}
+
+func (b LocalfsBackend) Exists(ctx context.Context, key string) (bool, error) {
+	if err := b.checkPaths(key); err != nil {
+		return false, err
+	}
+
+	_, err := os.Stat(b.blobPath(key))
 	return err == nil, err
 }
 
-func (b LocalfsBackend) Head(key string) (metadata backends.Metadata, err error) {
-	f, err := os.Open(path.Join(b.metaPath, key))
-	if os.IsNotExist(err) {
-		return metadata, backends.NotFoundErr
+// Both directories must exist and have room for a new file, unless the
+// backend is read-only, when they only need to exist
+func (b LocalfsBackend) HealthCheck(ctx context.Context) error {
+	for _, dir := range []string{b.metaPath, b.filesPath} {
+		if b.readOnly {
+			if _, err := os.Stat(dir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		f, err := createTemp(dir)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write([]byte{0})
+		f.Close()
+		os.Remove(f.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b LocalfsBackend) Head(ctx context.Context, key string) (metadata backends.Metadata, err error) {
+	if err = b.checkPaths(key); err != nil {
+		return
+	}
+
+	blobFile := b.blobPath(key)
+	persist := !b.singleFile && !b.readOnly
+	mjson, upgraded, err := b.loadMetadata(path.Join(b.metaPath, key), blobFile, persist)
+	if err != nil {
+		return
+	}
+	if upgraded && persist {
+		// Best effort, the upgrade is done again on the next read if
+		// this fails
+		b.writeMetadataFile(key, mjson)
+	}
+
+	metadata = decodeMetadata(mjson, blobFile)
+	metadata.Downloads += b.pendingDownloads(key)
+	return
+}
+
+// Read the metadata in metaFile of the blob stored at blobFile, or in the
+// blob itself with the single file layout
+func (b LocalfsBackend) readMetadata(metaFile string, blobFile string) (metadata backends.Metadata, err error) {
+	mjson, _, err := b.loadMetadata(metaFile, blobFile, false)
+	if err != nil {
+		return
+	}
+	return decodeMetadata(mjson, blobFile), nil
+}
+
+// Like readMetadata, returning the metadata as it's stored, upgraded to
+// the latest version, and whether that took an upgrade. Upgrades only worth
+// doing once are skipped unless the caller persists the upgraded metadata.
+func (b LocalfsBackend) loadMetadata(metaFile string, blobFile string, persist bool) (mjson MetadataJSON, upgraded bool, err error) {
+	f, err := b.openMetadata(metaFile, blobFile)
+	if os.IsNotExist(err) || err == backends.NotFoundErr {
+		return mjson, false, backends.NotFoundErr
 	} else if err != nil {
-		return metadata, backends.BadMetadata
+		return mjson, false, backends.BadMetadata
 	}
 	defer f.Close()
 
-	decoder := json.NewDecoder(f)
-
-	mjson := MetadataJSON{}
-	if err := decoder.Decode(&mjson); err != nil {
-		return metadata, backends.BadMetadata
+	if err := json.NewDecoder(f).Decode(&mjson); err != nil {
+		return mjson, false, backends.BadMetadata
 	}
+	return mjson, b.upgradeMetadata(&mjson, blobFile, persist), nil
+}
 
+func decodeMetadata(mjson MetadataJSON, blobFile string) (metadata backends.Metadata) {
+	metadata.PublicID = mjson.PublicID
 	metadata.DeleteKey = mjson.DeleteKey
 	metadata.AccessKey = mjson.AccessKey
 	metadata.Mimetype = mjson.Mimetype
 	metadata.ArchiveFiles = mjson.ArchiveFiles
+	metadata.ArchiveTruncated = mjson.ArchiveTruncated
+	metadata.ArchiveOmitted = mjson.ArchiveOmitted
 	metadata.OriginalName = mjson.OriginalName
 	metadata.Sha256sum = mjson.Sha256sum
+	metadata.Checksums = mjson.Checksums
 	metadata.Expiry = time.Unix(mjson.Expiry, 0)
 	metadata.Size = mjson.Size
+	metadata.SrcIp = mjson.SrcIp
+	metadata.Nonce = mjson.Nonce
+	metadata.Downloads = mjson.Downloads
+	metadata.MaxDownloads = mjson.MaxDownloads
+	metadata.Compression = mjson.Compression
+	if mjson.Encryption != nil {
+		metadata.Encryption = *mjson.Encryption
+	}
+	metadata.ETag = backends.ETag(mjson.Sha256sum)
+	metadata.Custom = mjson.Custom
+	metadata.Tags = mjson.Tags
+	metadata.DownloadRate = mjson.DownloadRate
+	if mjson.RetainUntil != 0 {
+		metadata.RetainUntil = time.Unix(mjson.RetainUntil, 0)
+	}
+	if mjson.AccessKeyExpiry != 0 {
+		metadata.AccessKeyExpiry = time.Unix(mjson.AccessKeyExpiry, 0)
+	}
+
+	if fileInfo, err := os.Stat(blobFile); err == nil {
+		metadata.ModTime = fileInfo.ModTime()
+	}
+
+	if mjson.Uploaded != 0 {
+		metadata.Uploaded = time.Unix(mjson.Uploaded, 0)
+	}
 
 	return
 }
 
-func (b LocalfsBackend) Get(key string) (metadata backends.Metadata, f io.ReadCloser, err error) {
-	metadata, err = b.Head(key)
+func (b LocalfsBackend) Get(ctx context.Context, key string) (metadata backends.Metadata, f io.ReadCloser, err error) {
+	metadata, err = b.Head(ctx, key)
 	if err != nil {
 		return
 	}
+	// Only ServeFile counts downloads, but files served as many times as
+	// they can be mustn't be read any other way either
+	if metadata.DownloadsExhausted() {
+		return backends.Metadata{}, nil, backends.NotFoundErr
+	}
 
-	f, err = os.Open(path.Join(b.filesPath, key))
+	f, err = b.openContent(b.blobPath(key), metadata)
 	if err != nil {
 		return
 	}
 
+	if backends.Serving(ctx) {
+		b.slide(ctx, key)
+	}
 	return
 }
 
-func (b LocalfsBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
-	_, err = b.Head(key)
+// Sliding the expiry is best effort, failing to doesn't fail the read
+func (b LocalfsBackend) slide(ctx context.Context, key string) {
+	if b.sliding > 0 && !b.readOnly {
+		b.Touch(ctx, key, b.sliding)
+	}
+}
+
+// Open the plaintext content of the blob at blobFile
+func (b LocalfsBackend) openContent(blobFile string, metadata backends.Metadata) (io.ReadCloser, error) {
+	blob, err := b.openBlob(blobFile, metadata)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	filePath := path.Join(b.filesPath, key)
-	http.ServeFile(w, r, filePath)
+	if metadata.Compression == "" {
+		return blob, nil
+	}
 
-	return
+	f, err := newDecompressedFile(blob, metadata.Compression)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return f, nil
 }
 
-func (b LocalfsBackend) writeMetadata(key string, metadata backends.Metadata) error {
-	metaPath := path.Join(b.metaPath, key)
-
-	mjson := MetadataJSON{
-		DeleteKey:    metadata.DeleteKey,
-		AccessKey:    metadata.AccessKey,
-		Mimetype:     metadata.Mimetype,
-		ArchiveFiles: metadata.ArchiveFiles,
-		OriginalName: metadata.OriginalName,
-		Sha256sum:    metadata.Sha256sum,
-		Expiry:       metadata.Expiry.Unix(),
-		Size:         metadata.Size,
-		SrcIp:        metadata.SrcIp,
-		
+func (b LocalfsBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	m, f, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, err
 	}
 
-	dst, err := os.Create(metaPath)
+	length, err = backends.RangeLength(m.Size, offset, length)
 	if err != nil {
-		return err
+		f.Close()
+		return nil, err
 	}
-	defer dst.Close()
 
-	encoder := json.NewEncoder(dst)
-	err = encoder.Encode(mjson)
+	// Compressed blobs can only be read forwards, everything else seeks
+	if seeker, ok := f.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, f, offset)
+	}
 	if err != nil {
-		os.Remove(metaPath)
-		return err
+		f.Close()
+		return nil, err
 	}
 
-	return nil
+	return backends.LimitReadCloser(f, length), nil
 }
 
-func (b LocalfsBackend) Put(key string, r io.Reader, expiryTime time.Duration, deleteKey, accessKey string, srcIp string, originalName string) (m backends.Metadata, err error) {
-	filePath := path.Join(b.filesPath, key)
+// Open the blob at blobFile as it is stored, decrypted if it is encrypted
+// but still compressed if it is compressed
+func (b LocalfsBackend) openBlob(blobFile string, metadata backends.Metadata) (io.ReadCloser, error) {
+	blob, offset, err := b.openStoredBlob(blobFile)
+	if os.IsNotExist(err) {
+		return nil, backends.OrphanedMetadataErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	if metadata.Nonce == "" {
+		if !b.singleFile {
+			return blob, nil
+		}
 
-	hasher := sha256.New()
-	dst, err := os.Create(filePath)
+		fileInfo, err := blob.Stat()
+		if err != nil {
+			blob.Close()
+			return nil, err
+		}
+		return blobSection{io.NewSectionReader(blob, offset, fileInfo.Size()-offset), blob}, nil
+	}
+
+	f, err := b.newDecryptedFile(blob, offset, metadata)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (b LocalfsBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
+	metadata, err := b.Head(r.Context(), key)
 	if err != nil {
 		return
 	}
-	defer dst.Close()
 
-	bytes, err := io.Copy(dst, io.TeeReader(r, hasher))
-	if bytes == 0 {
-		os.Remove(filePath)
-		return m, backends.FileEmptyError
+	backends.SetServeHeaders(w, r, key, metadata)
+	w = backends.ThrottleDownload(w, r, metadata)
+
+	filePath := b.blobPath(key)
+	fileInfo, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return backends.OrphanedMetadataErr
 	} else if err != nil {
-		os.Remove(filePath)
-		return m, err
-	} else if bytes >= backends.Limits.MaxSize {
-		os.Remove(filePath)
-		return m, backends.FileTooLargeError
+		return
+	}
+
+	if metadata.Compression != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	// Send gzip blobs as they are to clients that accept them, unless a
+	// range of the uncompressed content is asked for. The gzipped bytes
+	// are a different representation, so they need their own ETag.
+	passthrough := metadata.Compression == compressionGzip && r.Header.Get("Range") == "" && backends.AcceptsGzip(r)
+	// Compressing text on the fly is left to the proxy when it serves the
+	// file itself, which it can't do for throttled downloads. Files that
+	// can only be served so many times are expired once served, which
+	// mustn't happen before the proxy is done.
+	sendfile := b.canSendfile(metadata.Nonce, metadata.Compression) && backends.DownloadRate(metadata) == 0 && metadata.MaxDownloads == 0
+	if passthrough {
+		metadata.ETag = backends.GzipETag(metadata.ETag)
+	} else if !sendfile {
+		var finish func() error
+		w, finish = backends.GzipText(w, r, &metadata)
+		defer finish()
 	}
 
-	var fileExpiry time.Time
-	maxDurationTime := time.Duration(backends.Limits.MaxDurationTime) * time.Second
-	if expiryTime == 0 {
-		if bytes > backends.Limits.MaxDurationSize && maxDurationTime > 0 {
-			fileExpiry = time.Now().Add(maxDurationTime)
+	if backends.CheckPreconditions(w, r, metadata) {
+		return nil
+	}
+
+	// Count only requests for the start of the file, rather than every
+	// range a player or download manager asks for
+	if b.readOnly {
+		if metadata.MaxDownloads > 0 {
+			return backends.ReadOnlyErr
+		}
+	} else if rng := httputil.RangeHeader(w, r); rng == "" || strings.HasPrefix(rng, "bytes=0-") {
+		last, err := b.takeDownload(r.Context(), key)
+		if err != nil {
+			return err
+		}
+		if last {
+			// Expiring it any sooner could have it deleted before
+			// it's read
+			defer b.expireNow(context.WithoutCancel(r.Context()), key)
 		} else {
-			fileExpiry = expiry.NeverExpire
+			b.slide(r.Context(), key)
 		}
-	} else {
-		if bytes > backends.Limits.MaxDurationSize && expiryTime > maxDurationTime {
-			fileExpiry = time.Now().Add(maxDurationTime)
+	} else if metadata.DownloadsExhausted() {
+		return backends.NotFoundErr
+	}
+
+	if passthrough {
+		f, err := b.openBlob(filePath, metadata)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		if section, ok := f.(blobSection); ok {
+			w.Header().Set("Content-Length", strconv.FormatInt(section.Size(), 10))
+		} else if metadata.Nonce == "" {
+			w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
 		} else {
-			fileExpiry = time.Now().Add(expiryTime)
+			w.Header().Del("Content-Length")
 		}
+
+		_, err = io.Copy(w, f)
+		return err
 	}
 
-	dst.Seek(0, 0)
-	// Get first 512 bytes for mimetype detection
-	header := make([]byte, 512)
-	headerlen, err := dst.Read(header)
-	if err != nil {
-		os.Remove(filePath)
-		return
+	// Blobs starting with a header can't be served as files either
+	if metadata.Nonce != "" || metadata.Compression != "" || b.singleFile {
+		// Not with Get, which refuses the file once its last download
+		// was counted
+		f, err := b.openContent(filePath, metadata)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return backends.ServeReader(w, r, f, metadata.Size, metadata.Mimetype)
 	}
-	// Use the bytes we extracted earlier and attempt to determine the file
-	// type
-	kind := mimetype.Detect(header[:headerlen])
-	m.Mimetype = kind.String()
 
-	dst.Seek(0, 0)
+	if sendfile {
+		return b.sendfileHeader(w, filePath, metadata.Mimetype)
+	}
 
-  m.Size = bytes
-  m.Sha256sum = hex.EncodeToString(hasher.Sum(nil))
-	m.Expiry = fileExpiry
-	m.DeleteKey = deleteKey
-	m.AccessKey = accessKey
-	m.SrcIp = srcIp
-	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, dst)
-	m.OriginalName = originalName
+	// Throttled downloads are copied through the throttled writer by
+	// ServeReader, which honors ranges the same way http.ServeFile does
+	if backends.DownloadRate(metadata) > 0 {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
 
-	err = b.writeMetadata(key, m)
-	if err != nil {
-		os.Remove(filePath)
-		return
+		return backends.ServeReader(w, r, f, metadata.Size, metadata.Mimetype)
 	}
 
+	http.ServeFile(w, r, filePath)
+
 	return
 }
 
-func (b LocalfsBackend) PutMetadata(key string, m backends.Metadata) (err error) {
-	err = b.writeMetadata(key, m)
-	if err != nil {
-		return
+// A copy of the backend with ReadOnly set, for NewReadOnlyMetaBackend
+func (b LocalfsBackend) ReadOnly() backends.MetaStorageBackend {
+	b.readOnly = true
+	return b
+}
+
+// Viewing a thumbnail, variant or archive entry keeps the file from
+// expiring as downloading it does, but isn't counted as a download
+func (b LocalfsBackend) ServeThumbnail(key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error {
+	err := backends.ServeThumbnail(b, key, w, r, maxWidth, maxHeight)
+	if err == nil {
+		b.slide(r.Context(), key)
 	}
+	return err
+}
 
-	return
+func (b LocalfsBackend) ServeImageVariant(key string, w http.ResponseWriter, r *http.Request) error {
+	err := backends.ServeImageVariant(b, key, w, r)
+	if err == nil {
+		b.slide(r.Context(), key)
+	}
+	return err
 }
 
-func (b LocalfsBackend) Size(key string) (int64, error) {
-	fileInfo, err := os.Stat(path.Join(b.filesPath, key))
-	if err != nil {
-		return 0, err
+func (b LocalfsBackend) ServeArchiveEntry(key string, entryPath string, w http.ResponseWriter, r *http.Request) error {
+	err := backends.ServeArchiveEntry(b, key, entryPath, w, r)
+	if err == nil {
+		b.slide(r.Context(), key)
 	}
+	return err
+}
 
-	return fileInfo.Size(), nil
+func (b LocalfsBackend) ArchiveFS(key string) (fs.FS, error) {
+	return backends.ArchiveFS(b, key)
 }
 
-func (b LocalfsBackend) List() ([]string, error) {
-	var output []string
+func (b LocalfsBackend) Preview(ctx context.Context, key string, maxBytes int) (string, bool, error) {
+	return backends.Preview(ctx, b, key, maxBytes)
+}
+
+func (b LocalfsBackend) writeMetadata(key string, metadata backends.Metadata) error {
+	return b.writeBlobMetadata(key, metadata, b.recordedBlob(key))
+}
 
-	files, err := os.ReadDir(b.filesPath)
+// Like writeMetadata, recording that the blob of key is at the path
+// relative to filesPath rather than where blobPath would otherwise look.
+// Running out of space returns StorageFullErr.
+func (b LocalfsBackend) writeBlobMetadata(key string, metadata backends.Metadata, recorded string) error {
+	mjson, err := b.encodeMetadata(key, metadata)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	mjson.Blob = recorded
+
+	b.downloadsLock.Lock()
+	defer b.downloadsLock.Unlock()
 
-	for _, file := range files {
-		output = append(output, file.Name())
+	// Downloads are only ever counted up, so a lower count than the one
+	// stored for the same file was read before downloads that finished
+	// since, which would be lost
+	if current, err := b.readMetadata(path.Join(b.metaPath, key), b.blobPath(key)); err == nil && current.PublicID == metadata.PublicID {
+		mjson.Downloads = max(mjson.Downloads, current.Downloads+b.pendingDownloads(key))
 	}
 
-	return output, nil
+	if b.singleFile {
+		err = b.rewriteHeader(key, mjson)
+	} else {
+		err = b.writeMetadataFile(key, mjson)
+	}
+	if err != nil {
+		return backends.CheckStorageFull(err)
+	}
+
+	if err = b.indexPublicID(metadata.PublicID, key); err != nil {
+		return backends.CheckStorageFull(err)
+	}
+
+	// metadata.Downloads already includes the pending downloads
+	return backends.CheckStorageFull(b.resetDownloads(key))
 }
 
-func NewLocalfsBackend(metaPath string, filesPath string) LocalfsBackend {
-	return LocalfsBackend{
-		metaPath:  metaPath,
-		filesPath: filesPath,
+// The metadata of key as it's stored, with keys hashed and IPs anonymized
+// if enabled
+func (b LocalfsBackend) encodeMetadata(key string, metadata backends.Metadata) (mjson MetadataJSON, err error) {
+	if err = b.checkPaths(key); err != nil {
+		return
+	}
+	if err = backends.CheckCustom(metadata.Custom); err != nil {
+		return
+	}
+	if err = backends.CheckTags(metadata.Tags); err != nil {
+		return
+	}
+
+	mjson = MetadataJSON{
+		PublicID:         metadata.PublicID,
+		DeleteKey:        metadata.DeleteKey,
+		AccessKey:        metadata.AccessKey,
+		Mimetype:         metadata.Mimetype,
+		ArchiveFiles:     metadata.ArchiveFiles,
+		ArchiveTruncated: metadata.ArchiveTruncated,
+		ArchiveOmitted:   metadata.ArchiveOmitted,
+		OriginalName:     metadata.OriginalName,
+		Sha256sum:        metadata.Sha256sum,
+		Checksums:        metadata.Checksums,
+		Expiry:           metadata.Expiry.Unix(),
+		Size:             metadata.Size,
+		SrcIp:            metadata.SrcIp,
+		Nonce:            metadata.Nonce,
+		Downloads:        metadata.Downloads,
+		MaxDownloads:     metadata.MaxDownloads,
+		Compression:      metadata.Compression,
+		Custom:           metadata.Custom,
+		Tags:             metadata.Tags,
+		DownloadRate:     metadata.DownloadRate,
+		Version:          metadataVersion,
+	}
+	if metadata.Encryption.Scheme != "" {
+		mjson.Encryption = &metadata.Encryption
+	}
+	if b.hashKeys {
+		if mjson.DeleteKey, err = backends.HashKey(metadata.DeleteKey); err != nil {
+			return
+		}
+		if mjson.AccessKey, err = backends.HashKey(metadata.AccessKey); err != nil {
+			return
+		}
 	}
+	if b.anonymizeIP {
+		mjson.SrcIp = backends.AnonymizeIP(metadata.SrcIp)
+	}
+	if !metadata.RetainUntil.IsZero() {
+		mjson.RetainUntil = metadata.RetainUntil.Unix()
+	}
+	if !metadata.AccessKeyExpiry.IsZero() {
+		mjson.AccessKeyExpiry = metadata.AccessKeyExpiry.Unix()
+	}
+	if !metadata.Uploaded.IsZero() {
+		mjson.Uploaded = metadata.Uploaded.Unix()
+	}
+
+	return
+}
+
+func (b LocalfsBackend) writeMetadataFile(key string, mjson MetadataJSON) error {
+	metaPath := path.Join(b.metaPath, key)
+
+	dst, err := b.createFile(b.metaPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	encoder := json.NewEncoder(dst)
+	err = encoder.Encode(mjson)
+	if err == nil {
+		err = b.syncFile(dst)
+	}
+	if err == nil {
+		err = dst.Close()
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), metaPath)
+	}
+	if err == nil {
+		err = b.syncDir(b.metaPath)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
+
+// The URL is served by linx-server itself, which checks its signature
+// with backends.VerifySignedURL
+func (b LocalfsBackend) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if len(b.presignKey) == 0 {
+		return "", backends.NotSupportedErr
+	}
+
+	metadata, err := b.Head(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	q := backends.SignURL(b.presignKey, key, time.Now().Add(ttl))
+	if metadata.OriginalName != "" {
+		q.Set("download", "")
+	}
+	return b.presignURL + key + "?" + q.Encode(), nil
+}
+
+func (b LocalfsBackend) Put(ctx context.Context, key string, r io.Reader, expiryTime time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (m backends.Metadata, err error) {
+	// The partial blob is removed on the way out like for any other
+	// error, but a full disk is worth telling apart
+	defer func() {
+		err = backends.CheckStorageFull(err)
+	}()
+
+	if err = b.checkPaths(key); err != nil {
+		return
+	}
+	if expiryTime, err = backends.AllowedExpiry(expiryTime); err != nil {
+		return
+	}
+	if err = b.checkRetention(ctx, key); err != nil {
+		return
+	}
+	done, err := b.files.Check(ctx, b, key)
+	if err != nil {
+		return
+	}
+	defer done(false)
+	defer b.stats.Invalidate()
+
+	// Checked again when the metadata is written, but by then the whole
+	// file would have been stored for nothing
+	if err = backends.CheckCustom(o.Custom); err != nil {
+		return
+	}
+	if err = backends.CheckTags(o.Tags); err != nil {
+		return
+	}
+
+	if !o.Overwrite {
+		if err = b.reserveBlob(key); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				os.Remove(b.shardedPath(key))
+			}
+		}()
+	}
+
+	// The key's previous content stays in the dedup index until the new
+	// blob is in place, so that a Put failing on the way keeps it findable
+	var oldSum string
+	if b.dedup {
+		if old, err := b.Head(ctx, key); err == nil {
+			oldSum = old.Sha256sum
+		}
+	}
+
+	hasher := sha256.New()
+	checksummer := backends.NewChecksummer()
+
+	// Write to a temporary file that is renamed into place once complete,
+	// which also leaves any previous blob that is hardlinked to a copy
+	// under another key untouched
+	dst, err := b.createFile(b.filesPath)
+	if err != nil {
+		return
+	}
+	cleanupPath := dst.Name()
+	defer func() {
+		dst.Close()
+		if err != nil {
+			os.Remove(cleanupPath)
+		}
+	}()
+
+	// Encrypt on the way to disk, the sha256sum is still computed over
+	// the plaintext
+	var w io.Writer = dst
+	var enc *encryptWriter
+	if b.aead != nil {
+		nonce, err := newNonce(b.aead)
+		if err != nil {
+			return m, err
+		}
+		enc = newEncryptWriter(dst, b.aead, nonce)
+		w = enc
+		m.Nonce = hex.EncodeToString(nonce)
+	}
+
+	// Stop writing as soon as the request is cancelled, comes in too
+	// slowly or the file grows past MaxSize, the temporary file is
+	// removed on the way out
+	src := backends.MinRateReader(helpers.NewContextReader(ctx, r), backends.Limits.MinUploadRate, backends.Limits.MinUploadRateWindow)
+	src = backends.LimitedReader(src, backends.Limits.MaxSize)
+
+	// Detect the mimetype up front, as it decides whether the file is
+	// worth compressing. Content encrypted by the client is opaque and
+	// wouldn't compress anyway.
+	if o.Encryption.Scheme != "" {
+		m.Mimetype = helpers.OpaqueMimetype
+	} else {
+		var sniffed bytes.Buffer
+		m.Mimetype, err = helpers.DetectMimetype(io.TeeReader(src, &sniffed))
+		if err != nil {
+			return
+		}
+		m.Mimetype = helpers.RefineMimetype(m.Mimetype, originalName, key)
+		src = io.MultiReader(&sniffed, src)
+	}
+
+	var comp io.WriteCloser
+	if b.compression != "" && o.Encryption.Scheme == "" && compressible(m.Mimetype) {
+		comp, err = newCompressWriter(w, b.compression)
+		if err != nil {
+			return
+		}
+		w = comp
+		m.Compression = b.compression
+	}
+
+	written, err := io.Copy(w, io.TeeReader(src, io.MultiWriter(hasher, checksummer)))
+	if err == nil && comp != nil {
+		err = comp.Close()
+	}
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		return m, err
+	} else if written == 0 {
+		return m, backends.FileEmptyError
+	}
+
+	m.Size = written
+
+	// The blob is removed on the way out
+	if err = backends.CheckMimeSize(m.Mimetype, written); err != nil {
+		return
+	}
+	m.Sha256sum = hex.EncodeToString(hasher.Sum(nil))
+	m.Checksums = checksummer.Sums()
+	if err = backends.CheckSha256(o.ExpectedSha256, m.Sha256sum); err != nil {
+		return
+	}
+
+	// Read back the plaintext for scanning and archive listing
+	var plain helpers.ReadSeekerAt = dst
+	if enc != nil {
+		plain, err = b.newDecryptedFile(dst, 0, m)
+		if err != nil {
+			return
+		}
+	}
+
+	if b.scanner != nil {
+		plain.Seek(0, 0)
+		var content io.ReadCloser = io.NopCloser(plain)
+		if m.Compression != "" {
+			content, err = newDecompressedFile(content, m.Compression)
+			if err != nil {
+				return
+			}
+		}
+
+		err = backends.ScanFile(b.scanner, content)
+		content.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	plain.Seek(0, 0)
+	if m.Compression == "" {
+		m.ArchiveFiles, m.ArchiveTruncated, m.ArchiveOmitted, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, plain)
+	} else if m.Mimetype == "application/x-tar" {
+		// Other archives are already compressed, but tar archives can
+		// still be listed by decompressing them sequentially
+		dec, err := newDecompressedFile(io.NopCloser(plain), m.Compression)
+		if err == nil {
+			m.ArchiveFiles, m.ArchiveTruncated, m.ArchiveOmitted = helpers.ListTarFiles(dec)
+			dec.Close()
+		}
+	}
+
+	m.Expiry = backends.FileExpiry(expiryTime, written)
+	m.DeleteKey = deleteKey
+	m.AccessKey = accessKey
+	m.SrcIp = srcIp
+	m.PublicID = backends.NewPublicID()
+	m.OriginalName, m.Custom = backends.SanitizeOriginalName(originalName, o.Custom)
+	m.Tags = o.Tags
+	m.Encryption = o.Encryption
+	m.MaxDownloads = o.MaxDownloads
+	m.RetainUntil = o.RetainUntil
+	m.Uploaded = time.Now()
+
+	if b.singleFile {
+		err = b.putSingleFile(key, m, dst)
+		if err == nil {
+			os.Remove(dst.Name())
+			done(true)
+			err = b.indexPublicID(m.PublicID, key)
+		}
+		return
+	}
+
+	if err = b.syncFile(dst); err != nil {
+		return
+	}
+	// The reservation, or the blob this overwrites, unless the new blob
+	// takes its place
+	prevPath := b.blobPath(key)
+	blobPath, recorded := b.newBlobPath(key, m.Mimetype)
+	err = b.renameBlobTo(dst.Name(), key, blobPath)
+	if err != nil {
+		return
+	}
+	cleanupPath = blobPath
+
+	if b.dedup {
+		canonical, linked, err := b.dedupBlob(ctx, key, blobPath, m.Sha256sum)
+		if err != nil {
+			return m, err
+		}
+		if linked {
+			m.Nonce = canonical.Nonce
+			m.Compression = canonical.Compression
+		}
+	}
+
+	err = b.writeBlobMetadata(key, m, recorded)
+	if err != nil {
+		// The blob is removed on the way out, so metadata that made it to
+		// disk before the rest failed would be orphaned
+		if b.blobPath(key) == blobPath {
+			os.Remove(path.Join(b.metaPath, key))
+			b.unindexPublicID(m.PublicID, key)
+		}
+		if b.dedup && oldSum != m.Sha256sum {
+			b.dedupUnref(key, m.Sha256sum)
+		}
+		return
+	}
+
+	if prevPath != blobPath {
+		os.Remove(prevPath)
+	}
+	done(true)
+
+	// The file is stored either way, and a reference left behind is
+	// skipped by dedupBlob and FindBySha256 as its sum no longer matches
+	if oldSum != "" && oldSum != m.Sha256sum {
+		b.dedupUnref(key, oldSum)
+	}
+	return
+}
+
+func (b LocalfsBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) (err error) {
+	if err = b.checkRetention(ctx, key); err != nil {
+		return
+	}
+	defer b.stats.Invalidate()
+
+	err = b.writeMetadata(key, m)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (b LocalfsBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	if err := b.checkPaths(newKey); err != nil {
+		return err
+	}
+
+	m, err := b.Head(ctx, oldKey)
+	if err != nil {
+		return err
+	}
+	if m.RetentionLocked() {
+		return backends.RetentionLockedErr
+	}
+
+	if _, err := os.Lstat(path.Join(b.metaPath, newKey)); err == nil {
+		return backends.KeyExistsErr
+	}
+	if _, err := os.Lstat(b.blobPath(newKey)); err == nil {
+		return backends.KeyExistsErr
+	}
+
+	oldPath := b.blobPath(oldKey)
+	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+		return backends.OrphanedMetadataErr
+	} else if err != nil {
+		return err
+	}
+
+	newPath, recorded := b.newBlobPath(newKey, m.Mimetype)
+	if err := b.renameBlobTo(oldPath, newKey, newPath); err != nil {
+		return err
+	}
+
+	if !b.singleFile {
+		err = os.Rename(path.Join(b.metaPath, oldKey), path.Join(b.metaPath, newKey))
+		if err == nil {
+			err = b.recordBlob(newKey, recorded)
+		}
+		if err != nil {
+			// Put the blob back so the old key stays whole
+			os.Rename(path.Join(b.metaPath, newKey), path.Join(b.metaPath, oldKey))
+			os.Rename(newPath, oldPath)
+			return err
+		}
+	}
+	os.Rename(b.downloadsPath(oldKey), b.downloadsPath(newKey))
+
+	// The public ID moves with the file, which is what it's for
+	if err := b.indexPublicID(m.PublicID, newKey); err != nil {
+		return err
+	}
+
+	if b.dedup {
+		b.dedupUnref(oldKey, m.Sha256sum)
+		return b.dedupRef(newKey, m.Sha256sum)
+	}
+	return nil
+}
+
+func (b LocalfsBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if m.RetentionLocked() {
+		return backends.RetentionLockedErr
+	}
+	if err := backends.CheckExpiry(m.Size, newExpiry); err != nil {
+		return err
+	}
+
+	m.Expiry = newExpiry
+	return b.writeMetadata(key, m)
+}
+
+func (b LocalfsBackend) Touch(ctx context.Context, key string, extend time.Duration) error {
+	return backends.Touch(ctx, b, key, extend)
+}
+
+func (b LocalfsBackend) GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error {
+	return backends.GrantAccess(ctx, b, key, accessKey, until)
+}
+
+func (b LocalfsBackend) Size(ctx context.Context, key string) (int64, error) {
+	if err := b.checkPaths(key); err != nil {
+		return 0, err
+	}
+
+	f, offset, err := b.openStoredBlob(b.blobPath(key))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return fileInfo.Size() - offset, nil
+}
+
+// Get decrypts the blob if needed, so the plaintext is what gets hashed
+func (b LocalfsBackend) VerifyChecksum(ctx context.Context, key string) (bool, string, error) {
+	ok, computed, err := backends.VerifyChecksum(ctx, b, key)
+	if errors.Is(err, errChunkCorrupted) {
+		// A corrupted encrypted blob can't be decrypted to hash it, but
+		// it's just as much a mismatch
+		return false, "", nil
+	}
+	return ok, computed, err
+}
+
+// Computed from every file's metadata, then kept until a file is added,
+// changed or deleted through this backend
+func (b LocalfsBackend) Stats(ctx context.Context) (backends.Stats, error) {
+	return b.stats.Get(ctx, b)
+}
+
+func (b LocalfsBackend) List(ctx context.Context) ([]string, error) {
+	var output []string
+
+	err := b.walkBlobs(func(key string, _ string) error {
+		output = append(output, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// Keys are sorted by name, so the cursor is the last key of the previous
+// page. Only the first limit keys after it are kept while walking, so a
+// page costs a walk of the files directory but not memory for every key.
+func (b LocalfsBackend) ListPaginated(ctx context.Context, cursor string, limit int) (keys []string, nextCursor string, err error) {
+	more := false
+	trim := func() {
+		sort.Strings(keys)
+		if limit > 0 && len(keys) > limit {
+			keys = keys[:limit]
+			more = true
+		}
+	}
+
+	err = b.walkBlobs(func(key string, _ string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if key <= cursor {
+			return nil
+		}
+
+		keys = append(keys, key)
+		if limit > 0 && len(keys) >= 2*limit {
+			trim()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	trim()
+	if more {
+		nextCursor = keys[len(keys)-1]
+	}
+	return
+}
+
+// Create a temporary file in dir, to be renamed into place once completely
+// written so that a partial file never shows up under its final name. Being
+// in the same directory as its destination, it is always on the same
+// filesystem, as os.Rename requires.
+func createTemp(dir string) (*os.File, error) {
+	tmpPath := path.Join(dir, tempPrefix+uniuri.New())
+	return os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+const tempPrefix = ".tmp-"
+
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+func (b LocalfsBackend) copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := b.createFile(path.Dir(dstPath))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = b.syncFile(dst)
+	}
+	if err == nil {
+		err = dst.Close()
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), dstPath)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
+
+func (b LocalfsBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	type expiring struct {
+		key    string
+		expiry int64
+	}
+	var found []expiring
+
+	keys, err := b.metadataKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		ts, err := b.readExpiry(key)
+		if err != nil || ts == expiry.NeverExpire.Unix() {
+			continue
+		}
+
+		if time.Unix(ts, 0).Before(before) {
+			found = append(found, expiring{key, ts})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].expiry < found[j].expiry
+	})
+
+	output := make([]string, len(found))
+	for i, f := range found {
+		output[i] = f.key
+	}
+
+	return output, nil
+}
+
+// Like ListExpired, only the fields filtered on are decoded from each
+// metadata file. Files uploaded before the upload time was recorded are
+// read in full, for it to fall back to their blob's modification time.
+func (b LocalfsBackend) Query(ctx context.Context, filter backends.ListFilter) ([]string, error) {
+	keys, err := b.metadataKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var output []string
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		m, err := b.readQueryFields(key)
+		if err == nil && m.Uploaded.IsZero() && !filter.UploadedAfter.IsZero() {
+			m, err = b.Head(ctx, key)
+		}
+		if err != nil {
+			continue
+		}
+
+		if filter.Matches(m) {
+			output = append(output, key)
+		}
+	}
+
+	sort.Strings(output)
+	return output, nil
+}
+
+// Decode only the fields ListFilter matches on out of a metadata file
+func (b LocalfsBackend) readQueryFields(key string) (m backends.Metadata, err error) {
+	f, err := b.openKeyMetadata(key)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var mjson struct {
+		Sha256sum string `json:"sha256sum"`
+		Mimetype  string `json:"mimetype"`
+		Size      int64  `json:"size"`
+		Uploaded  int64  `json:"uploaded,omitempty"`
+	}
+	if err = json.NewDecoder(f).Decode(&mjson); err != nil {
+		return
+	}
+
+	m.Sha256sum = mjson.Sha256sum
+	m.Mimetype = mjson.Mimetype
+	m.Size = mjson.Size
+	if mjson.Uploaded != 0 {
+		m.Uploaded = time.Unix(mjson.Uploaded, 0)
+	}
+	return
+}
+
+// Decode only the expiry out of a metadata file
+func (b LocalfsBackend) readExpiry(key string) (int64, error) {
+	f, err := b.openKeyMetadata(key)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var mjson struct {
+		Expiry int64 `json:"expiry"`
+	}
+	err = json.NewDecoder(f).Decode(&mjson)
+	return mjson.Expiry, err
+}
+
+func NewLocalfsBackend(metaPath string, filesPath string) LocalfsBackend {
+	b, _ := NewLocalfsBackendWithOptions(metaPath, filesPath, LocalfsOptions{})
+	return b
+}
+
+func NewLocalfsBackendWithOptions(metaPath string, filesPath string, o LocalfsOptions) (LocalfsBackend, error) {
+	b := LocalfsBackend{
+		metaPath:      metaPath,
+		filesPath:     filesPath,
+		dedup:         o.Dedup,
+		dedupLock:     &sync.Mutex{},
+		downloadsLock: &sync.Mutex{},
+		uploadLocks:   newKeyLocks(),
+		shardDepth:    o.ShardDepth,
+		compression:   o.Compression,
+		hashKeys:      o.HashKeys,
+		presignKey:    o.PresignKey,
+		presignURL:    o.PresignURL,
+		softDelete:    o.SoftDelete,
+		scanner:       o.Scanner,
+		anonymizeIP:   o.AnonymizeIP,
+		sliding:       o.SlidingExpiry,
+		singleFile:    o.SingleFile,
+		extensions:    o.BlobExtensions,
+		fileMode:      o.FileMode,
+		dirMode:       o.DirMode,
+		durable:       o.Durable,
+		readOnly:      o.ReadOnly,
+		stats:         backends.NewStatsCache(),
+		files:         backends.NewFileCounter(),
+	}
+
+	if b.compression != "" && b.compression != compressionGzip && b.compression != compressionZstd {
+		return b, errUnknownCompression
+	}
+	if b.singleFile && b.dedup {
+		return b, errSingleFileDedup
+	}
+	if b.singleFile && b.extensions {
+		return b, errSingleFileBlobExtensions
+	}
+
+	var err error
+	b.sendfile, b.sendfilePrefix, err = sendfileOptions(o.Sendfile, o.SendfilePrefix, filesPath)
+	if err != nil {
+		return b, err
+	}
+
+	if len(o.EncryptionKey) > 0 {
+		aead, err := newAEAD(o.EncryptionKey)
+		if err != nil {
+			return b, err
+		}
+		b.aead = aead
+	}
+
+	if b.dedup {
+		err := os.MkdirAll(path.Join(metaPath, dedupIndexDir), 0700)
+		if err != nil {
+			return b, err
+		}
+	}
+
+	return b, nil
 }
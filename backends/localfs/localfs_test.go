@@ -0,0 +1,263 @@
+package localfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+func newTestBackend(t *testing.T, o LocalfsOptions) LocalfsBackend {
+	backends.Limits.MaxSize = 1024 * 1024
+
+	dir := t.TempDir()
+	for _, sub := range []string{"meta", "files"} {
+		if err := os.Mkdir(path.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := NewLocalfsBackendWithOptions(path.Join(dir, "meta"), path.Join(dir, "files"), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func serve(b LocalfsBackend, key string) error {
+	return b.ServeFile(key, httptest.NewRecorder(), httptest.NewRequest("GET", "/"+key, nil))
+}
+
+// The content of key as Get returns it
+func read(t *testing.T, b LocalfsBackend, key string) string {
+	t.Helper()
+	_, f, err := b.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestMaxDownloads(t *testing.T) {
+	ctx := context.Background()
+
+	for _, o := range []LocalfsOptions{{}, {Compression: compressionGzip}} {
+		b := newTestBackend(t, o)
+		_, err := b.Put(ctx, "once.txt", strings.NewReader(strings.Repeat("read me ", 100)), 0, "", "", "", "", backends.PutOptions{MaxDownloads: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := serve(b, "once.txt"); err != nil {
+				t.Fatalf("Download %d failed: %v", i+1, err)
+			}
+		}
+		if err := serve(b, "once.txt"); err != backends.NotFoundErr {
+			t.Errorf("Download past the limit returned %v", err)
+		}
+		if _, _, err := b.Get(ctx, "once.txt"); err != backends.NotFoundErr {
+			t.Errorf("Get past the limit returned %v", err)
+		}
+	}
+}
+
+func TestMaxDownloadsConcurrent(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{})
+	if _, err := b.Put(ctx, "few.txt", strings.NewReader("contents"), 0, "", "", "", "", backends.PutOptions{MaxDownloads: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- serve(b, "few.txt")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	served := 0
+	for err := range errs {
+		if err == nil {
+			served++
+		} else if err != backends.NotFoundErr {
+			t.Error(err)
+		}
+	}
+	if served != 3 {
+		t.Errorf("File limited to 3 downloads was served %d times", served)
+	}
+	if err := serve(b, "few.txt"); err != backends.NotFoundErr {
+		t.Errorf("Download past the limit returned %v", err)
+	}
+}
+
+func TestMaxFilesConcurrent(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{})
+	backends.Limits.MaxFiles = 3
+	defer func() { backends.Limits.MaxFiles = 0 }()
+
+	if _, err := b.Put(ctx, "first.txt", strings.NewReader("first"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("file-%d.txt", i)
+			_, err := b.Put(ctx, key, tricklingReader{strings.NewReader(key)}, 0, "", "", "", "", backends.PutOptions{})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	stored := 0
+	for err := range errs {
+		if err == nil {
+			stored++
+		} else if err != backends.TooManyFilesError {
+			t.Error(err)
+		}
+	}
+	if stored != 2 {
+		t.Errorf("%d files were stored with room for 2", stored)
+	}
+}
+
+func TestCopyOntoExisting(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{Dedup: true})
+	// Replacing dst used to count it as another file
+	backends.Limits.MaxFiles = 3
+	defer func() { backends.Limits.MaxFiles = 0 }()
+
+	if _, err := b.Put(ctx, "src", strings.NewReader("source"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := b.Put(ctx, "dst", strings.NewReader("destination"), 0, "", "", "", "", backends.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Copy(ctx, "src", "dst"); err != backends.KeyExistsErr {
+		t.Fatalf("Copy onto an existing key returned %v", err)
+	}
+	m, f, err := b.Get(ctx, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if content, _ := io.ReadAll(f); string(content) != "destination" || m.PublicID != dst.PublicID {
+		t.Errorf("Destination was replaced with %q", content)
+	}
+
+	if _, err := b.Copy(ctx, "src", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := b.List(ctx); err != nil || len(keys) != 3 {
+		t.Errorf("Expected 3 files, got %v, %v", keys, err)
+	}
+}
+
+func TestSlidingExpiry(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{SlidingExpiry: 24 * time.Hour})
+	if _, err := b.Put(ctx, "slide.txt", strings.NewReader("contents"), time.Hour, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := func() time.Time {
+		m, err := b.Head(ctx, "slide.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Expiry
+	}
+	stored := expiry()
+
+	_, f, err := b.Get(ctx, "slide.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	b.VerifyChecksum(ctx, "slide.txt")
+	b.Preview(ctx, "slide.txt", 100)
+	if got := expiry(); !got.Equal(stored) {
+		t.Errorf("Internal reads moved the expiry from %v to %v", stored, got)
+	}
+
+	_, f, err = b.Get(backends.WithServing(ctx), "slide.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if got := expiry(); !got.After(stored.Add(time.Hour)) {
+		t.Errorf("Serving with Get left the expiry at %v", got)
+	}
+
+	if err := b.SetExpiry(ctx, "slide.txt", stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := serve(b, "slide.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := expiry(); !got.After(stored.Add(time.Hour)) {
+		t.Errorf("ServeFile left the expiry at %v", got)
+	}
+}
+
+func TestCachedSlidingExpiry(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{SlidingExpiry: 24 * time.Hour})
+	c := backends.NewCachingBackend(b, time.Hour, 0)
+	if _, err := c.Put(ctx, "slide.txt", strings.NewReader("contents"), time.Hour, "", "", "", "", backends.PutOptions{MaxDownloads: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := c.Head(ctx, "slide.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, f, err := c.Get(backends.WithServing(ctx), "slide.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if m, _ := c.Head(ctx, "slide.txt"); !m.Expiry.After(stored.Expiry.Add(time.Hour)) {
+		t.Errorf("The cache kept the expiry at %v after serving with Get", m.Expiry)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.ServeFile("slide.txt", httptest.NewRecorder(), httptest.NewRequest("GET", "/slide.txt", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, _ := c.Head(ctx, "slide.txt"); m.Downloads != 2 || !m.DownloadsExhausted() {
+		t.Errorf("The cache kept %d downloads after serving the last one", m.Downloads)
+	}
+}
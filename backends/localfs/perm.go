@@ -0,0 +1,65 @@
+package localfs
+
+import (
+	"os"
+	"path"
+)
+
+// Permissions of the directories blobs are sharded into, less the umask,
+// when DirMode isn't set
+const defaultDirMode = 0755
+
+// Create a temporary file in dir to be renamed into place as a blob or a
+// metadata file. It gets FileMode exactly if that's set, whatever the
+// umask, or otherwise 0666 less the umask.
+func (b LocalfsBackend) createFile(dir string) (*os.File, error) {
+	f, err := createTemp(dir)
+	if err != nil || b.fileMode == 0 {
+		return f, err
+	}
+
+	if err := f.Chmod(b.fileMode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create dir along with any missing parents, giving those created DirMode
+// exactly if that's set
+func (b LocalfsBackend) mkdirAll(dir string) error {
+	if b.dirMode == 0 && !b.durable {
+		return os.MkdirAll(dir, defaultDirMode)
+	}
+
+	var missing []string
+	for d := dir; ; d = path.Dir(d) {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, d)
+		if path.Dir(d) == d {
+			break
+		}
+	}
+
+	mode := b.dirMode
+	if mode == 0 {
+		mode = defaultDirMode
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if b.dirMode != 0 {
+			if err := os.Chmod(d, b.dirMode); err != nil {
+				return err
+			}
+		}
+		if err := b.syncDir(path.Dir(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
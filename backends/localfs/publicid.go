@@ -0,0 +1,96 @@
+package localfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Files are looked up by public ID through an index with an entry per ID,
+// holding the key of the file it belongs to. Entries can go stale, such as
+// when a file is overwritten or soft deleted, so lookups check the ID
+// against the file's metadata.
+const publicIndexDir = ".public"
+
+func (b LocalfsBackend) publicIndexPath(id string) string {
+	return path.Join(b.metaPath, publicIndexDir, id)
+}
+
+func (b LocalfsBackend) readPublicIndex(id string) (string, error) {
+	key, err := os.ReadFile(b.publicIndexPath(id))
+	if os.IsNotExist(err) {
+		return "", backends.NotFoundErr
+	}
+	return strings.TrimSpace(string(key)), err
+}
+
+// Point the index entry for id at key, unless it already does
+func (b LocalfsBackend) indexPublicID(id string, key string) error {
+	if !backends.IsPublicID(id) {
+		return nil
+	}
+	if indexed, err := b.readPublicIndex(id); err == nil && indexed == key {
+		return nil
+	}
+
+	dir := path.Join(b.metaPath, publicIndexDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	dst, err := createTemp(dir)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = dst.WriteString(key)
+	if err == nil {
+		err = dst.Close()
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), b.publicIndexPath(id))
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
+
+// Remove the index entry for id if it still points at key
+func (b LocalfsBackend) unindexPublicID(id string, key string) error {
+	if !backends.IsPublicID(id) {
+		return nil
+	}
+	if indexed, err := b.readPublicIndex(id); err != nil || indexed != key {
+		return nil
+	}
+
+	err := os.Remove(b.publicIndexPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (b LocalfsBackend) GetByPublicID(ctx context.Context, id string) (string, error) {
+	if !backends.IsPublicID(id) {
+		return "", backends.NotFoundErr
+	}
+
+	key, err := b.readPublicIndex(id)
+	if err != nil {
+		return "", err
+	}
+
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if m.PublicID != id {
+		return "", backends.NotFoundErr
+	}
+	return key, nil
+}
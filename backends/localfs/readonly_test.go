@@ -0,0 +1,89 @@
+package localfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Every file and directory under dirs, with its content and time
+func snapshot(t *testing.T, dirs ...string) map[string]string {
+	files := make(map[string]string)
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files[p] = info.ModTime().String()
+			if !d.IsDir() {
+				content, err := os.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				files[p] += " " + string(content)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func TestReadOnlyBackend(t *testing.T) {
+	ctx := context.Background()
+	plain := newTestBackend(t, LocalfsOptions{})
+	if _, err := plain.Put(ctx, "file.txt", strings.NewReader("contents"), time.Hour, "del", "secret", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Put(ctx, "once.txt", strings.NewReader("contents"), time.Hour, "del", "", "", "", backends.PutOptions{MaxDownloads: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading through this one would otherwise count downloads, slide the
+	// expiry and hash the plaintext access key
+	b, err := NewLocalfsBackendWithOptions(plain.metaPath, plain.filesPath, LocalfsOptions{HashKeys: true, SlidingExpiry: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro := backends.NewReadOnlyMetaBackend(b)
+	before := snapshot(t, plain.metaPath, plain.filesPath)
+
+	w := httptest.NewRecorder()
+	if err := ro.ServeFile("file.txt", w, httptest.NewRequest("GET", "/file.txt", nil)); err != nil || w.Body.String() != "contents" {
+		t.Fatalf("ServeFile returned %q, %v", w.Body.String(), err)
+	}
+	_, f, err := ro.Get(ctx, "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, f)
+	f.Close()
+	if ok, err := ro.CheckAccessKey(ctx, "file.txt", "secret"); err != nil || !ok {
+		t.Fatalf("CheckAccessKey returned %v, %v", ok, err)
+	}
+	if err := ro.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.ServeFile("once.txt", httptest.NewRecorder(), httptest.NewRequest("GET", "/once.txt", nil)); err != backends.ReadOnlyErr {
+		t.Errorf("File limited to a download returned %v", err)
+	}
+
+	if after := snapshot(t, plain.metaPath, plain.filesPath); !reflect.DeepEqual(before, after) {
+		t.Errorf("Reading changed storage from %v to %v", before, after)
+	}
+}
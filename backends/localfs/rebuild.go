@@ -0,0 +1,152 @@
+package localfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// What Rebuild found, and what it fixed
+type RebuildReport struct {
+	// Number of files whose contents were hashed
+	Checked int
+	// Files whose metadata had a missing or wrong sha256sum, which now
+	// has the one computed from their contents
+	Repaired []string
+	// Blobs without any metadata, and metadata without a blob. Neither
+	// is removed, as there's no telling which half is right.
+	OrphanedBlobs    []string
+	OrphanedMetadata []string
+	// Encrypted files that can no longer be decrypted to hash them
+	Corrupted []string
+	// Files that couldn't be checked at all, such as for unreadable
+	// metadata
+	Failed map[string]error
+	// Entries of the dedup index that were rewritten or removed to match
+	// the sha256sums of the files
+	DedupEntriesFixed int
+}
+
+// Check the whole store like fsck would: hash the contents of every file,
+// rewrite metadata whose sha256sum is missing or doesn't match them, find
+// orphaned blobs and metadata, and with dedup enabled rebuild the dedup
+// index from the corrected sums. Nothing should be storing files while this
+// runs.
+func (b LocalfsBackend) Rebuild(ctx context.Context) (report RebuildReport, err error) {
+	report.Failed = make(map[string]error)
+	defer b.stats.Invalidate()
+
+	keys, err := b.metadataKeys()
+	if err != nil {
+		return
+	}
+
+	sums := make(map[string][]string)
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		m, err := b.Head(ctx, key)
+		if err != nil {
+			report.Failed[key] = err
+			continue
+		}
+
+		ok, computed, err := backends.VerifyChecksum(ctx, b, key)
+		if err == backends.OrphanedMetadataErr {
+			report.OrphanedMetadata = append(report.OrphanedMetadata, key)
+			continue
+		} else if errors.Is(err, errChunkCorrupted) {
+			report.Corrupted = append(report.Corrupted, key)
+			continue
+		} else if err != nil {
+			report.Failed[key] = err
+			continue
+		}
+		report.Checked++
+
+		if !ok {
+			m.Sha256sum = computed
+			if err := b.writeMetadata(key, m); err != nil {
+				report.Failed[key] = err
+				continue
+			}
+			report.Repaired = append(report.Repaired, key)
+		}
+		sums[computed] = append(sums[computed], key)
+	}
+
+	if !b.singleFile {
+		err = b.walkBlobs(func(key string, _ string) error {
+			if _, err := os.Stat(path.Join(b.metaPath, key)); os.IsNotExist(err) {
+				report.OrphanedBlobs = append(report.OrphanedBlobs, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	if b.dedup {
+		report.DedupEntriesFixed, err = b.rebuildDedupIndex(sums)
+	}
+	return
+}
+
+// Rewrite the dedup index so that it lists exactly the keys in sums under
+// each sha256sum, returning how many entries changed
+func (b LocalfsBackend) rebuildDedupIndex(sums map[string][]string) (fixed int, err error) {
+	b.dedupLock.Lock()
+	defer b.dedupLock.Unlock()
+
+	entries, err := os.ReadDir(path.Join(b.metaPath, dedupIndexDir))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		sum := entry.Name()
+		if _, ok := sums[sum]; ok || entry.IsDir() || isTemp(sum) {
+			continue
+		}
+		if err = b.writeDedupEntry(sum, dedupEntry{}); err != nil {
+			return
+		}
+		fixed++
+	}
+
+	for sum, keys := range sums {
+		// An entry that can't be read is rewritten like a wrong one
+		entry, _ := b.readDedupEntry(sum)
+
+		sort.Strings(keys)
+		if sameKeys(entry.Keys, keys) {
+			continue
+		}
+		if err = b.writeDedupEntry(sum, dedupEntry{Keys: keys}); err != nil {
+			return
+		}
+		fixed++
+	}
+	return
+}
+
+// Whether a and b hold the same keys in any order. b must be sorted.
+func sameKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sorted := append([]string(nil), a...)
+	sort.Strings(sorted)
+	for i := range sorted {
+		if sorted[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
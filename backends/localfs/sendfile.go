@@ -0,0 +1,84 @@
+package localfs
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sendfileAccelRedirect = "X-Accel-Redirect"
+	sendfileXSendfile     = "X-Sendfile"
+)
+
+var errUnknownSendfile = errors.New("Unknown sendfile header, must be X-Accel-Redirect or X-Sendfile.")
+
+// Whether ServeFile can hand the blob of a file with metadata off to the
+// reverse proxy, which serves it from disk as it is
+func (b LocalfsBackend) canSendfile(nonce, compression string) bool {
+	return b.sendfile != "" && nonce == "" && compression == "" && !b.singleFile
+}
+
+// Have the reverse proxy serve the blob at filePath, by answering with
+// just the headers that point it there. The proxy handles ranges itself.
+func (b LocalfsBackend) sendfileHeader(w http.ResponseWriter, filePath string, mimetype string) error {
+	rel, err := filepath.Rel(b.filesPath, filePath)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+
+	var location string
+	if b.sendfile == sendfileAccelRedirect {
+		// nginx takes a URI, which is decoded before it's mapped to a
+		// path
+		segments := strings.Split(rel, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		location = b.sendfilePrefix + strings.Join(segments, "/")
+	} else {
+		location = b.sendfilePrefix + rel
+	}
+
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Del("Content-Length")
+	w.Header().Set(b.sendfile, location)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// The header is matched case-insensitively, the prefix defaults to where
+// the proxy most likely finds the files: an internal location named after
+// the files directory for nginx, and its absolute path otherwise
+func sendfileOptions(header, prefix, filesPath string) (string, string, error) {
+	if header == "" {
+		return "", "", nil
+	}
+
+	switch {
+	case strings.EqualFold(header, sendfileAccelRedirect):
+		header = sendfileAccelRedirect
+		if prefix == "" {
+			prefix = "/" + filepath.Base(filepath.Clean(filesPath)) + "/"
+		}
+	case strings.EqualFold(header, sendfileXSendfile):
+		header = sendfileXSendfile
+		if prefix == "" {
+			abs, err := filepath.Abs(filesPath)
+			if err != nil {
+				return "", "", err
+			}
+			prefix = abs + "/"
+		}
+	default:
+		return "", "", errUnknownSendfile
+	}
+
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return header, prefix, nil
+}
@@ -0,0 +1,191 @@
+package localfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Where the blob for key belongs: flat in filesPath, or with sharding under
+// one directory per two characters of the start of the key, so that
+// abcd1234 is stored at ab/cd/abcd1234 with a depth of 2. Keys too short to
+// shard, or whose prefix would make a dot directory, are stored flat.
+func (b LocalfsBackend) shardedPath(key string) string {
+	prefixLen := 2 * b.shardDepth
+	if prefixLen == 0 || len(key) <= prefixLen || strings.Contains(key[:prefixLen], ".") {
+		return path.Join(b.filesPath, key)
+	}
+
+	parts := []string{b.filesPath}
+	for i := 0; i < prefixLen; i += 2 {
+		parts = append(parts, key[i:i+2])
+	}
+	parts = append(parts, key)
+
+	return path.Join(parts...)
+}
+
+// Path of the existing blob for key. This is the path recorded in its
+// metadata for blobs stored with an extension, otherwise the sharded path,
+// unless the blob is still stored flat from before sharding was enabled.
+func (b LocalfsBackend) blobPath(key string) string {
+	if recorded := b.recordedBlob(key); recorded != "" {
+		return path.Join(b.filesPath, recorded)
+	}
+
+	sharded := b.shardedPath(key)
+	flat := path.Join(b.filesPath, key)
+	if sharded == flat {
+		return sharded
+	}
+
+	if _, err := os.Lstat(sharded); os.IsNotExist(err) {
+		if _, err := os.Lstat(flat); err == nil {
+			return flat
+		}
+	}
+
+	return sharded
+}
+
+// Move a completely written file into place as the blob for key, creating
+// its shard directories as needed
+func (b LocalfsBackend) renameBlob(tmpPath string, key string) error {
+	return b.renameBlobTo(tmpPath, key, b.shardedPath(key))
+}
+
+// Like renameBlob, to dst rather than the sharded path of key
+func (b LocalfsBackend) renameBlobTo(tmpPath string, key string, dst string) error {
+	if err := b.mkdirAll(path.Dir(dst)); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return err
+	}
+	if err := b.syncDir(path.Dir(dst)); err != nil {
+		return err
+	}
+
+	// Drop any flat blob this replaces, which would otherwise linger. An
+	// unsharded path that isn't dst is the reservation of a Put, which
+	// removes it itself once the blob's metadata is written.
+	if flat := path.Join(b.filesPath, key); flat != dst && flat != b.shardedPath(key) {
+		os.Remove(flat)
+	}
+
+	return nil
+}
+
+// Create an empty blob for key, or return KeyConflictErr if there already
+// is one, so that only one of several Puts of the same key goes ahead. The
+// empty blob is replaced by renameBlob once the file is complete.
+func (b LocalfsBackend) reserveBlob(key string) error {
+	dst := b.shardedPath(key)
+	if flat := path.Join(b.filesPath, key); flat != dst {
+		if _, err := os.Lstat(flat); err == nil {
+			return backends.KeyConflictErr
+		}
+	}
+	if err := b.mkdirAll(path.Dir(dst)); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return backends.KeyConflictErr
+	} else if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// A blob stored with an extension isn't where it's reserved, but its
+	// metadata is written before the reservation is dropped
+	if b.recordedBlob(key) != "" {
+		os.Remove(dst)
+		return backends.KeyConflictErr
+	}
+	return nil
+}
+
+// Call fn with the key and path of every blob, whether flat or sharded, or
+// stored with an extension
+func (b LocalfsBackend) walkBlobs(fn func(key string, p string) error) error {
+	return filepath.WalkDir(b.filesPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == partialDir || d.Name() == trashDir) {
+			return fs.SkipDir
+		}
+		if d.IsDir() || isTemp(d.Name()) {
+			return nil
+		}
+		return fn(b.blobKey(d.Name(), p), p)
+	})
+}
+
+// The key of the blob named name at p, which is its name unless it was
+// stored with an extension
+func (b LocalfsBackend) blobKey(name string, p string) string {
+	ext := path.Ext(name)
+	if ext == "" {
+		return name
+	}
+
+	key := strings.TrimSuffix(name, ext)
+	if recorded := b.recordedBlob(key); recorded != "" && filepath.Clean(p) == filepath.Clean(path.Join(b.filesPath, recorded)) {
+		return key
+	}
+	return name
+}
+
+// Move every blob to where the configured shard depth expects it. This
+// converts a flat files directory to a sharded one, or back again with a
+// depth of 0, and returns the number of blobs moved.
+func (b LocalfsBackend) MigrateShards() (moved int, err error) {
+	type blob struct {
+		key  string
+		path string
+		ext  string
+	}
+	var misplaced []blob
+
+	// Collect first, as moving files while walking could visit them twice
+	err = b.walkBlobs(func(key string, p string) error {
+		// Blobs stored with an extension keep it
+		ext := strings.TrimPrefix(filepath.Base(p), key)
+		if filepath.Clean(p) != filepath.Clean(b.shardedPath(key)+ext) {
+			misplaced = append(misplaced, blob{key, p, ext})
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, bl := range misplaced {
+		dst := b.shardedPath(bl.key) + bl.ext
+		if err = b.mkdirAll(path.Dir(dst)); err != nil {
+			return
+		}
+		if err = os.Rename(bl.path, dst); err != nil {
+			return
+		}
+		if bl.ext != "" {
+			recorded, _ := filepath.Rel(b.filesPath, dst)
+			if err = b.recordBlob(bl.key, filepath.ToSlash(recorded)); err != nil {
+				return
+			}
+		}
+		moved++
+	}
+
+	return
+}
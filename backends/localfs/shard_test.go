@@ -0,0 +1,107 @@
+package localfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+func TestMigrateShards(t *testing.T) {
+	ctx := context.Background()
+	flat := newTestBackend(t, LocalfsOptions{BlobExtensions: true})
+
+	keys := map[string]string{"abcdefgh": "text/plain", "ijklmnop.txt": "text/plain", "x": "text/plain", "picture": "image/png"}
+	for key := range keys {
+		content := "content of " + key
+		if key == "picture" {
+			content = "\x89PNG\r\n\x1a\n" + content
+		}
+		if _, err := flat.Put(ctx, key, strings.NewReader(content), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path.Join(flat.filesPath, "abcdefgh.txt")); err != nil {
+		t.Fatalf("Blob wasn't stored flat: %v", err)
+	}
+
+	// As stored before blobs had extensions or were sharded
+	plain, err := NewLocalfsBackendWithOptions(flat.metaPath, flat.filesPath, LocalfsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Put(ctx, "qrstuvwx", strings.NewReader("content of qrstuvwx"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	keys["qrstuvwx"] = "text/plain"
+
+	b, err := NewLocalfsBackendWithOptions(flat.metaPath, flat.filesPath, LocalfsOptions{ShardDepth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blobs stored flat are read where they are until they're moved
+	for _, key := range []string{"abcdefgh", "qrstuvwx"} {
+		if got := read(t, b, key); got != "content of "+key {
+			t.Fatalf("Flat blob read as %q before migrating", got)
+		}
+	}
+
+	moved, err := b.MigrateShards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// x is too short to shard
+	if moved != 4 {
+		t.Fatalf("Moved %d blobs instead of 4", moved)
+	}
+	for _, p := range []string{"ab/cd/abcdefgh.txt", "qr/st/qrstuvwx", "ij/kl/ijklmnop.txt", "pi/ct/picture.png", "x.txt"} {
+		if _, err := os.Stat(path.Join(b.filesPath, p)); err != nil {
+			t.Errorf("Blob isn't at %s: %v", p, err)
+		}
+	}
+	if moved, err := b.MigrateShards(); moved != 0 || err != nil {
+		t.Fatalf("Migrating again moved %d blobs, %v", moved, err)
+	}
+
+	for key := range keys {
+		m, err := b.Head(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(m.Mimetype, keys[key]) {
+			t.Errorf("%s has mimetype %q", key, m.Mimetype)
+		}
+		if got := read(t, b, key); !strings.HasSuffix(got, "content of "+key) {
+			t.Errorf("%s read as %q after migrating", key, got)
+		}
+	}
+
+	if err := b.Delete(ctx, "abcdefgh"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(b.filesPath, "ab/cd/abcdefgh.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Sharded blob is left after Delete: %v", err)
+	}
+	if _, err := b.Head(ctx, "abcdefgh"); err != backends.NotFoundErr {
+		t.Fatalf("Head of the deleted file returned %v", err)
+	}
+
+	// And back to flat again
+	unsharded, err := NewLocalfsBackendWithOptions(b.metaPath, b.filesPath, LocalfsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved, err := unsharded.MigrateShards(); moved != 3 || err != nil {
+		t.Fatalf("Migrating back moved %d blobs, %v", moved, err)
+	}
+	if got := read(t, unsharded, "picture"); !strings.HasSuffix(got, "content of picture") {
+		t.Fatalf("Blob with an extension read as %q after migrating back", got)
+	}
+	if _, err := os.Stat(path.Join(unsharded.filesPath, "picture.png")); err != nil {
+		t.Fatalf("Blob with an extension isn't stored flat: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package localfs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// With the single file layout each blob starts with a header holding its
+// metadata: the magic below, the length of the metadata as a big endian
+// uint32, then the metadata as JSON. The blob as it would otherwise be
+// stored follows straight after.
+const (
+	singleFileMagic      = "lnx1"
+	singleFileHeaderSize = len(singleFileMagic) + 4
+)
+
+// Dedup hardlinks the blobs of different keys together, which can't work
+// once every blob carries its own key's metadata
+var errSingleFileDedup = errors.New("Dedup can't be used with the single file layout.")
+
+// Read the header of a blob stored with the single file layout, leaving f
+// at the start of the metadata and returning where the blob proper begins.
+// An empty file is the placeholder of a Put still in progress, so it
+// doesn't exist yet.
+func readHeader(f *os.File) (offset int64, err error) {
+	header := make([]byte, singleFileHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if n == 0 && err == io.EOF {
+		return 0, backends.NotFoundErr
+	} else if err != nil || string(header[:len(singleFileMagic)]) != singleFileMagic {
+		return 0, backends.BadMetadata
+	}
+
+	// A length reaching past the end of the file would have whatever
+	// metadata fits read as all of it
+	offset = int64(singleFileHeaderSize) + int64(binary.BigEndian.Uint32(header[len(singleFileMagic):]))
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	} else if offset > info.Size() {
+		return 0, backends.BadMetadata
+	}
+	return offset, nil
+}
+
+// Open the JSON metadata of a file, from metaFile or from the header of
+// blobFile depending on the layout
+func (b LocalfsBackend) openMetadata(metaFile string, blobFile string) (io.ReadCloser, error) {
+	if !b.singleFile {
+		return os.Open(metaFile)
+	}
+
+	f, err := os.Open(blobFile)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return blobSection{io.NewSectionReader(f, int64(singleFileHeaderSize), offset-int64(singleFileHeaderSize)), f}, nil
+}
+
+// The part of a file past its header
+type blobSection struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (s blobSection) Close() error {
+	return s.f.Close()
+}
+
+// Open the blob at blobFile as it is stored, skipping its header with the
+// single file layout
+func (b LocalfsBackend) openStoredBlob(blobFile string) (f *os.File, offset int64, err error) {
+	f, err = os.Open(blobFile)
+	if err != nil || !b.singleFile {
+		return
+	}
+
+	offset, err = readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return
+}
+
+// Write a file with the single file layout, its header followed by
+// content, and move it into place as key. The file is given modTime if
+// set, so that rewriting only the metadata doesn't change it.
+func (b LocalfsBackend) writeSingleFile(key string, mjson MetadataJSON, content io.Reader, modTime time.Time) error {
+	encoded, err := json.Marshal(mjson)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, singleFileHeaderSize, singleFileHeaderSize+len(encoded))
+	copy(header, singleFileMagic)
+	binary.BigEndian.PutUint32(header[len(singleFileMagic):], uint32(len(encoded)))
+	header = append(header, encoded...)
+
+	dst, err := b.createFile(b.filesPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = dst.Write(header)
+	if err == nil {
+		_, err = io.Copy(dst, content)
+	}
+	if err == nil {
+		err = b.syncFile(dst)
+	}
+	if err == nil {
+		err = dst.Close()
+	}
+	if err == nil && !modTime.IsZero() {
+		err = os.Chtimes(dst.Name(), modTime, modTime)
+	}
+	if err == nil {
+		err = b.renameBlob(dst.Name(), key)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
+
+// Store the blob Put wrote to tmp under key, after a header with m
+func (b LocalfsBackend) putSingleFile(key string, m backends.Metadata, tmp *os.File) error {
+	mjson, err := b.encodeMetadata(key, m)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := b.writeSingleFile(key, mjson, tmp, time.Time{}); err != nil {
+		return err
+	}
+	return b.resetDownloads(key)
+}
+
+// Replace the header of an existing file with the single file layout. The
+// whole file is written again, as the new header is rarely the same size.
+func (b LocalfsBackend) rewriteHeader(key string, mjson MetadataJSON) error {
+	f, offset, err := b.openStoredBlob(b.blobPath(key))
+	if os.IsNotExist(err) {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	content := io.NewSectionReader(f, offset, fileInfo.Size()-offset)
+	return b.writeSingleFile(key, mjson, content, fileInfo.ModTime())
+}
+
+// Keys of every file with metadata, which with the single file layout are
+// the keys of every blob
+func (b LocalfsBackend) metadataKeys() ([]string, error) {
+	if b.singleFile {
+		var keys []string
+		err := b.walkBlobs(func(key string, _ string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		return keys, err
+	}
+
+	entries, err := os.ReadDir(b.metaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !isTemp(entry.Name()) {
+			keys = append(keys, entry.Name())
+		}
+	}
+	return keys, nil
+}
+
+// Open the JSON metadata of key
+func (b LocalfsBackend) openKeyMetadata(key string) (io.ReadCloser, error) {
+	return b.openMetadata(path.Join(b.metaPath, key), b.blobPath(key))
+}
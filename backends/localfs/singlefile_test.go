@@ -0,0 +1,114 @@
+package localfs
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+func TestSingleFile(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{SingleFile: true})
+
+	m, err := b.Put(ctx, "single.txt", strings.NewReader("hello, world"), 0, "delkey", "", "127.0.0.1", "orig.txt", backends.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := os.ReadFile(b.blobPath("single.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(blob), singleFileMagic) || !strings.HasSuffix(string(blob), "hello, world") {
+		t.Fatalf("Blob is stored as %q", blob)
+	}
+	if _, err := os.Stat(path.Join(b.metaPath, "single.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Metadata was stored in a file of its own: %v", err)
+	}
+
+	head, err := b.Head(ctx, "single.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Sha256sum != m.Sha256sum || head.Size != 12 || head.DeleteKey != "delkey" || head.OriginalName != "orig.txt" {
+		t.Fatalf("Metadata read back as %+v", head)
+	}
+	if got := read(t, b, "single.txt"); got != "hello, world" {
+		t.Fatalf("Content read as %q", got)
+	}
+
+	r, err := b.GetRange(ctx, "single.txt", 7, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(r)
+	r.Close()
+	if string(content) != "world" {
+		t.Fatalf("Range read as %q", content)
+	}
+
+	w := httptest.NewRecorder()
+	if err := b.ServeFile("single.txt", w, httptest.NewRequest("GET", "/single.txt", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "hello, world" {
+		t.Fatalf("Served %q", w.Body.String())
+	}
+
+	// Rewriting the header moves the content along with it
+	head.AccessKey = "a much longer access key than there was before"
+	if err := b.PutMetadata(ctx, "single.txt", head); err != nil {
+		t.Fatal(err)
+	}
+	if head, err = b.Head(ctx, "single.txt"); err != nil || head.AccessKey != "a much longer access key than there was before" {
+		t.Fatalf("Rewritten metadata read back as %+v, %v", head, err)
+	}
+	if got := read(t, b, "single.txt"); got != "hello, world" {
+		t.Fatalf("Content read as %q after rewriting the header", got)
+	}
+
+	if keys, err := b.List(ctx); err != nil || len(keys) != 1 || keys[0] != "single.txt" {
+		t.Fatalf("Listed %v, %v", keys, err)
+	}
+}
+
+func TestSingleFileCorrupt(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{SingleFile: true})
+
+	tooLong := make([]byte, singleFileHeaderSize)
+	copy(tooLong, singleFileMagic)
+	binary.BigEndian.PutUint32(tooLong[len(singleFileMagic):], 1000)
+
+	for name, blob := range map[string]string{
+		"magic":     "lnx2\x00\x00\x00\x02{}content",
+		"truncated": "lnx1\x00",
+		"length":    string(tooLong) + "{}",
+		"json":      "lnx1\x00\x00\x00\x05{nope",
+	} {
+		if err := os.WriteFile(path.Join(b.filesPath, name), []byte(blob), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Head(ctx, name); err != backends.BadMetadata {
+			t.Errorf("Head of a blob with a bad %s returned %v", name, err)
+		}
+		if _, _, err := b.Get(ctx, name); err != backends.BadMetadata {
+			t.Errorf("Get of a blob with a bad %s returned %v", name, err)
+		}
+	}
+
+	// The placeholder of a Put in progress
+	if err := os.WriteFile(path.Join(b.filesPath, "empty"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Head(ctx, "empty"); err != backends.NotFoundErr {
+		t.Errorf("Head of an empty blob returned %v", err)
+	}
+}
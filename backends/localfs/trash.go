@@ -0,0 +1,162 @@
+package localfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Deleted files are moved here with soft delete enabled, in both metaPath
+// and filesPath. Blobs in the trash are always stored flat.
+const trashDir = ".trash"
+
+func (b LocalfsBackend) trashPaths(key string) (metaFile string, blobFile string) {
+	return path.Join(b.metaPath, trashDir, key), path.Join(b.filesPath, trashDir, key)
+}
+
+// Move the blob and metadata of key into the trash, replacing any file
+// deleted under the same key before. The metadata's modification time
+// records when it was deleted, or the blob's with the single file layout.
+func (b LocalfsBackend) trash(key string) error {
+	metaFile, blobFile := b.trashPaths(key)
+	for _, dir := range []string{path.Dir(metaFile), path.Dir(blobFile)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	oldPath := b.blobPath(key)
+	if err := os.Rename(oldPath, blobFile); err != nil {
+		return err
+	}
+	deleted := blobFile
+	if !b.singleFile {
+		if err := os.Rename(path.Join(b.metaPath, key), metaFile); err != nil {
+			// Put the blob back so the file stays whole
+			os.Rename(blobFile, oldPath)
+			return err
+		}
+		deleted = metaFile
+	}
+
+	now := time.Now()
+	return os.Chtimes(deleted, now, now)
+}
+
+// Get a file that was soft deleted, or NotFoundErr if it isn't in the trash
+func (b LocalfsBackend) GetDeleted(ctx context.Context, key string) (metadata backends.Metadata, f io.ReadCloser, err error) {
+	if err = b.checkPaths(key); err != nil {
+		return
+	}
+
+	metaFile, blobFile := b.trashPaths(key)
+	metadata, err = b.readMetadata(metaFile, blobFile)
+	if err != nil {
+		return
+	}
+
+	f, err = b.openContent(blobFile, metadata)
+	return
+}
+
+// Move a soft deleted file back out of the trash, or return KeyExistsErr
+// if another file has been stored under its key since
+func (b LocalfsBackend) Restore(ctx context.Context, key string) error {
+	if err := b.checkPaths(key); err != nil {
+		return err
+	}
+
+	metaFile, blobFile := b.trashPaths(key)
+	deleted := metaFile
+	if b.singleFile {
+		deleted = blobFile
+	}
+	if _, err := os.Lstat(deleted); os.IsNotExist(err) {
+		return backends.NotFoundErr
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(path.Join(b.metaPath, key)); err == nil {
+		return backends.KeyExistsErr
+	}
+	if _, err := os.Lstat(b.blobPath(key)); err == nil {
+		return backends.KeyExistsErr
+	}
+	defer b.stats.Invalidate()
+
+	// Blobs stored with an extension go back where their metadata says
+	dst := b.shardedPath(key)
+	if recorded := b.recordedBlobAt(metaFile); recorded != "" {
+		dst = path.Join(b.filesPath, recorded)
+	}
+	if err := b.renameBlobTo(blobFile, key, dst); err != nil {
+		return err
+	}
+	if !b.singleFile {
+		if err := os.Rename(metaFile, path.Join(b.metaPath, key)); err != nil {
+			os.Rename(dst, blobFile)
+			return err
+		}
+	}
+	b.files.Add(1)
+
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := b.indexPublicID(m.PublicID, key); err != nil {
+		return err
+	}
+	if b.dedup {
+		return b.dedupRef(key, m.Sha256sum)
+	}
+	return nil
+}
+
+// Permanently remove the files that were soft deleted more than olderThan
+// ago. Failing to remove a file doesn't stop the others from being removed,
+// such errors are joined together.
+func (b LocalfsBackend) PurgeTrash(ctx context.Context, olderThan time.Duration) error {
+	dir := b.metaPath
+	if b.singleFile {
+		dir = b.filesPath
+	}
+
+	entries, err := os.ReadDir(path.Join(dir, trashDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	deletedBefore := time.Now().Add(-olderThan)
+	var errs []error
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || !info.ModTime().Before(deletedBefore) {
+			continue
+		}
+
+		metaFile, blobFile := b.trashPaths(entry.Name())
+		m, _ := b.readMetadata(metaFile, blobFile)
+		if err := os.Remove(blobFile); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.Name(), err))
+			continue
+		}
+		b.unindexPublicID(m.PublicID, entry.Name())
+		if b.singleFile {
+			continue
+		}
+		if err := os.Remove(metaFile); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
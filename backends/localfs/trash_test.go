@@ -0,0 +1,143 @@
+package localfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+func TestTrashRestore(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{SoftDelete: true, Dedup: true})
+
+	var m backends.Metadata
+	for _, key := range []string{"a", "b"} {
+		var err error
+		if m, err = b.Put(ctx, key, strings.NewReader("shared content"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := b.Head(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Head(ctx, "a"); err != backends.NotFoundErr {
+		t.Fatalf("Head of a trashed file returned %v", err)
+	}
+	if _, err := b.GetByPublicID(ctx, a.PublicID); err != backends.NotFoundErr {
+		t.Fatalf("Public ID of a trashed file returned %v", err)
+	}
+	if entry, _ := b.readDedupEntry(m.Sha256sum); len(entry.Keys) != 1 || entry.Keys[0] != "b" {
+		t.Fatalf("Trashed file is still referenced: %v", entry.Keys)
+	}
+
+	deleted, f, err := b.GetDeleted(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(f)
+	f.Close()
+	if string(content) != "shared content" || deleted.PublicID != a.PublicID {
+		t.Fatalf("Trashed file read as %q, %+v", content, deleted)
+	}
+
+	if err := b.Restore(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, b, "a"); got != "shared content" {
+		t.Fatalf("Restored file read as %q", got)
+	}
+	if key, err := b.GetByPublicID(ctx, a.PublicID); key != "a" || err != nil {
+		t.Fatalf("Public ID of the restored file returned %q, %v", key, err)
+	}
+	if entry, _ := b.readDedupEntry(m.Sha256sum); len(entry.Keys) != 2 {
+		t.Fatalf("Restored file isn't referenced: %v", entry.Keys)
+	}
+	if _, _, err := b.GetDeleted(ctx, "a"); err != backends.NotFoundErr {
+		t.Fatalf("GetDeleted of a restored file returned %v", err)
+	}
+	if err := b.Restore(ctx, "missing"); err != backends.NotFoundErr {
+		t.Fatalf("Restoring a file that was never deleted returned %v", err)
+	}
+}
+
+func TestTrashRestoreTaken(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{SoftDelete: true})
+
+	if _, err := b.Put(ctx, "a", strings.NewReader("deleted"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(ctx, "a", strings.NewReader("stored since"), 0, "", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Restore(ctx, "a"); err != backends.KeyExistsErr {
+		t.Fatalf("Restoring over a newer file returned %v", err)
+	}
+	if got := read(t, b, "a"); got != "stored since" {
+		t.Fatalf("Newer file was replaced with %q", got)
+	}
+	if _, f, err := b.GetDeleted(ctx, "a"); err != nil {
+		t.Fatalf("Trashed file is gone: %v", err)
+	} else {
+		f.Close()
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBackend(t, LocalfsOptions{SoftDelete: true})
+
+	ids := map[string]string{}
+	for _, key := range []string{"old", "recent"} {
+		m, err := b.Put(ctx, key, strings.NewReader(key), 0, "", "", "", "", backends.PutOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[key] = m.PublicID
+		if err := b.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metaFile, _ := b.trashPaths("old")
+	deletedAt := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(metaFile, deletedAt, deletedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.PurgeTrash(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := b.GetDeleted(ctx, "old"); err != backends.NotFoundErr {
+		t.Fatalf("GetDeleted of a purged file returned %v", err)
+	}
+	if _, err := b.readPublicIndex(ids["old"]); err != backends.NotFoundErr {
+		t.Fatalf("Public ID of a purged file is still indexed: %v", err)
+	}
+	if _, f, err := b.GetDeleted(ctx, "recent"); err != nil {
+		t.Fatalf("File deleted within the cutoff was purged: %v", err)
+	} else {
+		f.Close()
+	}
+	if err := b.Restore(ctx, "recent"); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := b.GetByPublicID(ctx, ids["recent"]); key != "recent" || err != nil {
+		t.Fatalf("Public ID of the restored file returned %q, %v", key, err)
+	}
+}
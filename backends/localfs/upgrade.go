@@ -0,0 +1,54 @@
+package localfs
+
+import (
+	"os"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Version of the metadata written by this backend. Metadata written before
+// versions were recorded has none, which is version 0.
+const metadataVersion = 1
+
+// Upgrades metadata of version i to version i+1, for i from 0. Each is
+// given the path of the blob, and whether the upgraded metadata is going
+// to be written back.
+var metadataUpgrades = []func(b LocalfsBackend, mjson *MetadataJSON, blobFile string, persist bool) error{
+	// The upload time wasn't recorded, and plaintext keys were only hashed
+	// once they were checked
+	func(b LocalfsBackend, mjson *MetadataJSON, blobFile string, persist bool) error {
+		if mjson.Uploaded == 0 {
+			if fileInfo, err := os.Stat(blobFile); err == nil {
+				mjson.Uploaded = fileInfo.ModTime().Unix()
+			}
+		}
+
+		// Hashing is slow, so it's not worth doing for a single read
+		if !b.hashKeys || !persist {
+			return nil
+		}
+		var err error
+		if mjson.DeleteKey, err = backends.HashKey(mjson.DeleteKey); err != nil {
+			return err
+		}
+		mjson.AccessKey, err = backends.HashKey(mjson.AccessKey)
+		return err
+	},
+}
+
+// Run the upgrades from the version of mjson up to metadataVersion,
+// reporting whether any ran. An upgrade that fails leaves mjson at the
+// version before it, to be tried again on the next read. Metadata from a
+// newer version is left as it is.
+func (b LocalfsBackend) upgradeMetadata(mjson *MetadataJSON, blobFile string, persist bool) (upgraded bool) {
+	for mjson.Version >= 0 && mjson.Version < metadataVersion {
+		next := *mjson
+		if err := metadataUpgrades[mjson.Version](b, &next, blobFile, persist); err != nil {
+			break
+		}
+		next.Version++
+		*mjson = next
+		upgraded = true
+	}
+	return
+}
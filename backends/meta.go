@@ -1,20 +1,203 @@
 package backends
 
 import (
+	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 )
 
 type Metadata struct {
-	DeleteKey    string
-	AccessKey    string
-	Sha256sum    string
+	// Identifies the file in public links, staying the same when it's
+	// renamed so that keys can change without breaking them. Empty for
+	// files stored before these were generated.
+	PublicID  string
+	DeleteKey string
+	AccessKey string
+	Sha256sum string
+	// Hex-encoded checksums by algorithm, for those in Limits.Checksums
+	// when the file was stored
+	Checksums    map[string]string
 	Mimetype     string
 	Size         int64
 	Expiry       time.Time
 	SrcIp        string
 	OriginalName string
-	ArchiveFiles []string
+	ArchiveFiles []ArchiveEntry
+	// Whether listing the archive stopped short of every entry
+	ArchiveTruncated bool
+	// How many entries are known to have been left out of a truncated
+	// listing, which can be fewer than there are
+	ArchiveOmitted int
+	// Hex-encoded nonce if the blob is encrypted at rest
+	Nonce string
+	// How the client encrypted the file before uploading it, if it did
+	Encryption Encryption
+	// Number of times the file was served
+	Downloads int64
+	// Number of times the file can be served before it's gone. 0 for no
+	// limit.
+	MaxDownloads int64
+	// Codec the blob is compressed with at rest, if any. Size is still
+	// the uncompressed size.
+	Compression string
+	// Strong validator derived from Sha256sum, already quoted for use as
+	// an ETag header
+	ETag string
+	// When the content was last modified, for Last-Modified headers
+	ModTime time.Time
+	// The file can't be changed or deleted before this time
+	RetainUntil time.Time
+	// The access key is rejected after this time, even if the file itself
+	// hasn't expired. Zero means it's accepted for as long as the file is.
+	AccessKeyExpiry time.Time
+	// When the file was uploaded
+	Uploaded time.Time
+	// Arbitrary data attached by front-ends, up to MaxCustomSize bytes of
+	// keys and values altogether
+	Custom map[string]string
+	// Stored as native object tags on backends that have them, for the
+	// provider's lifecycle rules to act on, as checked by CheckTags
+	Tags map[string]string
+	// Bytes per second the file is served at, instead of
+	// Limits.DownloadRate unless it's 0. Negative to serve it as fast as
+	// possible whatever Limits.DownloadRate is.
+	DownloadRate int64
+}
+
+// Describes content the client encrypted itself, so the server only ever
+// stores the ciphertext. The key never reaches the server, but the nonce and
+// a hint at which key was used are kept for clients to decrypt it with.
+type Encryption struct {
+	// Cipher the content was encrypted with, such as "aes-256-gcm". The
+	// file isn't client-encrypted if this is empty.
+	Scheme  string `json:"scheme"`
+	Nonce   string `json:"nonce,omitempty"`
+	KeyHint string `json:"key_hint,omitempty"`
+}
+
+// A file or directory in an archive
+type ArchiveEntry struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+	IsDir    bool
+}
+
+type archiveEntryJSON struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size,omitempty"`
+	Modified int64  `json:"modified,omitempty"`
+	IsDir    bool   `json:"dir,omitempty"`
+}
+
+func (e ArchiveEntry) MarshalJSON() ([]byte, error) {
+	ej := archiveEntryJSON{Name: e.Name, Size: e.Size, IsDir: e.IsDir}
+	if !e.Modified.IsZero() {
+		ej.Modified = e.Modified.Unix()
+	}
+	return json.Marshal(ej)
+}
+
+// Archives used to be listed by name only, so a plain string decodes to
+// an entry of that name
+func (e *ArchiveEntry) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*e = ArchiveEntry{Name: name, IsDir: strings.HasSuffix(name, "/")}
+		return nil
+	}
+
+	var ej archiveEntryJSON
+	if err := json.Unmarshal(data, &ej); err != nil {
+		return err
+	}
+
+	*e = ArchiveEntry{Name: ej.Name, Size: ej.Size, IsDir: ej.IsDir}
+	if ej.Modified != 0 {
+		e.Modified = time.Unix(ej.Modified, 0)
+	}
+	return nil
+}
+
+// Cut an archive listing short to the most entries whose JSON fits in
+// maxBytes, for backends that can only store so much metadata, returning
+// the entries kept and how many were left out
+func FitArchiveFiles(files []ArchiveEntry, maxBytes int) ([]ArchiveEntry, int) {
+	// The brackets around the entries, and a comma between each
+	size := 2
+	for i, entry := range files {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return files[:i], len(files) - i
+		}
+		if i > 0 {
+			size++
+		}
+		size += len(encoded)
+		if size > maxBytes {
+			return files[:i], len(files) - i
+		}
+	}
+	return files, 0
+}
+
+// Whether the file is still under its retention lock
+func (m Metadata) RetentionLocked() bool {
+	return time.Now().Before(m.RetainUntil)
+}
+
+// Whether the file was served as many times as it could be
+func (m Metadata) DownloadsExhausted() bool {
+	return m.MaxDownloads > 0 && m.Downloads >= m.MaxDownloads
+}
+
+// Whether the file's access key has stopped being accepted
+func (m Metadata) AccessKeyExpired() bool {
+	return !m.AccessKeyExpiry.IsZero() && time.Now().After(m.AccessKeyExpiry)
+}
+
+const MaxCustomSize = 4096
+
+// Check that the custom metadata fits within MaxCustomSize
+func CheckCustom(custom map[string]string) error {
+	size := 0
+	for k, v := range custom {
+		size += len(k) + len(v)
+	}
+	if size > MaxCustomSize {
+		return CustomTooLargeErr
+	}
+	return nil
+}
+
+// Most tags a file can have, as on S3 and Azure
+const MaxTags = 10
+
+// Check that tags are within what every provider accepts: up to MaxTags
+// tags, with keys of 1 to 128 characters and values of up to 256, made of
+// letters, digits, spaces and + - . / : = _
+func CheckTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return InvalidTagsErr
+	}
+	for k, v := range tags {
+		if len(k) == 0 || len(k) > 128 || len(v) > 256 || !isTagText(k) || !isTagText(v) {
+			return InvalidTagsErr
+		}
+	}
+	return nil
+}
+
+func isTagText(s string) bool {
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune(" +-./:=_", c)) {
+			return false
+		}
+	}
+	return true
 }
 
 var BadMetadata = errors.New("Corrupted metadata.")
+var CustomTooLargeErr = errors.New("Custom metadata is larger than 4096 bytes.")
+var InvalidTagsErr = errors.New("Tags must be at most 10 keys of up to 128 and values of up to 256 letters, digits, spaces or +-./:=_ characters.")
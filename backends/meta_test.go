@@ -0,0 +1,103 @@
+package backends
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckCustom(t *testing.T) {
+	if err := CheckCustom(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	custom := map[string]string{"gallery": strings.Repeat("x", MaxCustomSize-len("gallery"))}
+	if err := CheckCustom(custom); err != nil {
+		t.Fatalf("Custom metadata of exactly MaxCustomSize returned %v", err)
+	}
+
+	custom["tag"] = "a"
+	if err := CheckCustom(custom); err != CustomTooLargeErr {
+		t.Fatalf("Oversized custom metadata returned %v", err)
+	}
+}
+
+func TestCheckTags(t *testing.T) {
+	for _, tags := range []map[string]string{nil, {"expiry": "7d", "tier": "cold/archive_1"}, {"empty": ""}} {
+		if err := CheckTags(tags); err != nil {
+			t.Errorf("%v returned %v", tags, err)
+		}
+	}
+
+	tooMany := map[string]string{}
+	for i := 0; i <= MaxTags; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	for _, tags := range []map[string]string{tooMany, {"": "v"}, {"k": "zoë"}, {"k,": "v"}, {strings.Repeat("k", 129): "v"}} {
+		if err := CheckTags(tags); err != InvalidTagsErr {
+			t.Errorf("%v returned %v", tags, err)
+		}
+	}
+}
+
+func TestArchiveEntryJSON(t *testing.T) {
+	entries := []ArchiveEntry{
+		{Name: "dir/", IsDir: true},
+		{Name: "dir/a.txt", Size: 3, Modified: time.Unix(1600000000, 0)},
+	}
+
+	encoded, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []ArchiveEntry
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0] != entries[0] || decoded[1].Name != "dir/a.txt" || decoded[1].Size != 3 || !decoded[1].Modified.Equal(entries[1].Modified) {
+		t.Fatalf("Decoded %+v from %s", decoded, encoded)
+	}
+
+	// Listings stored as names only
+	if err := json.Unmarshal([]byte(`["dir/", "dir/a.txt"]`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || !decoded[0].IsDir || decoded[1].Name != "dir/a.txt" || decoded[1].IsDir {
+		t.Fatalf("Decoded %+v from names", decoded)
+	}
+}
+
+func TestFitArchiveFiles(t *testing.T) {
+	files := []ArchiveEntry{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	encoded, _ := json.Marshal(files)
+
+	if kept, omitted := FitArchiveFiles(files, len(encoded)); len(kept) != 3 || omitted != 0 {
+		t.Fatalf("Listing that fits was cut to %v, %d omitted", kept, omitted)
+	}
+
+	kept, omitted := FitArchiveFiles(files, len(encoded)-1)
+	if len(kept) != 2 || omitted != 1 {
+		t.Fatalf("Expected 2 entries kept and 1 omitted, got %v and %d", kept, omitted)
+	}
+	if keptEncoded, _ := json.Marshal(kept); len(keptEncoded) > len(encoded)-1 {
+		t.Fatalf("Kept entries don't fit, %s", keptEncoded)
+	}
+}
+
+func TestDownloadsExhausted(t *testing.T) {
+	for _, c := range []struct {
+		m         Metadata
+		exhausted bool
+	}{
+		{Metadata{Downloads: 100}, false},
+		{Metadata{Downloads: 2, MaxDownloads: 3}, false},
+		{Metadata{Downloads: 3, MaxDownloads: 3}, true},
+		{Metadata{Downloads: 4, MaxDownloads: 3}, true},
+	} {
+		if c.m.DownloadsExhausted() != c.exhausted {
+			t.Errorf("%d of %d downloads returned %v", c.m.Downloads, c.m.MaxDownloads, !c.exhausted)
+		}
+	}
+}
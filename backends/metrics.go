@@ -0,0 +1,414 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus collectors for the operations of InstrumentedBackends, which
+// can share a Metrics with their backend label telling them apart. Metrics
+// is itself a prometheus.Collector, to be registered with a registry.
+type Metrics struct {
+	operations   *prometheus.CounterVec
+	errors       *prometheus.CounterVec
+	storageFull  *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	bytesRead    *prometheus.CounterVec
+	bytesWritten *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	labels := []string{"backend", "operation"}
+	return &Metrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "linx_backend_operations_total",
+			Help: "Storage backend operations made.",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "linx_backend_errors_total",
+			Help: "Storage backend operations that failed, other than with a file not being found.",
+		}, labels),
+		storageFull: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "linx_backend_storage_full_total",
+			Help: "Storage backend operations that failed for running out of space or quota.",
+		}, labels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "linx_backend_operation_duration_seconds",
+			Help:    "Time storage backend operations took, until the first byte for reads.",
+			Buckets: prometheus.DefBuckets,
+		}, labels),
+		bytesRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "linx_backend_read_bytes_total",
+			Help: "Bytes of files read from storage backends.",
+		}, labels),
+		bytesWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "linx_backend_written_bytes_total",
+			Help: "Bytes of files written to storage backends.",
+		}, labels),
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.operations.Describe(ch)
+	m.errors.Describe(ch)
+	m.storageFull.Describe(ch)
+	m.duration.Describe(ch)
+	m.bytesRead.Describe(ch)
+	m.bytesWritten.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.operations.Collect(ch)
+	m.errors.Collect(ch)
+	m.storageFull.Collect(ch)
+	m.duration.Collect(ch)
+	m.bytesRead.Collect(ch)
+	m.bytesWritten.Collect(ch)
+}
+
+// Wraps a StorageBackend, recording the count, duration and errors of each
+// operation and the bytes of files read and written in metrics, labelled
+// with name as the backend
+type InstrumentedBackend struct {
+	StorageBackend
+
+	name    string
+	metrics *Metrics
+}
+
+func NewInstrumentedBackend(b StorageBackend, name string, metrics *Metrics) InstrumentedBackend {
+	return InstrumentedBackend{b, name, metrics}
+}
+
+// Start timing an operation, returning a function that records it as done
+// with err and returns err
+func (b InstrumentedBackend) start(operation string) func(err error) error {
+	started := time.Now()
+	return func(err error) error {
+		b.metrics.operations.WithLabelValues(b.name, operation).Inc()
+		b.metrics.duration.WithLabelValues(b.name, operation).Observe(time.Since(started).Seconds())
+		if err != nil && err != NotFoundErr && err != NoVariantErr {
+			b.metrics.errors.WithLabelValues(b.name, operation).Inc()
+		}
+		if errors.Is(err, StorageFullErr) {
+			b.metrics.storageFull.WithLabelValues(b.name, operation).Inc()
+		}
+		return err
+	}
+}
+
+// Count the bytes read from r as read by operation
+func (b InstrumentedBackend) countRead(operation string, r io.ReadCloser) io.ReadCloser {
+	if r == nil {
+		return nil
+	}
+	return countingReadCloser{r, b.metrics.bytesRead.WithLabelValues(b.name, operation)}
+}
+
+// Count the bytes read from r as written by operation
+func (b InstrumentedBackend) countWritten(operation string, r io.Reader) io.Reader {
+	return countingReader{r, b.metrics.bytesWritten.WithLabelValues(b.name, operation)}
+}
+
+type countingReader struct {
+	io.Reader
+	counter prometheus.Counter
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (c countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// Counts the bytes of the responses of ServeFile, ServeThumbnail,
+// ServeImageVariant and ServeArchiveEntry
+type countingResponseWriter struct {
+	http.ResponseWriter
+	counter prometheus.Counter
+}
+
+func (c countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// For http.ResponseController to reach the wrapped writer
+func (c countingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (b InstrumentedBackend) countServed(operation string, w http.ResponseWriter) http.ResponseWriter {
+	return countingResponseWriter{w, b.metrics.bytesRead.WithLabelValues(b.name, operation)}
+}
+
+func (b InstrumentedBackend) Append(ctx context.Context, key string, r io.Reader, offset int64) (int64, error) {
+	done := b.start("append")
+	size, err := b.StorageBackend.Append(ctx, key, b.countWritten("append", r), offset)
+	return size, done(err)
+}
+
+func (b InstrumentedBackend) Copy(ctx context.Context, srcKey, dstKey string) (Metadata, error) {
+	done := b.start("copy")
+	m, err := b.StorageBackend.Copy(ctx, srcKey, dstKey)
+	return m, done(err)
+}
+
+func (b InstrumentedBackend) Delete(ctx context.Context, key string) error {
+	done := b.start("delete")
+	return done(b.StorageBackend.Delete(ctx, key))
+}
+
+// Counted as a single operation, failing if any of the files couldn't be
+// deleted
+func (b InstrumentedBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	done := b.start("batch_delete")
+	deleted, errs := b.StorageBackend.BatchDelete(ctx, keys)
+	for _, err := range errs {
+		if err != NotFoundErr {
+			done(err)
+			return deleted, errs
+		}
+	}
+	done(nil)
+	return deleted, errs
+}
+
+func (b InstrumentedBackend) CheckAccessKey(ctx context.Context, key, provided string) (bool, error) {
+	done := b.start("check_access_key")
+	ok, err := b.StorageBackend.CheckAccessKey(ctx, key, provided)
+	return ok, done(err)
+}
+
+func (b InstrumentedBackend) CheckDeleteKey(ctx context.Context, key, provided string) (bool, error) {
+	done := b.start("check_delete_key")
+	ok, err := b.StorageBackend.CheckDeleteKey(ctx, key, provided)
+	return ok, done(err)
+}
+
+func (b InstrumentedBackend) Exists(ctx context.Context, key string) (bool, error) {
+	done := b.start("exists")
+	exists, err := b.StorageBackend.Exists(ctx, key)
+	return exists, done(err)
+}
+
+func (b InstrumentedBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	done := b.start("finalize")
+	m, err := b.StorageBackend.Finalize(ctx, key, expiry, deleteKey, accessKey, srcIp, originalName, o)
+	return m, done(err)
+}
+
+func (b InstrumentedBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	done := b.start("head")
+	m, err := b.StorageBackend.Head(ctx, key)
+	return m, done(err)
+}
+
+func (b InstrumentedBackend) HealthCheck(ctx context.Context) error {
+	done := b.start("health_check")
+	return done(b.StorageBackend.HealthCheck(ctx))
+}
+
+func (b InstrumentedBackend) Get(ctx context.Context, key string) (Metadata, io.ReadCloser, error) {
+	done := b.start("get")
+	m, r, err := b.StorageBackend.Get(ctx, key)
+	return m, b.countRead("get", r), done(err)
+}
+
+func (b InstrumentedBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	done := b.start("get_range")
+	r, err := b.StorageBackend.GetRange(ctx, key, offset, length)
+	return b.countRead("get_range", r), done(err)
+}
+
+func (b InstrumentedBackend) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	done := b.start("presign_get")
+	u, err := b.StorageBackend.PresignGet(ctx, key, ttl)
+	return u, done(err)
+}
+
+func (b InstrumentedBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	done := b.start("put")
+	m, err := b.StorageBackend.Put(ctx, key, b.countWritten("put", r), expiry, deleteKey, accessKey, srcIp, originalName, o)
+	return m, done(err)
+}
+
+func (b InstrumentedBackend) PutMetadata(ctx context.Context, key string, m Metadata) error {
+	done := b.start("put_metadata")
+	return done(b.StorageBackend.PutMetadata(ctx, key, m))
+}
+
+func (b InstrumentedBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	done := b.start("rename")
+	return done(b.StorageBackend.Rename(ctx, oldKey, newKey))
+}
+
+func (b InstrumentedBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	done := b.start("set_expiry")
+	return done(b.StorageBackend.SetExpiry(ctx, key, newExpiry))
+}
+
+func (b InstrumentedBackend) Touch(ctx context.Context, key string, extend time.Duration) error {
+	done := b.start("touch")
+	return done(b.StorageBackend.Touch(ctx, key, extend))
+}
+
+func (b InstrumentedBackend) GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error {
+	done := b.start("grant_access")
+	return done(b.StorageBackend.GrantAccess(ctx, key, accessKey, until))
+}
+
+// Served files are timed until the whole response is written
+func (b InstrumentedBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	done := b.start("serve_file")
+	return done(b.StorageBackend.ServeFile(key, b.countServed("serve_file", w), r))
+}
+
+func (b InstrumentedBackend) ServeThumbnail(key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error {
+	done := b.start("serve_thumbnail")
+	return done(b.StorageBackend.ServeThumbnail(key, b.countServed("serve_thumbnail", w), r, maxWidth, maxHeight))
+}
+
+func (b InstrumentedBackend) ServeImageVariant(key string, w http.ResponseWriter, r *http.Request) error {
+	done := b.start("serve_image_variant")
+	return done(b.StorageBackend.ServeImageVariant(key, b.countServed("serve_image_variant", w), r))
+}
+
+func (b InstrumentedBackend) ServeArchiveEntry(key string, entryPath string, w http.ResponseWriter, r *http.Request) error {
+	done := b.start("serve_archive_entry")
+	return done(b.StorageBackend.ServeArchiveEntry(key, entryPath, b.countServed("serve_archive_entry", w), r))
+}
+
+func (b InstrumentedBackend) Preview(ctx context.Context, key string, maxBytes int) (string, bool, error) {
+	done := b.start("preview")
+	preview, truncated, err := b.StorageBackend.Preview(ctx, key, maxBytes)
+	if err == nil {
+		b.metrics.bytesRead.WithLabelValues(b.name, "preview").Add(float64(len(preview)))
+	}
+	return preview, truncated, done(err)
+}
+
+func (b InstrumentedBackend) Size(ctx context.Context, key string) (int64, error) {
+	done := b.start("size")
+	size, err := b.StorageBackend.Size(ctx, key)
+	return size, done(err)
+}
+
+func (b InstrumentedBackend) GetDeleted(ctx context.Context, key string) (Metadata, io.ReadCloser, error) {
+	done := b.start("get_deleted")
+	m, r, err := b.StorageBackend.GetDeleted(ctx, key)
+	return m, b.countRead("get_deleted", r), done(err)
+}
+
+func (b InstrumentedBackend) Restore(ctx context.Context, key string) error {
+	done := b.start("restore")
+	return done(b.StorageBackend.Restore(ctx, key))
+}
+
+func (b InstrumentedBackend) PurgeTrash(ctx context.Context, olderThan time.Duration) error {
+	done := b.start("purge_trash")
+	return done(b.StorageBackend.PurgeTrash(ctx, olderThan))
+}
+
+func (b InstrumentedBackend) PurgeUploads(ctx context.Context, olderThan time.Duration) error {
+	done := b.start("purge_uploads")
+	return done(b.StorageBackend.PurgeUploads(ctx, olderThan))
+}
+
+// An InstrumentedBackend around a MetaStorageBackend, recording its listing
+// operations too
+type InstrumentedMetaBackend struct {
+	InstrumentedBackend
+	metaForwarder
+}
+
+func NewInstrumentedMetaBackend(b MetaStorageBackend, name string, metrics *Metrics) InstrumentedMetaBackend {
+	return InstrumentedMetaBackend{NewInstrumentedBackend(b, name, metrics), metaForwarder{b}}
+}
+
+func (b InstrumentedMetaBackend) List(ctx context.Context) ([]string, error) {
+	done := b.start("list")
+	keys, err := b.meta.List(ctx)
+	return keys, done(err)
+}
+
+func (b InstrumentedMetaBackend) ListPaginated(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	done := b.start("list_paginated")
+	keys, nextCursor, err := b.meta.ListPaginated(ctx, cursor, limit)
+	return keys, nextCursor, done(err)
+}
+
+func (b InstrumentedMetaBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	done := b.start("list_expired")
+	keys, err := b.meta.ListExpired(ctx, before)
+	return keys, done(err)
+}
+
+func (b InstrumentedMetaBackend) VerifyChecksum(ctx context.Context, key string) (bool, string, error) {
+	done := b.start("verify_checksum")
+	ok, computed, err := b.meta.VerifyChecksum(ctx, key)
+	return ok, computed, done(err)
+}
+
+func (b InstrumentedMetaBackend) ArchiveFS(key string) (fs.FS, error) {
+	done := b.start("archive_fs")
+	fsys, err := b.meta.ArchiveFS(key)
+	return fsys, done(err)
+}
+
+func (b InstrumentedMetaBackend) Stats(ctx context.Context) (Stats, error) {
+	done := b.start("stats")
+	s, err := b.meta.Stats(ctx)
+	return s, done(err)
+}
+
+func (b InstrumentedMetaBackend) Query(ctx context.Context, filter ListFilter) ([]string, error) {
+	done := b.start("query")
+	keys, err := b.meta.Query(ctx, filter)
+	return keys, done(err)
+}
+
+func (b InstrumentedMetaBackend) GetByPublicID(ctx context.Context, id string) (string, error) {
+	done := b.start("get_by_public_id")
+	key, err := b.meta.GetByPublicID(ctx, id)
+	return key, done(err)
+}
+
+func (b InstrumentedMetaBackend) FindBySha256(ctx context.Context, sum string) (string, bool, error) {
+	done := b.start("find_by_sha256")
+	key, found, err := b.meta.FindBySha256(ctx, sum)
+	return key, found, done(err)
+}
+
+// Counted as one operation, failing only if every key did
+func (b InstrumentedMetaBackend) HeadMany(ctx context.Context, keys []string) (map[string]Metadata, map[string]error) {
+	done := b.start("head_many")
+	found, errs := b.meta.HeadMany(ctx, keys)
+	var err error
+	for _, err = range errs {
+		break
+	}
+	if len(found) > 0 {
+		err = nil
+	}
+	done(err)
+	return found, errs
+}
@@ -0,0 +1,58 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentedBackend(t *testing.T) {
+	ctx := context.Background()
+	metrics := NewMetrics()
+	b := NewInstrumentedBackend(&memBackend{files: map[string]string{}}, "mem", metrics)
+
+	if _, err := b.Put(ctx, "a", strings.NewReader("hello"), 0, "", "", "", "", PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := b.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(r)
+	r.Close()
+
+	if _, _, err := b.Get(ctx, "missing"); err != NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+	b.StorageBackend.(*memBackend).broken = true
+	b.Delete(ctx, "a")
+
+	for _, c := range []struct {
+		counter *prometheus.CounterVec
+		op      string
+		want    float64
+	}{
+		{metrics.operations, "put", 1},
+		{metrics.operations, "get", 2},
+		{metrics.errors, "get", 0},
+		{metrics.errors, "delete", 1},
+		{metrics.bytesWritten, "put", 5},
+		{metrics.bytesRead, "get", 5},
+	} {
+		if got := testutil.ToFloat64(c.counter.WithLabelValues("mem", c.op)); got != c.want {
+			t.Errorf("Expected %v for %s, got %v", c.want, c.op, got)
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := testutil.GatherAndCount(registry, "linx_backend_operation_duration_seconds"); err != nil || n != 3 {
+		t.Fatalf("Expected a histogram per operation, got %d and %v", n, err)
+	}
+}
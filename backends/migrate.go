@@ -0,0 +1,130 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+type MigrateOptions struct {
+	// How many files to copy at the same time, 1 if not positive
+	Workers int
+
+	// Called as each file is done with, along with how many of the total
+	// are done and the error copying it, if any. Files that are skipped
+	// count as done too. Calls don't overlap.
+	Progress func(key string, done, total int, err error)
+}
+
+// Copy every file in src to dst along with its metadata, such as to move to
+// another backend. Files already in dst are skipped, so that an interrupted
+// migration can be run again to pick up where it left off, and so are files
+// that have expired. Returns how many files were copied and the errors of
+// those that weren't, which don't stop the others from being copied.
+func Migrate(ctx context.Context, src, dst MetaStorageBackend, o MigrateOptions) (copied int, errs []error) {
+	keys, err := src.List(ctx)
+	if err != nil {
+		return 0, []error{err}
+	}
+
+	workers := o.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var mu sync.Mutex
+	done := 0
+	finish := func(key string, ok bool, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		done++
+		if ok {
+			copied++
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", key, err)
+			errs = append(errs, err)
+		}
+		if o.Progress != nil {
+			o.Progress(key, done, len(keys), err)
+		}
+	}
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			finish(key, false, err)
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ok, err := migrateFile(ctx, src, dst, key)
+			finish(key, ok, err)
+		}(key)
+	}
+	wg.Wait()
+
+	return
+}
+
+// Copy the file under key from src to dst, unless it's already there or has
+// expired, returning whether it was copied
+func migrateFile(ctx context.Context, src, dst MetaStorageBackend, key string) (bool, error) {
+	// Some backends return an error along with false for a key that isn't
+	// there, and Put fails anyway if it is
+	if exists, _ := dst.Exists(ctx, key); exists {
+		return false, nil
+	}
+
+	m, r, err := src.Get(ctx, key)
+	if err == NotFoundErr {
+		// Deleted since it was listed
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	if expiry.IsTsExpired(m.Expiry) {
+		return false, nil
+	}
+
+	var expiryTime time.Duration
+	if m.Expiry != expiry.NeverExpire {
+		expiryTime = time.Until(m.Expiry)
+	}
+
+	// The retention lock is only set with the rest of the metadata, as it
+	// would keep that from being stored
+	stored, err := dst.Put(ctx, key, r, expiryTime, m.DeleteKey, m.AccessKey, m.SrcIp, m.OriginalName, PutOptions{
+		ExpectedSha256: m.Sha256sum,
+		Custom:         m.Custom,
+		Encryption:     m.Encryption,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Put only takes some of the metadata, the rest is carried over as it
+	// was other than how dst stores the content at rest
+	m.Nonce = stored.Nonce
+	m.Compression = stored.Compression
+	if err := dst.PutMetadata(ctx, key, m); err != nil {
+		// Don't leave the file behind with the wrong metadata, as it
+		// would be skipped when migrating again
+		dst.Delete(ctx, key)
+		return false, err
+	}
+	return true, nil
+}
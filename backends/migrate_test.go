@@ -0,0 +1,125 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+// Keeps both the content and the metadata of files in memory
+type contentBackend struct {
+	MetaStorageBackend
+	mu      sync.Mutex
+	files   map[string]Metadata
+	content map[string]string
+}
+
+func newContentBackend() *contentBackend {
+	return &contentBackend{files: map[string]Metadata{}, content: map[string]string{}}
+}
+
+func (b *contentBackend) List(ctx context.Context) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var keys []string
+	for key := range b.files {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (b *contentBackend) Exists(ctx context.Context, key string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.files[key]
+	return ok, nil
+}
+
+func (b *contentBackend) Get(ctx context.Context, key string) (Metadata, io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.files[key]
+	if !ok {
+		return m, nil, NotFoundErr
+	}
+	return m, io.NopCloser(strings.NewReader(b.content[key])), nil
+}
+
+func (b *contentBackend) Put(ctx context.Context, key string, r io.Reader, expiryTime time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := Metadata{DeleteKey: deleteKey, Size: int64(len(data)), Compression: "zstd", Expiry: FileExpiry(expiryTime, int64(len(data)))}
+	b.files[key] = m
+	b.content[key] = string(data)
+	return m, nil
+}
+
+func (b *contentBackend) PutMetadata(ctx context.Context, key string, m Metadata) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.files[key] = m
+	return nil
+}
+
+func TestMigrate(t *testing.T) {
+	src, dst := newContentBackend(), newContentBackend()
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	retainUntil := time.Now().Add(time.Hour).Truncate(time.Second)
+	src.files["a"] = Metadata{PublicID: NewPublicID(), DeleteKey: "del", Mimetype: "text/plain", Size: 5, Expiry: expiresAt, RetainUntil: retainUntil, Downloads: 3, Compression: "gzip"}
+	src.content["a"] = "hello"
+	src.files["b"] = Metadata{Expiry: expiry.NeverExpire}
+	src.content["b"] = "world"
+	src.files["expired"] = Metadata{Expiry: time.Now().Add(-time.Hour)}
+	src.content["expired"] = "old"
+	dst.files["b"] = Metadata{Expiry: expiry.NeverExpire}
+	dst.content["b"] = "already copied"
+
+	progress := 0
+	copied, errs := Migrate(context.Background(), src, dst, MigrateOptions{
+		Workers: 2,
+		Progress: func(key string, done, total int, err error) {
+			progress++
+			if total != 3 || done != progress {
+				t.Errorf("Unexpected progress %d/%d for %s", done, total, key)
+			}
+		},
+	})
+	if copied != 1 || len(errs) != 0 {
+		t.Fatalf("Expected a file to be copied, got %d, %v", copied, errs)
+	}
+	if progress != 3 {
+		t.Fatalf("Expected progress for every file, got %d", progress)
+	}
+
+	m := dst.files["a"]
+	want := src.files["a"]
+	if m.PublicID != want.PublicID || m.DeleteKey != want.DeleteKey || m.Mimetype != want.Mimetype ||
+		!m.Expiry.Equal(want.Expiry) || !m.RetainUntil.Equal(want.RetainUntil) || m.Downloads != want.Downloads {
+		t.Fatalf("Metadata wasn't carried over, got %+v", m)
+	}
+	if m.Compression != "zstd" {
+		t.Fatalf("Expected how dst stores the file to be kept, got %q", m.Compression)
+	}
+	if dst.content["a"] != "hello" || dst.content["b"] != "already copied" {
+		t.Fatalf("Unexpected content %v", dst.content)
+	}
+	if _, ok := dst.files["expired"]; ok {
+		t.Fatal("Expected the expired file not to be copied")
+	}
+}
@@ -0,0 +1,86 @@
+package backends
+
+import (
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Longest original name kept in bytes when Limits.MaxNameLength isn't set,
+// the most filesystems allow for a file name
+const DefaultMaxNameLength = 255
+
+// Custom metadata key the original name is kept under as it was given when
+// Limits.KeepRawName is set and sanitizing it changed it
+const RawNameCustomKey = "raw_name"
+
+// Make a file's original name safe to store and use in downloads: it's
+// normalized to NFC, control characters, line breaks and bidirectional
+// overrides (which can disguise an extension) are removed, path separators
+// are replaced with underscores and it's truncated to Limits.MaxNameLength
+// bytes, keeping its extension where it can
+func SanitizeName(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = norm.NFC.String(name)
+
+	name = strings.Map(func(c rune) rune {
+		switch {
+		case c == '/' || c == '\\':
+			return '_'
+		case unicode.IsControl(c) || unicode.In(c, unicode.Zl, unicode.Zp, unicode.Bidi_Control):
+			return -1
+		}
+		return c
+	}, name)
+	name = strings.TrimSpace(name)
+
+	maxLength := Limits.MaxNameLength
+	if maxLength <= 0 {
+		maxLength = DefaultMaxNameLength
+	}
+	if len(name) <= maxLength {
+		return name
+	}
+
+	ext := path.Ext(name)
+	if len(ext) > maxLength/2 {
+		ext = ""
+	}
+	return truncateUTF8(strings.TrimSuffix(name, ext), maxLength-len(ext)) + ext
+}
+
+// Cut s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Sanitize the original name a file is being stored with, returning the
+// custom metadata to store with it. With Limits.KeepRawName set, the name as
+// given is added to a copy of custom if sanitizing changed it and it fits
+// within MaxCustomSize.
+func SanitizeOriginalName(name string, custom map[string]string) (string, map[string]string) {
+	sanitized := SanitizeName(name)
+	if !Limits.KeepRawName || sanitized == name {
+		return sanitized, custom
+	}
+
+	withRaw := make(map[string]string, len(custom)+1)
+	for k, v := range custom {
+		withRaw[k] = v
+	}
+	withRaw[RawNameCustomKey] = name
+
+	if CheckCustom(withRaw) != nil {
+		return sanitized, custom
+	}
+	return sanitized, withRaw
+}
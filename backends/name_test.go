@@ -0,0 +1,67 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	for _, test := range []struct{ name, want string }{
+		{"report.pdf", "report.pdf"},
+		{"evil\r\nSet-Cookie: a=b.txt", "evilSet-Cookie: a=b.txt"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{"dir\\file.txt", "dir_file.txt"},
+		{"café.txt", "café.txt"},
+		{"invoice\u202etxt.exe", "invoicetxt.exe"},
+		{"  padded  ", "padded"},
+		{"bad\xffutf8", "badutf8"},
+	} {
+		if got := SanitizeName(test.name); got != test.want {
+			t.Errorf("SanitizeName(%q) = %q, expected %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeNameTruncates(t *testing.T) {
+	Limits.MaxNameLength = 10
+	defer func() { Limits.MaxNameLength = 0 }()
+
+	if got := SanitizeName("averylongname.txt"); got != "averyl.txt" {
+		t.Fatalf("Expected the extension to be kept, got %q", got)
+	}
+	if got := SanitizeName("name.verylongextension"); got != "name.veryl" {
+		t.Fatalf("Expected a long extension to be cut, got %q", got)
+	}
+	if got := SanitizeName("ééééééé"); got != "ééééé" {
+		t.Fatalf("Expected a character not to be split, got %q", got)
+	}
+
+	Limits.MaxNameLength = 0
+	if got := SanitizeName(strings.Repeat("a", 300)); len(got) != DefaultMaxNameLength {
+		t.Fatalf("Expected the default limit, got %d bytes", len(got))
+	}
+}
+
+func TestSanitizeOriginalName(t *testing.T) {
+	custom := map[string]string{"a": "b"}
+
+	name, got := SanitizeOriginalName("x\ny", custom)
+	if name != "xy" || len(got) != 1 {
+		t.Fatalf("Expected the raw name not to be kept, got %q, %v", name, got)
+	}
+
+	Limits.KeepRawName = true
+	defer func() { Limits.KeepRawName = false }()
+
+	name, got = SanitizeOriginalName("x\ny", custom)
+	if name != "xy" || got[RawNameCustomKey] != "x\ny" || got["a"] != "b" {
+		t.Fatalf("Expected the raw name to be kept, got %q, %v", name, got)
+	}
+	if _, ok := custom[RawNameCustomKey]; ok {
+		t.Fatal("The caller's custom metadata was modified")
+	}
+
+	if _, got = SanitizeOriginalName("clean", custom); got[RawNameCustomKey] != "" {
+		t.Fatalf("Expected unchanged names not to be kept, got %v", got)
+	}
+}
@@ -0,0 +1,39 @@
+package backends
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Add a Link preload header to w for each of the first max images listed in
+// the archive under key, so that a page showing them as a gallery can have
+// the browser fetch them before it gets to them. entryURL gives the
+// escaped URL an entry is served at, or "" to leave it out. Files that
+// aren't archives get no headers.
+func WritePreloadLinks(ctx context.Context, b StorageBackend, key string, w http.ResponseWriter, max int, entryURL func(entry ArchiveEntry) string) error {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range m.ArchiveFiles {
+		if max <= 0 {
+			break
+		}
+		if entry.IsDir || !strings.HasPrefix(mime.TypeByExtension(path.Ext(entry.Name)), "image/") {
+			continue
+		}
+
+		// A name that wasn't escaped mustn't break out of the header
+		url := entryURL(entry)
+		if url == "" || strings.ContainsAny(url, "<>\r\n") {
+			continue
+		}
+		w.Header().Add("Link", "<"+url+">; rel=preload; as=image")
+		max--
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package backends
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestWritePreloadLinks(t *testing.T) {
+	b := &metadataBackend{files: map[string]Metadata{
+		"photos.zip": {ArchiveFiles: []ArchiveEntry{
+			{Name: "photos/", IsDir: true},
+			{Name: "photos/a b.jpg"},
+			{Name: "photos/notes.txt"},
+			{Name: "photos/c.png"},
+			{Name: "photos/d.gif"},
+		}},
+	}}
+	entryURL := func(entry ArchiveEntry) string {
+		return "/photos.zip/" + url.PathEscape(entry.Name)
+	}
+
+	w := httptest.NewRecorder()
+	if err := WritePreloadLinks(context.Background(), b, "photos.zip", w, 2, entryURL); err != nil {
+		t.Fatal(err)
+	}
+	links := w.Header().Values("Link")
+	if len(links) != 2 || links[0] != "</photos.zip/photos%2Fa%20b.jpg>; rel=preload; as=image" ||
+		links[1] != "</photos.zip/photos%2Fc.png>; rel=preload; as=image" {
+		t.Fatalf("Unexpected Link headers %q", links)
+	}
+
+	w = httptest.NewRecorder()
+	WritePreloadLinks(context.Background(), b, "photos.zip", w, 10, func(entry ArchiveEntry) string {
+		return "/" + entry.Name + ">; rel=stylesheet"
+	})
+	if links := w.Header().Values("Link"); len(links) != 0 {
+		t.Fatalf("Expected unescaped URLs to be left out, got %q", links)
+	}
+}
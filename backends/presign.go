@@ -0,0 +1,52 @@
+package backends
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The Content-Disposition that presigned URLs ask the provider to send, so
+// that a file downloads under the name it was uploaded with
+func PresignDisposition(m Metadata) string {
+	if m.OriginalName == "" {
+		return ""
+	}
+	return AttachmentDisposition(m.OriginalName)
+}
+
+// Query parameters that let key be downloaded until expires without its
+// access key, signed with an HMAC-SHA256 of both
+func SignURL(secret []byte, key string, expires time.Time) url.Values {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	q := url.Values{}
+	q.Set("expires", exp)
+	q.Set("signature", urlSignature(secret, key, exp))
+	return q
+}
+
+// Whether q holds a signature made by SignURL for key that hasn't expired
+func VerifySignedURL(secret []byte, key string, q url.Values) bool {
+	exp := q.Get("expires")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+
+	signature, err := hex.DecodeString(q.Get("signature"))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(urlSignature(secret, key, exp))
+	return hmac.Equal(signature, expected)
+}
+
+func urlSignature(secret []byte, key string, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,32 @@
+package backends
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignURL(t *testing.T) {
+	secret := []byte("secret")
+	q := SignURL(secret, "file.txt", time.Now().Add(time.Minute))
+
+	if !VerifySignedURL(secret, "file.txt", q) {
+		t.Fatal("Valid signature was rejected")
+	}
+	if VerifySignedURL(secret, "other.txt", q) {
+		t.Fatal("Signature was accepted for another key")
+	}
+	if VerifySignedURL([]byte("other"), "file.txt", q) {
+		t.Fatal("Signature was accepted with another secret")
+	}
+
+	tampered := SignURL(secret, "file.txt", time.Now().Add(time.Minute))
+	tampered.Set("expires", "99999999999")
+	if VerifySignedURL(secret, "file.txt", tampered) {
+		t.Fatal("Signature was accepted with a changed expiry")
+	}
+
+	expired := SignURL(secret, "file.txt", time.Now().Add(-time.Second))
+	if VerifySignedURL(secret, "file.txt", expired) {
+		t.Fatal("Expired signature was accepted")
+	}
+}
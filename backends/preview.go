@@ -0,0 +1,57 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"unicode/utf8"
+)
+
+// Read the start of a text file, for backends to implement Preview with.
+// Only the first maxBytes are read, cut back to the last whole UTF-8
+// character, and truncated reports whether the file goes on past them. Files
+// of unknown type are previewed if IsTextContent finds their start is text.
+func Preview(ctx context.Context, b StorageBackend, key string, maxBytes int) (preview string, truncated bool, err error) {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return
+	}
+	if !IsTextContent(m.Mimetype, nil) && !isOpaque(m.Mimetype) {
+		return "", false, NotTextErr
+	}
+	if m.Size == 0 || maxBytes <= 0 {
+		return "", m.Size > 0, nil
+	}
+
+	f, err := b.GetRange(ctx, key, 0, int64(maxBytes))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(f, int64(maxBytes)))
+	if err != nil {
+		return
+	}
+	if !IsTextContent(m.Mimetype, buf) {
+		return "", false, NotTextErr
+	}
+
+	truncated = m.Size > int64(len(buf))
+	if truncated {
+		buf = trimPartialRune(buf)
+	}
+	return string(buf), truncated, nil
+}
+
+// Drop a trailing UTF-8 character cut off partway through its bytes
+func trimPartialRune(buf []byte) []byte {
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				return buf[:i]
+			}
+			break
+		}
+	}
+	return buf
+}
@@ -0,0 +1,65 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+type previewBackend struct {
+	StorageBackend
+	mimetype string
+	content  string
+}
+
+func (b previewBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	return Metadata{Mimetype: b.mimetype, Size: int64(len(b.content))}, nil
+}
+
+func (b previewBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	length, err := RangeLength(int64(len(b.content)), offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(b.content[offset : offset+length])), nil
+}
+
+func TestPreview(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		content   string
+		maxBytes  int
+		preview   string
+		truncated bool
+	}{
+		{"hello", 10, "hello", false},
+		{"hello", 5, "hello", false},
+		{"hello world", 5, "hello", true},
+		{"héllo", 2, "h", true},
+		{"héllo", 3, "hé", true},
+		{"日本語", 5, "日", true},
+		{"", 10, "", false},
+	} {
+		b := previewBackend{mimetype: "text/plain; charset=utf-8", content: tt.content}
+		preview, truncated, err := Preview(ctx, b, "key", tt.maxBytes)
+		if err != nil || preview != tt.preview || truncated != tt.truncated {
+			t.Errorf("Preview of %q up to %d returned %q, %v, %v", tt.content, tt.maxBytes, preview, truncated, err)
+		}
+	}
+
+	b := previewBackend{mimetype: "image/png", content: "\x89PNG"}
+	if _, _, err := Preview(ctx, b, "key", 10); err != NotTextErr {
+		t.Fatalf("Preview of an image returned %v", err)
+	}
+
+	b = previewBackend{mimetype: "application/octet-stream", content: "plain words"}
+	if preview, _, err := Preview(ctx, b, "key", 10); err != nil || preview != "plain word" {
+		t.Fatalf("Preview of opaque text returned %q, %v", preview, err)
+	}
+	b = previewBackend{mimetype: "application/octet-stream", content: "\x7fELF\x02\x01\x01\x00"}
+	if _, _, err := Preview(ctx, b, "key", 10); err != NotTextErr {
+		t.Fatalf("Preview of an opaque binary returned %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package backends
+
+import (
+	"context"
+
+	"github.com/dchest/uniuri"
+)
+
+// Length of the identifiers files are given to be linked to by, independent
+// of the key they're stored under
+const PublicIDLength = 22
+
+// Generate a random public ID for a newly stored file
+func NewPublicID() string {
+	return uniuri.NewLen(PublicIDLength)
+}
+
+// Whether id could have been generated by NewPublicID, so that it's safe to
+// look up
+func IsPublicID(id string) bool {
+	if len(id) != PublicIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Find the key of the file with public ID id by the metadata of every file,
+// for backends without an index to implement GetByPublicID with. Returns
+// NotFoundErr if no file has it.
+func FindByPublicID(ctx context.Context, b MetaStorageBackend, id string) (string, error) {
+	if !IsPublicID(id) {
+		return "", NotFoundErr
+	}
+
+	keys, err := b.List(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range keys {
+		m, err := b.Head(ctx, key)
+		if err == NotFoundErr {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if m.PublicID == id {
+			return key, nil
+		}
+	}
+	return "", NotFoundErr
+}
@@ -0,0 +1,33 @@
+package backends
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPublicID(t *testing.T) {
+	id := NewPublicID()
+	if !IsPublicID(id) || id == NewPublicID() {
+		t.Fatalf("Expected a fresh valid ID, got %q", id)
+	}
+	for _, invalid := range []string{"", "short", "../../../../etc/passwd", id[1:] + "/"} {
+		if IsPublicID(invalid) {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+
+	b := &metadataBackend{files: map[string]Metadata{
+		"a.png": {PublicID: id},
+		"b.png": {PublicID: NewPublicID()},
+		"c.txt": {},
+	}}
+	if key, err := FindByPublicID(context.Background(), b, id); err != nil || key != "a.png" {
+		t.Fatalf("Expected a.png, got %q, %v", key, err)
+	}
+	if _, err := FindByPublicID(context.Background(), b, NewPublicID()); err != NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+	if _, err := FindByPublicID(context.Background(), b, ""); err != NotFoundErr {
+		t.Fatalf("Expected NotFoundErr for an empty ID, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Delete every file that expired before now, returning the purged keys and
+// the number of bytes reclaimed. Failing to delete a file doesn't stop the
+// purge, such errors are joined together in err.
+func PurgeExpired(ctx context.Context, b MetaStorageBackend, now time.Time) (purged []string, bytes int64, err error) {
+	keys, err := b.ListExpired(ctx, now)
+	if err != nil {
+		return
+	}
+
+	sizes := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		if size, err := b.Size(ctx, key); err == nil {
+			sizes[key] = size
+		}
+	}
+
+	purged, failed := b.BatchDelete(ctx, keys)
+	for _, key := range purged {
+		bytes += sizes[key]
+	}
+
+	var errs []error
+	for _, key := range keys {
+		// Locked files are left for a purge after their retention date
+		if derr, ok := failed[key]; ok && derr != RetentionLockedErr {
+			errs = append(errs, fmt.Errorf("%s: %w", key, derr))
+		}
+	}
+
+	err = errors.Join(errs...)
+	return
+}
@@ -0,0 +1,72 @@
+package backends
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Which files Query returns. Files have to match every field that's set,
+// and a zero ListFilter matches every file.
+type ListFilter struct {
+	// Pattern the mimetype, without any parameters, has to match, such
+	// as image/*
+	Mimetype string
+	// Start of the hex-encoded sha256sum, such as to find the duplicates
+	// of a file by its whole sum
+	Sha256Prefix string
+	// Only files uploaded after this time
+	UploadedAfter time.Time
+	// Bounds on the size in bytes, inclusive. A MaxSize of 0 means there
+	// is no upper bound.
+	MinSize int64
+	MaxSize int64
+}
+
+func (f ListFilter) Matches(m Metadata) bool {
+	if f.Mimetype != "" {
+		mimetype, _, _ := strings.Cut(m.Mimetype, ";")
+		if ok, _ := path.Match(f.Mimetype, strings.TrimSpace(mimetype)); !ok {
+			return false
+		}
+	}
+	if !strings.HasPrefix(m.Sha256sum, strings.ToLower(f.Sha256Prefix)) {
+		return false
+	}
+	if !f.UploadedAfter.IsZero() && !m.Uploaded.After(f.UploadedAfter) {
+		return false
+	}
+	if m.Size < f.MinSize || f.MaxSize > 0 && m.Size > f.MaxSize {
+		return false
+	}
+	return true
+}
+
+// Find the files matching filter by the metadata of every file, for
+// backends to implement Query with. Keys are returned sorted, and files
+// deleted while listing are skipped.
+func Query(ctx context.Context, b MetaStorageBackend, filter ListFilter) ([]string, error) {
+	keys, err := b.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var output []string
+	for _, key := range keys {
+		m, err := b.Head(ctx, key)
+		if err == NotFoundErr {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if filter.Matches(m) {
+			output = append(output, key)
+		}
+	}
+
+	sort.Strings(output)
+	return output, nil
+}
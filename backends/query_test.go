@@ -0,0 +1,36 @@
+package backends
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	b := &metadataBackend{files: map[string]Metadata{
+		"a.png": {Mimetype: "image/png", Sha256sum: "abc1", Size: 100, Uploaded: time.Unix(1000, 0)},
+		"b.png": {Mimetype: "image/png", Sha256sum: "abc1", Size: 100, Uploaded: time.Unix(2000, 0)},
+		"c.txt": {Mimetype: "text/plain; charset=utf-8", Sha256sum: "def2", Size: 10, Uploaded: time.Unix(3000, 0)},
+	}}
+
+	for _, tt := range []struct {
+		filter ListFilter
+		keys   []string
+	}{
+		{ListFilter{}, []string{"a.png", "b.png", "c.txt"}},
+		{ListFilter{Mimetype: "image/*"}, []string{"a.png", "b.png"}},
+		{ListFilter{Mimetype: "text/plain"}, []string{"c.txt"}},
+		{ListFilter{Sha256Prefix: "ABC"}, []string{"a.png", "b.png"}},
+		{ListFilter{UploadedAfter: time.Unix(1000, 0)}, []string{"b.png", "c.txt"}},
+		{ListFilter{MinSize: 50}, []string{"a.png", "b.png"}},
+		{ListFilter{MaxSize: 50}, []string{"c.txt"}},
+		{ListFilter{Mimetype: "image/*", UploadedAfter: time.Unix(1500, 0)}, []string{"b.png"}},
+		{ListFilter{Mimetype: "video/*"}, nil},
+	} {
+		keys, err := Query(context.Background(), b, tt.filter)
+		if err != nil || !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("Query(%+v) returned %v, %v", tt.filter, keys, err)
+		}
+	}
+}
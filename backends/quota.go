@@ -0,0 +1,199 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// How long a reservation holds quota for before it's dropped, if it's
+// neither used nor released
+const ReservationTTL = time.Hour
+
+type reservation struct {
+	size    int64
+	expires time.Time
+}
+
+// Wraps a MetaStorageBackend, letting clients reserve room for a file
+// before uploading it so that an upload over Limits.MaxSize,
+// Limits.MaxFiles or Limits.MaxTotalSize is refused before any of it is
+// sent. Files stored without a reservation are refused once the quota is
+// used up, counting what's reserved. Unlike the other wrappers it needs
+// Stats, so it only wraps a MetaStorageBackend.
+type QuotaBackend struct {
+	MetaStorageBackend
+	q *quota
+}
+
+type quota struct {
+	mu           sync.Mutex
+	reservations map[string]reservation
+	reserved     int64
+	// Stats as of counted, with the files stored since added to them
+	stats   Stats
+	counted time.Time
+}
+
+func NewQuotaBackend(b MetaStorageBackend) QuotaBackend {
+	return QuotaBackend{b, &quota{reservations: make(map[string]reservation)}}
+}
+
+// Reserve room for a file of size bytes, returning a token to pass to Put
+// in PutOptions.Reservation, or QuotaExceededErr if it wouldn't fit
+func (b QuotaBackend) Reserve(ctx context.Context, size int64) (token string, expires time.Time, err error) {
+	if size < 0 || (Limits.MaxSize > 0 && size > Limits.MaxSize) {
+		return "", time.Time{}, QuotaExceededErr
+	}
+
+	b.q.mu.Lock()
+	defer b.q.mu.Unlock()
+
+	if err = b.refresh(ctx); err != nil {
+		return
+	}
+	if !b.fits(size, 1) {
+		return "", time.Time{}, QuotaExceededErr
+	}
+
+	token = uniuri.NewLen(30)
+	expires = time.Now().Add(ReservationTTL)
+	b.q.reservations[token] = reservation{size, expires}
+	b.q.reserved += size
+	return
+}
+
+// Give back the room a reservation held, if it's still held
+func (b QuotaBackend) Release(token string) {
+	b.q.mu.Lock()
+	defer b.q.mu.Unlock()
+
+	b.take(token)
+}
+
+func (b QuotaBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (m Metadata, err error) {
+	res, err := b.admit(ctx, o.Reservation)
+	if err != nil {
+		return
+	}
+
+	// Reserved files can't grow past what was reserved for them
+	var limited *limitedReader
+	if o.Reservation != "" {
+		limited = &limitedReader{r: r, left: res.size}
+		r = limited
+	}
+
+	m, err = b.MetaStorageBackend.Put(ctx, key, r, expiry, deleteKey, accessKey, srcIp, originalName, o)
+
+	// Callers can retry another key with the same reservation if
+	// nothing was read yet
+	if err == KeyConflictErr && limited != nil && limited.left == res.size {
+		b.q.mu.Lock()
+		b.q.reservations[o.Reservation] = res
+		b.q.reserved += res.size
+		b.q.mu.Unlock()
+	}
+	if err == nil {
+		b.stored(m.Size)
+	}
+	return
+}
+
+func (b QuotaBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (m Metadata, err error) {
+	if _, err = b.admit(ctx, o.Reservation); err != nil {
+		return
+	}
+
+	m, err = b.MetaStorageBackend.Finalize(ctx, key, expiry, deleteKey, accessKey, srcIp, originalName, o)
+	if err == nil {
+		b.stored(m.Size)
+	}
+	return
+}
+
+// Use up the reservation with token, or without one check that there's
+// room left for another file
+func (b QuotaBackend) admit(ctx context.Context, token string) (reservation, error) {
+	b.q.mu.Lock()
+	defer b.q.mu.Unlock()
+
+	if token != "" {
+		res, ok := b.take(token)
+		if !ok {
+			return res, ReservationNotFoundErr
+		}
+		return res, nil
+	}
+
+	if err := b.refresh(ctx); err != nil {
+		return reservation{}, err
+	}
+	// Files can't be empty, so there has to be room for at least a byte
+	if !b.fits(1, 1) {
+		return reservation{}, QuotaExceededErr
+	}
+	return reservation{}, nil
+}
+
+// Remove a reservation, reporting whether it was there and hadn't expired.
+// Must be called with the lock held.
+func (b QuotaBackend) take(token string) (reservation, bool) {
+	res, ok := b.q.reservations[token]
+	if !ok {
+		return res, false
+	}
+	delete(b.q.reservations, token)
+	b.q.reserved -= res.size
+	return res, time.Now().Before(res.expires)
+}
+
+// Whether more files of size bytes altogether fit alongside those stored
+// and reserved. Files deleted since the last Stats are still counted until
+// the next. Must be called with the lock held.
+func (b QuotaBackend) fits(size int64, files int64) bool {
+	if Limits.MaxFiles > 0 && b.q.stats.FileCount+int64(len(b.q.reservations))+files > Limits.MaxFiles {
+		return false
+	}
+	if Limits.MaxTotalSize > 0 && b.q.stats.TotalBytes+b.q.reserved+size > Limits.MaxTotalSize {
+		return false
+	}
+	return true
+}
+
+// Drop expired reservations, and get Stats again if they're stale. Must be
+// called with the lock held.
+func (b QuotaBackend) refresh(ctx context.Context) error {
+	now := time.Now()
+	for token, res := range b.q.reservations {
+		if now.After(res.expires) {
+			b.take(token)
+		}
+	}
+
+	if Limits.MaxFiles <= 0 && Limits.MaxTotalSize <= 0 {
+		return nil
+	}
+	if time.Since(b.q.counted) <= fileRecountInterval {
+		return nil
+	}
+	stats, err := b.MetaStorageBackend.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	b.q.stats = stats
+	b.q.counted = now
+	return nil
+}
+
+// Count a file stored since the last Stats
+func (b QuotaBackend) stored(size int64) {
+	b.q.mu.Lock()
+	defer b.q.mu.Unlock()
+
+	b.q.stats.FileCount++
+	b.q.stats.TotalBytes += size
+}
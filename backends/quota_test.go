@@ -0,0 +1,86 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type quotaMemBackend struct {
+	MetaStorageBackend
+	mem *memBackend
+}
+
+func (b quotaMemBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	if _, ok := b.mem.files[key]; ok {
+		return Metadata{}, KeyConflictErr
+	}
+	return b.mem.Put(ctx, key, r, expiry, deleteKey, accessKey, srcIp, originalName, o)
+}
+
+func (b quotaMemBackend) Stats(ctx context.Context) (s Stats, err error) {
+	for _, content := range b.mem.files {
+		s.FileCount++
+		s.TotalBytes += int64(len(content))
+	}
+	return
+}
+
+func TestQuotaBackend(t *testing.T) {
+	Limits.MaxSize = 100
+	Limits.MaxTotalSize = 20
+	defer func() { Limits.MaxSize, Limits.MaxTotalSize = 0, 0 }()
+
+	ctx := context.Background()
+	mem := &memBackend{files: map[string]string{"old": "12345"}}
+	b := NewQuotaBackend(quotaMemBackend{mem: mem})
+
+	if _, _, err := b.Reserve(ctx, 16); err != QuotaExceededErr {
+		t.Fatalf("Expected a reservation past the total size to fail, got %v", err)
+	}
+	token, expires, err := b.Reserve(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expires) <= 0 {
+		t.Fatalf("Reservation expires at %v", expires)
+	}
+
+	// Only 5 bytes are left besides what's reserved
+	if _, _, err := b.Reserve(ctx, 6); err != QuotaExceededErr {
+		t.Fatalf("Expected reserved room to be counted, got %v", err)
+	}
+
+	// Taken keys leave the reservation to retry with
+	if _, err := b.Put(ctx, "old", strings.NewReader("0123456789"), 0, "", "", "", "", PutOptions{Reservation: token}); err != KeyConflictErr {
+		t.Fatalf("Expected KeyConflictErr, got %v", err)
+	}
+	if _, err := b.Put(ctx, "new", strings.NewReader("0123456789"), 0, "", "", "", "", PutOptions{Reservation: token}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(ctx, "again", strings.NewReader("x"), 0, "", "", "", "", PutOptions{Reservation: token}); err != ReservationNotFoundErr {
+		t.Fatalf("Expected a used reservation to be gone, got %v", err)
+	}
+
+	token, _, err = b.Reserve(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(ctx, "big", strings.NewReader("123"), 0, "", "", "", "", PutOptions{Reservation: token}); err != FileTooLargeError {
+		t.Fatalf("Expected a file over its reservation to fail, got %v", err)
+	}
+
+	token, _, err = b.Reserve(ctx, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(ctx, "other", strings.NewReader("y"), 0, "", "", "", "", PutOptions{}); err != QuotaExceededErr {
+		t.Fatalf("Expected an upload without a reservation to fail when all room is reserved, got %v", err)
+	}
+	b.Release(token)
+	if _, err := b.Put(ctx, "other", strings.NewReader("y"), 0, "", "", "", "", PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
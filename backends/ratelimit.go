@@ -0,0 +1,91 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Token buckets keyed by source IP, each refilled at rate tokens per second
+// up to burst. Buckets that have been idle long enough to refill completely
+// are dropped, as a new one would start out the same.
+type RateLimiter struct {
+	rate  rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:      rate.Limit(perSecond),
+		burst:     burst,
+		buckets:   make(map[string]*rate.Limiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take a token from srcIp's bucket, returning false if it's empty
+func (l *RateLimiter) Allow(srcIp string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		for ip, bucket := range l.buckets {
+			if bucket.TokensAt(now) >= float64(l.burst) {
+				delete(l.buckets, ip)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[srcIp]
+	if !ok {
+		bucket = rate.NewLimiter(l.rate, l.burst)
+		l.buckets[srcIp] = bucket
+	}
+	return bucket.AllowN(now, 1)
+}
+
+// Wraps a StorageBackend, returning RateLimitedErr from Put and Finalize
+// once the client they're storing a file for has run out of tokens. Files
+// stored without a source IP, such as by migrations and imports, aren't
+// limited, rather than all sharing one bucket.
+type RateLimitedBackend struct {
+	StorageBackend
+	limiter *RateLimiter
+}
+
+func NewRateLimitedBackend(b StorageBackend, perSecond float64, burst int) RateLimitedBackend {
+	return RateLimitedBackend{b, NewRateLimiter(perSecond, burst)}
+}
+
+func (b RateLimitedBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	if srcIp != "" && !b.limiter.Allow(srcIp) {
+		return Metadata{}, RateLimitedErr
+	}
+	return b.StorageBackend.Finalize(ctx, key, expiry, deleteKey, accessKey, srcIp, originalName, o)
+}
+
+func (b RateLimitedBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	if srcIp != "" && !b.limiter.Allow(srcIp) {
+		return Metadata{}, RateLimitedErr
+	}
+	return b.StorageBackend.Put(ctx, key, r, expiry, deleteKey, accessKey, srcIp, originalName, o)
+}
+
+// A RateLimitedBackend around a MetaStorageBackend
+type RateLimitedMetaBackend struct {
+	RateLimitedBackend
+	metaForwarder
+}
+
+func NewRateLimitedMetaBackend(b MetaStorageBackend, perSecond float64, burst int) RateLimitedMetaBackend {
+	return RateLimitedMetaBackend{NewRateLimitedBackend(b, perSecond, burst), metaForwarder{b}}
+}
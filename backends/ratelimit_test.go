@@ -0,0 +1,45 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Accepts every Put, leaving every other method unimplemented
+type putBackend struct {
+	StorageBackend
+}
+
+func (b putBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	return Metadata{}, nil
+}
+
+func TestRateLimitedBackend(t *testing.T) {
+	ctx := context.Background()
+	b := NewRateLimitedBackend(putBackend{}, 0.001, 2)
+	put := func(srcIp string) error {
+		_, err := b.Put(ctx, "key", strings.NewReader("a"), 0, "", "", srcIp, "", PutOptions{})
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := put("1.2.3.4"); err != nil {
+			t.Fatalf("Put %d within the burst returned %v", i, err)
+		}
+	}
+	if err := put("1.2.3.4"); err != RateLimitedErr {
+		t.Fatalf("Put past the burst returned %v", err)
+	}
+	if err := put("5.6.7.8"); err != nil {
+		t.Fatalf("Put from another IP returned %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := put(""); err != nil {
+			t.Fatalf("Put %d without a source IP returned %v", i, err)
+		}
+	}
+}
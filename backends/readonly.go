@@ -0,0 +1,102 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Wraps a StorageBackend, returning ReadOnlyErr from every method that
+// would change what's stored while files can still be read and served, such
+// as to keep storage in a consistent state during a backup. Backends whose
+// reads write to storage as well, as localfs's do, can only be kept from it
+// by NewReadOnlyMetaBackend. What's left is what reading changes outside of
+// the backend's control, such as access times.
+type ReadOnlyBackend struct {
+	StorageBackend
+}
+
+func NewReadOnlyBackend(b StorageBackend) ReadOnlyBackend {
+	return ReadOnlyBackend{b}
+}
+
+func (b ReadOnlyBackend) Append(ctx context.Context, key string, r io.Reader, offset int64) (int64, error) {
+	return 0, ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) Copy(ctx context.Context, srcKey, dstKey string) (Metadata, error) {
+	return Metadata{}, ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) Delete(ctx context.Context, key string) error {
+	return ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	errs := make(map[string]error, len(keys))
+	for _, key := range keys {
+		errs[key] = ReadOnlyErr
+	}
+	return nil, errs
+}
+
+func (b ReadOnlyBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	return Metadata{}, ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	return Metadata{}, ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) PutMetadata(ctx context.Context, key string, m Metadata) error {
+	return ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	return ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	return ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) Touch(ctx context.Context, key string, extend time.Duration) error {
+	return ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error {
+	return ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) Restore(ctx context.Context, key string) error {
+	return ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) PurgeTrash(ctx context.Context, olderThan time.Duration) error {
+	return ReadOnlyErr
+}
+
+func (b ReadOnlyBackend) PurgeUploads(ctx context.Context, olderThan time.Duration) error {
+	return ReadOnlyErr
+}
+
+// A ReadOnlyBackend around a MetaStorageBackend
+type ReadOnlyMetaBackend struct {
+	ReadOnlyBackend
+	metaForwarder
+}
+
+// Implemented by backends whose reads write to storage, returning one
+// that doesn't
+type readOnlySetter interface {
+	ReadOnly() MetaStorageBackend
+}
+
+// Wrap b directly, rather than other wrappers around it, for backends whose
+// reads write to storage to be told not to
+func NewReadOnlyMetaBackend(b MetaStorageBackend) ReadOnlyMetaBackend {
+	if s, ok := b.(readOnlySetter); ok {
+		b = s.ReadOnly()
+	}
+	return ReadOnlyMetaBackend{NewReadOnlyBackend(b), metaForwarder{b}}
+}
@@ -0,0 +1,41 @@
+package backends
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyBackend(t *testing.T) {
+	ctx := context.Background()
+	mem := &memBackend{files: map[string]string{"a": "hello"}}
+	b := NewReadOnlyBackend(mem)
+
+	if _, err := b.Put(ctx, "b", strings.NewReader("new"), 0, "", "", "", "", PutOptions{}); err != ReadOnlyErr {
+		t.Fatalf("Expected ReadOnlyErr from Put, got %v", err)
+	}
+	if err := b.Delete(ctx, "a"); err != ReadOnlyErr {
+		t.Fatalf("Expected ReadOnlyErr from Delete, got %v", err)
+	}
+	if err := b.SetExpiry(ctx, "a", time.Now()); err != ReadOnlyErr {
+		t.Fatalf("Expected ReadOnlyErr from SetExpiry, got %v", err)
+	}
+	if deleted, errs := b.BatchDelete(ctx, []string{"a"}); len(deleted) != 0 || errs["a"] != ReadOnlyErr {
+		t.Fatalf("Expected nothing to be deleted, got %v and %v", deleted, errs)
+	}
+	if len(mem.files) != 1 {
+		t.Fatalf("Expected the stored files to be unchanged, got %v", mem.files)
+	}
+
+	_, r, err := b.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Fatalf("Get returned %q", data)
+	}
+}
@@ -0,0 +1,40 @@
+package backends
+
+import (
+	"fmt"
+	"io"
+)
+
+// Scans the content of files as they're stored, for backends configured
+// with one
+type Scanner interface {
+	// Scan reads r to the end, reporting whether it's clean, or the name
+	// of the signature it matched if it isn't
+	Scan(r io.Reader) (clean bool, signature string, err error)
+}
+
+// Returned by Put when the configured Scanner finds malware in a file
+type MalwareDetectedError struct {
+	Signature string
+}
+
+func (e MalwareDetectedError) Error() string {
+	return fmt.Sprintf("File was rejected as malware: %s.", e.Signature)
+}
+
+// Scan the content read from r with s, returning a MalwareDetectedError if
+// it isn't clean. Without a Scanner every file is clean.
+func ScanFile(s Scanner, r io.Reader) error {
+	if s == nil {
+		return nil
+	}
+
+	clean, signature, err := s.Scan(r)
+	if err != nil {
+		return err
+	}
+	if !clean {
+		return MalwareDetectedError{signature}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package backends
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Finds malware in anything containing EICAR
+type eicarScanner struct{}
+
+func (eicarScanner) Scan(r io.Reader) (bool, string, error) {
+	content, err := io.ReadAll(r)
+	if strings.Contains(string(content), "EICAR") {
+		return false, "Eicar-Test-Signature", err
+	}
+	return true, "", err
+}
+
+func TestScanFile(t *testing.T) {
+	if err := ScanFile(nil, strings.NewReader("EICAR")); err != nil {
+		t.Errorf("Scanning without a scanner returned %v", err)
+	}
+	if err := ScanFile(eicarScanner{}, strings.NewReader("clean")); err != nil {
+		t.Errorf("Clean file returned %v", err)
+	}
+
+	var malwareErr MalwareDetectedError
+	err := ScanFile(eicarScanner{}, strings.NewReader("EICAR"))
+	if !errors.As(err, &malwareErr) || malwareErr.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Infected file returned %v", err)
+	}
+}
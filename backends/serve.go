@@ -0,0 +1,324 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/httputil"
+)
+
+type servingKey struct{}
+
+// Returns a context that has reads with it count as serving the file to a
+// client, for backends that act on that, such as by sliding its expiry.
+// Reads without it are the server's own, such as for thumbnails, exports
+// or migrations.
+func WithServing(ctx context.Context) context.Context {
+	return context.WithValue(ctx, servingKey{}, true)
+}
+
+// Whether ctx was given by WithServing
+func Serving(ctx context.Context) bool {
+	serving, _ := ctx.Value(servingKey{}).(bool)
+	return serving
+}
+
+// Serve the size bytes of content read from rd, honoring Range requests
+// the same way http.ServeContent does. If rd is an io.Seeker it is seeked
+// to each range, otherwise it is only read forwards, skipping the bytes in
+// between and serving multiple ranges in ascending order. Ranges are only
+// served if an If-Range matches the ETag or Last-Modified set on w.
+func ServeReader(w http.ResponseWriter, r *http.Request, rd io.Reader, size int64, contentType string) error {
+	w.Header().Set("Accept-Ranges", "bytes")
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	contentType = w.Header().Get("Content-Type")
+
+	ranges, err := httputil.ParseRange(httputil.RangeHeader(w, r), size)
+	if err != nil {
+		if err == httputil.ErrNoOverlap {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		}
+		w.Header().Del("Content-Length")
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+
+	if httputil.SumRangesSize(ranges) > size {
+		// The total number of bytes in all the ranges is larger than the
+		// size of the file, so serve the whole thing instead
+		ranges = nil
+	}
+
+	seeker, seekable := rd.(io.Seeker)
+	if !seekable {
+		ranges = coalesceRanges(ranges)
+	}
+
+	var pos int64
+	seekTo := func(offset int64) (err error) {
+		if seekable {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, rd, offset-pos)
+		}
+		pos = offset
+		return
+	}
+
+	sendSize := size
+	code := http.StatusOK
+	var mw *multipart.Writer
+
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		if err := seekTo(ra.Start); err != nil {
+			return err
+		}
+		sendSize = ra.Length
+		code = http.StatusPartialContent
+		w.Header().Set("Content-Range", ra.ContentRange(size))
+	} else if len(ranges) > 1 {
+		sendSize = httputil.RangesMIMESize(ranges, contentType, size)
+		code = http.StatusPartialContent
+		mw = multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	}
+
+	if w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
+	}
+
+	w.WriteHeader(code)
+
+	if r.Method == "HEAD" {
+		return nil
+	}
+
+	if mw == nil {
+		_, err = io.CopyN(w, rd, sendSize)
+		return err
+	}
+
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(ra.MimeHeader(contentType, size))
+		if err != nil {
+			return err
+		}
+		if err := seekTo(ra.Start); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(part, rd, ra.Length); err != nil {
+			return err
+		}
+		pos += ra.Length
+	}
+
+	return mw.Close()
+}
+
+// Sort ranges and merge any that overlap, so that they can be served from
+// a reader that can't go backwards
+func coalesceRanges(ranges []httputil.HttpRange) []httputil.HttpRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+
+	sorted := make([]httputil.HttpRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	merged := sorted[:1]
+	for _, ra := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if ra.Start <= last.Start+last.Length {
+			if end := ra.Start + ra.Length; end > last.Start+last.Length {
+				last.Length = end - last.Start
+			}
+			continue
+		}
+		merged = append(merged, ra)
+	}
+
+	return merged
+}
+
+// Quote a file's sha256sum for use as its ETag
+func ETag(sha256sum string) string {
+	if sha256sum == "" {
+		return ""
+	}
+	return "\"" + sha256sum + "\""
+}
+
+// Have the file saved as an attachment named after its original name, or
+// key if it has none, when the request has a download query parameter
+func SetContentDisposition(w http.ResponseWriter, r *http.Request, key string, m Metadata) {
+	if _, ok := r.URL.Query()["download"]; !ok {
+		return
+	}
+
+	w.Header().Set("Content-Disposition", AttachmentDisposition(attachmentName(key, m)))
+}
+
+// The name a file is saved as: its original name, or key if it has none
+func attachmentName(key string, m Metadata) string {
+	if m.OriginalName == "" {
+		return key
+	}
+	return m.OriginalName
+}
+
+// Content-Security-Policy for files whose markup may be shown but mustn't
+// run anything, such as SVG images opened on their own
+const SandboxContentSecurityPolicy = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; sandbox"
+
+// How files of a mimetype are served
+type ServePolicy struct {
+	// Serve files as attachments even without a download parameter
+	Attachment bool
+	// Content-Security-Policy to serve files with instead of the one set
+	// already, if not empty
+	ContentSecurityPolicy string
+}
+
+// Policies for the mimetypes browsers run scripts in when shown inline:
+// HTML is downloaded rather than shown, and SVG images are shown sandboxed
+var DefaultServePolicies = map[string]ServePolicy{
+	"text/html":             {Attachment: true},
+	"application/xhtml+xml": {Attachment: true},
+	"image/svg+xml":         {ContentSecurityPolicy: SandboxContentSecurityPolicy},
+}
+
+// Set the headers a file described by m is served with by ServeFile: its
+// Content-Disposition as SetContentDisposition does, and whatever its
+// mimetype's policy in Limits.ServePolicies asks for. Browsers are told not
+// to sniff the content, as the stored mimetype is authoritative.
+func SetServeHeaders(w http.ResponseWriter, r *http.Request, key string, m Metadata) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	SetContentDisposition(w, r, key, m)
+
+	policy, ok := matchMimetype(Limits.ServePolicies, m.Mimetype)
+	if !ok {
+		return
+	}
+	if policy.Attachment {
+		w.Header().Set("Content-Disposition", AttachmentDisposition(attachmentName(key, m)))
+	}
+	if policy.ContentSecurityPolicy != "" {
+		w.Header().Set("Content-Security-Policy", policy.ContentSecurityPolicy)
+	}
+}
+
+// Content-Disposition value for an attachment called name. Names that
+// aren't plain ASCII are also given RFC 5987 encoded, with an ASCII-only
+// quoted name as a fallback for clients that don't understand it.
+func AttachmentDisposition(name string) string {
+	fallback := strings.Map(func(c rune) rune {
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			return '_'
+		}
+		return c
+	}, name)
+
+	disposition := "attachment; filename=\"" + fallback + "\""
+	if fallback != name {
+		disposition += "; filename*=UTF-8''" + encodeExtValue(name)
+	}
+	return disposition
+}
+
+// Percent-encode everything but the attr-chars of RFC 5987
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		}
+	}
+	return b.String()
+}
+
+// Set the ETag and Last-Modified headers of the file described by m, and
+// answer conditional requests that match them with 304 Not Modified or 412
+// Precondition Failed. Returns true if the response has been written.
+func CheckPreconditions(w http.ResponseWriter, r *http.Request, m Metadata) (done bool) {
+	if m.ETag != "" {
+		w.Header().Set("Etag", m.ETag)
+	}
+	if !m.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", m.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	return httputil.CheckPreconditions(w, r, m.ModTime)
+}
+
+// An io.ReadSeeker over a remote file that is read with one request per
+// contiguous range. Open is called with the offset to read from on the first
+// Read after a Seek, so ServeReader can serve ranges of the file without
+// downloading the bytes before them.
+type RangeReader struct {
+	Open func(offset int64) (io.ReadCloser, error)
+	Size int64
+
+	offset int64
+	r      io.ReadCloser
+}
+
+func (rr *RangeReader) Read(p []byte) (int, error) {
+	if rr.r == nil {
+		r, err := rr.Open(rr.offset)
+		if err != nil {
+			return 0, err
+		}
+		rr.r = r
+	}
+
+	n, err := rr.r.Read(p)
+	rr.offset += int64(n)
+	return n, err
+}
+
+func (rr *RangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += rr.offset
+	case io.SeekEnd:
+		offset += rr.Size
+	}
+	if offset < 0 {
+		return rr.offset, errors.New("Negative seek offset.")
+	}
+
+	if offset != rr.offset {
+		rr.Close()
+		rr.offset = offset
+	}
+	return offset, nil
+}
+
+func (rr *RangeReader) Close() error {
+	if rr.r == nil {
+		return nil
+	}
+	err := rr.r.Close()
+	rr.r = nil
+	return err
+}
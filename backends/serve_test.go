@@ -0,0 +1,303 @@
+package backends
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const serveContent = "0123456789abcdefghij"
+
+// Hide Seek so that ServeReader has to skip through the content
+type forwardReader struct {
+	io.Reader
+}
+
+func serveRange(t *testing.T, rangeHeader string, seekable bool) *httptest.ResponseRecorder {
+	var rd io.Reader = strings.NewReader(serveContent)
+	if !seekable {
+		rd = forwardReader{rd}
+	}
+
+	req := httptest.NewRequest("GET", "/file", nil)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	w := httptest.NewRecorder()
+	err := ServeReader(w, req, rd, int64(len(serveContent)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+func readParts(t *testing.T, w *httptest.ResponseRecorder) []string {
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parts []string
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Range")+" "+string(b))
+	}
+
+	return parts
+}
+
+func TestServeReaderFull(t *testing.T) {
+	w := serveRange(t, "", false)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code was %d instead of 200", w.Code)
+	}
+	if w.Body.String() != serveContent {
+		t.Fatalf("Body was %q", w.Body.String())
+	}
+	if w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatal("Accept-Ranges was not set")
+	}
+}
+
+func TestServeReaderSingleRange(t *testing.T) {
+	for _, seekable := range []bool{true, false} {
+		w := serveRange(t, "bytes=5-9", seekable)
+
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("Status code was %d instead of 206", w.Code)
+		}
+		if w.Body.String() != "56789" {
+			t.Fatalf("Body was %q instead of 56789", w.Body.String())
+		}
+		if cr := w.Header().Get("Content-Range"); cr != "bytes 5-9/20" {
+			t.Fatalf("Content-Range was %q", cr)
+		}
+		if cl := w.Header().Get("Content-Length"); cl != "5" {
+			t.Fatalf("Content-Length was %q", cl)
+		}
+	}
+}
+
+func TestServeReaderSuffixRange(t *testing.T) {
+	w := serveRange(t, "bytes=-3", false)
+
+	if w.Body.String() != "hij" {
+		t.Fatalf("Body was %q instead of hij", w.Body.String())
+	}
+}
+
+func TestServeReaderMultiRange(t *testing.T) {
+	w := serveRange(t, "bytes=0-1,10-12", false)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("Status code was %d instead of 206", w.Code)
+	}
+
+	parts := readParts(t, w)
+	expected := []string{"bytes 0-1/20 01", "bytes 10-12/20 abc"}
+	if strings.Join(parts, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Parts were %q instead of %q", parts, expected)
+	}
+}
+
+func TestServeReaderMultiRangeUnordered(t *testing.T) {
+	// Out of order ranges come back in request order when seekable, and
+	// ascending and merged otherwise
+	w := serveRange(t, "bytes=10-12,0-1", true)
+	parts := readParts(t, w)
+	if len(parts) != 2 || parts[0] != "bytes 10-12/20 abc" {
+		t.Fatalf("Seekable parts were %q", parts)
+	}
+
+	w = serveRange(t, "bytes=10-12,0-1,11-14", false)
+	parts = readParts(t, w)
+	expected := []string{"bytes 0-1/20 01", "bytes 10-14/20 abcde"}
+	if strings.Join(parts, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Parts were %q instead of %q", parts, expected)
+	}
+}
+
+func TestServeReaderUnsatisfiable(t *testing.T) {
+	w := serveRange(t, "bytes=50-60", false)
+
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("Status code was %d instead of 416", w.Code)
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes */20" {
+		t.Fatalf("Content-Range was %q", cr)
+	}
+}
+
+func TestServeRangeReader(t *testing.T) {
+	var opened []int64
+	rd := &RangeReader{
+		Open: func(offset int64) (io.ReadCloser, error) {
+			opened = append(opened, offset)
+			return io.NopCloser(strings.NewReader(serveContent[offset:])), nil
+		},
+		Size: int64(len(serveContent)),
+	}
+	defer rd.Close()
+
+	req := httptest.NewRequest("GET", "/file", nil)
+	req.Header.Set("Range", "bytes=10-12,0-1")
+	w := httptest.NewRecorder()
+	err := ServeReader(w, req, rd, rd.Size, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := readParts(t, w)
+	expected := []string{"bytes 10-12/20 abc", "bytes 0-1/20 01"}
+	if strings.Join(parts, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Parts were %q instead of %q", parts, expected)
+	}
+	if len(opened) != 2 || opened[0] != 10 || opened[1] != 0 {
+		t.Fatalf("Opened at offsets %v instead of [10 0]", opened)
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	m := Metadata{
+		ETag:    ETag("abc123"),
+		ModTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	req := httptest.NewRequest("GET", "/file", nil)
+	w := httptest.NewRecorder()
+	if CheckPreconditions(w, req, m) {
+		t.Fatal("Unconditional request was answered")
+	}
+	if etag := w.Header().Get("Etag"); etag != `"abc123"` {
+		t.Fatalf("ETag was %q", etag)
+	}
+	if lm := w.Header().Get("Last-Modified"); lm != "Thu, 02 Jan 2020 03:04:05 GMT" {
+		t.Fatalf("Last-Modified was %q", lm)
+	}
+
+	req.Header.Set("If-None-Match", `"abc123"`)
+	w = httptest.NewRecorder()
+	if !CheckPreconditions(w, req, m) || w.Code != http.StatusNotModified {
+		t.Fatalf("Matching If-None-Match returned %d instead of 304", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/file", nil)
+	req.Header.Set("If-Modified-Since", "Thu, 02 Jan 2020 03:04:05 GMT")
+	w = httptest.NewRecorder()
+	if !CheckPreconditions(w, req, m) || w.Code != http.StatusNotModified {
+		t.Fatalf("Matching If-Modified-Since returned %d instead of 304", w.Code)
+	}
+
+	req.Header.Set("If-Modified-Since", "Wed, 01 Jan 2020 00:00:00 GMT")
+	w = httptest.NewRecorder()
+	if CheckPreconditions(w, req, m) {
+		t.Fatal("File modified since was answered with 304")
+	}
+}
+
+func TestSetContentDisposition(t *testing.T) {
+	for _, tc := range []struct {
+		url, originalName, expected string
+	}{
+		{"/file", "report.txt", ""},
+		{"/file?download", "report.txt", `attachment; filename="report.txt"`},
+		{"/file?download", "", `attachment; filename="file"`},
+		{"/file?download", "héllo wörld.txt", `attachment; filename="h_llo w_rld.txt"; filename*=UTF-8''h%C3%A9llo%20w%C3%B6rld.txt`},
+		{"/file?download", `a"b`, `attachment; filename="a_b"; filename*=UTF-8''a%22b`},
+	} {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		w := httptest.NewRecorder()
+		SetContentDisposition(w, req, "file", Metadata{OriginalName: tc.originalName})
+
+		if cd := w.Header().Get("Content-Disposition"); cd != tc.expected {
+			t.Errorf("Content-Disposition for %s %q was %q instead of %q", tc.url, tc.originalName, cd, tc.expected)
+		}
+	}
+}
+
+func TestSetServeHeaders(t *testing.T) {
+	Limits.ServePolicies = map[string]ServePolicy{
+		"text/html":     {Attachment: true},
+		"image/svg+xml": {ContentSecurityPolicy: SandboxContentSecurityPolicy},
+		"text/*":        {ContentSecurityPolicy: "default-src 'none'"},
+		"text/plain":    {},
+	}
+	defer func() { Limits.ServePolicies = nil }()
+
+	for _, tc := range []struct {
+		mimetype, disposition, csp string
+	}{
+		{"text/html; charset=utf-8", `attachment; filename="page.html"`, "original"},
+		{"image/svg+xml", "", SandboxContentSecurityPolicy},
+		{"text/css", "", "default-src 'none'"},
+		{"text/plain; charset=utf-8", "", "original"},
+		{"image/png", "", "original"},
+	} {
+		req := httptest.NewRequest("GET", "/page.html", nil)
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Security-Policy", "original")
+		SetServeHeaders(w, req, "page.html", Metadata{Mimetype: tc.mimetype})
+
+		if cd := w.Header().Get("Content-Disposition"); cd != tc.disposition {
+			t.Errorf("Content-Disposition for %s was %q instead of %q", tc.mimetype, cd, tc.disposition)
+		}
+		if csp := w.Header().Get("Content-Security-Policy"); csp != tc.csp {
+			t.Errorf("Content-Security-Policy for %s was %q instead of %q", tc.mimetype, csp, tc.csp)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("Expected nosniff for %s", tc.mimetype)
+		}
+	}
+}
+
+func TestServeReaderIfRange(t *testing.T) {
+	m := Metadata{
+		ETag:    ETag("abc123"),
+		ModTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	for _, test := range []struct {
+		ifRange string
+		partial bool
+	}{
+		{`"abc123"`, true},
+		{`"def456"`, false},
+		{`W/"abc123"`, false},
+		{"Thu, 02 Jan 2020 03:04:05 GMT", true},
+		{"Fri, 03 Jan 2020 00:00:00 GMT", false},
+		{"not a date", false},
+	} {
+		req := httptest.NewRequest("GET", "/file", nil)
+		req.Header.Set("Range", "bytes=5-9")
+		req.Header.Set("If-Range", test.ifRange)
+		w := httptest.NewRecorder()
+		if CheckPreconditions(w, req, m) {
+			t.Fatalf("If-Range %q was answered as a precondition", test.ifRange)
+		}
+		if err := ServeReader(w, req, strings.NewReader(serveContent), int64(len(serveContent)), "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+
+		if test.partial && (w.Code != http.StatusPartialContent || w.Body.String() != "56789") {
+			t.Fatalf("Matching If-Range %q returned %d, %q", test.ifRange, w.Code, w.Body.String())
+		}
+		if !test.partial && (w.Code != http.StatusOK || w.Body.String() != serveContent) {
+			t.Fatalf("Changed If-Range %q returned %d, %q", test.ifRange, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package backends
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/minio/sha256-simd"
+)
+
+// Whether sum looks like a hex sha256sum, so that it's safe to look up
+func IsSha256(sum string) bool {
+	if len(sum) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+// Hash everything read from r without storing any of it, for clients to
+// find out whether content is already stored before uploading it
+func HashStream(r io.Reader) (sum string, size int64, err error) {
+	hasher := sha256.New()
+	size, err = io.Copy(hasher, r)
+	if err != nil {
+		return "", size, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// Find the key of a file with contents hashing to sum by the metadata of
+// every file, for backends without an index to implement FindBySha256 with.
+// Expired files aren't found.
+func ScanBySha256(ctx context.Context, b MetaStorageBackend, sum string) (key string, found bool, err error) {
+	if !IsSha256(sum) {
+		return "", false, nil
+	}
+
+	keys, err := b.List(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, key := range keys {
+		m, err := b.Head(ctx, key)
+		if err == NotFoundErr {
+			continue
+		} else if err != nil {
+			return "", false, err
+		}
+
+		if m.Sha256sum == sum && !expiry.IsTsExpired(m.Expiry) {
+			return key, true, nil
+		}
+	}
+	return "", false, nil
+}
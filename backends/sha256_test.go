@@ -0,0 +1,48 @@
+package backends
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func TestHashStream(t *testing.T) {
+	sum, size, err := HashStream(strings.NewReader("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" || size != 4 {
+		t.Fatalf("Unexpected sum %q of %d bytes", sum, size)
+	}
+
+	if !IsSha256(sum) {
+		t.Fatalf("Expected %q to be a sha256sum", sum)
+	}
+	for _, invalid := range []string{"", sum[1:], "../" + sum[3:], strings.Repeat("g", 64)} {
+		if IsSha256(invalid) {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestScanBySha256(t *testing.T) {
+	sum, _, _ := HashStream(strings.NewReader("test"))
+	other, _, _ := HashStream(strings.NewReader("other"))
+
+	b := &metadataBackend{files: map[string]Metadata{
+		"expired.txt": {Sha256sum: sum, Expiry: time.Now().Add(-time.Minute)},
+		"a.txt":       {Sha256sum: sum, Expiry: expiry.NeverExpire},
+		"b.txt":       {Sha256sum: other, Expiry: expiry.NeverExpire},
+	}}
+	if key, found, err := ScanBySha256(context.Background(), b, sum); err != nil || !found || key != "a.txt" {
+		t.Fatalf("Expected a.txt, got %q, %v, %v", key, found, err)
+	}
+
+	missing, _, _ := HashStream(strings.NewReader("missing"))
+	if _, found, err := ScanBySha256(context.Background(), b, missing); err != nil || found {
+		t.Fatalf("Expected nothing to be found, got %v, %v", found, err)
+	}
+}
@@ -0,0 +1,936 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/dchest/uniuri"
+	driver "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Stores files and their metadata in a single SQLite database, for small
+// instances where one file is easier to back up than a directory of
+// thousands. Each change is a transaction, so a file is never stored
+// without its metadata or the other way around. Contents are kept in
+// chunks of chunkSize bytes, so that they can be read in ranges without
+// loading whole files into memory, and copies share their contents.
+type SqliteBackend struct {
+	db      *sql.DB
+	scanner backends.Scanner
+}
+
+type SqliteOptions struct {
+	// Scan new files with this before storing them, if set
+	Scanner backends.Scanner
+}
+
+// Size of the chunks contents are split into
+const chunkSize = 1 << 20
+
+// How many files BatchDelete deletes and HeadMany reads at the same time
+const batchWorkers = 8
+
+const schema = `
+CREATE TABLE IF NOT EXISTS blobs (
+	id INTEGER PRIMARY KEY,
+	size INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS chunks (
+	blob INTEGER NOT NULL,
+	seq INTEGER NOT NULL,
+	data BLOB NOT NULL,
+	PRIMARY KEY (blob, seq)
+);
+CREATE TABLE IF NOT EXISTS files (
+	key TEXT PRIMARY KEY,
+	blob INTEGER NOT NULL,
+	public_id TEXT NOT NULL DEFAULT '',
+	delete_key TEXT NOT NULL DEFAULT '',
+	access_key TEXT NOT NULL DEFAULT '',
+	sha256sum TEXT NOT NULL,
+	mimetype TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	expiry INTEGER NOT NULL,
+	uploaded INTEGER NOT NULL DEFAULT 0,
+	retain_until INTEGER NOT NULL DEFAULT 0,
+	srcip TEXT NOT NULL DEFAULT '',
+	original_name TEXT NOT NULL DEFAULT '',
+	extra TEXT NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS files_blob ON files (blob);
+CREATE INDEX IF NOT EXISTS files_expiry ON files (expiry);
+CREATE INDEX IF NOT EXISTS files_public_id ON files (public_id);
+CREATE INDEX IF NOT EXISTS files_sha256sum ON files (sha256sum);
+`
+
+const fileColumns = "blob, public_id, delete_key, access_key, sha256sum, mimetype, size, expiry, uploaded, retain_until, srcip, original_name, extra"
+
+// The metadata that isn't queried, stored as JSON in the extra column
+type extraJSON struct {
+	Checksums        map[string]string       `json:"checksums,omitempty"`
+	ArchiveFiles     []backends.ArchiveEntry `json:"archive_files,omitempty"`
+	ArchiveTruncated bool                    `json:"archive_truncated,omitempty"`
+	ArchiveOmitted   int                     `json:"archive_omitted,omitempty"`
+	Encryption       *backends.Encryption    `json:"encryption,omitempty"`
+	AccessKeyExpiry  int64                   `json:"access_key_expiry,omitempty"`
+	Custom           map[string]string       `json:"custom,omitempty"`
+	Tags             map[string]string       `json:"tags,omitempty"`
+	DownloadRate     int64                   `json:"download_rate,omitempty"`
+}
+
+// What both the database and a transaction run queries with
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Run fn in a transaction, committing it if fn succeeds. Transactions take
+// the write lock as they begin, so what fn reads can't change under it.
+func (b SqliteBackend) update(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return checkFull(err)
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return checkFull(err)
+	}
+	return checkFull(tx.Commit())
+}
+
+// Wrap err in StorageFullErr if the database couldn't grow
+func checkFull(err error) error {
+	var e *driver.Error
+	if errors.As(err, &e) && e.Code()&0xff == sqlite3.SQLITE_FULL {
+		return fmt.Errorf("%w: %w", backends.StorageFullErr, err)
+	}
+	return backends.CheckStorageFull(err)
+}
+
+func readMetadata(ctx context.Context, q queryer, key string) (m backends.Metadata, blob int64, err error) {
+	if err = backends.ValidateKey(key); err != nil {
+		return
+	}
+
+	var expiryUnix, uploaded, retainUntil int64
+	var extra string
+	err = q.QueryRowContext(ctx, "SELECT "+fileColumns+" FROM files WHERE key = ?", key).Scan(
+		&blob, &m.PublicID, &m.DeleteKey, &m.AccessKey, &m.Sha256sum, &m.Mimetype, &m.Size,
+		&expiryUnix, &uploaded, &retainUntil, &m.SrcIp, &m.OriginalName, &extra)
+	if err == sql.ErrNoRows {
+		return m, 0, backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
+	var ejson extraJSON
+	if err := json.Unmarshal([]byte(extra), &ejson); err != nil {
+		return m, 0, backends.BadMetadata
+	}
+
+	m.Expiry = time.Unix(expiryUnix, 0)
+	m.Checksums = ejson.Checksums
+	m.ArchiveFiles = ejson.ArchiveFiles
+	m.ArchiveTruncated = ejson.ArchiveTruncated
+	m.ArchiveOmitted = ejson.ArchiveOmitted
+	m.Custom = ejson.Custom
+	m.Tags = ejson.Tags
+	m.DownloadRate = ejson.DownloadRate
+	m.ETag = backends.ETag(m.Sha256sum)
+	if ejson.Encryption != nil {
+		m.Encryption = *ejson.Encryption
+	}
+	if ejson.AccessKeyExpiry != 0 {
+		m.AccessKeyExpiry = time.Unix(ejson.AccessKeyExpiry, 0)
+	}
+	if retainUntil != 0 {
+		m.RetainUntil = time.Unix(retainUntil, 0)
+	}
+	if uploaded != 0 {
+		m.Uploaded = time.Unix(uploaded, 0)
+	}
+
+	// Contents are never changed in place, only replaced along with the
+	// metadata, so they were last modified when they were uploaded
+	m.ModTime = m.Uploaded
+
+	return m, blob, nil
+}
+
+// Store the metadata of key with the contents in blob, replacing any
+// metadata it had
+func writeMetadata(ctx context.Context, tx *sql.Tx, key string, blob int64, m backends.Metadata) error {
+	ejson := extraJSON{
+		Checksums:        m.Checksums,
+		ArchiveFiles:     m.ArchiveFiles,
+		ArchiveTruncated: m.ArchiveTruncated,
+		ArchiveOmitted:   m.ArchiveOmitted,
+		Custom:           m.Custom,
+		Tags:             m.Tags,
+		DownloadRate:     m.DownloadRate,
+	}
+	if m.Encryption.Scheme != "" {
+		ejson.Encryption = &m.Encryption
+	}
+	if !m.AccessKeyExpiry.IsZero() {
+		ejson.AccessKeyExpiry = m.AccessKeyExpiry.Unix()
+	}
+	extra, err := json.Marshal(ejson)
+	if err != nil {
+		return err
+	}
+
+	var uploaded, retainUntil int64
+	if !m.Uploaded.IsZero() {
+		uploaded = m.Uploaded.Unix()
+	}
+	if !m.RetainUntil.IsZero() {
+		retainUntil = m.RetainUntil.Unix()
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO files (key, "+fileColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		key, blob, m.PublicID, m.DeleteKey, m.AccessKey, m.Sha256sum, m.Mimetype, m.Size,
+		m.Expiry.Unix(), uploaded, retainUntil, m.SrcIp, m.OriginalName, string(extra))
+	return err
+}
+
+// Store the size bytes read from r as a new blob, returning its id
+func writeBlob(ctx context.Context, tx *sql.Tx, r io.Reader, size int64) (int64, error) {
+	res, err := tx.ExecContext(ctx, "INSERT INTO blobs (size) VALUES (?)", size)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, chunkSize)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO chunks (blob, seq, data) VALUES (?, ?, ?)", id, seq, buf[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return id, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Remove a blob once no file refers to it anymore
+func releaseBlob(ctx context.Context, tx *sql.Tx, blob int64) error {
+	if blob == 0 {
+		return nil
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM blobs WHERE id = ? AND NOT EXISTS (SELECT 1 FROM files WHERE blob = ?)", blob, blob)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM chunks WHERE blob = ?", blob)
+	return err
+}
+
+// The blob key refers to, or 0 if there's no file under key
+func blobOf(ctx context.Context, q queryer, key string) (int64, error) {
+	var blob int64
+	err := q.QueryRowContext(ctx, "SELECT blob FROM files WHERE key = ?", key).Scan(&blob)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return blob, err
+}
+
+// Return RetentionLockedErr if key exists and is under a retention lock
+func checkRetention(ctx context.Context, q queryer, key string) error {
+	var retainUntil int64
+	err := q.QueryRowContext(ctx, "SELECT retain_until FROM files WHERE key = ?", key).Scan(&retainUntil)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	m := backends.Metadata{}
+	if retainUntil != 0 {
+		m.RetainUntil = time.Unix(retainUntil, 0)
+	}
+	if m.RetentionLocked() {
+		return backends.RetentionLockedErr
+	}
+	return nil
+}
+
+// Return TooManyFilesError if Limits.MaxFiles files are already stored,
+// unless key is one of them and would only be overwritten
+func checkFiles(ctx context.Context, q queryer, key string) error {
+	if backends.Limits.MaxFiles <= 0 {
+		return nil
+	}
+
+	var count int64
+	if err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM files").Scan(&count); err != nil {
+		return err
+	}
+	if count < backends.Limits.MaxFiles {
+		return nil
+	}
+	if blob, err := blobOf(ctx, q, key); err != nil || blob != 0 {
+		return err
+	}
+	return backends.TooManyFilesError
+}
+
+// Reads length bytes of a blob from offset, a chunk at a time
+type blobReader struct {
+	ctx    context.Context
+	db     *sql.DB
+	blob   int64
+	offset int64
+	left   int64
+	chunk  []byte
+}
+
+func (b SqliteBackend) openBlob(ctx context.Context, blob, offset, length int64) io.ReadCloser {
+	return &blobReader{ctx: ctx, db: b.db, blob: blob, offset: offset, left: length}
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+
+	if len(r.chunk) == 0 {
+		// Only the rest of the chunk from the offset is read
+		seq, skip := r.offset/chunkSize, r.offset%chunkSize
+		err := r.db.QueryRowContext(r.ctx, "SELECT substr(data, ?) FROM chunks WHERE blob = ? AND seq = ?", skip+1, r.blob, seq).Scan(&r.chunk)
+		if err == sql.ErrNoRows {
+			// The file was replaced or deleted while it was read
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		if len(r.chunk) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	r.offset += int64(n)
+	r.left -= int64(n)
+	return n, nil
+}
+
+func (r *blobReader) Close() error {
+	r.chunk = nil
+	return nil
+}
+
+// Uploads in progress would hold the write lock between chunks, so they
+// aren't supported
+func (b SqliteBackend) Append(ctx context.Context, key string, r io.Reader, offset int64) (int64, error) {
+	return 0, backends.NotSupportedErr
+}
+
+func (b SqliteBackend) PurgeUploads(ctx context.Context, olderThan time.Duration) error {
+	return backends.NotSupportedErr
+}
+
+func (b SqliteBackend) Capabilities() backends.Caps {
+	return backends.Caps{
+		SupportsRange:     true,
+		SupportsCopy:      true,
+		SupportsList:      true,
+		SupportsRetention: true,
+	}
+}
+
+func (b SqliteBackend) Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (backends.Metadata, error) {
+	return backends.Metadata{}, backends.NotSupportedErr
+}
+
+func (b SqliteBackend) CheckAccessKey(ctx context.Context, key, provided string) (bool, error) {
+	return backends.CheckAccessKey(ctx, b, key, provided)
+}
+
+func (b SqliteBackend) CheckDeleteKey(ctx context.Context, key, provided string) (bool, error) {
+	return backends.CheckDeleteKey(ctx, b, key, provided)
+}
+
+// Copies share the contents of the original, only the metadata is copied
+func (b SqliteBackend) Copy(ctx context.Context, srcKey, dstKey string) (m backends.Metadata, err error) {
+	if err = backends.ValidateKey(dstKey); err != nil {
+		return
+	}
+
+	err = b.update(ctx, func(tx *sql.Tx) error {
+		var blob int64
+		var err error
+		m, blob, err = readMetadata(ctx, tx, srcKey)
+		if err != nil {
+			return err
+		}
+		if err := checkRetention(ctx, tx, dstKey); err != nil {
+			return err
+		}
+		if err := checkFiles(ctx, tx, dstKey); err != nil {
+			return err
+		}
+		replaced, err := blobOf(ctx, tx, dstKey)
+		if err != nil {
+			return err
+		}
+
+		m.PublicID = backends.NewPublicID()
+		m.DeleteKey = uniuri.NewLen(30)
+		m.Uploaded = time.Now()
+		m.ModTime = m.Uploaded
+		m.RetainUntil = time.Time{}
+
+		if err := writeMetadata(ctx, tx, dstKey, blob, m); err != nil {
+			return err
+		}
+		return releaseBlob(ctx, tx, replaced)
+	})
+	return
+}
+
+func (b SqliteBackend) Delete(ctx context.Context, key string) error {
+	if err := backends.ValidateKey(key); err != nil {
+		return err
+	}
+
+	return b.update(ctx, func(tx *sql.Tx) error {
+		blob, err := blobOf(ctx, tx, key)
+		if err != nil {
+			return err
+		} else if blob == 0 {
+			return backends.NotFoundErr
+		}
+		if err := checkRetention(ctx, tx, key); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM files WHERE key = ?", key); err != nil {
+			return err
+		}
+		return releaseBlob(ctx, tx, blob)
+	})
+}
+
+func (b SqliteBackend) BatchDelete(ctx context.Context, keys []string) ([]string, map[string]error) {
+	return backends.DeleteEach(ctx, keys, batchWorkers, b.Delete)
+}
+
+func (b SqliteBackend) Exists(ctx context.Context, key string) (bool, error) {
+	if err := backends.ValidateKey(key); err != nil {
+		return false, err
+	}
+
+	blob, err := blobOf(ctx, b.db, key)
+	return blob != 0, err
+}
+
+func (b SqliteBackend) HealthCheck(ctx context.Context) error {
+	return b.db.PingContext(ctx)
+}
+
+func (b SqliteBackend) Head(ctx context.Context, key string) (backends.Metadata, error) {
+	m, _, err := readMetadata(ctx, b.db, key)
+	return m, err
+}
+
+// Deleted files are gone once the transaction deleting them commits, so
+// there is no trash
+func (b SqliteBackend) GetDeleted(ctx context.Context, key string) (backends.Metadata, io.ReadCloser, error) {
+	return backends.Metadata{}, nil, backends.NotSupportedErr
+}
+
+func (b SqliteBackend) PurgeTrash(ctx context.Context, olderThan time.Duration) error {
+	return backends.NotSupportedErr
+}
+
+func (b SqliteBackend) Restore(ctx context.Context, key string) error {
+	return backends.NotSupportedErr
+}
+
+func (b SqliteBackend) Get(ctx context.Context, key string) (m backends.Metadata, r io.ReadCloser, err error) {
+	m, blob, err := readMetadata(ctx, b.db, key)
+	if err != nil {
+		return
+	}
+
+	return m, b.openBlob(ctx, blob, 0, m.Size), nil
+}
+
+func (b SqliteBackend) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	m, blob, err := readMetadata(ctx, b.db, key)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err = backends.RangeLength(m.Size, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.openBlob(ctx, blob, offset, length), nil
+}
+
+func (b SqliteBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
+	metadata, blob, err := readMetadata(r.Context(), b.db, key)
+	if err != nil {
+		return
+	}
+
+	backends.SetServeHeaders(w, r, key, metadata)
+	w = backends.ThrottleDownload(w, r, metadata)
+
+	w, finish := backends.GzipText(w, r, &metadata)
+	defer finish()
+
+	if backends.CheckPreconditions(w, r, metadata) {
+		return nil
+	}
+
+	rd := &backends.RangeReader{
+		Open: func(offset int64) (io.ReadCloser, error) {
+			return b.openBlob(r.Context(), blob, offset, metadata.Size-offset), nil
+		},
+		Size: metadata.Size,
+	}
+	defer rd.Close()
+
+	return backends.ServeReader(w, r, rd, metadata.Size, metadata.Mimetype)
+}
+
+func (b SqliteBackend) ServeThumbnail(key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error {
+	return backends.ServeThumbnail(b, key, w, r, maxWidth, maxHeight)
+}
+
+func (b SqliteBackend) ServeImageVariant(key string, w http.ResponseWriter, r *http.Request) error {
+	return backends.ServeImageVariant(b, key, w, r)
+}
+
+func (b SqliteBackend) ServeArchiveEntry(key string, entryPath string, w http.ResponseWriter, r *http.Request) error {
+	return backends.ServeArchiveEntry(b, key, entryPath, w, r)
+}
+
+func (b SqliteBackend) ArchiveFS(key string) (fs.FS, error) {
+	return backends.ArchiveFS(b, key)
+}
+
+func (b SqliteBackend) Preview(ctx context.Context, key string, maxBytes int) (string, bool, error) {
+	return backends.Preview(ctx, b, key, maxBytes)
+}
+
+// Files are only ever served through linx-server, so there are no
+// presigned URLs
+func (b SqliteBackend) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", backends.NotSupportedErr
+}
+
+func (b SqliteBackend) Put(ctx context.Context, key string, r io.Reader, expiryTime time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (m backends.Metadata, err error) {
+	if err = backends.ValidateKey(key); err != nil {
+		return
+	}
+	if err = backends.CheckCustom(o.Custom); err != nil {
+		return
+	}
+	if err = backends.CheckTags(o.Tags); err != nil {
+		return
+	}
+	if expiryTime, err = backends.AllowedExpiry(expiryTime); err != nil {
+		return
+	}
+	if err = checkRetention(ctx, b.db, key); err != nil {
+		return
+	}
+	if err = checkFiles(ctx, b.db, key); err != nil {
+		return
+	}
+
+	// Checked before reading r so that the caller can still retry with
+	// another key, and again when storing the file in case of a race
+	if !o.Overwrite {
+		if exists, _ := b.Exists(ctx, key); exists {
+			return m, backends.KeyConflictErr
+		}
+	}
+
+	// The file is checked in full before it's stored, and the write lock
+	// shouldn't be held while waiting on the client, so buffer it on
+	// disk first
+	tmpDst, err := os.CreateTemp("", "linx-server-upload")
+	if err != nil {
+		return
+	}
+	defer tmpDst.Close()
+	defer os.Remove(tmpDst.Name())
+
+	src := backends.MinRateReader(helpers.NewContextReader(ctx, r), backends.Limits.MinUploadRate, backends.Limits.MinUploadRateWindow)
+	bytes, err := io.Copy(tmpDst, backends.LimitedReader(src, backends.Limits.MaxSize))
+	if err != nil {
+		return m, backends.CheckStorageFull(err)
+	} else if bytes == 0 {
+		return m, backends.FileEmptyError
+	}
+
+	if _, err = tmpDst.Seek(0, 0); err != nil {
+		return
+	}
+	if o.Encryption.Scheme != "" {
+		m, err = helpers.GenerateOpaqueMetadata(tmpDst)
+	} else {
+		m, err = helpers.GenerateMetadata(tmpDst)
+		m.Mimetype = helpers.RefineMimetype(m.Mimetype, originalName, key)
+	}
+	if err != nil {
+		return
+	}
+	if err = backends.CheckMimeSize(m.Mimetype, bytes); err != nil {
+		return
+	}
+	if err = backends.CheckSha256(o.ExpectedSha256, m.Sha256sum); err != nil {
+		return
+	}
+
+	if _, err = tmpDst.Seek(0, 0); err != nil {
+		return
+	}
+	if err = backends.ScanFile(b.scanner, tmpDst); err != nil {
+		return
+	}
+
+	m.Expiry = backends.FileExpiry(expiryTime, bytes)
+	m.DeleteKey = deleteKey
+	m.AccessKey = accessKey
+	m.SrcIp = srcIp
+	m.PublicID = backends.NewPublicID()
+	m.OriginalName, m.Custom = backends.SanitizeOriginalName(originalName, o.Custom)
+	m.Tags = o.Tags
+	m.Encryption = o.Encryption
+	m.Uploaded = time.Now()
+	m.ModTime = m.Uploaded
+	m.RetainUntil = o.RetainUntil
+	m.ArchiveFiles, m.ArchiveTruncated, m.ArchiveOmitted, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, tmpDst)
+
+	if _, err = tmpDst.Seek(0, 0); err != nil {
+		return
+	}
+
+	err = b.update(ctx, func(tx *sql.Tx) error {
+		replaced, err := blobOf(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if replaced != 0 && !o.Overwrite {
+			return backends.KeyConflictErr
+		}
+		if err := checkRetention(ctx, tx, key); err != nil {
+			return err
+		}
+		if err := checkFiles(ctx, tx, key); err != nil {
+			return err
+		}
+
+		blob, err := writeBlob(ctx, tx, tmpDst, m.Size)
+		if err != nil {
+			return err
+		}
+		if err := writeMetadata(ctx, tx, key, blob, m); err != nil {
+			return err
+		}
+		return releaseBlob(ctx, tx, replaced)
+	})
+	return
+}
+
+func (b SqliteBackend) PutMetadata(ctx context.Context, key string, m backends.Metadata) error {
+	if err := backends.CheckCustom(m.Custom); err != nil {
+		return err
+	}
+	if err := backends.CheckTags(m.Tags); err != nil {
+		return err
+	}
+
+	return b.update(ctx, func(tx *sql.Tx) error {
+		if err := checkRetention(ctx, tx, key); err != nil {
+			return err
+		}
+		_, blob, err := readMetadata(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		return writeMetadata(ctx, tx, key, blob, m)
+	})
+}
+
+func (b SqliteBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	if err := backends.ValidateKey(oldKey); err != nil {
+		return err
+	}
+	if err := backends.ValidateKey(newKey); err != nil {
+		return err
+	}
+
+	return b.update(ctx, func(tx *sql.Tx) error {
+		if err := checkRetention(ctx, tx, oldKey); err != nil {
+			return err
+		}
+		if taken, err := blobOf(ctx, tx, newKey); err != nil {
+			return err
+		} else if taken != 0 {
+			return backends.KeyExistsErr
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE files SET key = ? WHERE key = ?", newKey, oldKey)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return backends.NotFoundErr
+		}
+		return nil
+	})
+}
+
+func (b SqliteBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	return b.update(ctx, func(tx *sql.Tx) error {
+		if err := checkRetention(ctx, tx, key); err != nil {
+			return err
+		}
+		m, _, err := readMetadata(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if err := backends.CheckExpiry(m.Size, newExpiry); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE files SET expiry = ? WHERE key = ?", newExpiry.Unix(), key)
+		return err
+	})
+}
+
+func (b SqliteBackend) Touch(ctx context.Context, key string, extend time.Duration) error {
+	return backends.Touch(ctx, b, key, extend)
+}
+
+func (b SqliteBackend) GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error {
+	return backends.GrantAccess(ctx, b, key, accessKey, until)
+}
+
+func (b SqliteBackend) Size(ctx context.Context, key string) (int64, error) {
+	m, _, err := readMetadata(ctx, b.db, key)
+	return m.Size, err
+}
+
+func (b SqliteBackend) VerifyChecksum(ctx context.Context, key string) (bool, string, error) {
+	return backends.VerifyChecksum(ctx, b, key)
+}
+
+func (b SqliteBackend) Stats(ctx context.Context) (s backends.Stats, err error) {
+	rows, err := b.db.QueryContext(ctx, "SELECT mimetype, COUNT(*), SUM(size) FROM files GROUP BY mimetype")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	s.BytesByType = make(map[string]int64)
+	for rows.Next() {
+		var mimetype string
+		var count, size int64
+		if err = rows.Scan(&mimetype, &count, &size); err != nil {
+			return
+		}
+
+		mimeType, _, _ := strings.Cut(mimetype, "/")
+		s.FileCount += count
+		s.TotalBytes += size
+		s.BytesByType[mimeType] += size
+	}
+	return s, rows.Err()
+}
+
+// Everything but the mimetype pattern is matched in SQL
+func (b SqliteBackend) Query(ctx context.Context, filter backends.ListFilter) ([]string, error) {
+	query := "SELECT key, mimetype, sha256sum, size, uploaded FROM files WHERE size >= ?"
+	args := []any{filter.MinSize}
+	if filter.MaxSize > 0 {
+		query += " AND size <= ?"
+		args = append(args, filter.MaxSize)
+	}
+	if filter.Sha256Prefix != "" {
+		query += " AND substr(sha256sum, 1, ?) = ?"
+		args = append(args, len(filter.Sha256Prefix), strings.ToLower(filter.Sha256Prefix))
+	}
+	if !filter.UploadedAfter.IsZero() {
+		query += " AND uploaded > ?"
+		args = append(args, filter.UploadedAfter.Unix())
+	}
+
+	rows, err := b.db.QueryContext(ctx, query+" ORDER BY key", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		var m backends.Metadata
+		var uploaded int64
+		if err := rows.Scan(&key, &m.Mimetype, &m.Sha256sum, &m.Size, &uploaded); err != nil {
+			return nil, err
+		}
+		m.Uploaded = time.Unix(uploaded, 0)
+
+		if filter.Matches(m) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, rows.Err()
+}
+
+func (b SqliteBackend) GetByPublicID(ctx context.Context, id string) (key string, err error) {
+	if id == "" {
+		return "", backends.NotFoundErr
+	}
+
+	err = b.db.QueryRowContext(ctx, "SELECT key FROM files WHERE public_id = ?", id).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", backends.NotFoundErr
+	}
+	return
+}
+
+func (b SqliteBackend) FindBySha256(ctx context.Context, sum string) (key string, found bool, err error) {
+	if !backends.IsSha256(sum) {
+		return "", false, nil
+	}
+
+	err = b.db.QueryRowContext(ctx, "SELECT key FROM files WHERE sha256sum = ? AND (expiry = ? OR expiry >= ?) ORDER BY key LIMIT 1",
+		sum, expiry.NeverExpire.Unix(), time.Now().Unix()).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return key, true, nil
+}
+
+func (b SqliteBackend) HeadMany(ctx context.Context, keys []string) (map[string]backends.Metadata, map[string]error) {
+	return backends.HeadEach(ctx, keys, batchWorkers, b.Head)
+}
+
+func (b SqliteBackend) List(ctx context.Context) ([]string, error) {
+	keys, _, err := b.ListPaginated(ctx, "", 0)
+	return keys, err
+}
+
+func (b SqliteBackend) ListPaginated(ctx context.Context, cursor string, limit int) (keys []string, nextCursor string, err error) {
+	// One more key than asked for tells whether there's another page
+	rows, err := b.db.QueryContext(ctx, "SELECT key FROM files WHERE key > ? ORDER BY key LIMIT ?", cursor, limitOrAll(limit))
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	keys, err = scanKeys(rows)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit > 0 && len(keys) > limit {
+		return keys[:limit], keys[limit-1], nil
+	}
+	return keys, "", nil
+}
+
+func (b SqliteBackend) ListExpired(ctx context.Context, before time.Time) ([]string, error) {
+	// Expiries are stored in seconds, so one in the same second as before
+	// is still before it if before isn't on the second
+	cutoff := before.Unix()
+	if before.Nanosecond() > 0 {
+		cutoff++
+	}
+
+	rows, err := b.db.QueryContext(ctx, "SELECT key FROM files WHERE expiry < ? AND expiry != ? ORDER BY expiry, key", cutoff, expiry.NeverExpire.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanKeys(rows)
+}
+
+// A LIMIT of one more than limit, or -1 for no limit
+func limitOrAll(limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit + 1
+}
+
+func scanKeys(rows *sql.Rows) ([]string, error) {
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (b SqliteBackend) Close() error {
+	return b.db.Close()
+}
+
+// Open the database at path, creating it if it doesn't exist. It's kept in
+// WAL mode, so that files can be read while another is being stored.
+func NewSqliteBackend(path string, o SqliteOptions) (SqliteBackend, error) {
+	params := url.Values{
+		"_pragma": {"busy_timeout(10000)", "journal_mode(WAL)", "synchronous(NORMAL)"},
+		"_txlock": {"immediate"},
+	}
+	db, err := sql.Open("sqlite", path+"?"+params.Encode())
+	if err != nil {
+		return SqliteBackend{}, err
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return SqliteBackend{}, err
+	}
+
+	return SqliteBackend{db: db, scanner: o.Scanner}, nil
+}
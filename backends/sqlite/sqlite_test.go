@@ -0,0 +1,308 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+var ctx = context.Background()
+
+func newTestBackend(t *testing.T) SqliteBackend {
+	backends.Limits.MaxSize = 16 * 1024 * 1024
+
+	b, err := NewSqliteBackend(filepath.Join(t.TempDir(), "linx.db"), SqliteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// Content over a few chunks, so that reads cross from one to the next
+func largeContent() []byte {
+	content := make([]byte, 2*chunkSize+1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestSqlitePutHeadGet(t *testing.T) {
+	b := newTestBackend(t)
+
+	if err := b.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	content := largeContent()
+	m, err := b.Put(ctx, "file.bin", bytes.NewReader(content), 0, "del", "", "127.0.0.1", "file.bin", backends.PutOptions{Tags: map[string]string{"tier": "hot"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head(ctx, "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Sha256sum != m.Sha256sum || head.Size != int64(len(content)) || head.DeleteKey != "del" || head.Tags["tier"] != "hot" || head.PublicID != m.PublicID {
+		t.Fatalf("Unexpected metadata %+v", head)
+	}
+
+	_, r, err := b.Get(ctx, "file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(data, content) {
+		t.Fatalf("Get returned %d bytes that don't match", len(data))
+	}
+
+	r, err = b.GetRange(ctx, "file.bin", chunkSize-2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(data, content[chunkSize-2:chunkSize+3]) {
+		t.Fatalf("GetRange returned %v", data)
+	}
+	if _, err := b.GetRange(ctx, "file.bin", int64(len(content))+1, 1); err != backends.RangeNotSatisfiableErr {
+		t.Fatalf("Expected RangeNotSatisfiableErr, got %v", err)
+	}
+
+	if _, err := b.Put(ctx, "file.bin", strings.NewReader("again"), 0, "del", "", "", "", backends.PutOptions{}); err != backends.KeyConflictErr {
+		t.Fatalf("Expected KeyConflictErr, got %v", err)
+	}
+	if _, err := b.Put(ctx, "file.bin", strings.NewReader("again"), 0, "del", "", "", "", backends.PutOptions{Overwrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := b.Size(ctx, "file.bin"); size != 5 {
+		t.Fatalf("Expected the overwritten file to be 5 bytes, got %d", size)
+	}
+
+	var blobs int
+	b.db.QueryRow("SELECT COUNT(*) FROM chunks").Scan(&blobs)
+	if blobs != 1 {
+		t.Fatalf("Expected the replaced contents to be removed, got %d chunks", blobs)
+	}
+
+	if key, err := b.GetByPublicID(ctx, head.PublicID); err != backends.NotFoundErr {
+		t.Fatalf("Expected the replaced file's public ID to be gone, got %q, %v", key, err)
+	}
+	if _, err := b.Head(ctx, "missing"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+}
+
+func TestSqliteServeFile(t *testing.T) {
+	b := newTestBackend(t)
+
+	content := largeContent()
+	if _, err := b.Put(ctx, "file.bin", bytes.NewReader(content), 0, "del", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/file.bin", nil)
+	r.Header.Set("Range", "bytes=1048570-1048580")
+	w := httptest.NewRecorder()
+	if err := b.ServeFile("file.bin", w, r); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[1048570:1048581]) {
+		t.Fatalf("ServeFile returned %d, %v", w.Code, w.Body.Bytes())
+	}
+}
+
+func TestSqliteCopyDeleteSharedContent(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "a", strings.NewReader("same"), 0, "del", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Copy(ctx, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := b.Get(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	if string(data) != "same" {
+		t.Fatalf("Expected the copy to keep the contents, got %q", data)
+	}
+
+	if err := b.Rename(ctx, "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Rename(ctx, "b", "d"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+	if err := b.Delete(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	var blobs int
+	b.db.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobs)
+	if blobs != 0 {
+		t.Fatalf("Expected the contents to be removed, got %d blobs", blobs)
+	}
+	if err := b.Delete(ctx, "c"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr, got %v", err)
+	}
+}
+
+func TestSqliteListAndQuery(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, key := range []string{"c.txt", "a.txt", "b.png"} {
+		content := "text " + key
+		if strings.HasSuffix(key, ".png") {
+			content = "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32)
+		}
+		if _, err := b.Put(ctx, key, strings.NewReader(content), time.Hour, "del", "", "", "", backends.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, cursor, err := b.ListPaginated(ctx, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "a.txt,b.png" || cursor != "b.png" {
+		t.Fatalf("First page was %v, %q", keys, cursor)
+	}
+	keys, cursor, _ = b.ListPaginated(ctx, cursor, 2)
+	if strings.Join(keys, ",") != "c.txt" || cursor != "" {
+		t.Fatalf("Last page was %v, %q", keys, cursor)
+	}
+
+	keys, err = b.Query(ctx, backends.ListFilter{Mimetype: "text/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "a.txt,c.txt" {
+		t.Fatalf("Query returned %v", keys)
+	}
+
+	stats, err := b.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FileCount != 3 || stats.BytesByType["image"] != 40 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	past := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := b.SetExpiry(ctx, "b.png", past); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = b.ListExpired(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "b.png" {
+		t.Fatalf("Expected b.png to have expired, got %v", keys)
+	}
+}
+
+func TestSqliteMaxFiles(t *testing.T) {
+	b := newTestBackend(t)
+	backends.Limits.MaxFiles = 1
+	defer func() { backends.Limits.MaxFiles = 0 }()
+
+	if _, err := b.Put(ctx, "a", strings.NewReader("a"), 0, "del", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(ctx, "b", strings.NewReader("b"), 0, "del", "", "", "", backends.PutOptions{}); err != backends.TooManyFilesError {
+		t.Fatalf("Expected TooManyFilesError, got %v", err)
+	}
+	if _, err := b.Put(ctx, "a", strings.NewReader("again"), 0, "del", "", "", "", backends.PutOptions{Overwrite: true}); err != nil {
+		t.Fatalf("Expected overwriting to be allowed, got %v", err)
+	}
+}
+
+func TestSqliteFindBySha256(t *testing.T) {
+	b := newTestBackend(t)
+
+	m, err := b.Put(ctx, "b", strings.NewReader("same"), 0, "del", "", "", "", backends.PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(ctx, "a", strings.NewReader("same"), time.Hour, "del", "", "", "", backends.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, found, err := b.FindBySha256(ctx, m.Sha256sum); err != nil || !found || key != "a" {
+		t.Fatalf("Expected a, got %q, %v, %v", key, found, err)
+	}
+
+	if err := b.SetExpiry(ctx, "a", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if key, found, err := b.FindBySha256(ctx, m.Sha256sum); err != nil || !found || key != "b" {
+		t.Fatalf("Expected the expired file to be skipped, got %q, %v, %v", key, found, err)
+	}
+
+	sum, _, _ := backends.HashStream(strings.NewReader("missing"))
+	if _, found, err := b.FindBySha256(ctx, sum); err != nil || found {
+		t.Fatalf("Expected nothing to be found, got %v, %v", found, err)
+	}
+}
+
+func TestSqlitePutTooSlow(t *testing.T) {
+	b := newTestBackend(t)
+	backends.Limits.MinUploadRate = 1000
+	backends.Limits.MinUploadRateWindow = 50 * time.Millisecond
+	defer func() { backends.Limits.MinUploadRate, backends.Limits.MinUploadRateWindow = 0, 0 }()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("partial"))
+	if _, err := b.Put(ctx, "slow", pr, 0, "del", "", "", "", backends.PutOptions{}); err != backends.UploadTooSlowErr {
+		t.Fatalf("Expected UploadTooSlowErr, got %v", err)
+	}
+	if _, err := b.Head(ctx, "slow"); err != backends.NotFoundErr {
+		t.Fatalf("Expected the slow upload not to be stored, got %v", err)
+	}
+}
+
+func TestSqliteRetention(t *testing.T) {
+	b := newTestBackend(t)
+
+	if _, err := b.Put(ctx, "locked", strings.NewReader("keep"), time.Hour, "del", "", "", "", backends.PutOptions{RetainUntil: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := b.Head(ctx, "locked")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.RetainUntil = time.Time{}
+	if err := b.PutMetadata(ctx, "locked", m); err != backends.RetentionLockedErr {
+		t.Fatalf("Expected PutMetadata to be refused, got %v", err)
+	}
+	if err := b.SetExpiry(ctx, "locked", time.Now().Add(time.Minute)); err != backends.RetentionLockedErr {
+		t.Fatalf("Expected SetExpiry to be refused, got %v", err)
+	}
+	if err := b.Delete(ctx, "locked"); err != backends.RetentionLockedErr {
+		t.Fatalf("Expected Delete to be refused, got %v", err)
+	}
+
+	if head, err := b.Head(ctx, "locked"); err != nil || !head.RetentionLocked() || !head.Expiry.Equal(m.Expiry) {
+		t.Fatalf("Expected the metadata to be unchanged, got %+v, %v", head, err)
+	}
+}
@@ -0,0 +1,90 @@
+package backends
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"sync"
+)
+
+// Storage used by a backend's files, each counted at its size as uploaded
+type Stats struct {
+	FileCount  int64
+	TotalBytes int64
+	// Bytes by the part of the mimetype before the slash, such as image
+	// or application
+	BytesByType map[string]int64
+}
+
+// Compute Stats from the metadata of every file. Files deleted while
+// listing, or whose metadata is missing, are skipped.
+func ComputeStats(ctx context.Context, b MetaStorageBackend) (s Stats, err error) {
+	keys, err := b.List(ctx)
+	if err != nil {
+		return
+	}
+
+	s.BytesByType = make(map[string]int64)
+	for _, key := range keys {
+		m, err := b.Head(ctx, key)
+		if err == NotFoundErr {
+			continue
+		} else if err != nil {
+			return s, err
+		}
+
+		mimeType, _, _ := strings.Cut(m.Mimetype, "/")
+		s.FileCount++
+		s.TotalBytes += m.Size
+		s.BytesByType[mimeType] += m.Size
+	}
+	return
+}
+
+// Keeps the Stats of a backend from being computed again until a change
+// to its files invalidates them
+type StatsCache struct {
+	mu sync.Mutex
+	// Incremented by every invalidation, so that Stats computed while
+	// files changed aren't kept
+	generation uint64
+	stats      *Stats
+}
+
+func NewStatsCache() *StatsCache {
+	return &StatsCache{}
+}
+
+func (c *StatsCache) Get(ctx context.Context, b MetaStorageBackend) (Stats, error) {
+	c.mu.Lock()
+	if c.stats != nil {
+		s := *c.stats
+		c.mu.Unlock()
+		s.BytesByType = maps.Clone(s.BytesByType)
+		return s, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	s, err := ComputeStats(ctx, b)
+	if err != nil {
+		return s, err
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		cached := s
+		cached.BytesByType = maps.Clone(s.BytesByType)
+		c.stats = &cached
+	}
+	c.mu.Unlock()
+	return s, nil
+}
+
+func (c *StatsCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.stats = nil
+}
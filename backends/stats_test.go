@@ -0,0 +1,59 @@
+package backends
+
+import (
+	"context"
+	"testing"
+)
+
+// Lists and heads a fixed set of files, counting how often it's listed
+type statsBackend struct {
+	MetaStorageBackend
+	files map[string]Metadata
+	lists int
+}
+
+func (b *statsBackend) List(ctx context.Context) ([]string, error) {
+	b.lists++
+	keys := []string{"gone"}
+	for key := range b.files {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (b *statsBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	m, ok := b.files[key]
+	if !ok {
+		return m, NotFoundErr
+	}
+	return m, nil
+}
+
+func TestStatsCache(t *testing.T) {
+	ctx := context.Background()
+	b := &statsBackend{files: map[string]Metadata{
+		"a.png": {Mimetype: "image/png", Size: 10},
+		"b.jpg": {Mimetype: "image/jpeg", Size: 20},
+		"c.txt": {Mimetype: "text/plain; charset=utf-8", Size: 5},
+	}}
+	c := NewStatsCache()
+
+	s, err := c.Get(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.FileCount != 3 || s.TotalBytes != 35 || s.BytesByType["image"] != 30 || s.BytesByType["text"] != 5 {
+		t.Fatalf("Computed %+v", s)
+	}
+
+	s.BytesByType["image"] = 0
+	if s, _ := c.Get(ctx, b); b.lists != 1 || s.BytesByType["image"] != 30 {
+		t.Fatalf("Cached stats weren't used as they were, got %+v after %d lists", s, b.lists)
+	}
+
+	delete(b.files, "c.txt")
+	c.Invalidate()
+	if s, _ := c.Get(ctx, b); b.lists != 2 || s.FileCount != 2 {
+		t.Fatalf("Stats weren't invalidated, got %+v after %d lists", s, b.lists)
+	}
+}
@@ -1,34 +1,540 @@
 package backends
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"github.com/andreimarcu/linx-server/expiry"
 )
 
+// Optional settings for Put
+type PutOptions struct {
+	// The file can't be changed, renamed or deleted before this time, on
+	// backends that support retention locks
+	RetainUntil time.Time
+
+	// Hex sha256sum the contents must have, or else Put stores nothing
+	// and returns ChecksumMismatchError
+	ExpectedSha256 string
+
+	// Custom metadata to store with the file
+	Custom map[string]string
+
+	// Tags to store with the file, natively where the backend can
+	Tags map[string]string
+
+	// Token from QuotaBackend.Reserve for the room to store the file in
+	Reservation string
+
+	// Marks the content as encrypted by the client. Its mimetype isn't
+	// detected and archives aren't listed, as the content is opaque, and
+	// it's stored as application/octet-stream.
+	Encryption Encryption
+
+	// Number of times the file can be served before it's gone, on
+	// backends that count downloads. 0 for no limit.
+	MaxDownloads int64
+
+	// Replace any file already stored under the key. Otherwise Put
+	// returns KeyConflictErr if the key is taken, checking before it
+	// reads r where it can so that callers generating random keys can
+	// retry with another one.
+	Overwrite bool
+}
+
+// The optional features a backend supports, for callers to check rather
+// than calling methods that would return NotSupportedErr
+type Caps struct {
+	// PresignGet makes URLs that download files directly from storage
+	SupportsPresign bool
+	// GetRange and Range requests read from an offset without reading
+	// everything before it
+	SupportsRange bool
+	// Copy stores a file under another key without uploading it again
+	SupportsCopy bool
+	// Stored files can be listed, as a MetaStorageBackend
+	SupportsList bool
+	// Append and Finalize store files uploaded in chunks
+	SupportsAppend bool
+	// Deleted files are kept for GetDeleted, Restore and PurgeTrash
+	SupportsTrash bool
+	// PutOptions.RetainUntil locks files against changes
+	SupportsRetention bool
+	// Files are encrypted at rest by the backend itself
+	SupportsEncryption bool
+	// PutOptions.MaxDownloads limits how often files can be served
+	SupportsMaxDownloads bool
+}
+
+// How long an upload in progress is kept after it was last appended to,
+// before cleanup takes it for abandoned and removes it
+const UploadTTL = 24 * time.Hour
+
+// Every method but ServeFile, which uses the request's context, takes a
+// context that cancels the operation once done
 type StorageBackend interface {
-	Delete(key string) error
-	Exists(key string) (bool, error)
-	Head(key string) (Metadata, error)
-	Get(key string) (Metadata, io.ReadCloser, error)
-	Put(key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string) (Metadata, error)
-	PutMetadata(key string, m Metadata) error
+	// Append writes r to an upload in progress at offset, which can't be
+	// past what was written so far, and returns the size of the upload.
+	// Finalize then stores it as Put would, returning FileEmptyError if
+	// nothing was appended.
+	Append(ctx context.Context, key string, r io.Reader, offset int64) (int64, error)
+	// Capabilities reports the optional features the backend supports as
+	// configured
+	Capabilities() Caps
+	// Copy stores a copy of a file under a new key with its own delete
+	// key and public ID, returning KeyExistsErr rather than overwriting a
+	// file already there
+	Copy(ctx context.Context, srcKey, dstKey string) (Metadata, error)
+	Delete(ctx context.Context, key string) error
+	// BatchDelete deletes many files at once, returning the keys that
+	// were deleted and the error for each of those that weren't
+	BatchDelete(ctx context.Context, keys []string) (deleted []string, errs map[string]error)
+	// CheckAccessKey and CheckDeleteKey report whether provided matches
+	// the file's access or delete key, whether it's stored hashed or not
+	CheckAccessKey(ctx context.Context, key, provided string) (bool, error)
+	CheckDeleteKey(ctx context.Context, key, provided string) (bool, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Finalize(ctx context.Context, key string, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error)
+	Head(ctx context.Context, key string) (Metadata, error)
+	// HealthCheck returns an error if files can't currently be stored,
+	// such as when the storage is unreachable or its credentials expired
+	HealthCheck(ctx context.Context) error
+	Get(ctx context.Context, key string) (Metadata, io.ReadCloser, error)
+	// GetRange reads length bytes of a file from offset, or up to its end
+	// if length is negative or reaches past it. An offset past the end
+	// returns RangeNotSatisfiableErr.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// PresignGet returns a URL that downloads a file directly from where
+	// it's stored until ttl passes, or NotSupportedErr if a backend can't
+	// make one
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+	Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error)
+	PutMetadata(ctx context.Context, key string, m Metadata) error
+	// Rename moves a file and its metadata to a new key, returning
+	// KeyExistsErr rather than overwriting a file already there
+	Rename(ctx context.Context, oldKey, newKey string) error
+	// SetExpiry changes only the expiry of a file, returning
+	// ExpiryTooLongErr if the file's size doesn't allow it
+	SetExpiry(ctx context.Context, key string, newExpiry time.Time) error
+	// Touch moves the expiry of a file to extend from now, leaving files
+	// that never expire alone
+	Touch(ctx context.Context, key string, extend time.Duration) error
+	// GrantAccess replaces the access key of a file with one that's
+	// rejected after until, or never if until is zero
+	GrantAccess(ctx context.Context, key, accessKey string, until time.Time) error
+	// ServeFile must honor Range requests, replying with 206 Partial
+	// Content (or 416 if no range is satisfiable) like http.ServeContent,
+	// and serve the whole file instead if If-Range doesn't match. Backends
+	// that can only read files sequentially can use ServeReader.
 	ServeFile(key string, w http.ResponseWriter, r *http.Request) error
-	Size(key string) (int64, error)
+	// ServeThumbnail serves a JPEG of the image under key scaled down to
+	// fit within maxWidth by maxHeight, or returns NotAnImageErr. Backends
+	// can implement it with the ServeThumbnail function.
+	ServeThumbnail(key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error
+	// ServeImageVariant serves the image under key transcoded to a
+	// smaller format the request accepts, or returns NoVariantErr for the
+	// original to be served instead. Backends can implement it with the
+	// ServeImageVariant function.
+	ServeImageVariant(key string, w http.ResponseWriter, r *http.Request) error
+	// ServeArchiveEntry serves a single file from inside the archive
+	// under key, or returns NotFoundErr if entryPath isn't one of its
+	// ArchiveFiles. Backends can implement it with the ServeArchiveEntry
+	// function.
+	ServeArchiveEntry(key string, entryPath string, w http.ResponseWriter, r *http.Request) error
+	// Preview returns up to maxBytes from the start of a text file, and
+	// whether there's more of it, or NotTextErr if its mimetype isn't
+	// text. Backends can implement it with the Preview function.
+	Preview(ctx context.Context, key string, maxBytes int) (preview string, truncated bool, err error)
+	Size(ctx context.Context, key string) (int64, error)
+	// GetDeleted, Restore and PurgeTrash manage the files a backend with
+	// soft delete enabled keeps after they're deleted, which Head and Get
+	// don't see. GetDeleted and Restore return NotFoundErr for a key that
+	// isn't in the trash, and backends without soft delete return
+	// NotSupportedErr.
+	GetDeleted(ctx context.Context, key string) (Metadata, io.ReadCloser, error)
+	Restore(ctx context.Context, key string) error
+	PurgeTrash(ctx context.Context, olderThan time.Duration) error
+	// PurgeUploads removes the uploads in progress that were last
+	// appended to more than olderThan ago. Backends without Append return
+	// NotSupportedErr.
+	PurgeUploads(ctx context.Context, olderThan time.Duration) error
 }
 
 type MetaStorageBackend interface {
 	StorageBackend
-	List() ([]string, error)
+	List(ctx context.Context) ([]string, error)
+	// ListPaginated returns up to limit keys, or all of them if limit
+	// isn't positive, starting after cursor. Pass the nextCursor returned
+	// as the cursor for the following page, starting with an empty one;
+	// an empty nextCursor means there are no more pages.
+	ListPaginated(ctx context.Context, cursor string, limit int) (keys []string, nextCursor string, err error)
+	// ListExpired returns the keys whose expiry is before the given time,
+	// oldest first. Files that never expire are never returned.
+	ListExpired(ctx context.Context, before time.Time) ([]string, error)
+	// VerifyChecksum recomputes the sha256sum of a file's contents and
+	// compares it to its metadata, returning ok as false along with the
+	// computed sum on a mismatch
+	VerifyChecksum(ctx context.Context, key string) (ok bool, computed string, err error)
+	// Stats returns the number of files stored and the bytes they take up
+	Stats(ctx context.Context) (Stats, error)
+	// Query returns the keys of the files matching filter, sorted
+	Query(ctx context.Context, filter ListFilter) ([]string, error)
+	// GetByPublicID returns the key of the file with the given public ID,
+	// or NotFoundErr if there's none
+	GetByPublicID(ctx context.Context, id string) (key string, err error)
+	// FindBySha256 returns the key of a file whose contents have the hex
+	// sha256sum sum, if one that hasn't expired is stored
+	FindBySha256(ctx context.Context, sum string) (key string, found bool, err error)
+	// HeadMany returns the metadata of many files at once, with the error
+	// of each key that couldn't be read in errs rather than failing them
+	// all
+	HeadMany(ctx context.Context, keys []string) (found map[string]Metadata, errs map[string]error)
+	// ArchiveFS returns the entries of the archive under key as a file
+	// system, or NotSupportedErr if its format can't be read entry by
+	// entry. Backends can implement it with the ArchiveFS function.
+	ArchiveFS(key string) (fs.FS, error)
+}
+
+// What keys look like beyond being valid file names, in characters. Any
+// length or character is allowed when its field is zero.
+type KeyPolicy struct {
+	MinLen  int
+	MaxLen  int
+	Charset string
+}
+
+// Files larger than Size bytes are kept for at most MaxDuration, or for
+// as long as they're asked to be if it's 0
+type ExpiryTier struct {
+	Size        int64
+	MaxDuration time.Duration
 }
 
 var Limits struct {
+	// Files larger than MaxDurationSize are kept for at most
+	// MaxDurationTime seconds, if it isn't 0. This is one more of the
+	// ExpiryTiers.
 	MaxDurationTime uint64
 	MaxDurationSize int64
-	MaxSize         int64
+	// Files are limited by the tier with the largest Size they're over
+	ExpiryTiers []ExpiryTier
+	MaxSize     int64
+	// Smaller limits for some mimetypes, keyed by mimetype or by glob
+	// pattern such as image/*
+	MaxSizeByMime map[string]int64
+	// The only expiries files may be stored with, with 0 allowing files
+	// that never expire. Any expiry is allowed when empty
+	AllowedExpiries []time.Duration
+	// Round expiries that aren't allowed down to the closest allowed one
+	// instead of rejecting them
+	SnapExpiry bool
+	// Most files to store at once, such as to keep tiny uploads from
+	// running a filesystem out of inodes. 0 for no limit
+	MaxFiles int64
+	// Most bytes all files may take up together, for QuotaBackend to
+	// enforce. 0 for no limit
+	MaxTotalSize int64
+	// Longest original name to store in bytes, longer ones being
+	// truncated. 0 for DefaultMaxNameLength
+	MaxNameLength int
+	// Keep original names as they were given in custom metadata when
+	// sanitizing changes them
+	KeepRawName bool
+	// How files are served by mimetype or by glob pattern, such as to
+	// keep uploaded markup from running in the site's origin. Files of
+	// mimetypes without a policy are served inline as they are.
+	ServePolicies map[string]ServePolicy
+	// Checksums to compute for new files in addition to the sha256sum,
+	// by algorithm name such as md5 or blake3
+	Checksums []string
+	// Keys that don't follow it can't be stored, read or deleted
+	KeyPolicy KeyPolicy
+	// Bytes per second each download is served at, unless the file has a
+	// DownloadRate of its own. 0 for no limit
+	DownloadRate int64
+	// Fewest bytes per second an upload may come in at on average over
+	// MinUploadRateWindow, for stalled uploads to be dropped rather than
+	// hold on to a connection and a file. 0 for no limit
+	MinUploadRate       int64
+	MinUploadRateWindow time.Duration
+}
+
+// Keys name a single file, so they can't be empty, . or .., or contain path
+// separators or null bytes. They must also follow Limits.KeyPolicy.
+func ValidateKey(key string) error {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, "/\\\x00") {
+		return InvalidKeyErr
+	}
+	return Limits.KeyPolicy.Validate(key)
+}
+
+// InvalidKeyErr if key is too short, too long or has characters outside of
+// the policy's charset
+func (p KeyPolicy) Validate(key string) error {
+	length := utf8.RuneCountInString(key)
+	if length < p.MinLen || (p.MaxLen > 0 && length > p.MaxLen) {
+		return InvalidKeyErr
+	}
+	if p.Charset != "" {
+		for _, c := range key {
+			if !strings.ContainsRune(p.Charset, c) {
+				return InvalidKeyErr
+			}
+		}
+	}
+	return nil
+}
+
+// The longest a file of the given size may be kept for, from the tier with
+// the largest size it's over, or 0 if it may be kept forever
+func maxDuration(size int64) time.Duration {
+	tiers := Limits.ExpiryTiers
+	if Limits.MaxDurationTime > 0 {
+		tiers = append(tiers[:len(tiers):len(tiers)], ExpiryTier{
+			Size:        Limits.MaxDurationSize,
+			MaxDuration: time.Duration(Limits.MaxDurationTime) * time.Second,
+		})
+	}
+
+	var applicable *ExpiryTier
+	for i, tier := range tiers {
+		if size > tier.Size && (applicable == nil || tier.Size > applicable.Size) {
+			applicable = &tiers[i]
+		}
+	}
+	if applicable == nil {
+		return 0
+	}
+	return applicable.MaxDuration
+}
+
+// Determine when a file of the given size expires, given the requested
+// expiry (0 for none) and the configured Limits
+func FileExpiry(expiryTime time.Duration, size int64) time.Time {
+	maxDuration := maxDuration(size)
+	if expiryTime == 0 {
+		if maxDuration > 0 {
+			return time.Now().Add(maxDuration)
+		}
+		return expiry.NeverExpire
+	}
+
+	if maxDuration > 0 && expiryTime > maxDuration {
+		return time.Now().Add(maxDuration)
+	}
+	return time.Now().Add(expiryTime)
+}
+
+// Check the requested expiry (0 for none) against Limits.AllowedExpiries,
+// returning the expiry to store the file with. Snapped expiries are the
+// longest allowed one that isn't longer than requested, or the shortest if
+// every allowed one is
+func AllowedExpiry(expiryTime time.Duration) (time.Duration, error) {
+	if len(Limits.AllowedExpiries) == 0 || slices.Contains(Limits.AllowedExpiries, expiryTime) {
+		return expiryTime, nil
+	}
+	if !Limits.SnapExpiry {
+		return 0, InvalidExpiryErr
+	}
+
+	// Never expiring is longer than any expiry
+	longer := func(a, b time.Duration) bool {
+		return b != 0 && (a == 0 || a > b)
+	}
+
+	var snapped, shortest time.Duration
+	found := false
+	for i, allowed := range Limits.AllowedExpiries {
+		if i == 0 || longer(shortest, allowed) {
+			shortest = allowed
+		}
+		if !longer(allowed, expiryTime) && (!found || longer(allowed, snapped)) {
+			snapped, found = allowed, true
+		}
+	}
+	if !found {
+		return shortest, nil
+	}
+	return snapped, nil
+}
+
+// Check that a file of the given size may expire at newExpiry, given the
+// limit on how long files of its size are kept
+func CheckExpiry(size int64, newExpiry time.Time) error {
+	maxDuration := maxDuration(size)
+	if maxDuration == 0 {
+		return nil
+	}
+
+	maxExpiry := time.Now().Add(maxDuration)
+	if newExpiry == expiry.NeverExpire || newExpiry.After(maxExpiry) {
+		return ExpiryTooLongErr
+	}
+	return nil
+}
+
+// Move the expiry of a file forward to extend from now, for backends to
+// implement Touch with. Expiries are never brought forward, and aren't
+// written unless they move by more than 1% of extend, so a file downloaded
+// over and over doesn't have its metadata rewritten every time
+func Touch(ctx context.Context, b StorageBackend, key string, extend time.Duration) error {
+	m, err := b.Head(ctx, key)
+	if err != nil {
+		return err
+	}
+	if m.Expiry == expiry.NeverExpire {
+		return nil
+	}
+
+	newExpiry := FileExpiry(extend, m.Size)
+	if newExpiry.Sub(m.Expiry) <= extend/100 {
+		return nil
+	}
+	return b.SetExpiry(ctx, key, newExpiry)
+}
+
+// Store r under key unless a file with the sha256sum expectedSha is already
+// stored there, so that clients retrying or syncing uploads don't write the
+// same file again. Returns the existing file's metadata and false when
+// nothing was written. A different file already under key is only replaced
+// if o.Overwrite is set, and r must have expectedSha to be stored.
+func PutIfAbsent(ctx context.Context, b StorageBackend, key string, r io.Reader, expiryTime time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions, expectedSha string) (Metadata, bool, error) {
+	if expectedSha != "" {
+		m, err := b.Head(ctx, key)
+		if err == nil && strings.EqualFold(m.Sha256sum, expectedSha) && !expiry.IsTsExpired(m.Expiry) {
+			return m, false, nil
+		} else if err != nil && err != NotFoundErr {
+			return m, false, err
+		}
+		o.ExpectedSha256 = expectedSha
+	}
+
+	m, err := b.Put(ctx, key, r, expiryTime, deleteKey, accessKey, srcIp, originalName, o)
+	return m, err == nil, err
+}
+
+// Compare the sha256sum computed while storing a file to the one the caller
+// expected, if any
+func CheckSha256(expected, computed string) error {
+	if expected != "" && !strings.EqualFold(expected, computed) {
+		return ChecksumMismatchError
+	}
+	return nil
+}
+
+// Check a file of the given mimetype and size against Limits.MaxSizeByMime.
+// An exact mimetype takes precedence over patterns, and longer patterns
+// over shorter ones.
+func CheckMimeSize(mimetype string, size int64) error {
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	mimetype = strings.TrimSpace(mimetype)
+
+	maxSize, ok := matchMimetype(Limits.MaxSizeByMime, mimetype)
+	if ok && size > maxSize {
+		return MimeSizeLimitError{mimetype, maxSize}
+	}
+	return nil
+}
+
+// Look up mimetype in values keyed by mimetype or glob pattern, with an
+// exact mimetype taking precedence over patterns, and longer patterns over
+// shorter ones. Parameters such as a charset are ignored.
+func matchMimetype[V any](values map[string]V, mimetype string) (value V, ok bool) {
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	mimetype = strings.TrimSpace(mimetype)
+
+	value, ok = values[mimetype]
+	if ok {
+		return
+	}
+
+	matched := ""
+	for pattern, v := range values {
+		if m, _ := path.Match(pattern, mimetype); m && (len(pattern) > len(matched) || len(pattern) == len(matched) && pattern < matched) {
+			matched, value, ok = pattern, v, true
+		}
+	}
+	return
+}
+
+// Clamp a range of a file of the given size the way GetRange does,
+// returning the number of bytes to read from offset
+func RangeLength(size, offset, length int64) (int64, error) {
+	if offset < 0 || offset > size {
+		return 0, RangeNotSatisfiableErr
+	}
+	if length < 0 || length > size-offset {
+		length = size - offset
+	}
+	return length, nil
+}
+
+// Wrap err in StorageFullErr if it's from running out of disk space or
+// quota, which may clear up, so that callers can tell it apart from other
+// failures. Other errors are returned as they are.
+func CheckStorageFull(err error) error {
+	if err == nil || errors.Is(err, StorageFullErr) {
+		return err
+	}
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return fmt.Errorf("%w: %w", StorageFullErr, err)
+	}
+	return err
+}
+
+// Read at most n bytes from rc, closing it when done
+func LimitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	return limitedReadCloser{io.LimitReader(rc, n), rc}
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Returned by Put when a file is over the limit for its mimetype
+type MimeSizeLimitError struct {
+	Mimetype string
+	MaxSize  int64
+}
+
+func (e MimeSizeLimitError) Error() string {
+	return fmt.Sprintf("Files of type %s cannot be larger than %d bytes.", e.Mimetype, e.MaxSize)
 }
 
 var NotFoundErr = errors.New("File not found.")
 var FileEmptyError = errors.New("Empty file")
 var FileTooLargeError = errors.New("File too large.")
+var TooManyFilesError = errors.New("Too many files are stored, try again later.")
+var OrphanedMetadataErr = errors.New("File metadata exists but its contents are missing.")
+var RangeNotSatisfiableErr = errors.New("Range starts past the end of the file.")
+var KeyExistsErr = errors.New("A file with this key already exists.")
+var KeyConflictErr = errors.New("Another file is already stored under this key.")
+var RetentionLockedErr = errors.New("File is locked from changes until its retention date.")
+var ExpiryTooLongErr = errors.New("Expiry is too long for the size of this file.")
+var InvalidExpiryErr = errors.New("Expiry is not one of the allowed expiries.")
+var NotSupportedErr = errors.New("Not supported by this storage backend.")
+var ChecksumMismatchError = errors.New("File contents don't match the expected sha256sum.")
+var InvalidOffsetErr = errors.New("Offset is past the end of the upload so far.")
+var InvalidKeyErr = errors.New("Invalid file key.")
+var RateLimitedErr = errors.New("Too many uploads, try again later.")
+var ReadOnlyErr = errors.New("Storage is read-only, try again later.")
+var NotAnImageErr = errors.New("File is not an image that can be thumbnailed.")
+var NotTextErr = errors.New("File is not text.")
+var PartialDeleteErr = errors.New("Only part of the file was deleted.")
+var AuditLogErr = errors.New("Could not record the delete in the audit log.")
+var AuditLogTamperedErr = errors.New("Audit log entry does not follow the one before it.")
+var QuotaExceededErr = errors.New("Not enough room left to store the file.")
+var ReservationNotFoundErr = errors.New("Reservation does not exist or has expired.")
+var StorageFullErr = errors.New("Storage is full, try again later.")
+var UploadTooSlowErr = errors.New("Upload is too slow.")
@@ -0,0 +1,331 @@
+package backends
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func TestCheckExpiry(t *testing.T) {
+	Limits.MaxDurationSize = 100
+	Limits.MaxDurationTime = 3600
+	defer func() {
+		Limits.MaxDurationSize = 0
+		Limits.MaxDurationTime = 0
+	}()
+
+	if err := CheckExpiry(50, expiry.NeverExpire); err != nil {
+		t.Fatalf("Small file was limited: %v", err)
+	}
+	if err := CheckExpiry(200, time.Now().Add(30*time.Minute)); err != nil {
+		t.Fatalf("Expiry within the limit was rejected: %v", err)
+	}
+	if err := CheckExpiry(200, time.Now().Add(2*time.Hour)); err != ExpiryTooLongErr {
+		t.Fatalf("Expiry over the limit returned %v", err)
+	}
+	if err := CheckExpiry(200, expiry.NeverExpire); err != ExpiryTooLongErr {
+		t.Fatalf("Never expiring large file returned %v", err)
+	}
+}
+
+func TestExpiryTiers(t *testing.T) {
+	Limits.ExpiryTiers = []ExpiryTier{
+		{Size: 1000, MaxDuration: time.Hour},
+		{Size: 100, MaxDuration: 24 * time.Hour},
+	}
+	Limits.MaxDurationSize = 10000
+	Limits.MaxDurationTime = 60
+	defer func() {
+		Limits.ExpiryTiers = nil
+		Limits.MaxDurationSize = 0
+		Limits.MaxDurationTime = 0
+	}()
+
+	if e := FileExpiry(0, 50); e != expiry.NeverExpire {
+		t.Fatalf("Expected a file under every tier not to expire, got %v", e)
+	}
+	for size, want := range map[int64]time.Duration{
+		500:   24 * time.Hour,
+		5000:  time.Hour,
+		20000: time.Minute,
+	} {
+		e := FileExpiry(0, size)
+		if d := time.Until(e); d > want || d < want-time.Minute {
+			t.Errorf("Expected a file of %d bytes to expire in %v, got %v", size, want, d)
+		}
+	}
+
+	if e := FileExpiry(30*time.Minute, 5000); time.Until(e) > 30*time.Minute {
+		t.Fatalf("Expected a shorter expiry than the tier's to be kept, got %v", e)
+	}
+	if err := CheckExpiry(500, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("Expiry within the tier was rejected: %v", err)
+	}
+	if err := CheckExpiry(5000, time.Now().Add(2*time.Hour)); err != ExpiryTooLongErr {
+		t.Fatalf("Expiry over the tier returned %v", err)
+	}
+}
+
+func TestAllowedExpiry(t *testing.T) {
+	Limits.AllowedExpiries = []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+	defer func() {
+		Limits.AllowedExpiries = nil
+		Limits.SnapExpiry = false
+	}()
+
+	if e, err := AllowedExpiry(24 * time.Hour); err != nil || e != 24*time.Hour {
+		t.Fatalf("Allowed expiry returned %v, %v", e, err)
+	}
+	if _, err := AllowedExpiry(2 * time.Hour); err != InvalidExpiryErr {
+		t.Fatalf("Expiry not in the list returned %v", err)
+	}
+	if _, err := AllowedExpiry(0); err != InvalidExpiryErr {
+		t.Fatalf("Never expiring without it being allowed returned %v", err)
+	}
+
+	Limits.SnapExpiry = true
+	for requested, snapped := range map[time.Duration]time.Duration{
+		2 * time.Hour:    time.Hour,
+		30 * time.Minute: time.Hour,
+		0:                7 * 24 * time.Hour,
+	} {
+		if e, err := AllowedExpiry(requested); err != nil || e != snapped {
+			t.Fatalf("%v was snapped to %v instead of %v (%v)", requested, e, snapped, err)
+		}
+	}
+
+	Limits.AllowedExpiries = append(Limits.AllowedExpiries, 0)
+	if e, err := AllowedExpiry(0); err != nil || e != 0 {
+		t.Fatalf("Allowed never expiring returned %v, %v", e, err)
+	}
+	if e, _ := AllowedExpiry(30 * 24 * time.Hour); e != 7*24*time.Hour {
+		t.Fatalf("Snapped to %v instead of the longest expiry", e)
+	}
+}
+
+// Stores the metadata of a single file, counting how often its expiry is set
+type expiryBackend struct {
+	StorageBackend
+	m    Metadata
+	sets int
+}
+
+func (b *expiryBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	return b.m, nil
+}
+
+func (b *expiryBackend) SetExpiry(ctx context.Context, key string, newExpiry time.Time) error {
+	b.sets++
+	b.m.Expiry = newExpiry
+	return nil
+}
+
+// Stores the metadata of files put, checking their sha256sums like a real
+// backend would
+type hashingBackend struct {
+	StorageBackend
+	files map[string]Metadata
+	puts  int
+}
+
+func (b *hashingBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	m, ok := b.files[key]
+	if !ok {
+		return m, NotFoundErr
+	}
+	return m, nil
+}
+
+func (b *hashingBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o PutOptions) (Metadata, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	sum := sha256.Sum256(data)
+	m := Metadata{Sha256sum: hex.EncodeToString(sum[:]), Expiry: FileExpiry(expiry, int64(len(data)))}
+	if err := CheckSha256(o.ExpectedSha256, m.Sha256sum); err != nil {
+		return Metadata{}, err
+	}
+
+	b.puts++
+	b.files[key] = m
+	return m, nil
+}
+
+func TestTouch(t *testing.T) {
+	ctx := context.Background()
+	b := &expiryBackend{m: Metadata{Expiry: time.Now().Add(time.Hour)}}
+
+	if err := Touch(ctx, b, "a", 24*time.Hour); err != nil || b.sets != 1 {
+		t.Fatalf("Expiry wasn't moved, %d sets and %v", b.sets, err)
+	}
+	if time.Until(b.m.Expiry) < 23*time.Hour {
+		t.Fatalf("Expiry moved to %v", b.m.Expiry)
+	}
+
+	if Touch(ctx, b, "a", 24*time.Hour); b.sets != 1 {
+		t.Fatal("Expiry was rewritten when it barely moved")
+	}
+	if Touch(ctx, b, "a", time.Hour); b.sets != 1 {
+		t.Fatal("Expiry was brought forward")
+	}
+
+	b.m.Expiry = expiry.NeverExpire
+	if Touch(ctx, b, "a", 24*time.Hour); b.sets != 1 || b.m.Expiry != expiry.NeverExpire {
+		t.Fatal("Never expiring file was touched")
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	ctx := context.Background()
+	b := &hashingBackend{files: map[string]Metadata{}}
+
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	put := func(content, expected string) (Metadata, bool, error) {
+		return PutIfAbsent(ctx, b, "a", strings.NewReader(content), 0, "del", "", "", "", PutOptions{Overwrite: true}, expected)
+	}
+
+	if _, written, err := put("hello", sum); err != nil || !written || b.puts != 1 {
+		t.Fatalf("Missing file wasn't stored, %v and %v", written, err)
+	}
+	if m, written, err := put("hello", strings.ToUpper(sum)); err != nil || written || b.puts != 1 || m.Sha256sum != sum {
+		t.Fatalf("Present file was stored again, %v and %v", written, err)
+	}
+	delete(b.files, "a")
+	if _, _, err := put("other", sum); err != ChecksumMismatchError {
+		t.Fatalf("Mismatching content returned %v", err)
+	}
+
+	b.files["a"] = Metadata{Sha256sum: sum, Expiry: time.Now().Add(-time.Minute)}
+	if _, written, err := put("hello", sum); err != nil || !written {
+		t.Fatalf("Expired file wasn't replaced, %v and %v", written, err)
+	}
+}
+
+func TestCheckMimeSize(t *testing.T) {
+	Limits.MaxSizeByMime = map[string]int64{
+		"image/*":       100,
+		"image/svg+xml": 10,
+		"text/*":        50,
+		"text/h*":       20,
+	}
+	defer func() {
+		Limits.MaxSizeByMime = nil
+	}()
+
+	for _, tc := range []struct {
+		mimetype string
+		size     int64
+		maxSize  int64
+	}{
+		{"image/png", 100, 0},
+		{"image/png", 101, 100},
+		{"image/svg+xml", 11, 10},
+		{"text/html; charset=utf-8", 21, 20},
+		{"text/plain; charset=utf-8", 21, 0},
+		{"video/mp4", 1000, 0},
+	} {
+		err := CheckMimeSize(tc.mimetype, tc.size)
+		if tc.maxSize == 0 {
+			if err != nil {
+				t.Errorf("%s of %d bytes was limited: %v", tc.mimetype, tc.size, err)
+			}
+			continue
+		}
+
+		mimeErr, ok := err.(MimeSizeLimitError)
+		if !ok || mimeErr.MaxSize != tc.maxSize {
+			t.Errorf("%s of %d bytes returned %v instead of a limit of %d", tc.mimetype, tc.size, err, tc.maxSize)
+		}
+	}
+}
+
+func TestRangeLength(t *testing.T) {
+	for _, tc := range []struct {
+		offset, length, expected int64
+	}{
+		{0, 10, 10},
+		{5, -1, 5},
+		{5, 100, 5},
+		{10, 5, 0},
+	} {
+		length, err := RangeLength(10, tc.offset, tc.length)
+		if err != nil || length != tc.expected {
+			t.Errorf("Range %d+%d returned %d, %v instead of %d", tc.offset, tc.length, length, err, tc.expected)
+		}
+	}
+
+	if _, err := RangeLength(10, 11, 1); err != RangeNotSatisfiableErr {
+		t.Fatalf("Range past the end returned %v", err)
+	}
+}
+
+func TestCheckSha256(t *testing.T) {
+	sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	for _, expected := range []string{"", sum, strings.ToUpper(sum)} {
+		if err := CheckSha256(expected, sum); err != nil {
+			t.Errorf("Expecting %q returned %v", expected, err)
+		}
+	}
+	if err := CheckSha256(sum[1:]+"0", sum); err != ChecksumMismatchError {
+		t.Fatalf("Mismatch returned %v", err)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	for _, key := range []string{"file.txt", "my..file", ".hidden"} {
+		if err := ValidateKey(key); err != nil {
+			t.Errorf("%q was rejected: %v", key, err)
+		}
+	}
+	for _, key := range []string{"", ".", "..", "../etc", "a/b", "a\\b", "a\x00b"} {
+		if err := ValidateKey(key); err != InvalidKeyErr {
+			t.Errorf("%q wasn't rejected", key)
+		}
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	Limits.KeyPolicy = KeyPolicy{MinLen: 5, MaxLen: 10, Charset: "abcdé.txt"}
+	defer func() { Limits.KeyPolicy = KeyPolicy{} }()
+
+	for _, key := range []string{"abc.txt", "ééééé", "aaaaaaaaaa"} {
+		if err := ValidateKey(key); err != nil {
+			t.Errorf("%q was rejected: %v", key, err)
+		}
+	}
+	for _, key := range []string{"a.txt2", "abcd", "aaaaaaaaaaa", "ABC.txt", "../abc"} {
+		if err := ValidateKey(key); err != InvalidKeyErr {
+			t.Errorf("%q wasn't rejected", key)
+		}
+	}
+}
+
+func TestCheckStorageFull(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EDQUOT} {
+		written := &os.PathError{Op: "write", Path: "files/.tmp", Err: errno}
+		err := CheckStorageFull(written)
+		if !errors.Is(err, StorageFullErr) || !errors.Is(err, errno) {
+			t.Errorf("%v was returned as %v", written, err)
+		}
+		if again := CheckStorageFull(err); again != err {
+			t.Errorf("Checking %v again returned %v", err, again)
+		}
+	}
+
+	for _, err := range []error{nil, io.ErrUnexpectedEOF, &os.PathError{Op: "open", Path: "meta/key", Err: syscall.EACCES}} {
+		if checked := CheckStorageFull(err); checked != err {
+			t.Errorf("%v was returned as %v", err, checked)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package backends
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// Byte order marks of the Unicode encodings text files are saved in, which
+// for UTF-16 and UTF-32 are followed by text full of null bytes
+var textBOMs = [][]byte{
+	{0xEF, 0xBB, 0xBF},
+	{0x00, 0x00, 0xFE, 0xFF},
+	{0xFF, 0xFE, 0x00, 0x00},
+	{0xFE, 0xFF},
+	{0xFF, 0xFE},
+}
+
+// Most control characters a sample can have in every 100 bytes and still
+// be text, allowing for a stray form feed or escape sequence
+const maxControlPercent = 5
+
+// Whether a file of mimetype that starts with sample is text, for Preview,
+// GzipText and displaying files to agree on. A file detected as something
+// other than text or application/octet-stream is never text, and without a
+// sample only text mimetypes are. Otherwise the sample is text if it starts
+// with a Unicode byte order mark, or has no null bytes and hardly any other
+// control characters. Invalid UTF-8 is only text if mimetype says so, as it
+// may then be in a legacy charset.
+func IsTextContent(mimetype string, sample []byte) bool {
+	text := isText(mimetype)
+	if len(sample) == 0 {
+		return text
+	}
+	if !text && !isOpaque(mimetype) {
+		return false
+	}
+
+	for _, bom := range textBOMs {
+		if bytes.HasPrefix(sample, bom) {
+			return true
+		}
+	}
+
+	if !text && !utf8.Valid(trimPartialRune(sample)) {
+		return false
+	}
+
+	controls := 0
+	for _, c := range sample {
+		switch {
+		case c == 0:
+			return false
+		case c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == 0x1b:
+		case c < 0x20 || c == 0x7f:
+			controls++
+		}
+	}
+	return controls*100 <= len(sample)*maxControlPercent
+}
+
+// Whether mimetype says nothing about what's in a file
+func isOpaque(mimetype string) bool {
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	mimetype = strings.TrimSpace(mimetype)
+	return mimetype == "" || mimetype == "application/octet-stream"
+}
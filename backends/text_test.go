@@ -0,0 +1,37 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsTextContent(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		mimetype string
+		sample   string
+		want     bool
+	}{
+		{"text mimetype without a sample", "text/plain; charset=utf-8", "", true},
+		{"opaque without a sample", "application/octet-stream", "", false},
+		{"plain text", "text/plain; charset=utf-8", "hello\nworld\n", true},
+		{"minified json", "application/json", `{"a":[1,2,{"b":"c"}],"d":null}`, true},
+		{"json detected as opaque", "application/octet-stream", `{"a":1,"b":"é"}`, true},
+		{"utf-16 with a bom", "text/plain; charset=utf-16le", "\xff\xfeh\x00i\x00", true},
+		{"utf-16 detected as opaque", "application/octet-stream", "\xfe\xff\x00h\x00i", true},
+		{"utf-16 without a bom", "application/octet-stream", "h\x00i\x00", false},
+		{"mostly ascii binary", "application/octet-stream", "\x7fELF\x02\x01\x01" + strings.Repeat("a", 100) + "\x00", false},
+		{"control characters", "application/octet-stream", strings.Repeat("ab\x01\x02", 10), false},
+		{"ansi colours", "text/plain", "\x1b[31mred\x1b[0m\r\n", true},
+		{"truncated utf-8", "application/octet-stream", "日本"[:5], true},
+		{"latin-1 text", "text/plain; charset=iso-8859-1", "caf\xe9", true},
+		{"invalid utf-8 detected as opaque", "application/octet-stream", "caf\xe9 au lait", false},
+		{"text in an image", "image/png", "hello", false},
+		{"svg", "image/svg+xml", "<svg></svg>", true},
+		{"nul in text", "text/plain", "hello\x00world", false},
+	} {
+		if got := IsTextContent(tt.mimetype, []byte(tt.sample)); got != tt.want {
+			t.Errorf("%s: IsTextContent(%q, %q) = %v, expected %v", tt.name, tt.mimetype, tt.sample, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package backends
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// Most bytes a throttled download writes at once, which is also how far
+// ahead of its rate it can get
+const throttleBurst = 32 * 1024
+
+// The bytes per second a file described by m is served at: its own
+// DownloadRate if it has one, or else Limits.DownloadRate. 0 for no limit.
+func DownloadRate(m Metadata) int64 {
+	if m.DownloadRate != 0 {
+		return max(m.DownloadRate, 0)
+	}
+	return max(Limits.DownloadRate, 0)
+}
+
+// For ServeFile to keep a download of the file described by m to its
+// DownloadRate, wrapping w so that writes wait for their turn. Each download
+// has a rate of its own, and waiting stops when the request is canceled. w
+// is returned as it is if the file isn't throttled.
+func ThrottleDownload(w http.ResponseWriter, r *http.Request, m Metadata) http.ResponseWriter {
+	bps := DownloadRate(m)
+	if bps == 0 {
+		return w
+	}
+
+	burst := int(min(bps, throttleBurst))
+	return &throttledWriter{w, r.Context(), rate.NewLimiter(rate.Limit(bps), burst)}
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (t *throttledWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		n := min(len(p), t.limiter.Burst())
+		if err = t.limiter.WaitN(t.ctx, n); err != nil {
+			return
+		}
+
+		n, err = t.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return
+		}
+		p = p[n:]
+	}
+	return
+}
+
+// For http.ResponseController to reach the wrapped writer
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
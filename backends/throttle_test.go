@@ -0,0 +1,52 @@
+package backends
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadRate(t *testing.T) {
+	Limits.DownloadRate = 1000
+	defer func() { Limits.DownloadRate = 0 }()
+
+	if rate := DownloadRate(Metadata{}); rate != 1000 {
+		t.Fatalf("Expected the global rate, got %d", rate)
+	}
+	if rate := DownloadRate(Metadata{DownloadRate: 50}); rate != 50 {
+		t.Fatalf("Expected the file's own rate, got %d", rate)
+	}
+	if rate := DownloadRate(Metadata{DownloadRate: -1}); rate != 0 {
+		t.Fatalf("Expected the file to be unthrottled, got %d", rate)
+	}
+}
+
+func TestThrottleDownload(t *testing.T) {
+	r := httptest.NewRequest("GET", "/file", nil)
+	w := httptest.NewRecorder()
+	if ThrottleDownload(w, r, Metadata{}) != w {
+		t.Fatal("Expected an unthrottled file to be written as it is")
+	}
+
+	// The first 20000 bytes are the burst, the rest take half a second
+	tw := ThrottleDownload(w, r, Metadata{DownloadRate: 20000})
+	start := time.Now()
+	if n, err := tw.Write([]byte(strings.Repeat("x", 30000))); n != 30000 || err != nil {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expected the write to be throttled, took %v", elapsed)
+	}
+	if w.Body.Len() != 30000 {
+		t.Fatalf("Expected everything to be written, got %d bytes", w.Body.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tw = ThrottleDownload(httptest.NewRecorder(), r.WithContext(ctx), Metadata{DownloadRate: 10})
+	if _, err := tw.Write([]byte(strings.Repeat("x", 100))); err == nil {
+		t.Fatal("Expected a canceled download to stop waiting")
+	}
+}
@@ -0,0 +1,202 @@
+package backends
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// Largest thumbnail that can be asked for, in either dimension
+	MaxThumbnailDimension = 2048
+	// Images with more pixels than this aren't decoded, as a guard
+	// against decompression bombs
+	maxThumbnailSourcePixels = 64 * 1024 * 1024
+	maxCachedThumbnails      = 512
+	thumbnailQuality         = 85
+)
+
+var thumbnailMimetypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var ThumbnailDimensionsErr = fmt.Errorf("Thumbnail dimensions must be between 1 and %d.", MaxThumbnailDimension)
+
+// Serve a JPEG thumbnail of the image stored under key, scaled down to fit
+// within maxWidth by maxHeight while preserving its aspect ratio, or
+// NotAnImageErr if it isn't an image of a supported format. Thumbnails are
+// cached by the image's sha256sum and dimensions, so they're shared by
+// identical images under different keys.
+func ServeThumbnail(b StorageBackend, key string, w http.ResponseWriter, r *http.Request, maxWidth, maxHeight int) error {
+	if maxWidth < 1 || maxHeight < 1 || maxWidth > MaxThumbnailDimension || maxHeight > MaxThumbnailDimension {
+		return ThumbnailDimensionsErr
+	}
+
+	m, err := b.Head(r.Context(), key)
+	if err != nil {
+		return err
+	}
+
+	mimetype, _, _ := strings.Cut(m.Mimetype, ";")
+	if !thumbnailMimetypes[strings.TrimSpace(mimetype)] {
+		return NotAnImageErr
+	}
+
+	cacheKey := fmt.Sprintf("%s-%dx%d", m.Sha256sum, maxWidth, maxHeight)
+	if m.ETag != "" {
+		m.ETag = strings.TrimSuffix(m.ETag, "\"") + fmt.Sprintf("-%dx%d\"", maxWidth, maxHeight)
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	if CheckPreconditions(w, r, m) {
+		return nil
+	}
+
+	thumbnail, ok := thumbnails.get(cacheKey)
+	if !ok || m.Sha256sum == "" {
+		_, f, err := b.Get(r.Context(), key)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		thumbnail, err = makeThumbnail(f, maxWidth, maxHeight)
+		if err != nil {
+			return err
+		}
+		if m.Sha256sum != "" {
+			thumbnails.put(cacheKey, thumbnail)
+		}
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(thumbnail)))
+	if r.Method != "HEAD" {
+		_, err = w.Write(thumbnail)
+	}
+	return err
+}
+
+func makeThumbnail(r io.Reader, maxWidth, maxHeight int) ([]byte, error) {
+	// Check the image's size before decoding all of it
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, NotAnImageErr
+	}
+	if config.Width < 1 || config.Height < 1 || int64(config.Width)*int64(config.Height) > maxThumbnailSourcePixels {
+		return nil, FileTooLargeError
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, NotAnImageErr
+	}
+
+	width, height := thumbnailSize(config.Width, config.Height, maxWidth, maxHeight)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	// JPEG has no transparency, so transparent images are shown on white
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Scale width by height down to fit within maxWidth by maxHeight, keeping
+// its aspect ratio. Smaller images are left as they are.
+func thumbnailSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+
+	if int64(width)*int64(maxHeight) > int64(height)*int64(maxWidth) {
+		return maxWidth, max(1, int(int64(height)*int64(maxWidth)/int64(width)))
+	}
+	return max(1, int(int64(width)*int64(maxHeight)/int64(height))), maxHeight
+}
+
+// Recently served images, evicting the least recently used first once
+// there are more than maxEntries or they take more than maxBytes
+type imageCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	bytes      int
+	maxEntries int
+	maxBytes   int
+}
+
+type imageCacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newImageCache(maxEntries, maxBytes int) *imageCache {
+	return &imageCache{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+var thumbnails = newImageCache(maxCachedThumbnails, 0)
+var variants = newImageCache(maxCachedVariants, maxCachedVariantBytes)
+
+func (c *imageCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*imageCacheEntry).data, true
+}
+
+func (c *imageCache) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*imageCacheEntry)
+		c.bytes += len(data) - len(entry.data)
+		entry.data = data
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[key] = c.lru.PushFront(&imageCacheEntry{key, data})
+		c.bytes += len(data)
+	}
+
+	for c.lru.Len() > 0 && ((c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		entry := oldest.Value.(*imageCacheEntry)
+		delete(c.entries, entry.key)
+		c.bytes -= len(entry.data)
+	}
+}
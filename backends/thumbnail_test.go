@@ -0,0 +1,78 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+// Stores a single file, counting how often it's read
+type imageBackend struct {
+	StorageBackend
+	m    Metadata
+	data []byte
+	gets int
+}
+
+func (b *imageBackend) Head(ctx context.Context, key string) (Metadata, error) {
+	return b.m, nil
+}
+
+func (b *imageBackend) Get(ctx context.Context, key string) (Metadata, io.ReadCloser, error) {
+	b.gets++
+	return b.m, io.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+func TestThumbnailSize(t *testing.T) {
+	for _, tc := range []struct {
+		width, height, maxWidth, maxHeight int
+		newWidth, newHeight                int
+	}{
+		{400, 200, 100, 100, 100, 50},
+		{200, 400, 100, 100, 50, 100},
+		{50, 20, 100, 100, 50, 20},
+		{1000, 1, 100, 100, 100, 1},
+	} {
+		width, height := thumbnailSize(tc.width, tc.height, tc.maxWidth, tc.maxHeight)
+		if width != tc.newWidth || height != tc.newHeight {
+			t.Errorf("%dx%d within %dx%d was %dx%d", tc.width, tc.height, tc.maxWidth, tc.maxHeight, width, height)
+		}
+	}
+}
+
+func TestServeThumbnail(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 150)))
+	b := &imageBackend{m: Metadata{Mimetype: "image/png", Sha256sum: "thumbnailtest", ETag: ETag("thumbnailtest")}, data: buf.Bytes()}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		if err := ServeThumbnail(b, "key", w, httptest.NewRequest("GET", "/key", nil), 64, 64); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := jpeg.DecodeConfig(w.Body)
+		if err != nil || config.Width != 64 || config.Height != 32 {
+			t.Fatalf("Thumbnail was %+v, %v", config, err)
+		}
+		if etag := w.Header().Get("Etag"); etag != "\"thumbnailtest-64x64\"" {
+			t.Errorf("Thumbnail ETag was %s", etag)
+		}
+	}
+	if b.gets != 1 {
+		t.Errorf("Image was read %d times instead of being cached", b.gets)
+	}
+
+	b.m.Mimetype = "text/plain"
+	if err := ServeThumbnail(b, "key", httptest.NewRecorder(), httptest.NewRequest("GET", "/key", nil), 64, 64); err != NotAnImageErr {
+		t.Errorf("Text file returned %v", err)
+	}
+	if err := ServeThumbnail(b, "key", httptest.NewRecorder(), httptest.NewRequest("GET", "/key", nil), 0, 64); err != ThumbnailDimensionsErr {
+		t.Errorf("Zero width returned %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+)
+
+const (
+	// Larger images are served as they are, as transcoding them would
+	// take too long
+	maxVariantSourcePixels = 16 * 1024 * 1024
+	maxCachedVariants      = 4096
+	maxCachedVariantBytes  = 256 * 1024 * 1024
+)
+
+// Returned by ServeImageVariant when the original should be served
+// instead, having written nothing but a Vary header
+var NoVariantErr = errors.New("No variant of the image to serve.")
+
+// Encodes images in a format that some browsers accept
+type VariantEncoder struct {
+	// Mimetype of the images it encodes, such as image/avif
+	Mimetype string
+	// Mimetypes of the images it's worth transcoding, usually because it
+	// makes them smaller
+	Sources []string
+	// Encode m, decoded from an image of mimetype source
+	Encode func(w io.Writer, m image.Image, source string) error
+}
+
+var (
+	variantEncodersMu sync.RWMutex
+	// AVIF is preferred when a client accepts both, as it's the smaller
+	variantEncoders = []VariantEncoder{
+		{Mimetype: "image/webp", Sources: []string{"image/png", "image/jpeg"}, Encode: encodeWebP},
+		{Mimetype: "image/avif", Sources: []string{"image/png", "image/jpeg"}, Encode: encodeAVIF},
+	}
+)
+
+// JPEGs have already lost detail, so their variants can too, but PNGs are
+// often screenshots and drawings that have to stay exact
+func encodeWebP(w io.Writer, m image.Image, source string) error {
+	if source == "image/png" {
+		return webp.Encode(w, m, webp.Options{Lossless: true, Method: webp.DefaultMethod, Exact: true})
+	}
+	return webp.Encode(w, m, webp.Options{Quality: webp.DefaultQuality, Method: webp.DefaultMethod})
+}
+
+func encodeAVIF(w io.Writer, m image.Image, source string) error {
+	if source == "image/png" {
+		return avif.Encode(w, m, avif.Options{Quality: 100, QualityAlpha: 100, Speed: avif.DefaultSpeed, ChromaSubsampling: image.YCbCrSubsampleRatio444})
+	}
+	return avif.Encode(w, m, avif.Options{Quality: avif.DefaultQuality, QualityAlpha: avif.DefaultQuality, Speed: avif.DefaultSpeed, ChromaSubsampling: image.YCbCrSubsampleRatio420})
+}
+
+// Register an encoder for ServeImageVariant, replacing any for the same
+// mimetype. Encoders registered later are preferred when a client accepts
+// several equally.
+func RegisterVariantEncoder(e VariantEncoder) {
+	variantEncodersMu.Lock()
+	defer variantEncodersMu.Unlock()
+
+	variantEncoders = slices.DeleteFunc(slices.Clone(variantEncoders), func(other VariantEncoder) bool {
+		return other.Mimetype == e.Mimetype
+	})
+	variantEncoders = append(variantEncoders, e)
+}
+
+// Images being transcoded at once, leaving the rest to be served as they
+// are rather than waiting for a turn
+var transcodes = make(chan struct{}, runtime.NumCPU())
+
+// Serve the image stored under key transcoded to a format the request
+// accepts, if there's an encoder for it and the result is smaller, or
+// NoVariantErr. Only explicitly accepted formats count, not wildcards.
+// Variants are cached by the image's sha256sum and format, as is finding
+// that an image has none, so it's only transcoded on the first request.
+// Ranges, attachments and files limited to a number of downloads are
+// always served as they are.
+func ServeImageVariant(b StorageBackend, key string, w http.ResponseWriter, r *http.Request) error {
+	m, err := b.Head(r.Context(), key)
+	if err != nil {
+		return err
+	}
+
+	mimetype, _, _ := strings.Cut(m.Mimetype, ";")
+	mimetype = strings.ToLower(strings.TrimSpace(mimetype))
+	encoders := variantEncodersFor(mimetype)
+	if len(encoders) == 0 {
+		return NoVariantErr
+	}
+
+	// The original is served as it is on account of the Accept header too
+	w.Header().Add("Vary", "Accept")
+	if m.Sha256sum == "" || m.MaxDownloads > 0 || r.Header.Get("Range") != "" || w.Header().Get("Content-Disposition") != "" {
+		return NoVariantErr
+	}
+
+	e, ok := negotiateVariant(r.Header.Get("Accept"), encoders)
+	if !ok {
+		return NoVariantErr
+	}
+
+	cacheKey := m.Sha256sum + "-" + e.Mimetype
+	variant, ok := variants.get(cacheKey)
+	if !ok {
+		select {
+		case transcodes <- struct{}{}:
+		default:
+			return NoVariantErr
+		}
+		variant, err = makeVariant(b, r, key, m, mimetype, e)
+		<-transcodes
+		if err != nil {
+			return err
+		}
+		variants.put(cacheKey, variant)
+	}
+	if variant == nil {
+		return NoVariantErr
+	}
+
+	_, subtype, _ := strings.Cut(e.Mimetype, "/")
+	if m.ETag != "" {
+		m.ETag = strings.TrimSuffix(m.ETag, "\"") + "-" + subtype + "\""
+	}
+
+	w.Header().Set("Content-Type", e.Mimetype)
+	w.Header().Set("Content-Length", strconv.Itoa(len(variant)))
+	if CheckPreconditions(w, r, m) {
+		return nil
+	}
+
+	if r.Method != "HEAD" {
+		_, err = ThrottleDownload(w, r, m).Write(variant)
+	}
+	return err
+}
+
+// Encoders worth transcoding images of mimetype with, most preferred first
+func variantEncodersFor(mimetype string) []VariantEncoder {
+	variantEncodersMu.RLock()
+	defer variantEncodersMu.RUnlock()
+
+	var encoders []VariantEncoder
+	for i := len(variantEncoders) - 1; i >= 0; i-- {
+		e := variantEncoders[i]
+		if e.Mimetype != mimetype && slices.Contains(e.Sources, mimetype) {
+			encoders = append(encoders, e)
+		}
+	}
+	return encoders
+}
+
+// The encoder for the format accept gives the highest quality value,
+// taking the earliest of equally accepted ones
+func negotiateVariant(accept string, encoders []VariantEncoder) (best VariantEncoder, ok bool) {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		accepted[mediatype] = q
+	}
+
+	bestQ := 0.0
+	for _, e := range encoders {
+		if q := accepted[e.Mimetype]; q > bestQ {
+			best, bestQ, ok = e, q, true
+		}
+	}
+	return
+}
+
+// Transcode the image of mimetype stored under key with e, or return nil if
+// it can't be decoded or isn't any smaller for it
+func makeVariant(b StorageBackend, r *http.Request, key string, m Metadata, mimetype string, e VariantEncoder) ([]byte, error) {
+	_, f, err := b.Get(r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(f, &header))
+	if err != nil || config.Width < 1 || config.Height < 1 || int64(config.Width)*int64(config.Height) > maxVariantSourcePixels {
+		return nil, nil
+	}
+	src, _, err := image.Decode(io.MultiReader(&header, f))
+	if err != nil {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := e.Encode(&buf, src, mimetype); err != nil || int64(buf.Len()) >= m.Size {
+		return nil, nil
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,191 @@
+package backends
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+// An uncompressed PNG, which WebP is sure to be smaller than
+func uncompressedPNG() []byte {
+	m := image.NewNRGBA(image.Rect(0, 0, 120, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 120; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x / 10 * 20), uint8(y / 10 * 30), 200, 255})
+		}
+	}
+	var buf bytes.Buffer
+	(&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&buf, m)
+	return buf.Bytes()
+}
+
+func TestServeImageVariant(t *testing.T) {
+	data := uncompressedPNG()
+
+	for _, subtype := range []string{"webp", "avif"} {
+		b := &imageBackend{m: Metadata{Mimetype: "image/png", Size: int64(len(data)), Sha256sum: "varianttest", ETag: ETag("varianttest")}, data: data}
+
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest("GET", "/key", nil)
+			r.Header.Set("Accept", "image/"+subtype+",*/*;q=0.8")
+			w := httptest.NewRecorder()
+			if err := ServeImageVariant(b, "key", w, r); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Header().Get("Content-Type") != "image/"+subtype || w.Header().Get("Vary") != "Accept" {
+				t.Fatalf("%s variant was served with %v", subtype, w.Header())
+			}
+			if etag := w.Header().Get("Etag"); etag != "\"varianttest-"+subtype+"\"" {
+				t.Errorf("%s variant ETag was %s", subtype, etag)
+			}
+			if w.Body.Len() >= len(data) {
+				t.Errorf("%s variant was %d bytes, not smaller than %d", subtype, w.Body.Len(), len(data))
+			}
+			if config, format, err := image.DecodeConfig(w.Body); err != nil || format != subtype || config.Width != 120 || config.Height != 80 {
+				t.Fatalf("%s variant was %s %+v, %v", subtype, format, config, err)
+			}
+		}
+		if b.gets != 1 {
+			t.Errorf("Image was read %d times instead of its %s variant being cached", b.gets, subtype)
+		}
+	}
+
+	b := &imageBackend{m: Metadata{Mimetype: "image/png", Size: int64(len(data)), Sha256sum: "varianttest", ETag: ETag("varianttest")}, data: data}
+	r := httptest.NewRequest("GET", "/key", nil)
+	r.Header.Set("Accept", "image/webp")
+	r.Header.Set("If-None-Match", "\"varianttest-webp\"")
+	w := httptest.NewRecorder()
+	if err := ServeImageVariant(b, "key", w, r); err != nil || w.Code != 304 {
+		t.Errorf("Matching variant ETag returned %d, %v", w.Code, err)
+	}
+
+	for _, header := range [][2]string{{"Accept", "image/*,*/*"}, {"Accept", "image/webp;q=0"}, {"Range", "bytes=0-10"}} {
+		r := httptest.NewRequest("GET", "/key", nil)
+		r.Header.Set("Accept", "image/webp")
+		r.Header.Set(header[0], header[1])
+		w := httptest.NewRecorder()
+		if err := ServeImageVariant(b, "key", w, r); err != NoVariantErr {
+			t.Errorf("%s: %s returned %v", header[0], header[1], err)
+		}
+		if w.Header().Get("Vary") != "Accept" || w.Header().Get("Content-Type") != "" {
+			t.Errorf("%s: %s left headers %v", header[0], header[1], w.Header())
+		}
+	}
+
+	b.m.Mimetype = "image/gif"
+	r = httptest.NewRequest("GET", "/key", nil)
+	r.Header.Set("Accept", "image/webp")
+	w = httptest.NewRecorder()
+	if err := ServeImageVariant(b, "key", w, r); err != NoVariantErr || w.Header().Get("Vary") != "" {
+		t.Errorf("GIF returned %v with %v", err, w.Header())
+	}
+}
+
+func TestServeImageVariantJPEG(t *testing.T) {
+	m, _ := png.Decode(bytes.NewReader(uncompressedPNG()))
+	var data bytes.Buffer
+	jpeg.Encode(&data, m, &jpeg.Options{Quality: 100})
+	b := &imageBackend{m: Metadata{Mimetype: "image/jpeg", Size: int64(data.Len()), Sha256sum: "variantjpeg"}, data: data.Bytes()}
+
+	for _, subtype := range []string{"webp", "avif"} {
+		r := httptest.NewRequest("GET", "/key", nil)
+		r.Header.Set("Accept", "image/"+subtype)
+		w := httptest.NewRecorder()
+		if err := ServeImageVariant(b, "key", w, r); err != nil {
+			t.Fatal(err)
+		}
+		if w.Header().Get("Content-Type") != "image/"+subtype || w.Body.Len() >= data.Len() {
+			t.Errorf("JPEG was served as %d bytes of %s", w.Body.Len(), w.Header().Get("Content-Type"))
+		}
+	}
+
+	// Browsers that accept both get AVIF
+	r := httptest.NewRequest("GET", "/key", nil)
+	r.Header.Set("Accept", "image/avif,image/webp,image/apng,*/*;q=0.8")
+	w := httptest.NewRecorder()
+	if err := ServeImageVariant(b, "key", w, r); err != nil || w.Header().Get("Content-Type") != "image/avif" {
+		t.Errorf("Accepting both was served %s, %v", w.Header().Get("Content-Type"), err)
+	}
+}
+
+func TestServeImageVariantFallback(t *testing.T) {
+	for name, b := range map[string]*imageBackend{
+		"corrupt":     {m: Metadata{Mimetype: "image/png", Size: 100, Sha256sum: "variantcorrupt"}, data: bytes.Repeat([]byte{1}, 100)},
+		"not smaller": {m: Metadata{Mimetype: "image/png", Size: 1, Sha256sum: "variantlarger"}, data: uncompressedPNG()},
+	} {
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest("GET", "/key", nil)
+			r.Header.Set("Accept", "image/webp")
+			if err := ServeImageVariant(b, "key", httptest.NewRecorder(), r); err != NoVariantErr {
+				t.Errorf("%s image returned %v", name, err)
+			}
+		}
+		if b.gets != 1 {
+			t.Errorf("%s image was read %d times instead of being cached", name, b.gets)
+		}
+	}
+}
+
+func TestRegisterVariantEncoder(t *testing.T) {
+	defer func(encoders []VariantEncoder) { variantEncoders = encoders }(variantEncoders)
+
+	RegisterVariantEncoder(VariantEncoder{Mimetype: "image/jxl", Sources: []string{"image/png"}, Encode: func(w io.Writer, m image.Image, source string) error {
+		_, err := w.Write([]byte("jxl from " + source))
+		return err
+	}})
+	RegisterVariantEncoder(VariantEncoder{Mimetype: "image/webp", Sources: []string{"image/png"}, Encode: func(w io.Writer, m image.Image, source string) error {
+		_, err := w.Write([]byte("webp"))
+		return err
+	}})
+
+	for _, tc := range []struct {
+		mimetype, accept, chosen string
+	}{
+		{"image/png", "image/jxl,image/avif,image/webp", "image/webp"},
+		{"image/png", "image/jxl,image/avif", "image/jxl"},
+		{"image/png", "image/jxl;q=0.5,image/avif", "image/avif"},
+		{"image/jpeg", "image/avif,image/webp", "image/avif"},
+		{"image/jpeg", "image/jxl,image/webp", ""},
+		{"image/webp", "image/avif", ""},
+	} {
+		e, ok := negotiateVariant(tc.accept, variantEncodersFor(tc.mimetype))
+		if e.Mimetype != tc.chosen || ok != (tc.chosen != "") {
+			t.Errorf("%s accepting %s chose %q", tc.mimetype, tc.accept, e.Mimetype)
+		}
+	}
+
+	data := uncompressedPNG()
+	b := &imageBackend{m: Metadata{Mimetype: "image/png", Size: int64(len(data)), Sha256sum: "variantjxl"}, data: data}
+	r := httptest.NewRequest("GET", "/key", nil)
+	r.Header.Set("Accept", "image/jxl")
+	w := httptest.NewRecorder()
+	if err := ServeImageVariant(b, "key", w, r); err != nil || w.Body.String() != "jxl from image/png" || w.Header().Get("Content-Type") != "image/jxl" {
+		t.Errorf("Registered encoder served %q, %v", w.Body.String(), err)
+	}
+}
+
+func TestImageCacheEviction(t *testing.T) {
+	c := newImageCache(3, 10)
+	c.put("a", make([]byte, 4))
+	c.put("b", make([]byte, 4))
+	c.get("a")
+	c.put("c", make([]byte, 4))
+	if _, ok := c.get("b"); ok {
+		t.Error("Least recently used entry was kept past maxBytes")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("Recently used entry was evicted")
+	}
+
+	c.put("d", nil)
+	c.put("e", nil)
+	if c.lru.Len() != 3 || c.bytes != 4 {
+		t.Errorf("Cache has %d entries of %d bytes", c.lru.Len(), c.bytes)
+	}
+}
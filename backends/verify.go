@@ -0,0 +1,28 @@
+package backends
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+
+	"github.com/minio/sha256-simd"
+)
+
+// Recompute the sha256sum of a file from its contents and compare it to
+// the one in its metadata. A mismatch isn't an error: ok is false and the
+// computed sum is returned so the caller can decide what to do with it.
+func VerifyChecksum(ctx context.Context, b StorageBackend, key string) (ok bool, computed string, err error) {
+	m, r, err := b.Get(ctx, key)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, r); err != nil {
+		return
+	}
+
+	computed = hex.EncodeToString(hasher.Sum(nil))
+	return computed == m.Sha256sum, computed, nil
+}
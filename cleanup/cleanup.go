@@ -1,42 +1,55 @@
 package cleanup
 
 import (
+	"context"
 	"log"
 	"time"
 
-	"github.com/andreimarcu/linx-server/backends/localfs"
-	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/backends"
 )
 
-func Cleanup(filesDir string, metaDir string, noLogs bool) {
-	fileBackend := localfs.NewLocalfsBackend(metaDir, filesDir)
+func Cleanup(fileBackend backends.MetaStorageBackend, noLogs bool) {
+	ctx := backends.WithDeleteReason(context.Background(), "expired", "cleanup")
+	files, _, err := backends.PurgeExpired(ctx, fileBackend, time.Now())
+	if !noLogs {
+		for _, filename := range files {
+			log.Printf("Delete %s", filename)
+		}
+		if err != nil {
+			log.Printf("Failed to delete some expired files: %s", err)
+		}
+	}
 
-	files, err := fileBackend.List()
-	if err != nil {
-		panic(err)
+	if !fileBackend.Capabilities().SupportsAppend {
+		return
+	}
+	if err := fileBackend.PurgeUploads(ctx, backends.UploadTTL); err != nil && !noLogs {
+		log.Printf("Failed to remove abandoned uploads: %s", err)
 	}
+}
 
-	for _, filename := range files {
-		metadata, err := fileBackend.Head(filename)
-		if err != nil {
-			if !noLogs {
-				log.Printf("Failed to find metadata for %s", filename)
-			}
-		}
+// Permanently remove the files that were soft deleted more than olderThan
+// ago, if the backend keeps them
+func CleanupTrash(fileBackend backends.StorageBackend, olderThan time.Duration, noLogs bool) {
+	if !fileBackend.Capabilities().SupportsTrash {
+		return
+	}
 
-		if expiry.IsTsExpired(metadata.Expiry) {
-			if !noLogs {
-				log.Printf("Delete %s", filename)
-			}
-			fileBackend.Delete(filename)
-		}
+	err := fileBackend.PurgeTrash(context.Background(), olderThan)
+	if err != nil && !noLogs {
+		log.Printf("Failed to empty the trash: %s", err)
 	}
 }
 
-func PeriodicCleanup(minutes time.Duration, filesDir string, metaDir string, noLogs bool) {
+// Clean up expired files every few minutes, and with a trashGracePeriod
+// also the files soft deleted longer ago than that
+func PeriodicCleanup(minutes time.Duration, fileBackend backends.MetaStorageBackend, trashGracePeriod time.Duration, noLogs bool) {
 	c := time.Tick(minutes)
 	for range c {
-		Cleanup(filesDir, metaDir, noLogs)
+		Cleanup(fileBackend, noLogs)
+		if trashGracePeriod > 0 {
+			CleanupTrash(fileBackend, trashGracePeriod, noLogs)
+		}
 	}
 
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/andreimarcu/linx-server/backends"
@@ -10,15 +12,15 @@ import (
 
 func deleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	requestKey := r.Header.Get("Linx-Delete-Key")
-	
+
 	if len(r.URL.Query().Get("linx-delete-key")) > 0 {
 		requestKey = r.URL.Query().Get("linx-delete-key")
 	}
-	
+
 	filename := c.URLParams["name"]
-	
+
 	// Ensure that file exists and delete key is correct
-	metadata, err := storageBackend.Head(filename)
+	ok, err := storageBackend.CheckDeleteKey(r.Context(), filename, requestKey)
 	if err == backends.NotFoundErr {
 		notFoundHandler(c, w, r) // 404 - file doesn't exist
 		return
@@ -27,9 +29,16 @@ func deleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if metadata.DeleteKey == requestKey {
-		err := storageBackend.Delete(filename)
-		if err != nil {
+	if ok {
+		reason := r.Header.Get("Linx-Delete-Reason")
+		if reason == "" {
+			reason = "delete key"
+		}
+		err := backends.DeleteWithReason(r.Context(), storageBackend, filename, reason, deleteActor(r))
+		if errors.Is(err, backends.AuditLogErr) {
+			// The file is gone all the same, so that's still what to report
+			log.Printf("Deleted %s: %v", filename, err)
+		} else if err != nil {
 			oopsHandler(c, w, r, RespPLAIN, "Could not delete")
 			return
 		}
@@ -42,3 +51,13 @@ func deleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// Who to record as deleting a file in the audit log: the source IP, as
+// anonymized as those stored with files
+func deleteActor(r *http.Request) string {
+	actor := clientIP(r)
+	if Config.anonymizeIP {
+		actor = backends.AnonymizeIP(actor)
+	}
+	return actor
+}
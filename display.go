@@ -11,6 +11,7 @@ import (
 
 	"github.com/andreimarcu/linx-server/backends"
 	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/helpers"
 	"github.com/dustin/go-humanize"
 	"github.com/flosch/pongo2"
 	"github.com/microcosm-cc/bluemonday"
@@ -20,6 +21,18 @@ import (
 
 const maxDisplayFileSizeBytes = 1024 * 512
 
+func archiveContext(entries []backends.ArchiveEntry) []pongo2.Context {
+	files := make([]pongo2.Context, len(entries))
+	for i, entry := range entries {
+		files[i] = pongo2.Context{
+			"name":  entry.Name,
+			"size":  humanize.Bytes(uint64(entry.Size)),
+			"isdir": entry.IsDir,
+		}
+	}
+	return files
+}
+
 func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileName string, metadata backends.Metadata) {
 	var expiryHuman string
 	if metadata.Expiry != expiry.NeverExpire {
@@ -32,21 +45,26 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 	extension := strings.TrimPrefix(filepath.Ext(fileName), ".")
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		js, _ := json.Marshal(map[string]string{
+		resp := map[string]string{
 			"filename":   fileName,
 			"direct_url": getSiteURL(r) + Config.selifPath + fileName,
 			"expiry":     strconv.FormatInt(metadata.Expiry.Unix(), 10),
 			"size":       strconv.FormatInt(metadata.Size, 10),
 			"mimetype":   metadata.Mimetype,
 			"sha256sum":  metadata.Sha256sum,
-		})
+			"public_id":  metadata.PublicID,
+		}
+		addEncryptionJSON(resp, metadata.Encryption)
+		addChecksumsJSON(resp, metadata.Checksums)
+
+		js, _ := json.Marshal(resp)
 		w.Write(js)
 		return
 	}
 
 	var tpl *pongo2.Template
 
-	if strings.HasPrefix(metadata.Mimetype, "image/") {
+	if helpers.IsImage(metadata.Mimetype) {
 		tpl = Templates["display/image.html"]
 
 	} else if strings.HasPrefix(metadata.Mimetype, "video/") {
@@ -58,11 +76,20 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 	} else if metadata.Mimetype == "application/pdf" {
 		tpl = Templates["display/pdf.html"]
 
+	} else if metadata.MaxDownloads > 0 {
+		// Showing the content here would read it without counting a
+		// download, so it's only linked to
+
 	} else if extension == "story" {
-		metadata, reader, err := storageBackend.Get(fileName)
-		if err != nil {
+		metadata, reader, err := storageBackend.Get(backends.WithServing(r.Context()), fileName)
+		if err == backends.OrphanedMetadataErr {
+			oopsHandler(c, w, r, RespHTML, "File corrupted.")
+			return
+		} else if err != nil {
 			oopsHandler(c, w, r, RespHTML, err.Error())
+			return
 		}
+		defer reader.Close()
 
 		if metadata.Size < maxDisplayFileSizeBytes {
 			bytes, err := ioutil.ReadAll(reader)
@@ -74,10 +101,15 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 		}
 
 	} else if extension == "md" {
-		metadata, reader, err := storageBackend.Get(fileName)
-		if err != nil {
+		metadata, reader, err := storageBackend.Get(backends.WithServing(r.Context()), fileName)
+		if err == backends.OrphanedMetadataErr {
+			oopsHandler(c, w, r, RespHTML, "File corrupted.")
+			return
+		} else if err != nil {
 			oopsHandler(c, w, r, RespHTML, err.Error())
+			return
 		}
+		defer reader.Close()
 
 		if metadata.Size < maxDisplayFileSizeBytes {
 			bytes, err := ioutil.ReadAll(reader)
@@ -90,15 +122,21 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 			}
 		}
 
-	} else if strings.HasPrefix(metadata.Mimetype, "text/") || supportedBinExtension(extension) {
-		metadata, reader, err := storageBackend.Get(fileName)
-		if err != nil {
+	} else if helpers.IsTextContent(metadata.Mimetype, nil) || supportedBinExtension(extension) {
+		metadata, reader, err := storageBackend.Get(backends.WithServing(r.Context()), fileName)
+		if err == backends.OrphanedMetadataErr {
+			oopsHandler(c, w, r, RespHTML, "File corrupted.")
+			return
+		} else if err != nil {
 			oopsHandler(c, w, r, RespHTML, err.Error())
+			return
 		}
+		defer reader.Close()
 
 		if metadata.Size < maxDisplayFileSizeBytes {
 			bytes, err := ioutil.ReadAll(reader)
-			if err == nil {
+			// Binary files with the extension of a language aren't shown
+			if err == nil && helpers.IsTextContent(metadata.Mimetype, bytes) {
 				extra["extension"] = extension
 				extra["lang_hl"] = extensionToHlLang(extension)
 				extra["contents"] = string(bytes)
@@ -121,7 +159,9 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 		"extra":       extra,
 		"forcerandom": Config.forceRandomFilename,
 		"lines":       lines,
-		"files":       metadata.ArchiveFiles,
+		"files":       archiveContext(metadata.ArchiveFiles),
+		"truncated":   metadata.ArchiveTruncated,
+		"omitted":     metadata.ArchiveOmitted,
 		"siteurl":     strings.TrimSuffix(getSiteURL(r), "/"),
 	}, r, w)
 
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"sort"
 	"time"
 
 	"github.com/andreimarcu/linx-server/expiry"
@@ -14,8 +16,8 @@ var defaultExpiryList = []uint64{
 	86400,
 	604800,
 	2419200,
-  7257600,
-  14515200,
+	7257600,
+	14515200,
 	31536000,
 }
 
@@ -25,8 +27,8 @@ type ExpirationTime struct {
 }
 
 // Determine if the given filename is expired
-func isFileExpired(filename string) (bool, error) {
-	metadata, err := storageBackend.Head(filename)
+func isFileExpired(ctx context.Context, filename string) (bool, error) {
+	metadata, err := storageBackend.Head(ctx, filename)
 	if err != nil {
 		return false, err
 	}
@@ -40,6 +42,34 @@ func listExpirationTimes() []ExpirationTime {
 	actualExpiryInList := false
 	var expiryList []ExpirationTime
 
+	// Only offer the expiration times uploads may use
+	if len(Config.allowedExpiries) > 0 {
+		allowNever := false
+		for _, expiryEntry := range Config.allowedExpiries {
+			if expiryEntry == 0 {
+				allowNever = true
+				continue
+			}
+
+			duration := time.Duration(expiryEntry) * time.Second
+			expiryList = append(expiryList, ExpirationTime{
+				Seconds: expiryEntry,
+				Human:   humanize.RelTime(epoch, epoch.Add(duration), "", ""),
+			})
+		}
+		sort.Slice(expiryList, func(i, j int) bool {
+			return expiryList[i].Seconds < expiryList[j].Seconds
+		})
+
+		if allowNever {
+			expiryList = append(expiryList, ExpirationTime{
+				0,
+				"never",
+			})
+		}
+		return expiryList
+	}
+
 	for _, expiryEntry := range defaultExpiryList {
 		if Config.maxExpiry == 0 || expiryEntry <= Config.maxExpiry {
 			if expiryEntry == Config.maxExpiry {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -10,14 +11,13 @@ import (
 
 	"github.com/andreimarcu/linx-server/backends"
 	"github.com/andreimarcu/linx-server/expiry"
-	"github.com/andreimarcu/linx-server/httputil"
 	"github.com/zenazn/goji/web"
 )
 
 func fileServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	fileName := c.URLParams["name"]
 
-	metadata, err := checkFile(fileName)
+	metadata, err := checkFile(r.Context(), fileName)
 	if err == backends.NotFoundErr {
 		notFoundHandler(c, w, r)
 		return
@@ -26,7 +26,11 @@ func fileServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if src, err := checkAccessKey(r, &metadata); err != nil {
+	// A presigned URL stands in for the access key and may be linked to
+	// from anywhere
+	presigned := len(Config.presignKey) > 0 && backends.VerifySignedURL(Config.presignKey, fileName, r.URL.Query())
+
+	if src, _, err := checkAccessKey(r, fileName, &metadata); err != nil && !presigned {
 		// remove invalid cookie
 		if src == accessKeySourceCookie {
 			setAccessKeyCookies(w, getSiteURL(r), fileName, "", time.Unix(0, 0))
@@ -36,7 +40,7 @@ func fileServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !Config.allowHotlink {
+	if !Config.allowHotlink && !presigned {
 		referer := r.Header.Get("Referer")
 		u, _ := url.Parse(referer)
 		p, _ := url.Parse(getSiteURL(r))
@@ -51,28 +55,51 @@ func fileServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", metadata.Mimetype)
 	w.Header().Set("Content-Length", strconv.FormatInt(metadata.Size, 10))
-  if metadata.OriginalName != "" {
-    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", metadata.OriginalName))
-  }
-  //w.Header().Set("Content-Disposition", "attachment; filename=\"abc\"")
-	w.Header().Set("Etag", fmt.Sprintf("\"%s\"", metadata.Sha256sum))
+	backends.SetServeHeaders(w, r, fileName, metadata)
 	w.Header().Set("Cache-Control", "public, no-cache")
 
-	modtime := time.Unix(0, 0)
-	if done := httputil.CheckPreconditions(w, r, modtime); done == true {
+	// A variant has preconditions of its own, so it's tried before the
+	// original's are checked
+	if Config.imageVariants {
+		err = storageBackend.ServeImageVariant(fileName, w, r)
+		if err != backends.NoVariantErr {
+			if err != nil {
+				serveFileError(c, w, r, err)
+			}
+			return
+		}
+	}
+
+	if done := backends.CheckPreconditions(w, r, metadata); done == true {
 		return
 	}
 
 	if r.Method != "HEAD" {
-
-		storageBackend.ServeFile(fileName, w, r)
+		err = storageBackend.ServeFile(fileName, w, r)
 		if err != nil {
-			oopsHandler(c, w, r, RespAUTO, err.Error())
+			serveFileError(c, w, r, err)
 			return
 		}
 	}
 }
 
+func serveFileError(c web.C, w http.ResponseWriter, r *http.Request, err error) {
+	// nothing was written yet, drop the headers meant for the file
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Disposition", "Etag", "Last-Modified"} {
+		w.Header().Del(h)
+	}
+
+	if err == backends.NotFoundErr {
+		// Served as many times as it could be since it was
+		// checked
+		notFoundHandler(c, w, r)
+	} else if err == backends.OrphanedMetadataErr {
+		oopsHandler(c, w, r, RespAUTO, "File corrupted.")
+	} else {
+		oopsHandler(c, w, r, RespAUTO, err.Error())
+	}
+}
+
 func staticHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	if path[len(path)-1:] == "/" {
@@ -97,14 +124,20 @@ func staticHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func checkFile(filename string) (metadata backends.Metadata, err error) {
-	metadata, err = storageBackend.Head(filename)
+func checkFile(ctx context.Context, filename string) (metadata backends.Metadata, err error) {
+	metadata, err = storageBackend.Head(ctx, filename)
 	if err != nil {
 		return
 	}
 
 	if expiry.IsTsExpired(metadata.Expiry) {
-		storageBackend.Delete(filename)
+		backends.DeleteWithReason(ctx, storageBackend, filename, "expired", "")
+		err = backends.NotFoundErr
+		return
+	}
+	// Expired once its last download is done, or kept while under a
+	// retention lock
+	if metadata.DownloadsExhausted() {
 		err = backends.NotFoundErr
 		return
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -49,3 +50,14 @@ func getSiteURL(r *http.Request) string {
 		return u.String()
 	}
 }
+
+// The address of the client, which the RealIP middleware takes from
+// X-Forwarded-For or X-Real-IP when -realip says a proxy in front sets
+// them. Clients can't set it themselves otherwise.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
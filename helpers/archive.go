@@ -3,10 +3,18 @@ package helpers
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"encoding/binary"
+	"errors"
 	"io"
 	"sort"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/bodgit/sevenzip"
+	"github.com/nwaples/rardecode"
 )
 
 type ReadSeekerAt interface {
@@ -15,56 +23,333 @@ type ReadSeekerAt interface {
 	io.ReaderAt
 }
 
-func ListArchiveFiles(mimetype string, size int64, r ReadSeekerAt) (files []string, err error) {
-	if mimetype == "application/x-tar" {
-		tReadr := tar.NewReader(r)
-		for {
-			hdr, err := tReadr.Next()
-			if err == io.EOF || err != nil {
-				break
-			}
-			if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeReg {
-				files = append(files, hdr.Name)
-			}
-		}
-		sort.Strings(files)
-	} else if mimetype == "application/x-gzip" {
+// Limits on listing archives, and the archives nested within them
+type ArchiveLimits struct {
+	// Levels of nested archives to list the contents of, 0 lists only
+	// the top level
+	MaxDepth int
+	// Entries to list in total before giving up, 0 for no limit
+	MaxEntries int
+	// Bytes to decompress from nested archives in total before giving
+	// up, 0 for no limit. Bytes are counted at every level of nesting.
+	MaxDecompressed int64
+}
+
+var archiveLimits ArchiveLimits
+
+func SetArchiveLimits(limits ArchiveLimits) {
+	archiveLimits = limits
+}
+
+var errArchiveBudget = errors.New("Decompressed size budget for nested archives exceeded.")
+
+// Returned with an empty listing for archives whose entries can't be
+// listed without their password
+var ArchiveEncryptedErr = errors.New("Archive is encrypted.")
+
+// Collects the entries of an archive, descending into nested archives
+// while the limits allow. Whenever they cut the listing short, truncated
+// is set. Entries past MaxEntries are still counted in omitted, but those
+// of nested archives that weren't read at all can't be.
+type archiveLister struct {
+	limits    ArchiveLimits
+	budget    int64
+	files     []backends.ArchiveEntry
+	truncated bool
+	omitted   int
+	encrypted bool
+}
+
+func newArchiveLister() *archiveLister {
+	return &archiveLister{limits: archiveLimits, budget: archiveLimits.MaxDecompressed}
+}
+
+func (l *archiveLister) add(entry backends.ArchiveEntry) bool {
+	if l.limits.MaxEntries > 0 && len(l.files) >= l.limits.MaxEntries {
+		l.truncated = true
+		l.omitted++
+		return false
+	}
+	l.files = append(l.files, entry)
+	return true
+}
+
+func (l *archiveLister) full() bool {
+	return l.limits.MaxEntries > 0 && len(l.files) >= l.limits.MaxEntries
+}
+
+func (l *archiveLister) sorted() []backends.ArchiveEntry {
+	sort.Slice(l.files, func(i, j int) bool {
+		return l.files[i].Name < l.files[j].Name
+	})
+	return l.files
+}
+
+// List r as an archive of the given mimetype, prefixing the names of its
+// entries. Zip archives need r to be an io.ReaderAt.
+func (l *archiveLister) list(mimetype string, r io.Reader, size int64, prefix string, depth int) {
+	switch mimetype {
+	case "application/x-tar":
+		l.listTar(r, prefix, depth)
+	case "application/x-gzip":
 		gzf, err := gzip.NewReader(r)
 		if err == nil {
-			tReadr := tar.NewReader(gzf)
-			for {
-				hdr, err := tReadr.Next()
-				if err == io.EOF || err != nil {
-					break
-				}
-				if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeReg {
-					files = append(files, hdr.Name)
-				}
-			}
-			sort.Strings(files)
-		}
-	} else if mimetype == "application/x-bzip" {
-		bzf := bzip2.NewReader(r)
-		tReadr := tar.NewReader(bzf)
-		for {
-			hdr, err := tReadr.Next()
-			if err == io.EOF || err != nil {
-				break
-			}
-			if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeReg {
-				files = append(files, hdr.Name)
+			l.listTar(gzf, prefix, depth)
+		}
+	case "application/x-bzip":
+		l.listTar(bzip2.NewReader(r), prefix, depth)
+	case "application/zip":
+		if ra, ok := r.(io.ReaderAt); ok {
+			l.listZip(ra, size, prefix, depth)
+		}
+	case "application/x-7z-compressed":
+		if ra, ok := r.(io.ReaderAt); ok {
+			l.list7z(ra, size, prefix, depth)
+		}
+	case "application/x-rar-compressed", "application/vnd.rar":
+		l.listRar(r, prefix, depth)
+	}
+}
+
+func (l *archiveLister) listTar(r io.Reader, prefix string, depth int) {
+	tReadr := tar.NewReader(r)
+	for {
+		hdr, err := tReadr.Next()
+		if err == io.EOF || err != nil {
+			break
+		}
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := prefix + hdr.Name
+		isDir := hdr.Typeflag == tar.TypeDir
+		if !l.add(backends.ArchiveEntry{Name: name, Size: hdr.Size, Modified: hdr.ModTime, IsDir: isDir}) {
+			continue
+		}
+		if !isDir {
+			l.listNested(name, tReadr, hdr.Size, depth)
+		}
+	}
+}
+
+func (l *archiveLister) listZip(r io.ReaderAt, size int64, prefix string, depth int) {
+	zf, err := zip.NewReader(r, size)
+	if err != nil {
+		return
+	}
+
+	for _, f := range zf.File {
+		name := prefix + f.Name
+		isDir := f.FileInfo().IsDir()
+		if !l.add(backends.ArchiveEntry{Name: name, Size: int64(f.UncompressedSize64), Modified: f.Modified, IsDir: isDir}) {
+			continue
+		}
+		if !isDir && depth < l.limits.MaxDepth && nestedMimetype(name) != "" {
+			if rc, err := f.Open(); err == nil {
+				l.listNested(name, rc, int64(f.UncompressedSize64), depth)
+				rc.Close()
 			}
 		}
-		sort.Strings(files)
-	} else if mimetype == "application/zip" {
-		zf, err := zip.NewReader(r, size)
-		if err == nil {
-			for _, f := range zf.File {
-				files = append(files, f.Name)
+	}
+}
+
+func (l *archiveLister) list7z(r io.ReaderAt, size int64, prefix string, depth int) {
+	zf, err := sevenzip.NewReader(r, size)
+	if err != nil {
+		l.encrypted = l.encrypted || (depth == 0 && sevenZipHeadersEncrypted(r))
+		return
+	}
+
+	for _, f := range zf.File {
+		name := prefix + f.Name
+		isDir := f.FileInfo().IsDir()
+		if !l.add(backends.ArchiveEntry{Name: name, Size: int64(f.UncompressedSize), Modified: f.Modified, IsDir: isDir}) {
+			continue
+		}
+		if !isDir && depth < l.limits.MaxDepth && nestedMimetype(name) != "" {
+			if rc, err := f.Open(); err == nil {
+				l.listNested(name, rc, int64(f.UncompressedSize), depth)
+				rc.Close()
 			}
 		}
-		sort.Strings(files)
+	}
+}
+
+func (l *archiveLister) listRar(r io.Reader, prefix string, depth int) {
+	// Keep the start of the archive to check whether its headers are
+	// encrypted if it can't be read
+	head := make([]byte, rarHeaderPeek)
+	n, _ := io.ReadFull(r, head)
+	head = head[:n]
+
+	rr, err := rardecode.NewReader(io.MultiReader(bytes.NewReader(head), r), "")
+	if err != nil {
+		l.encrypted = l.encrypted || (depth == 0 && rarHeadersEncrypted(head))
+		return
+	}
+
+	for {
+		hdr, err := rr.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			l.encrypted = l.encrypted || (depth == 0 && (rarHeadersEncrypted(head) || isPasswordError(err)))
+			return
+		}
+
+		name := prefix + hdr.Name
+		if !l.add(backends.ArchiveEntry{Name: name, Size: hdr.UnPackedSize, Modified: hdr.ModificationTime, IsDir: hdr.IsDir}) {
+			continue
+		}
+		if !hdr.IsDir {
+			l.listNested(name, rr, hdr.UnPackedSize, depth)
+		}
+	}
+}
+
+// The RAR reader doesn't export its errors, but mentions the password when
+// one is needed to read the archive
+func isPasswordError(err error) bool {
+	return strings.Contains(err.Error(), "password")
+}
+
+const rarHeaderPeek = 32
+
+// Whether the headers of a RAR archive, including the names of its entries,
+// are encrypted, judging from the flags of its main header in RAR 4 and
+// older, or the encryption header that comes first in RAR 5
+func rarHeadersEncrypted(head []byte) bool {
+	if rest, ok := bytes.CutPrefix(head, []byte("Rar!\x1a\x07\x00")); ok {
+		// CRC, type, flags
+		return len(rest) >= 5 && rest[2] == 0x73 && rest[3]&0x80 != 0
+	}
+
+	if rest, ok := bytes.CutPrefix(head, []byte("Rar!\x1a\x07\x01\x00")); ok && len(rest) > 4 {
+		// CRC, then the header size and type as variable length integers
+		rest = rest[4:]
+		if _, n := binary.Uvarint(rest); n > 0 {
+			headerType, m := binary.Uvarint(rest[n:])
+			return m > 0 && headerType == 4
+		}
+	}
+	return false
+}
+
+// Whether a 7-Zip archive's header, which lists its entries, is encrypted.
+// The start header points to it, and an encoded header that is decoded
+// with AES names the AES coder's ID.
+func sevenZipHeadersEncrypted(r io.ReaderAt) bool {
+	start := make([]byte, 32)
+	if _, err := r.ReadAt(start, 0); err != nil || !bytes.HasPrefix(start, []byte("7z\xbc\xaf\x27\x1c")) {
+		return false
+	}
+
+	offset := binary.LittleEndian.Uint64(start[12:20])
+	size := binary.LittleEndian.Uint64(start[20:28])
+	if size == 0 || size > 1<<16 || offset > 1<<62 {
+		return false
+	}
+
+	header := make([]byte, size)
+	if _, err := r.ReadAt(header, int64(32+offset)); err != nil {
+		return false
+	}
+
+	const encodedHeader = 0x17
+	return header[0] == encodedHeader && bytes.Contains(header, []byte{0x06, 0xf1, 0x07, 0x01})
+}
+
+// List the contents of an archive found inside another one, reading it
+// from r within the decompressed size budget
+func (l *archiveLister) listNested(name string, r io.Reader, size int64, depth int) {
+	mimetype := nestedMimetype(name)
+	if depth >= l.limits.MaxDepth || mimetype == "" || l.full() {
+		return
+	}
+
+	r = &budgetReader{r, l}
+	if mimetype == "application/zip" || mimetype == "application/x-7z-compressed" {
+		// Zip and 7-Zip archives are read from their end, so the whole
+		// nested archive has to be buffered
+		if l.limits.MaxDecompressed > 0 && size > l.budget {
+			l.truncated = true
+			return
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return
+		}
+		r = bytes.NewReader(content)
+		size = int64(len(content))
 	}
 
-	return
+	l.list(mimetype, r, size, name+"/", depth+1)
+}
+
+// Nested archives are recognized by their extension, as detecting the
+// mimetype of every entry would mean reading them all
+func nestedMimetype(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "application/zip"
+	case strings.HasSuffix(name, ".7z"):
+		return "application/x-7z-compressed"
+	case strings.HasSuffix(name, ".rar"):
+		return "application/x-rar-compressed"
+	case strings.HasSuffix(name, ".tar"):
+		return "application/x-tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "application/x-gzip"
+	case strings.HasSuffix(name, ".tar.bz2"), strings.HasSuffix(name, ".tbz2"):
+		return "application/x-bzip"
+	}
+	return ""
+}
+
+// Counts the bytes read from nested archives against the lister's budget
+type budgetReader struct {
+	r io.Reader
+	l *archiveLister
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	if b.l.limits.MaxDecompressed > 0 {
+		if b.l.budget <= 0 {
+			b.l.truncated = true
+			return 0, errArchiveBudget
+		}
+		if int64(len(p)) > b.l.budget {
+			p = p[:b.l.budget]
+		}
+	}
+
+	n, err := b.r.Read(p)
+	b.l.budget -= int64(n)
+	return n, err
+}
+
+// List the files in a tar archive, which only needs reading sequentially
+func ListTarFiles(r io.Reader) (files []backends.ArchiveEntry, truncated bool, omitted int) {
+	l := newArchiveLister()
+	l.listTar(r, "", 0)
+	return l.sorted(), l.truncated, l.omitted
+}
+
+// List the entries of an archive of the given mimetype, up to the limits
+// set with SetArchiveLimits. When they cut the listing short truncated is
+// set, with omitted the number of entries that were counted but left out.
+// Images are skipped without reading them.
+func ListArchiveFiles(mimetype string, size int64, r ReadSeekerAt) (files []backends.ArchiveEntry, truncated bool, omitted int, err error) {
+	if IsImage(mimetype) {
+		return nil, false, 0, nil
+	}
+
+	l := newArchiveLister()
+	l.list(mimetype, r, size, "", 0)
+	if l.encrypted {
+		return nil, false, 0, ArchiveEncryptedErr
+	}
+	return l.sorted(), l.truncated, l.omitted, nil
 }
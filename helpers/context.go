@@ -0,0 +1,24 @@
+package helpers
+
+import (
+	"context"
+	"io"
+)
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Wrap r so that reading from it fails with ctx.Err() once ctx is done,
+// which stops an io.Copy from it when a client goes away
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return contextReader{ctx, r}
+}
@@ -1,10 +1,182 @@
 package helpers
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"strings"
 	"unicode"
 
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/minio/sha256-simd"
 )
 
+// Default number of bytes from the start of a file used to detect its
+// mimetype
+const DefaultMimetypeReadLimit = 3072
+
+// Mimetype content the server can't look into is stored with
+const OpaqueMimetype = "application/octet-stream"
+
+// Most bytes SetMimetypeReadLimit allows, as they're buffered in memory for
+// every upload
+const MaxMimetypeReadLimit = 1024 * 1024
+
+var MimetypeReadLimitErr = errors.New("Mimetype read limit must be between 1 and 1048576 bytes.")
+
+// Set how many bytes from the start of a file are read to detect its
+// mimetype. Signatures of some container formats are found well past the
+// first few hundred bytes.
+func SetMimetypeReadLimit(limit uint) error {
+	// A limit of 0 would have the whole file read
+	if limit == 0 || limit > MaxMimetypeReadLimit {
+		return MimetypeReadLimitErr
+	}
+	mimetype.SetLimit(uint32(limit))
+	return nil
+}
+
+// Detect the mimetype of the content at the start of r, reading no more
+// than the configured limit
+func DetectMimetype(r io.Reader) (string, error) {
+	var head bytes.Buffer
+	kind, err := mimetype.DetectReader(io.TeeReader(r, &head))
+	if err != nil {
+		return "", err
+	}
+
+	// AVIF images whose major brand is the generic HEIF one are only
+	// recognised as AVIF by their compatible brands
+	if (kind.Is("image/heif") || kind.Is("application/octet-stream")) && hasAVIFBrand(head.Bytes()) {
+		return "image/avif", nil
+	}
+
+	return kind.String(), nil
+}
+
+// Mimetypes for file extensions that detection can't tell apart from
+// plain text or arbitrary binary data
+var DefaultMimetypeOverrides = map[string]string{
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".csv":      "text/csv",
+	".tsv":      "text/tab-separated-values",
+	".json":     "application/json",
+	".yaml":     "application/yaml",
+	".yml":      "application/yaml",
+	".toml":     "application/toml",
+}
+
+var mimetypeOverrides = DefaultMimetypeOverrides
+
+// Set the mimetypes RefineMimetype gives files by extension, such as
+// ".md" to "text/markdown"
+func SetMimetypeOverrides(overrides map[string]string) {
+	mimetypeOverrides = overrides
+}
+
+// Narrow down a generic detected mimetype, text/plain or
+// application/octet-stream, by the extension of the file's original name,
+// or of its key if it has none. Detection always decides first, so only
+// content that could be anything can take a more specific type. A charset
+// detected for text is kept.
+func RefineMimetype(detected, originalName, key string) string {
+	kind, params, _ := strings.Cut(detected, ";")
+	if kind != "text/plain" && kind != OpaqueMimetype {
+		return detected
+	}
+
+	name := originalName
+	if name == "" {
+		name = key
+	}
+	override, ok := mimetypeOverrides[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return detected
+	}
+
+	if kind == "text/plain" && params != "" {
+		return override + ";" + params
+	}
+	return override
+}
+
+// Whether the ftyp box an ISO media file starts with lists an AVIF brand
+func hasAVIFBrand(head []byte) bool {
+	if len(head) < 16 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+
+	size := int(binary.BigEndian.Uint32(head[:4]))
+	if size > len(head) {
+		size = len(head)
+	}
+
+	// The major brand, then the minor version and the compatible brands
+	for i := 8; i+4 <= size; i += 4 {
+		if brand := string(head[i : i+4]); i != 12 && (brand == "avif" || brand == "avis") {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether files of mimetype are images, as opposed to archives, documents
+// and other media. Parameters such as a charset are ignored.
+func IsImage(mimetype string) bool {
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	return strings.HasPrefix(strings.TrimSpace(mimetype), "image/")
+}
+
+// Whether a file of mimetype that starts with sample is text, as judged by
+// backends.IsTextContent. A nil sample judges by mimetype alone.
+func IsTextContent(mimetype string, sample []byte) bool {
+	return backends.IsTextContent(mimetype, sample)
+}
+
+func GenerateMetadata(r io.Reader) (m backends.Metadata, err error) {
+	// Keep a copy of the bytes consumed by mimetype detection, as they are
+	// still needed to hash the file and determine its size
+	var buf bytes.Buffer
+	m.Mimetype, err = DetectMimetype(io.TeeReader(r, &buf))
+	if err != nil {
+		return
+	}
+
+	hasher := sha256.New()
+	checksummer := backends.NewChecksummer()
+	m.Size, err = io.Copy(io.MultiWriter(hasher, checksummer), io.MultiReader(&buf, r))
+	if err != nil {
+		return
+	}
+
+	m.Sha256sum = hex.EncodeToString(hasher.Sum(nil))
+	m.Checksums = checksummer.Sums()
+
+	return
+}
+
+// Generate the metadata of content that's opaque to the server, such as a
+// file encrypted by the client, without trying to detect its mimetype
+func GenerateOpaqueMetadata(r io.Reader) (m backends.Metadata, err error) {
+	hasher := sha256.New()
+	checksummer := backends.NewChecksummer()
+	m.Size, err = io.Copy(io.MultiWriter(hasher, checksummer), r)
+	if err != nil {
+		return
+	}
+
+	m.Sha256sum = hex.EncodeToString(hasher.Sum(nil))
+	m.Checksums = checksummer.Sums()
+	m.Mimetype = OpaqueMimetype
+
+	return
+}
+
 func printable(data []byte) bool {
 	for i, b := range data {
 		r := rune(b)
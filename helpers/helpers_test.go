@@ -1,10 +1,18 @@
 package helpers
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
 	"strings"
 	"testing"
+	"time"
 	"unicode/utf16"
+
+	"github.com/andreimarcu/linx-server/backends"
 )
 
 func TestGenerateMetadata(t *testing.T) {
@@ -30,6 +38,51 @@ func TestGenerateMetadata(t *testing.T) {
 	}
 }
 
+func TestGenerateOpaqueMetadata(t *testing.T) {
+	m, err := GenerateOpaqueMetadata(strings.NewReader("This is my test content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Sha256sum != "966152d20a77e739716a625373ee15af16e8f4aec631a329a27da41c204b0171" || m.Size != 23 {
+		t.Fatalf("Unexpected metadata %+v", m)
+	}
+	if m.Mimetype != OpaqueMimetype {
+		t.Fatalf("Mimetype was %q instead of %q", m.Mimetype, OpaqueMimetype)
+	}
+}
+
+func TestGenerateMetadataChecksums(t *testing.T) {
+	backends.Limits.Checksums = []string{"sha1"}
+	defer func() { backends.Limits.Checksums = nil }()
+
+	m, err := GenerateMetadata(strings.NewReader("This is my test content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Checksums) != 1 || m.Checksums["sha1"] != "da01739880cbe9c3b499e36428c5fb35b1ef5b57" {
+		t.Fatalf("Unexpected checksums %v", m.Checksums)
+	}
+	if m.Sha256sum != "966152d20a77e739716a625373ee15af16e8f4aec631a329a27da41c204b0171" {
+		t.Fatalf("Unexpected sha256sum %s", m.Sha256sum)
+	}
+}
+
+func TestRefineMimetype(t *testing.T) {
+	for _, test := range []struct{ detected, originalName, key, want string }{
+		{"text/plain; charset=utf-8", "README.md", "abc.txt", "text/markdown; charset=utf-8"},
+		{"text/plain", "", "data.CSV", "text/csv"},
+		{"application/octet-stream", "config.yaml", "", "application/yaml"},
+		{"image/png", "picture.md", "", "image/png"},
+		{"text/html; charset=utf-8", "page.md", "", "text/html; charset=utf-8"},
+		{"text/plain; charset=utf-8", "notes.txt", "", "text/plain; charset=utf-8"},
+	} {
+		if got := RefineMimetype(test.detected, test.originalName, test.key); got != test.want {
+			t.Errorf("RefineMimetype(%q, %q, %q) = %q, expected %q", test.detected, test.originalName, test.key, got, test.want)
+		}
+	}
+}
+
 func TestTextCharsets(t *testing.T) {
 	// verify that different text encodings are detected and passed through
 	orig := "This is a text string"
@@ -71,3 +124,189 @@ func TestTextCharsets(t *testing.T) {
 		}
 	}
 }
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewContextReader(ctx, strings.NewReader("This is my test content"))
+
+	buf := make([]byte, 4)
+	if _, err := r.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := io.ReadAll(r); err != context.Canceled {
+		t.Fatalf("Read after cancel returned %v instead of context.Canceled", err)
+	}
+}
+
+func TestListArchiveFiles(t *testing.T) {
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var tarred bytes.Buffer
+	tw := tar.NewWriter(&tarred)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, ModTime: modified})
+	tw.WriteHeader(&tar.Header{Name: "dir/b.txt", Typeflag: tar.TypeReg, Size: 3, ModTime: modified})
+	tw.Write([]byte("abc"))
+	tw.Close()
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	f, _ := zw.CreateHeader(&zip.FileHeader{Name: "dir/b.txt", Modified: modified})
+	f.Write([]byte("abc"))
+	zw.CreateHeader(&zip.FileHeader{Name: "dir/", Modified: modified})
+	zw.Close()
+
+	for mimetype, content := range map[string][]byte{
+		"application/x-tar": tarred.Bytes(),
+		"application/zip":   zipped.Bytes(),
+	} {
+		files, truncated, _, err := ListArchiveFiles(mimetype, int64(len(content)), bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 || truncated {
+			t.Fatalf("Listed %+v, %v from %s", files, truncated, mimetype)
+		}
+
+		dir, file := files[0], files[1]
+		if dir.Name != "dir/" || !dir.IsDir {
+			t.Errorf("Directory in %s was %+v", mimetype, dir)
+		}
+		if file.Name != "dir/b.txt" || file.IsDir || file.Size != 3 || !file.Modified.Equal(modified) {
+			t.Errorf("File in %s was %+v", mimetype, file)
+		}
+	}
+}
+
+func TestListNestedArchives(t *testing.T) {
+	defer SetArchiveLimits(ArchiveLimits{})
+
+	var inner bytes.Buffer
+	tw := tar.NewWriter(&inner)
+	tw.WriteHeader(&tar.Header{Name: "file.txt", Typeflag: tar.TypeReg, Size: 1000})
+	tw.Write(bytes.Repeat([]byte("a"), 1000))
+	tw.Close()
+
+	var outer bytes.Buffer
+	zw := zip.NewWriter(&outer)
+	f, _ := zw.Create("inner.tar")
+	f.Write(inner.Bytes())
+	f, _ = zw.Create("readme.txt")
+	f.Write([]byte("hello"))
+	zw.Close()
+
+	list := func(limits ArchiveLimits) (names []string, truncated bool, omitted int) {
+		SetArchiveLimits(limits)
+		files, truncated, omitted, _ := ListArchiveFiles("application/zip", int64(outer.Len()), bytes.NewReader(outer.Bytes()))
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		return names, truncated, omitted
+	}
+
+	for _, tc := range []struct {
+		limits    ArchiveLimits
+		names     string
+		truncated bool
+		omitted   int
+	}{
+		{ArchiveLimits{}, "inner.tar,readme.txt", false, 0},
+		{ArchiveLimits{MaxDepth: 1}, "inner.tar,inner.tar/file.txt,readme.txt", false, 0},
+		{ArchiveLimits{MaxDepth: 1, MaxEntries: 2}, "inner.tar,inner.tar/file.txt", true, 1},
+		{ArchiveLimits{MaxEntries: 1}, "inner.tar", true, 1},
+		{ArchiveLimits{MaxDepth: 1, MaxDecompressed: 100}, "inner.tar,readme.txt", true, 0},
+	} {
+		names, truncated, omitted := list(tc.limits)
+		if strings.Join(names, ",") != tc.names || truncated != tc.truncated || omitted != tc.omitted {
+			t.Errorf("Limits %+v listed %v, %v, %d instead of %s, %v, %d", tc.limits, names, truncated, omitted, tc.names, tc.truncated, tc.omitted)
+		}
+	}
+}
+
+func TestArchiveHeadersEncrypted(t *testing.T) {
+	for _, tc := range []struct {
+		head      string
+		encrypted bool
+	}{
+		{"Rar!\x1a\x07\x00\xcf\x90\x73\x00\x00\x0d\x00", false},
+		{"Rar!\x1a\x07\x00\xcf\x90\x73\x80\x00\x0d\x00", true},
+		{"Rar!\x1a\x07\x01\x00\x00\x00\x00\x00\x0c\x01", false},
+		{"Rar!\x1a\x07\x01\x00\x00\x00\x00\x00\x0c\x04", true},
+		{"PK\x03\x04", false},
+	} {
+		if rarHeadersEncrypted([]byte(tc.head)) != tc.encrypted {
+			t.Errorf("Headers of %q weren't detected as encrypted: %v", tc.head, !tc.encrypted)
+		}
+	}
+
+	// A start header pointing to an encoded header using AES
+	archive := []byte("7z\xbc\xaf\x27\x1c\x00\x04")
+	archive = append(archive, make([]byte, 24)...)
+	header := []byte{0x17, 0x06, 0x00, 0x0b, 0x01, 0x00, 0x24, 0x06, 0xf1, 0x07, 0x01}
+	binary.LittleEndian.PutUint64(archive[20:28], uint64(len(header)))
+	archive = append(archive, header...)
+	files, _, _, err := ListArchiveFiles("application/x-7z-compressed", int64(len(archive)), bytes.NewReader(archive))
+	if err != ArchiveEncryptedErr || len(files) != 0 {
+		t.Errorf("Encrypted 7-Zip archive listed %v, %v", files, err)
+	}
+
+	archive[32] = 0x01
+	if sevenZipHeadersEncrypted(bytes.NewReader(archive)) {
+		t.Error("Plain 7-Zip header was detected as encrypted")
+	}
+
+	files, _, _, err = ListArchiveFiles("application/x-7z-compressed", int64(len(archive)), bytes.NewReader(archive))
+	if err != nil || len(files) != 0 {
+		t.Errorf("Unreadable 7-Zip archive listed %v, %v", files, err)
+	}
+}
+
+func TestDetectImageMimetypes(t *testing.T) {
+	for _, tc := range []struct {
+		head     string
+		mimetype string
+	}{
+		{"\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf", "image/avif"},
+		{"\x00\x00\x00\x1cftypmif1\x00\x00\x00\x00mif1avifmiaf", "image/avif"},
+		{"\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1heic", "image/heif"},
+		{"RIFF\x24\x00\x00\x00WEBPVP8 \x18\x00\x00\x00", "image/webp"},
+	} {
+		mimetype, err := DetectMimetype(strings.NewReader(tc.head))
+		if err != nil || mimetype != tc.mimetype {
+			t.Errorf("%q was detected as %s instead of %s", tc.head, mimetype, tc.mimetype)
+		}
+		if !IsImage(mimetype) {
+			t.Errorf("%s isn't an image", mimetype)
+		}
+
+		files, _, _, err := ListArchiveFiles(mimetype, int64(len(tc.head)), strings.NewReader(tc.head))
+		if files != nil || err != nil {
+			t.Errorf("Image %s was listed as %v, %v", mimetype, files, err)
+		}
+	}
+
+	for _, mimetype := range []string{"image/svg+xml; charset=utf-8", " image/png"} {
+		if !IsImage(mimetype) {
+			t.Errorf("%s isn't an image", mimetype)
+		}
+	}
+	if IsImage("application/zip") {
+		t.Error("application/zip is an image")
+	}
+}
+
+func TestSetMimetypeReadLimit(t *testing.T) {
+	defer SetMimetypeReadLimit(DefaultMimetypeReadLimit)
+
+	for _, limit := range []uint{0, MaxMimetypeReadLimit + 1, 1 << 32} {
+		if err := SetMimetypeReadLimit(limit); err != MimetypeReadLimitErr {
+			t.Errorf("Limit %d returned %v", limit, err)
+		}
+	}
+	for _, limit := range []uint{1, DefaultMimetypeReadLimit, MaxMimetypeReadLimit} {
+		if err := SetMimetypeReadLimit(limit); err != nil {
+			t.Errorf("Limit %d returned %v", limit, err)
+		}
+	}
+}
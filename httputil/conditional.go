@@ -158,6 +158,50 @@ func checkIfModifiedSince(r *http.Request, modtime time.Time) condResult {
 	return condTrue
 }
 
+func checkIfRange(w http.ResponseWriter, r *http.Request, modtime time.Time) condResult {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return condNone
+	}
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return condNone
+	}
+	etag, _ := scanETag(ir)
+	if etag != "" {
+		if etagStrongMatch(etag, w.Header().Get("Etag")) {
+			return condTrue
+		}
+		return condFalse
+	}
+	// The If-Range value is typically the ETag value, but it may also be
+	// the modtime date. See golang.org/issue/8367.
+	if isZeroTime(modtime) {
+		return condFalse
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return condFalse
+	}
+	if t.Unix() == modtime.Unix() {
+		return condTrue
+	}
+	return condFalse
+}
+
+// RangeHeader returns the Range header of r, or "" if r has an If-Range
+// that doesn't match the Etag or Last-Modified header already set on w, in
+// which case the whole content must be sent.
+func RangeHeader(w http.ResponseWriter, r *http.Request) string {
+	var modtime time.Time
+	if lm := w.Header().Get("Last-Modified"); lm != "" {
+		modtime, _ = http.ParseTime(lm)
+	}
+	if checkIfRange(w, r, modtime) == condFalse {
+		return ""
+	}
+	return r.Header.Get("Range")
+}
+
 var unixEpochTime = time.Unix(0, 0)
 
 // isZeroTime reports whether t is obviously unspecified (either zero or Unix()=0).
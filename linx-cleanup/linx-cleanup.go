@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
+	"math"
+	"os"
+	"time"
 
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
 	"github.com/andreimarcu/linx-server/cleanup"
 )
 
@@ -10,6 +17,21 @@ func main() {
 	var filesDir string
 	var metaDir string
 	var noLogs bool
+	var dedup bool
+	var shardDepth int
+	var singleFile bool
+	var migrateShards bool
+	var softDelete bool
+	var trashGracePeriod time.Duration
+	var exportMetadata string
+	var importMetadata string
+	var migrateFilesDir string
+	var migrateMetaDir string
+	var migrateWorkers int
+	var rebuild bool
+	var deduplicate bool
+	var auditLog string
+	var verifyAuditLog string
 
 	flag.StringVar(&filesDir, "filespath", "files/",
 		"path to files directory")
@@ -17,7 +39,183 @@ func main() {
 		"path to metadata directory")
 	flag.BoolVar(&noLogs, "nologs", false,
 		"don't log deleted files")
+	flag.BoolVar(&dedup, "dedup", false,
+		"files were stored with dedup enabled")
+	flag.IntVar(&shardDepth, "shard-depth", 0,
+		"files are stored under this many levels of subdirectories")
+	flag.BoolVar(&singleFile, "single-file", false,
+		"files are stored with their metadata at the start of each file")
+	flag.BoolVar(&migrateShards, "migrate-shards", false,
+		"move files stored flat or under another shard depth to where -shard-depth expects them, instead of cleaning up")
+	flag.BoolVar(&softDelete, "soft-delete", false,
+		"move expired files into the trash, and remove files from it that were deleted more than -trash-grace-period ago")
+	flag.DurationVar(&trashGracePeriod, "trash-grace-period", 7*24*time.Hour,
+		"how long to keep soft deleted files for")
+	flag.StringVar(&exportMetadata, "export-metadata", "",
+		"write the metadata of every file to this path as JSON Lines, instead of cleaning up")
+	flag.StringVar(&importMetadata, "import-metadata", "",
+		"store the metadata in this file written by -export-metadata, instead of cleaning up")
+	flag.StringVar(&migrateFilesDir, "migrate-to-filespath", "",
+		"copy every file to a store with its files in this directory and its metadata in -migrate-to-metapath, instead of cleaning up")
+	flag.StringVar(&migrateMetaDir, "migrate-to-metapath", "",
+		"metadata directory of the store to copy files to with -migrate-to-filespath")
+	flag.IntVar(&migrateWorkers, "migrate-workers", 4,
+		"how many files to copy at the same time when migrating")
+	flag.BoolVar(&rebuild, "rebuild", false,
+		"hash every file, fix sha256sums in metadata that don't match and report orphaned files and metadata, instead of cleaning up")
+	flag.BoolVar(&deduplicate, "deduplicate", false,
+		"replace files stored more than once with the same contents with hardlinks to one of them, instead of cleaning up")
+	flag.StringVar(&auditLog, "audit-log", "",
+		"path of linx-server's audit-log to record the files cleaned up in")
+	flag.StringVar(&verifyAuditLog, "verify-audit-log", "",
+		"check that no entries of the audit log at this path were changed or removed, instead of cleaning up")
 	flag.Parse()
 
-	cleanup.Cleanup(filesDir, metaDir, noLogs)
+	if verifyAuditLog != "" {
+		f, err := os.Open(verifyAuditLog)
+		if err != nil {
+			log.Fatal("Could not open audit log: ", err)
+		}
+		defer f.Close()
+
+		entries, err := backends.VerifyAuditLog(f)
+		if err != nil {
+			log.Fatalf("Audit log failed verification after %d entries: %v", entries, err)
+		}
+		log.Printf("Verified %d audit log entries", entries)
+		return
+	}
+
+	fileBackend, err := localfs.NewLocalfsBackendWithOptions(metaDir, filesDir, localfs.LocalfsOptions{
+		Dedup:      dedup,
+		ShardDepth: shardDepth,
+		SoftDelete: softDelete,
+		SingleFile: singleFile,
+	})
+	if err != nil {
+		log.Fatal("Could not initialize storage backend: ", err)
+	}
+
+	if migrateShards {
+		moved, err := fileBackend.MigrateShards()
+		if err != nil {
+			log.Fatal("Could not migrate files: ", err)
+		}
+		log.Printf("Moved %d files", moved)
+		return
+	}
+
+	if rebuild {
+		report, err := fileBackend.Rebuild(context.Background())
+		for _, key := range report.Repaired {
+			log.Printf("Fixed the sha256sum of %s", key)
+		}
+		for _, key := range report.OrphanedBlobs {
+			log.Printf("Orphaned file without metadata: %s", key)
+		}
+		for _, key := range report.OrphanedMetadata {
+			log.Printf("Orphaned metadata without a file: %s", key)
+		}
+		for _, key := range report.Corrupted {
+			log.Printf("Corrupted encrypted file: %s", key)
+		}
+		for key, err := range report.Failed {
+			log.Printf("Could not check %s: %s", key, err)
+		}
+		if report.DedupEntriesFixed > 0 {
+			log.Printf("Fixed %d dedup index entries", report.DedupEntriesFixed)
+		}
+		if err != nil {
+			log.Fatal("Could not rebuild: ", err)
+		}
+		log.Printf("Checked %d files, fixed %d", report.Checked, len(report.Repaired))
+		return
+	}
+
+	if deduplicate {
+		freed, merged, err := fileBackend.Deduplicate(context.Background())
+		if err != nil {
+			log.Fatal("Could not deduplicate files: ", err)
+		}
+		log.Printf("Merged %d files, freeing %d bytes", merged, freed)
+		return
+	}
+
+	if exportMetadata != "" {
+		f, err := os.Create(exportMetadata)
+		if err != nil {
+			log.Fatal("Could not create export file: ", err)
+		}
+		defer f.Close()
+
+		if err := backends.ExportMetadata(context.Background(), fileBackend, f); err != nil {
+			log.Fatal("Could not export metadata: ", err)
+		}
+		return
+	}
+
+	if migrateFilesDir != "" || migrateMetaDir != "" {
+		if migrateFilesDir == "" || migrateMetaDir == "" {
+			log.Fatal("Both -migrate-to-filespath and -migrate-to-metapath are needed to migrate")
+		}
+		for _, dir := range []string{migrateFilesDir, migrateMetaDir} {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				log.Fatal("Could not create destination directory: ", err)
+			}
+		}
+
+		dst, err := localfs.NewLocalfsBackendWithOptions(migrateMetaDir, migrateFilesDir, localfs.LocalfsOptions{})
+		if err != nil {
+			log.Fatal("Could not initialize destination storage backend: ", err)
+		}
+
+		// Files were already checked against the limits when uploaded
+		backends.Limits.MaxSize = math.MaxInt64
+
+		copied, errs := backends.Migrate(context.Background(), fileBackend, dst, backends.MigrateOptions{
+			Workers: migrateWorkers,
+			Progress: func(key string, done, total int, err error) {
+				if err != nil {
+					log.Printf("[%d/%d] Could not copy %s", done, total, err)
+				} else if !noLogs {
+					log.Printf("[%d/%d] %s", done, total, key)
+				}
+			},
+		})
+		log.Printf("Copied %d files, %d failed", copied, len(errs))
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if importMetadata != "" {
+		f, err := os.Open(importMetadata)
+		if err != nil {
+			log.Fatal("Could not open import file: ", err)
+		}
+		defer f.Close()
+
+		imported, err := backends.ImportMetadata(context.Background(), fileBackend, f)
+		if err != nil {
+			log.Fatalf("Could not import metadata after %d files: %v", imported, err)
+		}
+		log.Printf("Imported metadata of %d files", imported)
+		return
+	}
+
+	var cleanupBackend backends.MetaStorageBackend = fileBackend
+	if auditLog != "" {
+		auditLogger, err := backends.NewFileAuditLogger(auditLog)
+		if err != nil {
+			log.Fatal("Could not open audit log: ", err)
+		}
+		defer auditLogger.Close()
+		cleanupBackend = backends.NewAuditedMetaBackend(fileBackend, auditLogger)
+	}
+
+	cleanup.Cleanup(cleanupBackend, noLogs)
+	if softDelete {
+		cleanup.CleanupTrash(fileBackend, trashGracePeriod, noLogs)
+	}
 }
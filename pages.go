@@ -44,8 +44,11 @@ func pasteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
 func apiDocHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	err := renderTemplate(Templates["API.html"], pongo2.Context{
-		"siteurl":     getSiteURL(r),
-		"forcerandom": Config.forceRandomFilename,
+		"siteurl":       getSiteURL(r),
+		"forcerandom":   Config.forceRandomFilename,
+		"reservations":  Config.reservations,
+		"maxdownloads":  storageBackend.Capabilities().SupportsMaxDownloads,
+		"imagevariants": Config.imageVariants,
 	}, r, w)
 	if err != nil {
 		oopsHandler(c, w, r, RespHTML, "")
@@ -136,6 +139,35 @@ func badRequestHandler(c web.C, w http.ResponseWriter, r *http.Request, rt RespT
 	}
 }
 
+// Answers with 507 Insufficient Storage, for when files can't be stored
+// until room is made for them
+func storageFullHandler(c web.C, w http.ResponseWriter, r *http.Request, rt RespType, msg string) {
+	if rt == RespHTML {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		renderTemplate(Templates["oops.html"], pongo2.Context{"msg": msg}, r, w)
+		return
+	} else if rt == RespPLAIN {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		fmt.Fprintf(w, "%s", msg)
+		return
+	} else if rt == RespJSON {
+		js, _ := json.Marshal(map[string]string{
+			"error": msg,
+		})
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write(js)
+		return
+	} else if rt == RespAUTO {
+		if strings.EqualFold("application/json", r.Header.Get("Accept")) {
+			storageFullHandler(c, w, r, RespJSON, msg)
+		} else {
+			storageFullHandler(c, w, r, RespHTML, msg)
+		}
+	}
+}
+
 func unauthorizedHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(401)
 	err := renderTemplate(Templates["401.html"], pongo2.Context{}, r, w)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/zenazn/goji/web"
+)
+
+// Reserve room for a file of the size given in the Linx-Size header,
+// before uploading it with the token in a Linx-Reservation header
+func reserveHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !strictReferrerCheck(r, getSiteURL(r), []string{"Linx-Size", "X-Requested-With"}) {
+		badRequestHandler(c, w, r, RespAUTO, "")
+		return
+	}
+
+	rt := RespPLAIN
+	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
+		rt = RespJSON
+	}
+
+	size, err := strconv.ParseInt(r.Header.Get("Linx-Size"), 10, 64)
+	if err != nil {
+		badRequestHandler(c, w, r, rt, "Missing or invalid Linx-Size header.")
+		return
+	}
+
+	token, expires, err := quotaBackend.Reserve(r.Context(), size)
+	if err == backends.QuotaExceededErr {
+		badRequestHandler(c, w, r, rt, err.Error())
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, rt, "Could not reserve room for the file.")
+		return
+	}
+
+	if rt == RespJSON {
+		js, _ := json.Marshal(map[string]string{
+			"reservation": token,
+			"expiry":      strconv.FormatInt(expires.Unix(), 10),
+		})
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Write(js)
+	} else {
+		fmt.Fprintf(w, "%s\n", token)
+	}
+}
+
+// Give back the room reserved for a file that won't be uploaded after all
+func releaseHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	quotaBackend.Release(c.URLParams["token"])
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"log"
 	"net"
@@ -10,6 +13,7 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -18,9 +22,19 @@ import (
 	rice "github.com/GeertJohan/go.rice"
 	"github.com/andreimarcu/linx-server/auth/apikeys"
 	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/azure"
+	"github.com/andreimarcu/linx-server/backends/clamav"
+	"github.com/andreimarcu/linx-server/backends/googlecloud"
+	"github.com/andreimarcu/linx-server/backends/ipfs"
 	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/sqlite"
 	"github.com/andreimarcu/linx-server/cleanup"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/andreimarcu/linx-server/webdav"
 	"github.com/flosch/pongo2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/vharitonsky/iniflags"
 	"github.com/zenazn/goji/graceful"
 	"github.com/zenazn/goji/web"
@@ -38,6 +52,197 @@ func (h *headerList) Set(value string) error {
 	return nil
 }
 
+// Permissions given in octal, such as 0640
+type fileModeFlag os.FileMode
+
+func (m *fileModeFlag) String() string {
+	if *m == 0 {
+		return ""
+	}
+	return "0" + strconv.FormatUint(uint64(*m), 8)
+}
+
+func (m *fileModeFlag) Set(value string) error {
+	mode, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+	if err != nil || mode > 0777 {
+		return errors.New("must be octal permissions such as 0640")
+	}
+	*m = fileModeFlag(mode)
+	return nil
+}
+
+// Checksums to compute for new files, by algorithm name
+type checksumList []string
+
+func (c *checksumList) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *checksumList) Set(value string) error {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if !backends.IsChecksumAlgorithm(value) {
+		return errors.New("must be one of " + strings.Join(backends.ChecksumAlgorithms(), ", "))
+	}
+	*c = append(*c, value)
+	return nil
+}
+
+type mimeSizeList map[string]int64
+
+func (m *mimeSizeList) String() string {
+	var limits []string
+	for mimetype, size := range *m {
+		limits = append(limits, mimetype+"="+strconv.FormatInt(size, 10))
+	}
+	sort.Strings(limits)
+	return strings.Join(limits, ",")
+}
+
+func (m *mimeSizeList) Set(value string) error {
+	mimetype, size, ok := strings.Cut(value, "=")
+	if !ok {
+		return errors.New("must be mimetype=size")
+	}
+
+	maxSize, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	if *m == nil {
+		*m = make(mimeSizeList)
+	}
+	(*m)[strings.TrimSpace(mimetype)] = maxSize
+	return nil
+}
+
+// Mimetypes by file extension, as .ext=mimetype, or .ext= to leave files
+// with that extension as they're detected
+type mimetypeOverrideList map[string]string
+
+func (m *mimetypeOverrideList) String() string {
+	var overrides []string
+	for ext, mimetype := range *m {
+		overrides = append(overrides, ext+"="+mimetype)
+	}
+	sort.Strings(overrides)
+	return strings.Join(overrides, ",")
+}
+
+func (m *mimetypeOverrideList) Set(value string) error {
+	ext, mimetype, ok := strings.Cut(value, "=")
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if !ok || !strings.HasPrefix(ext, ".") {
+		return errors.New("must be .ext=mimetype")
+	}
+
+	if *m == nil {
+		*m = make(mimetypeOverrideList)
+	}
+	(*m)[ext] = strings.TrimSpace(mimetype)
+	return nil
+}
+
+// How files are served by mimetype, as mimetype=attachment to have them
+// downloaded, mimetype=inline to serve them without restrictions or
+// mimetype=policy to serve them with that Content-Security-Policy
+type servePolicyList map[string]backends.ServePolicy
+
+func (p *servePolicyList) String() string {
+	var policies []string
+	for mimetype, policy := range *p {
+		switch {
+		case policy.Attachment:
+			policies = append(policies, mimetype+"=attachment")
+		case policy.ContentSecurityPolicy != "":
+			policies = append(policies, mimetype+"="+policy.ContentSecurityPolicy)
+		default:
+			policies = append(policies, mimetype+"=inline")
+		}
+	}
+	sort.Strings(policies)
+	return strings.Join(policies, ",")
+}
+
+func (p *servePolicyList) Set(value string) error {
+	mimetype, policy, ok := strings.Cut(value, "=")
+	if !ok {
+		return errors.New("must be mimetype=attachment, mimetype=inline or mimetype=policy")
+	}
+
+	if *p == nil {
+		*p = make(servePolicyList)
+	}
+	switch policy = strings.TrimSpace(policy); policy {
+	case "attachment":
+		(*p)[strings.TrimSpace(mimetype)] = backends.ServePolicy{Attachment: true}
+	case "inline":
+		(*p)[strings.TrimSpace(mimetype)] = backends.ServePolicy{}
+	default:
+		(*p)[strings.TrimSpace(mimetype)] = backends.ServePolicy{ContentSecurityPolicy: policy}
+	}
+	return nil
+}
+
+// Longest times in seconds files over a size in bytes are kept for, as
+// size=seconds
+type expiryTierList []backends.ExpiryTier
+
+func (e *expiryTierList) String() string {
+	var tiers []string
+	for _, tier := range *e {
+		tiers = append(tiers, strconv.FormatInt(tier.Size, 10)+"="+strconv.FormatInt(int64(tier.MaxDuration/time.Second), 10))
+	}
+	return strings.Join(tiers, ",")
+}
+
+func (e *expiryTierList) Set(value string) error {
+	size, seconds, ok := strings.Cut(value, "=")
+	if !ok {
+		return errors.New("must be size=seconds")
+	}
+
+	tier := backends.ExpiryTier{}
+	var err error
+	if tier.Size, err = strconv.ParseInt(strings.TrimSpace(size), 10, 64); err != nil {
+		return err
+	}
+	maxDuration, err := strconv.ParseUint(strings.TrimSpace(seconds), 10, 64)
+	if err != nil {
+		return err
+	}
+	tier.MaxDuration = time.Duration(maxDuration) * time.Second
+
+	*e = append(*e, tier)
+	return nil
+}
+
+// Expiries in seconds, with never or 0 for files that never expire
+type expiryList []uint64
+
+func (e *expiryList) String() string {
+	var expiries []string
+	for _, seconds := range *e {
+		expiries = append(expiries, strconv.FormatUint(seconds, 10))
+	}
+	return strings.Join(expiries, ",")
+}
+
+func (e *expiryList) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "never" {
+		*e = append(*e, 0)
+		return nil
+	}
+
+	seconds, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	*e = append(*e, seconds)
+	return nil
+}
+
 var Config struct {
 	bind                      string
 	filesDir                  string
@@ -50,12 +255,26 @@ var Config struct {
 	keyFile                   string
 	contentSecurityPolicy     string
 	fileContentSecurityPolicy string
+	servePolicies             servePolicyList
+	allowInlineMarkup         bool
 	referrerPolicy            string
 	fileReferrerPolicy        string
 	xFrameOptions             string
 	maxSize                   int64
+	maxSizeByMime             mimeSizeList
+	maxFiles                  int64
+	maxTotalSize              int64
+	reservations              bool
+	maxNameLength             int
+	keepRawName               bool
 	maxExpiry                 uint64
 	defaultExpiry             uint64
+	allowedExpiries           expiryList
+	checksums                 checksumList
+	keyMinLength              int
+	keyMaxLength              int
+	keyCharset                string
+	snapExpiry                bool
 	realIp                    bool
 	noLogs                    bool
 	allowHotlink              bool
@@ -73,8 +292,56 @@ var Config struct {
 	extraFooterText           string
 	maxDurationTime           uint64
 	maxDurationSize           int64
+	expiryTiers               expiryTierList
 	disableAccessKey          bool
 	defaultRandomFilename     bool
+	dedup                     bool
+	singleFile                bool
+	blobExtensions            bool
+	fileMode                  fileModeFlag
+	dirMode                   fileModeFlag
+	durable                   bool
+	sendfile                  string
+	sendfilePrefix            string
+	softDelete                bool
+	anonymizeIP               bool
+	slidingExpiry             uint64
+	webdav                    bool
+	trashGracePeriod          uint64
+	encryptionKeyFile         string
+	shardDepth                int
+	compression               string
+	hashKeys                  bool
+	presignKeyFile            string
+	presignKey                []byte
+	metadataCacheTTL          uint64
+	metadataCacheSize         int
+	clamavAddress             string
+	clamavTimeout             uint64
+	putRateLimit              float64
+	putRateBurst              int
+	downloadRate              int64
+	minUploadRate             int64
+	minUploadRateWindow       uint64
+	imageVariants             bool
+	readOnly                  bool
+	auditLog                  string
+	mimetypeReadLimit         uint
+	mimetypeOverrides         mimetypeOverrideList
+	archiveMaxDepth           int
+	archiveMaxEntries         int
+	archiveMaxDecompressed    int64
+	gcsBucket                 string
+	gcsCredentialsFile        string
+	gcsSignedURLExpiry        uint64
+	azureContainer            string
+	azureAccountName          string
+	azureAccountKey           string
+	azureServiceURL           string
+	azureSASExpiry            uint64
+	ipfsAPIURL                string
+	sqlitePath                string
+	metricsBind               string
 }
 
 var Templates = make(map[string]*pongo2.Template)
@@ -85,6 +352,7 @@ var timeStartedStr string
 var remoteAuthKeys []string
 var metaStorageBackend backends.MetaStorageBackend
 var storageBackend backends.StorageBackend
+var quotaBackend backends.QuotaBackend
 var customPages = make(map[string]string)
 var customPagesNames = make(map[string]string)
 
@@ -155,11 +423,153 @@ func setup() *web.Mux {
 
 	backends.Limits.MaxDurationTime = Config.maxDurationTime
 	backends.Limits.MaxDurationSize = Config.maxDurationSize
+	backends.Limits.ExpiryTiers = Config.expiryTiers
 	backends.Limits.MaxSize = Config.maxSize
-  storageBackend = localfs.NewLocalfsBackend(Config.metaDir, Config.filesDir)
-  if Config.cleanupEveryMinutes > 0 {
-    go cleanup.PeriodicCleanup(time.Duration(Config.cleanupEveryMinutes)*time.Minute, Config.filesDir, Config.metaDir, Config.noLogs)
-
+	backends.Limits.MaxSizeByMime = Config.maxSizeByMime
+	backends.Limits.MaxFiles = Config.maxFiles
+	backends.Limits.MaxTotalSize = Config.maxTotalSize
+	backends.Limits.DownloadRate = Config.downloadRate
+	backends.Limits.MinUploadRate = Config.minUploadRate
+	backends.Limits.MinUploadRateWindow = time.Duration(Config.minUploadRateWindow) * time.Second
+	backends.Limits.MaxNameLength = Config.maxNameLength
+	backends.Limits.KeepRawName = Config.keepRawName
+	backends.Limits.AllowedExpiries = nil
+	for _, seconds := range Config.allowedExpiries {
+		backends.Limits.AllowedExpiries = append(backends.Limits.AllowedExpiries, time.Duration(seconds)*time.Second)
+	}
+	backends.Limits.SnapExpiry = Config.snapExpiry
+	backends.Limits.Checksums = Config.checksums
+	backends.Limits.KeyPolicy = backends.KeyPolicy{
+		MinLen:  Config.keyMinLength,
+		MaxLen:  Config.keyMaxLength,
+		Charset: Config.keyCharset,
+	}
+	backends.Limits.ServePolicies = make(map[string]backends.ServePolicy)
+	if !Config.allowInlineMarkup {
+		for mimetype, policy := range backends.DefaultServePolicies {
+			backends.Limits.ServePolicies[mimetype] = policy
+		}
+	}
+	for mimetype, policy := range Config.servePolicies {
+		backends.Limits.ServePolicies[mimetype] = policy
+	}
+	if err := helpers.SetMimetypeReadLimit(Config.mimetypeReadLimit); err != nil {
+		log.Fatal("Invalid mimetype-read-limit: ", err)
+	}
+	mimetypeOverrides := make(map[string]string)
+	for ext, mimetype := range helpers.DefaultMimetypeOverrides {
+		mimetypeOverrides[ext] = mimetype
+	}
+	for ext, mimetype := range Config.mimetypeOverrides {
+		if mimetype == "" {
+			delete(mimetypeOverrides, ext)
+		} else {
+			mimetypeOverrides[ext] = mimetype
+		}
+	}
+	helpers.SetMimetypeOverrides(mimetypeOverrides)
+	helpers.SetArchiveLimits(helpers.ArchiveLimits{
+		MaxDepth:        Config.archiveMaxDepth,
+		MaxEntries:      Config.archiveMaxEntries,
+		MaxDecompressed: Config.archiveMaxDecompressed,
+	})
+	if Config.presignKeyFile != "" {
+		Config.presignKey = readPresignKey(Config.presignKeyFile)
+	}
+	var scanner backends.Scanner
+	if Config.clamavAddress != "" {
+		scanner = clamav.NewScanner(Config.clamavAddress, time.Duration(Config.clamavTimeout)*time.Second)
+	}
+	backendName := "localfs"
+	if Config.gcsBucket != "" {
+		backendName = "gcs"
+		metaStorageBackend, err = googlecloud.NewGoogleCloudBackend(Config.gcsBucket, googlecloud.GoogleCloudOptions{
+			CredentialsFile: Config.gcsCredentialsFile,
+			SignedURLExpiry: time.Duration(Config.gcsSignedURLExpiry) * time.Second,
+			Scanner:         scanner,
+		})
+	} else if Config.azureContainer != "" {
+		backendName = "azure"
+		metaStorageBackend, err = azure.NewAzureBackend(Config.azureContainer, azure.AzureOptions{
+			ServiceURL:  Config.azureServiceURL,
+			AccountName: Config.azureAccountName,
+			AccountKey:  Config.azureAccountKey,
+			SASExpiry:   time.Duration(Config.azureSASExpiry) * time.Second,
+			Scanner:     scanner,
+		})
+	} else if Config.ipfsAPIURL != "" {
+		backendName = "ipfs"
+		metaStorageBackend, err = ipfs.NewIPFSBackend(Config.metaDir, ipfs.IPFSOptions{
+			APIURL:  Config.ipfsAPIURL,
+			Scanner: scanner,
+		})
+	} else if Config.sqlitePath != "" {
+		backendName = "sqlite"
+		metaStorageBackend, err = sqlite.NewSqliteBackend(Config.sqlitePath, sqlite.SqliteOptions{
+			Scanner: scanner,
+		})
+	} else {
+		localfsOptions := localfs.LocalfsOptions{
+			Dedup:          Config.dedup,
+			SoftDelete:     Config.softDelete,
+			Scanner:        scanner,
+			AnonymizeIP:    Config.anonymizeIP,
+			SlidingExpiry:  time.Duration(Config.slidingExpiry) * time.Second,
+			ShardDepth:     Config.shardDepth,
+			SingleFile:     Config.singleFile,
+			BlobExtensions: Config.blobExtensions,
+			FileMode:       os.FileMode(Config.fileMode),
+			DirMode:        os.FileMode(Config.dirMode),
+			Durable:        Config.durable,
+			Sendfile:       Config.sendfile,
+			SendfilePrefix: Config.sendfilePrefix,
+			Compression:    Config.compression,
+			HashKeys:       Config.hashKeys,
+			PresignKey:     Config.presignKey,
+			PresignURL:     Config.sitePath + Config.selifPath,
+		}
+		if Config.encryptionKeyFile != "" {
+			localfsOptions.EncryptionKey = readEncryptionKey(Config.encryptionKeyFile)
+		}
+		metaStorageBackend, err = localfs.NewLocalfsBackendWithOptions(Config.metaDir, Config.filesDir, localfsOptions)
+	}
+	if err != nil {
+		log.Fatal("Could not initialize storage backend:", err)
+	}
+	if Config.readOnly {
+		metaStorageBackend = backends.NewReadOnlyMetaBackend(metaStorageBackend)
+	}
+	if Config.auditLog != "" {
+		auditLogger, err := backends.NewFileAuditLogger(Config.auditLog)
+		if err != nil {
+			log.Fatal("Could not open audit log:", err)
+		}
+		metaStorageBackend = backends.NewAuditedMetaBackend(metaStorageBackend, auditLogger)
+	}
+	if Config.metricsBind != "" {
+		metrics := backends.NewMetrics()
+		metaStorageBackend = backends.NewInstrumentedMetaBackend(metaStorageBackend, backendName, metrics)
+		go serveMetrics(Config.metricsBind, metrics)
+	}
+	if Config.metadataCacheTTL > 0 {
+		metaStorageBackend = backends.NewCachingMetaBackend(metaStorageBackend,
+			time.Duration(Config.metadataCacheTTL)*time.Second, Config.metadataCacheSize)
+	}
+	if Config.maxTotalSize > 0 || Config.reservations {
+		quotaBackend = backends.NewQuotaBackend(metaStorageBackend)
+		metaStorageBackend = quotaBackend
+	}
+	if Config.putRateLimit > 0 {
+		metaStorageBackend = backends.NewRateLimitedMetaBackend(metaStorageBackend,
+			Config.putRateLimit, Config.putRateBurst)
+	}
+	storageBackend = metaStorageBackend
+	if Config.cleanupEveryMinutes > 0 && !Config.readOnly {
+		var trashGracePeriod time.Duration
+		if Config.softDelete {
+			trashGracePeriod = time.Duration(Config.trashGracePeriod) * time.Second
+		}
+		go cleanup.PeriodicCleanup(time.Duration(Config.cleanupEveryMinutes)*time.Minute, metaStorageBackend, trashGracePeriod, Config.noLogs)
 	}
 
 	// Template setup
@@ -210,10 +620,42 @@ func setup() *web.Mux {
 	mux.Put(Config.sitePath+"upload/", uploadPutHandler)
 	mux.Put(Config.sitePath+"upload/:name", uploadPutHandler)
 
+	if Config.reservations {
+		mux.Post(Config.sitePath+"reserve", reserveHandler)
+		mux.Delete(Config.sitePath+"reserve/:token", releaseHandler)
+	}
+
 	mux.Delete(Config.sitePath+":name", deleteHandler)
 	// Adding new delete path method to make linx-server usable with ShareX.
 	mux.Get(Config.sitePath+"delete/:name", deleteHandler)
-	
+
+	mux.Get(Config.sitePath+"p/:id", publicIDHandler)
+
+	if Config.webdav {
+		if Config.authFile == "" || !Config.basicAuth {
+			log.Fatal("WebDAV requires authfile and basicauth")
+		}
+
+		// Unlike the rest of the site, reading files through WebDAV
+		// needs authorization too, as it skips their access keys
+		dav := web.New()
+		dav.Use(apikeys.NewApiKeysMiddleware(apikeys.AuthOptions{
+			AuthFile:  Config.authFile,
+			BasicAuth: true,
+			SiteName:  Config.siteName,
+			SitePath:  Config.sitePath,
+		}))
+		davHandler := webdav.NewHandler(storageBackend, webdav.Options{
+			Prefix:      Config.sitePath + "dav",
+			Expiry:      parseExpiry(""),
+			ValidateKey: validateUploadName,
+		})
+		dav.Handle(Config.sitePath+"dav", davHandler)
+		dav.Handle(Config.sitePath+"dav/*", davHandler)
+		mux.Handle(Config.sitePath+"dav", dav)
+		mux.Handle(Config.sitePath+"dav/*", dav)
+	}
+
 	mux.Get(Config.sitePath+"static/*", staticHandler)
 	mux.Get(Config.sitePath+"favicon.ico", staticHandler)
 	mux.Get(Config.sitePath+"robots.txt", staticHandler)
@@ -236,6 +678,47 @@ func setup() *web.Mux {
 	return mux
 }
 
+func readPresignKey(keyFile string) []byte {
+	contents, err := os.ReadFile(keyFile)
+	if err != nil {
+		log.Fatal("Could not read presign key file:", err)
+	}
+
+	key := bytes.TrimSpace(contents)
+	if len(key) == 0 {
+		log.Fatal("Presign key file is empty")
+	}
+
+	return key
+}
+
+// Serve metrics for Prometheus to scrape on their own address, so that they
+// aren't public along with the site
+func serveMetrics(bind string, metrics *backends.Metrics) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics, collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	log.Printf("Serving metrics on %s/metrics", bind)
+	log.Fatal(http.ListenAndServe(bind, metricsMux))
+}
+
+func readEncryptionKey(keyFile string) []byte {
+	contents, err := os.ReadFile(keyFile)
+	if err != nil {
+		log.Fatal("Could not read encryption key file:", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		log.Fatal("Encryption key file must contain a hex-encoded key:", err)
+	}
+
+	return key
+}
+
 func main() {
 	flag.StringVar(&Config.bind, "bind", "127.0.0.1:8080",
 		"host to bind to (default: 127.0.0.1:8080)")
@@ -245,6 +728,8 @@ func main() {
 		"path to metadata directory")
 	flag.BoolVar(&Config.basicAuth, "basicauth", false,
 		"allow logging by basic auth password")
+	flag.BoolVar(&Config.webdav, "webdav", false,
+		"serve files over WebDAV under /dav/, for mounting as a drive (requires authfile and basicauth)")
 	flag.BoolVar(&Config.noLogs, "nologs", false,
 		"remove stdout output for each request")
 	flag.BoolVar(&Config.allowHotlink, "allowhotlink", false,
@@ -257,10 +742,34 @@ func main() {
 		"path relative to site base url where files are accessed directly")
 	flag.Int64Var(&Config.maxSize, "maxsize", 4*1024*1024*1024,
 		"maximum upload file size in bytes (default 4GB)")
+	flag.Var(&Config.maxSizeByMime, "maxsize-by-mime",
+		"smaller maximum size in bytes for a mimetype or pattern like image/*, as mimetype=size (can be specified multiple times)")
+	flag.Int64Var(&Config.maxFiles, "max-files", 0,
+		"maximum number of files to store at once (default is 0, which is no limit)")
+	flag.Int64Var(&Config.maxTotalSize, "max-total-size", 0,
+		"maximum number of bytes all files may take up together (default is 0, which is no limit)")
+	flag.BoolVar(&Config.reservations, "reservations", false,
+		"let clients reserve room for a file at /reserve before uploading it, so that uploads that wouldn't fit are refused up front")
+	flag.IntVar(&Config.maxNameLength, "max-name-length", backends.DefaultMaxNameLength,
+		"longest original filename in bytes to store, longer ones being truncated")
+	flag.BoolVar(&Config.keepRawName, "keep-raw-name", false,
+		"keep original filenames as uploaded in custom metadata when sanitizing changes them")
 	flag.Uint64Var(&Config.maxExpiry, "maxexpiry", 0,
 		"maximum expiration time in seconds (default is 0, which is no expiry)")
 	flag.Uint64Var(&Config.defaultExpiry, "default-expiry", 86400,
 		"default expiration time in seconds (default is 86400, which is 1 day)")
+	flag.Var(&Config.allowedExpiries, "allowed-expiry",
+		"an expiration time in seconds files may be stored with, or never (can be specified multiple times, default is to allow any)")
+	flag.BoolVar(&Config.snapExpiry, "snap-expiry", false,
+		"round expiration times that aren't allowed down to the closest allowed one instead of rejecting the upload")
+	flag.IntVar(&Config.keyMinLength, "key-min-length", 0,
+		"fewest characters a file's name may have, including its extension, and the length of random names if over 8 (default is 0, which allows any)")
+	flag.IntVar(&Config.keyMaxLength, "key-max-length", 0,
+		"most characters a file's name may have, including its extension (default is 0, which allows any)")
+	flag.StringVar(&Config.keyCharset, "key-charset", "",
+		"the only characters file names may have, and random names are drawn from (default is any, with random names of a-z and 0-9)")
+	flag.Var(&Config.checksums, "checksum",
+		"a checksum to compute for new files besides the sha256sum: md5, sha1, sha512 or blake3 (can be specified multiple times)")
 	flag.StringVar(&Config.certFile, "certfile", "",
 		"path to ssl certificate (for https)")
 	flag.StringVar(&Config.keyFile, "keyfile", "",
@@ -281,6 +790,10 @@ func main() {
 	flag.StringVar(&Config.fileContentSecurityPolicy, "filecontentsecuritypolicy",
 		"default-src 'none'; img-src 'self'; object-src 'self'; media-src 'self'; style-src 'self' 'unsafe-inline'; frame-ancestors 'self';",
 		"value of Content-Security-Policy header for file access")
+	flag.Var(&Config.servePolicies, "serve-policy",
+		"how files of a mimetype or pattern like text/* are served, as mimetype=attachment, mimetype=inline or mimetype=policy for a Content-Security-Policy (can be specified multiple times)")
+	flag.BoolVar(&Config.allowInlineMarkup, "allow-inline-markup", false,
+		"serve HTML and SVG files inline like any other, for instances where only trusted users upload")
 	flag.StringVar(&Config.referrerPolicy, "referrerpolicy",
 		"same-origin",
 		"value of default Referrer-Policy header")
@@ -304,8 +817,100 @@ func main() {
 		"Extra text above the footer for notices.")
 	flag.Uint64Var(&Config.maxDurationTime, "max-duration-time", 0, "Time till expiry for files over max-duration-size. (Default is 0 for no-expiry.)")
 	flag.Int64Var(&Config.maxDurationSize, "max-duration-size", 4*1024*1024*1024, "Size of file before max-duration-time is used to determine expiry max time. (Default is 4GB)")
+	flag.Var(&Config.expiryTiers, "expiry-tier",
+		"longest time in seconds files over a size in bytes are kept for, as size=seconds, with files limited by the largest size they're over (can be specified multiple times)")
 	flag.BoolVar(&Config.disableAccessKey, "disable-access-key", false, "Disables access key usage. (Default is false.)")
 	flag.BoolVar(&Config.defaultRandomFilename, "default-random-filename", true, "Makes it so the random filename is not default if set false. (Default is true.)")
+	flag.BoolVar(&Config.dedup, "dedup", false,
+		"store uploads with identical content only once by hardlinking them")
+	flag.BoolVar(&Config.anonymizeIP, "anonymize-ip", false,
+		"store only the network part of uploaders' IPs, zeroing the last octet of IPv4 and the last 80 bits of IPv6 addresses")
+	flag.Uint64Var(&Config.slidingExpiry, "sliding-expiry", 0,
+		"move the expiry of files to this many seconds after they were last downloaded (default is 0, which keeps the expiry set on upload)")
+	flag.BoolVar(&Config.softDelete, "soft-delete", false,
+		"move deleted files into a trash directory they can be restored from, instead of removing them")
+	flag.Uint64Var(&Config.trashGracePeriod, "trash-grace-period", 7*24*60*60,
+		"seconds to keep soft deleted files for before cleanup removes them for good")
+	flag.StringVar(&Config.encryptionKeyFile, "encryption-key-file", "",
+		"path to a file containing a hex-encoded 32 byte key to encrypt files at rest with")
+	flag.IntVar(&Config.shardDepth, "shard-depth", 0,
+		"store files under this many levels of subdirectories named after the start of their key (default is 0, which stores them flat)")
+	flag.BoolVar(&Config.singleFile, "single-file", false,
+		"store the metadata of files at the start of each file instead of in metapath, halving the number of files stored")
+	flag.BoolVar(&Config.blobExtensions, "blob-extensions", false,
+		"store files with an extension for their mimetype, such as files/abcd1234.png, while their URLs stay the same")
+	flag.Var(&Config.fileMode, "file-mode",
+		"octal permissions to create files and their metadata with regardless of the umask, such as 0640 (default is 0666 less the umask)")
+	flag.Var(&Config.dirMode, "dir-mode",
+		"octal permissions to create the subdirectories of shard-depth with regardless of the umask, such as 0750 (default is 0755 less the umask)")
+	flag.BoolVar(&Config.durable, "durable", false,
+		"flush files and their metadata to disk before responding to uploads, at the cost of throughput")
+	flag.StringVar(&Config.sendfile, "sendfile", "",
+		"have the reverse proxy serve files from disk by answering with this header, X-Accel-Redirect for nginx or X-Sendfile for Apache and lighttpd")
+	flag.StringVar(&Config.sendfilePrefix, "sendfile-prefix", "",
+		"prefix of the paths sent in the sendfile header, such as an nginx internal location (default is /<name of filespath>/ for X-Accel-Redirect, the absolute filespath for X-Sendfile)")
+	flag.StringVar(&Config.compression, "compression", "",
+		"compress files at rest with gzip or zstd, except for already compressed content (default is none)")
+	flag.BoolVar(&Config.hashKeys, "hash-keys", false,
+		"store hashes of delete and access keys instead of the keys themselves")
+	flag.StringVar(&Config.presignKeyFile, "presign-key-file", "",
+		"path to a file containing a secret to sign presigned download URLs for local files with")
+	flag.Uint64Var(&Config.metadataCacheTTL, "metadata-cache-ttl", 0,
+		"cache file metadata in memory for this many seconds (default is 0, which disables the cache)")
+	flag.IntVar(&Config.metadataCacheSize, "metadata-cache-size", 10000,
+		"maximum number of files to cache metadata for")
+	flag.StringVar(&Config.clamavAddress, "clamav-address", "",
+		"address of a clamd TCP socket to scan new files with, such as localhost:3310 (default is none, which disables scanning)")
+	flag.Uint64Var(&Config.clamavTimeout, "clamav-timeout", 60,
+		"seconds to wait for clamd to scan a file before rejecting it")
+	flag.Float64Var(&Config.putRateLimit, "put-rate-limit", 0,
+		"number of files per second each source IP may store, on average (default is 0, which disables the limit)")
+	flag.IntVar(&Config.putRateBurst, "put-rate-burst", 10,
+		"number of files a source IP may store at once before put-rate-limit applies")
+	flag.Int64Var(&Config.downloadRate, "download-rate", 0,
+		"number of bytes per second each download is sent at, at most (default is 0, which disables the limit)")
+	flag.Int64Var(&Config.minUploadRate, "min-upload-rate", 0,
+		"fewest bytes per second an upload may come in at on average over min-upload-rate-window before it's dropped (default is 0, which disables the limit)")
+	flag.Uint64Var(&Config.minUploadRateWindow, "min-upload-rate-window", 30,
+		"seconds over which min-upload-rate is averaged")
+	flag.BoolVar(&Config.imageVariants, "image-variants", false,
+		"serve JPEG and PNG images as smaller AVIF or WebP to browsers that accept them, transcoding each once and caching the result in memory")
+	flag.BoolVar(&Config.readOnly, "read-only", false,
+		"serve stored files but refuse to store, change or delete any, such as during maintenance")
+	flag.StringVar(&Config.auditLog, "audit-log", "",
+		"path of a file to append a JSON line to for each deleted file, recording why and by whom it was deleted (default is none)")
+	flag.UintVar(&Config.mimetypeReadLimit, "mimetype-read-limit", helpers.DefaultMimetypeReadLimit,
+		"number of bytes from the start of a file used to detect its mimetype, from 1 to 1048576")
+	flag.Var(&Config.mimetypeOverrides, "mimetype-override",
+		"mimetype for files with an extension that would otherwise be detected as text/plain or application/octet-stream, as .ext=mimetype, or .ext= to remove a default (can be specified multiple times)")
+	flag.IntVar(&Config.archiveMaxDepth, "archive-max-depth", 0,
+		"levels of archives within archives to list the contents of (default is 0, which lists only the top level)")
+	flag.IntVar(&Config.archiveMaxEntries, "archive-max-entries", 10000,
+		"maximum number of entries to list in an archive, including nested ones")
+	flag.Int64Var(&Config.archiveMaxDecompressed, "archive-max-decompressed", 100*1024*1024,
+		"maximum number of bytes to decompress from nested archives to list them")
+	flag.StringVar(&Config.gcsBucket, "gcs-bucket", "",
+		"Google Cloud Storage bucket to store files and metadata in")
+	flag.StringVar(&Config.gcsCredentialsFile, "gcs-credentials-file", "",
+		"path to a Google Cloud service account key file (default is application default credentials)")
+	flag.Uint64Var(&Config.gcsSignedURLExpiry, "gcs-signed-url-expiry", 0,
+		"redirect downloads to signed URLs valid for this many seconds instead of streaming them (default is 0, which streams)")
+	flag.StringVar(&Config.azureContainer, "azure-container", "",
+		"Azure Blob Storage container to store files and metadata in")
+	flag.StringVar(&Config.azureAccountName, "azure-account-name", "",
+		"Azure storage account name")
+	flag.StringVar(&Config.azureAccountKey, "azure-account-key", "",
+		"Azure storage account key")
+	flag.StringVar(&Config.azureServiceURL, "azure-service-url", "",
+		"Azure blob service URL (default is https://<account>.blob.core.windows.net/)")
+	flag.Uint64Var(&Config.azureSASExpiry, "azure-sas-expiry", 0,
+		"redirect downloads to SAS URLs valid for this many seconds instead of proxying them (default is 0, which proxies)")
+	flag.StringVar(&Config.ipfsAPIURL, "ipfs-api-url", "",
+		"RPC API of an IPFS node to store files on, such as http://127.0.0.1:5001, with their metadata kept in metapath")
+	flag.StringVar(&Config.sqlitePath, "sqlite-path", "",
+		"SQLite database to store files and their metadata in, such as linx.db, instead of filespath and metapath")
+	flag.StringVar(&Config.metricsBind, "metrics-bind", "",
+		"host to serve Prometheus metrics of storage backend operations on at /metrics, such as 127.0.0.1:9090 (default is to not serve them)")
 	iniflags.Parse()
 
 	mux := setup()
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"mime/multipart"
 	"net/http"
@@ -15,8 +16,17 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/zenazn/goji/web/middleware"
 )
 
+// Flags aren't parsed in tests, and setup refuses the limit they'd leave
+func init() {
+	Config.mimetypeReadLimit = helpers.DefaultMimetypeReadLimit
+}
+
 type RespOkJSON struct {
 	Filename   string
 	Url        string
@@ -1303,3 +1313,60 @@ func TestPutAndGetCLI(t *testing.T) {
 	}
 
 }
+
+type failingAuditLogger struct{}
+
+func (failingAuditLogger) LogDelete(key, reason, actor string) error {
+	return errors.New("disk full")
+}
+
+func TestDeleteAuditFailure(t *testing.T) {
+	var myjson RespOkJSON
+
+	oldMaxSize := Config.maxSize
+	Config.maxSize = 1024
+	defer func() { Config.maxSize = oldMaxSize }()
+
+	mux := setup()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/upload", strings.NewReader("File content"))
+	req.Header.Set("Accept", "application/json")
+	mux.ServeHTTP(w, req)
+	if err := json.Unmarshal(w.Body.Bytes(), &myjson); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := storageBackend
+	storageBackend = backends.NewAuditedBackend(stored, failingAuditLogger{})
+	defer func() { storageBackend = stored }()
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", "/"+myjson.Filename, nil)
+	req.Header.Set("Linx-Delete-Key", myjson.Delete_Key)
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 || w.Body.String() != "DELETED" {
+		t.Fatalf("Delete that couldn't be audited returned %d %q", w.Code, w.Body.String())
+	}
+
+	if exists, _ := stored.Exists(req.Context(), myjson.Filename); exists {
+		t.Fatal("File wasn't deleted")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("PUT", "/upload/file.txt", nil)
+	req.RemoteAddr = "192.0.2.1:51234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	if ip := clientIP(req); ip != "192.0.2.1" {
+		t.Fatalf("Expected the connection's address, got %q", ip)
+	}
+
+	var proxied string
+	middleware.RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = clientIP(r)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if proxied != "198.51.100.7" {
+		t.Fatalf("Expected the forwarded address behind -realip, got %q", proxied)
+	}
+}
@@ -50,13 +50,16 @@ func createTorrent(fileName string, f io.Reader, r *http.Request) ([]byte, error
 func fileTorrentHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	fileName := c.URLParams["name"]
 
-	metadata, f, err := storageBackend.Get(fileName)
+	metadata, f, err := storageBackend.Get(backends.WithServing(r.Context()), fileName)
 	if err == backends.NotFoundErr {
 		notFoundHandler(c, w, r)
 		return
 	} else if err == backends.BadMetadata {
 		oopsHandler(c, w, r, RespAUTO, "Corrupt metadata.")
 		return
+	} else if err == backends.OrphanedMetadataErr {
+		oopsHandler(c, w, r, RespAUTO, "File corrupted.")
+		return
 	} else if err != nil {
 		oopsHandler(c, w, r, RespAUTO, err.Error())
 		return
@@ -64,7 +67,7 @@ func fileTorrentHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	defer f.Close()
 
 	if expiry.IsTsExpired(metadata.Expiry) {
-		storageBackend.Delete(fileName)
+		backends.DeleteWithReason(r.Context(), storageBackend, fileName, "expired", "")
 		notFoundHandler(c, w, r)
 		return
 	}
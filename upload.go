@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/zenazn/goji/web"
 )
+
 var fileBlacklist = map[string]bool{
 	"favicon.ico":     true,
 	"index.htm":       true,
@@ -38,7 +40,11 @@ type UploadRequest struct {
 	deleteKey      string        // Empty string if not defined
 	randomBarename bool
 	accessKey      string // Empty string if not defined
-	srcIp          string // Empty string if not defined
+	srcIp          string
+	sha256sum      string              // Empty string if not defined
+	encryption     backends.Encryption // Zero if the client didn't encrypt the file
+	reservation    string              // Empty string if no room was reserved
+	maxDownloads   int64               // 0 = unlimited
 }
 
 // Metadata associated with a file as it would actually be stored
@@ -111,13 +117,17 @@ func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	upReq.srcIp = r.Header.Get("X-Forwarded-For")
-	upload, err := processUpload(upReq)
+	upReq.srcIp = clientIP(r)
+	upload, err := processUpload(r.Context(), upReq)
+	endStalledRead(w, err)
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		if err == backends.FileTooLargeError || err == backends.FileEmptyError {
+		if isBadUpload(err) {
 			badRequestHandler(c, w, r, RespJSON, err.Error())
 			return
+		} else if errors.Is(err, backends.StorageFullErr) {
+			storageFullHandler(c, w, r, RespJSON, "Could not upload file: "+backends.StorageFullErr.Error())
+			return
 		} else if err != nil {
 			oopsHandler(c, w, r, RespJSON, "Could not upload file: "+err.Error())
 			return
@@ -127,9 +137,12 @@ func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.Write(js)
 	} else {
-		if err == backends.FileTooLargeError || err == backends.FileEmptyError {
+		if isBadUpload(err) {
 			badRequestHandler(c, w, r, RespHTML, err.Error())
 			return
+		} else if errors.Is(err, backends.StorageFullErr) {
+			storageFullHandler(c, w, r, RespHTML, "Could not upload file: "+backends.StorageFullErr.Error())
+			return
 		} else if err != nil {
 			oopsHandler(c, w, r, RespHTML, "Could not upload file: "+err.Error())
 			return
@@ -142,17 +155,21 @@ func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 func uploadPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	upReq := UploadRequest{}
 	uploadHeaderProcess(r, &upReq)
-	
+
 	defer r.Body.Close()
 	upReq.filename = c.URLParams["name"]
 	upReq.src = r.Body
-	upReq.srcIp = r.Header.Get("X-Forwarded-For")
-	upload, err := processUpload(upReq)
+	upReq.srcIp = clientIP(r)
+	upload, err := processUpload(r.Context(), upReq)
+	endStalledRead(w, err)
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		if err == backends.FileTooLargeError || err == backends.FileEmptyError {
+		if isBadUpload(err) {
 			badRequestHandler(c, w, r, RespJSON, err.Error())
 			return
+		} else if errors.Is(err, backends.StorageFullErr) {
+			storageFullHandler(c, w, r, RespJSON, "Could not upload file: "+backends.StorageFullErr.Error())
+			return
 		} else if err != nil {
 			oopsHandler(c, w, r, RespJSON, "Could not upload file: "+err.Error())
 			return
@@ -162,9 +179,12 @@ func uploadPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.Write(js)
 	} else {
-		if err == backends.FileTooLargeError || err == backends.FileEmptyError {
+		if isBadUpload(err) {
 			badRequestHandler(c, w, r, RespPLAIN, err.Error())
 			return
+		} else if errors.Is(err, backends.StorageFullErr) {
+			storageFullHandler(c, w, r, RespPLAIN, "Could not upload file: "+backends.StorageFullErr.Error())
+			return
 		} else if err != nil {
 			oopsHandler(c, w, r, RespPLAIN, "Could not upload file: "+err.Error())
 			return
@@ -211,18 +231,24 @@ func uploadRemote(c web.C, w http.ResponseWriter, r *http.Request) {
 		oopsHandler(c, w, r, RespAUTO, "Could not retrieve URL")
 		return
 	}
-	
+
+	// Closing the body also ends a read given up on for being too slow
+	defer resp.Body.Close()
+
 	upReq.filename = filepath.Base(grabUrl.Path)
 	upReq.src = resp.Body
 	upReq.deleteKey = r.FormValue("deletekey")
 	upReq.accessKey = r.FormValue(accessKeyParamName)
 	upReq.randomBarename = r.FormValue("randomize") == "yes"
 	upReq.expiry = parseExpiry(r.FormValue("expiry"))
-	upReq.srcIp = r.Header.Get("X-Forwarded-For")
-	upload, err := processUpload(upReq)
+	upReq.srcIp = clientIP(r)
+	upload, err := processUpload(r.Context(), upReq)
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		if err != nil {
+		if errors.Is(err, backends.StorageFullErr) {
+			storageFullHandler(c, w, r, RespJSON, "Could not upload file: "+backends.StorageFullErr.Error())
+			return
+		} else if err != nil {
 			oopsHandler(c, w, r, RespJSON, "Could not upload file: "+err.Error())
 			return
 		}
@@ -231,7 +257,10 @@ func uploadRemote(c web.C, w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.Write(js)
 	} else {
-		if err != nil {
+		if errors.Is(err, backends.StorageFullErr) {
+			storageFullHandler(c, w, r, RespHTML, "Could not upload file: "+backends.StorageFullErr.Error())
+			return
+		} else if err != nil {
 			oopsHandler(c, w, r, RespHTML, "Could not upload file: "+err.Error())
 			return
 		}
@@ -244,18 +273,55 @@ func uploadRemote(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Whether an upload was refused because of the file itself, rather than an
+// error on the server's side
+func isBadUpload(err error) bool {
+	var mimeErr backends.MimeSizeLimitError
+	var malwareErr backends.MalwareDetectedError
+	return err == backends.FileTooLargeError || err == backends.FileEmptyError ||
+		err == backends.ChecksumMismatchError || err == backends.RateLimitedErr ||
+		err == backends.InvalidExpiryErr || err == backends.InvalidKeyErr ||
+		err == backends.QuotaExceededErr || err == backends.ReservationNotFoundErr ||
+		err == backends.NotSupportedErr || err == backends.UploadTooSlowErr ||
+		errors.As(err, &mimeErr) || errors.As(err, &malwareErr)
+}
+
+// A read from the request body that was given up on for being too slow is
+// still waiting for the client, and closing the body would wait for it
+// too. Ending it lets the response be sent and the connection closed.
+func endStalledRead(w http.ResponseWriter, err error) {
+	if err == backends.UploadTooSlowErr {
+		http.NewResponseController(w).SetReadDeadline(time.Now())
+	}
+}
+
 func uploadHeaderProcess(r *http.Request, upReq *UploadRequest) {
 	if r.Header.Get("Linx-Randomize") == "yes" {
 		upReq.randomBarename = true
 	}
 	upReq.deleteKey = r.Header.Get("Linx-Delete-Key")
 	upReq.accessKey = r.Header.Get(accessKeyHeaderName)
+	upReq.sha256sum = r.Header.Get("Linx-Sha256sum")
+	upReq.encryption = backends.Encryption{
+		Scheme:  r.Header.Get("Linx-Encryption-Scheme"),
+		Nonce:   r.Header.Get("Linx-Encryption-Nonce"),
+		KeyHint: r.Header.Get("Linx-Encryption-Key-Hint"),
+	}
+	upReq.reservation = r.Header.Get("Linx-Reservation")
+	// Anything but a positive integer is unlimited
+	if n, err := strconv.ParseInt(r.Header.Get("Linx-Max-Downloads"), 10, 64); err == nil && n > 0 {
+		upReq.maxDownloads = n
+	}
 	// Get seconds until expiry. Non-integer responses never expire.
 	expStr := r.Header.Get("Linx-Expiry")
 	upReq.expiry = parseExpiry(expStr)
 }
 
-func processUpload(upReq UploadRequest) (upload Upload, err error) {
+func processUpload(ctx context.Context, upReq UploadRequest) (upload Upload, err error) {
+	if upReq.maxDownloads > 0 && !storageBackend.Capabilities().SupportsMaxDownloads {
+		return upload, backends.NotSupportedErr
+	}
+
 	// Determine the appropriate filename
 	barename, extension := barePlusExt(upReq.filename)
 	randomize := false
@@ -267,7 +333,10 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 	}
 
 	var header []byte
-	if len(extension) == 0 {
+	if len(extension) == 0 && upReq.encryption.Scheme != "" {
+		// There's nothing to detect in encrypted content
+		extension = "file"
+	} else if len(extension) == 0 {
 		// Pull the first 512 bytes off for use in MIME detection
 		header = make([]byte, 512)
 		n, _ := upReq.src.Read(header)
@@ -288,14 +357,16 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 	upload.Filename = strings.Join([]string{barename, extension}, ".")
 	upload.Filename = strings.Replace(upload.Filename, " ", "", -1)
 
-	fileexists, _ := storageBackend.Exists(upload.Filename)
+	fileexists, _ := storageBackend.Exists(ctx, upload.Filename)
+	overwrite := false
 
 	// Check if the delete key matches, in which case overwrite
 	if fileexists {
-		metad, merr := storageBackend.Head(upload.Filename)
+		matches, merr := storageBackend.CheckDeleteKey(ctx, upload.Filename, upReq.deleteKey)
 		if merr == nil {
-			if upReq.deleteKey == metad.DeleteKey {
+			if matches {
 				fileexists = false
+				overwrite = true
 			} else if Config.forceRandomFilename == true {
 				// the file exists
 				// the delete key doesn't match
@@ -312,24 +383,10 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 		fileexists = true
 	}
 
+	gen := &filenameGenerator{barename, extension, randomize}
 	for fileexists {
-		if randomize {
-			barename = generateBarename()
-		} else {
-			counter, err := strconv.Atoi(string(barename[len(barename)-1]))
-			if err != nil {
-				barename = barename + "1"
-			} else {
-				barename = barename[:len(barename)-1] + strconv.Itoa(counter+1)
-			}
-		}
-		upload.Filename = strings.Join([]string{barename, extension}, ".")
-
-		fileexists, err = storageBackend.Exists(upload.Filename)
-	}
-
-	if fileBlacklist[strings.ToLower(upload.Filename)] {
-		return upload, errors.New("Prohibited filename")
+		upload.Filename = gen.Generate()
+		fileexists, err = storageBackend.Exists(ctx, upload.Filename)
 	}
 
 	if upReq.deleteKey == "" {
@@ -339,13 +396,26 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 		upReq.accessKey = ""
 	}
 
-  var original_filename string
-  if randomize {
-    original_filename = ""
-  } else {
-    original_filename = upReq.filename
-  }
-	upload.Metadata, err = storageBackend.Put(upload.Filename, io.LimitReader(io.MultiReader(bytes.NewReader(header), upReq.src), Config.maxSize), upReq.expiry, upReq.deleteKey, upReq.accessKey, upReq.srcIp, original_filename)
+	var original_filename string
+	if randomize {
+		original_filename = ""
+	} else {
+		original_filename = upReq.filename
+	}
+
+	if fileBlacklist[strings.ToLower(upload.Filename)] {
+		return upload, errors.New("Prohibited filename")
+	}
+
+	// Another upload can still take the filename since it was checked, in
+	// which case the next one is tried
+	upload.Filename, upload.Metadata, err = backends.PutGenerated(ctx, storageBackend, upload.Filename, gen, maxKeyAttempts, backends.LimitedReader(io.MultiReader(bytes.NewReader(header), upReq.src), Config.maxSize), upReq.expiry, upReq.deleteKey, upReq.accessKey, upReq.srcIp, original_filename, backends.PutOptions{
+		ExpectedSha256: upReq.sha256sum,
+		Overwrite:      overwrite,
+		Encryption:     upReq.encryption,
+		Reservation:    upReq.reservation,
+		MaxDownloads:   upReq.maxDownloads,
+	})
 	if err != nil {
 		return upload, err
 	}
@@ -353,12 +423,54 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 	return
 }
 
+// How many filenames an upload tries when others keep taking them first
+const maxKeyAttempts = 10
+
+// Comes up with the next filename to try when one is taken: a new random
+// barename, or the same one with a counter at the end. Blacklisted
+// filenames are skipped.
+type filenameGenerator struct {
+	barename  string
+	extension string
+	randomize bool
+}
+
+func (g *filenameGenerator) Generate() string {
+	for {
+		if g.randomize {
+			g.barename = generateBarename()
+		} else {
+			counter, err := strconv.Atoi(string(g.barename[len(g.barename)-1]))
+			if err != nil {
+				g.barename = g.barename + "1"
+			} else {
+				g.barename = g.barename[:len(g.barename)-1] + strconv.Itoa(counter+1)
+			}
+		}
+
+		filename := strings.Join([]string{g.barename, g.extension}, ".")
+		if !fileBlacklist[strings.ToLower(filename)] {
+			return filename
+		}
+	}
+}
+
+// Random barenames are at least key-min-length long, and drawn from
+// key-charset if given, leaving out the dot that separates extensions
+func barenameGenerator() backends.KeyGenerator {
+	chars := "abcdefghijklmnopqrstuvwxyz0123456789"
+	if charset := strings.ReplaceAll(Config.keyCharset, ".", ""); charset != "" {
+		chars = charset
+	}
+	return backends.RandomKeyGenerator{Length: max(8, Config.keyMinLength), Charset: chars}
+}
+
 func generateBarename() string {
-	return uniuri.NewLenChars(8, []byte("abcdefghijklmnopqrstuvwxyz0123456789"))
+	return barenameGenerator().Generate()
 }
 
 func generateJSONresponse(upload Upload, r *http.Request) []byte {
-	js, _ := json.Marshal(map[string]string{
+	resp := map[string]string{
 		"url":        getSiteURL(r) + upload.Filename,
 		"direct_url": getSiteURL(r) + Config.selifPath + upload.Filename,
 		"filename":   upload.Filename,
@@ -368,11 +480,34 @@ func generateJSONresponse(upload Upload, r *http.Request) []byte {
 		"size":       strconv.FormatInt(upload.Metadata.Size, 10),
 		"mimetype":   upload.Metadata.Mimetype,
 		"sha256sum":  upload.Metadata.Sha256sum,
-	})
+		"public_id":  upload.Metadata.PublicID,
+	}
+	addEncryptionJSON(resp, upload.Metadata.Encryption)
+	addChecksumsJSON(resp, upload.Metadata.Checksums)
 
+	js, _ := json.Marshal(resp)
 	return js
 }
 
+// Add what clients need to decrypt a file they encrypted themselves to a
+// JSON response, if they did
+func addEncryptionJSON(resp map[string]string, e backends.Encryption) {
+	if e.Scheme == "" {
+		return
+	}
+	resp["encryption_scheme"] = e.Scheme
+	resp["encryption_nonce"] = e.Nonce
+	resp["encryption_key_hint"] = e.KeyHint
+}
+
+// Add the checksums computed besides the sha256sum to a JSON response, as
+// <algorithm>sum like the sha256sum
+func addChecksumsJSON(resp map[string]string, checksums map[string]string) {
+	for algorithm, sum := range checksums {
+		resp[algorithm+"sum"] = sum
+	}
+}
+
 var bareRe = regexp.MustCompile(`[^A-Za-z0-9\-]`)
 var extRe = regexp.MustCompile(`[^A-Za-z0-9\-\.]`)
 var compressedExts = map[string]bool{
@@ -384,6 +519,17 @@ var archiveExts = map[string]bool{
 	".tar": true,
 }
 
+// The names files can be accessed under, for files stored other than by
+// uploading them, such as through WebDAV
+var uploadNameRe = regexp.MustCompile(`^[a-z0-9-\.]+$`)
+
+func validateUploadName(name string) error {
+	if !uploadNameRe.MatchString(name) || fileBlacklist[name] {
+		return backends.InvalidKeyErr
+	}
+	return nil
+}
+
 func barePlusExt(filename string) (barename, extension string) {
 	filename = strings.TrimSpace(filename)
 	filename = strings.ToLower(filename)
@@ -0,0 +1,399 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/dchest/uniuri"
+)
+
+const allowedMethods = "OPTIONS, GET, HEAD, PUT, DELETE, COPY, MOVE, PROPFIND"
+
+type Options struct {
+	// Path the handler is served under, which is stripped from request
+	// paths and Destination headers to get keys
+	Prefix string
+
+	// Expiry to store files with, 0 for none
+	Expiry time.Duration
+
+	// Checked for every key on top of backends.ValidateKey, such as to
+	// only allow the names normal uploads can have
+	ValidateKey func(key string) error
+
+	// List every file in the root collection for PROPFIND, on backends
+	// that can list their files. Anyone allowed to make requests to the
+	// handler can see every key.
+	Listing bool
+}
+
+// Serves the files of a StorageBackend as a single WebDAV collection, with
+// files stored through it getting a random delete key. Locking isn't
+// supported, so clients have to mount it as DAV class 1.
+type Handler struct {
+	b backends.StorageBackend
+	o Options
+}
+
+func NewHandler(b backends.StorageBackend, o Options) Handler {
+	o.Prefix = "/" + strings.Trim(o.Prefix, "/") + "/"
+	if o.Prefix == "//" {
+		o.Prefix = "/"
+	}
+	return Handler{b, o}
+}
+
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var key string
+	if strings.HasPrefix(r.URL.Path, h.o.Prefix) {
+		key = strings.TrimPrefix(r.URL.Path, h.o.Prefix)
+	} else if r.URL.Path != strings.TrimSuffix(h.o.Prefix, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("Allow", allowedMethods)
+		w.Header().Set("DAV", "1")
+		w.WriteHeader(http.StatusOK)
+		return
+	case "PROPFIND":
+		h.propfind(w, r, key)
+		return
+	}
+
+	// The root collection itself can only be listed
+	if key == "" {
+		w.Header().Set("Allow", "OPTIONS, PROPFIND")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.validateKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		h.get(w, r, key)
+	case "PUT":
+		h.put(w, r, key)
+	case "DELETE":
+		h.delete(w, r, key)
+	case "COPY", "MOVE":
+		h.copyMove(w, r, key)
+	default:
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h Handler) validateKey(key string) error {
+	if err := backends.ValidateKey(key); err != nil {
+		return err
+	}
+	if h.o.ValidateKey != nil {
+		return h.o.ValidateKey(key)
+	}
+	return nil
+}
+
+// Expired files are treated as gone, as they are everywhere else
+func (h Handler) head(r *http.Request, key string) (backends.Metadata, error) {
+	m, err := h.b.Head(r.Context(), key)
+	if err == nil && expiry.IsTsExpired(m.Expiry) {
+		return m, backends.NotFoundErr
+	}
+	return m, err
+}
+
+func (h Handler) get(w http.ResponseWriter, r *http.Request, key string) {
+	if _, err := h.head(r, key); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := h.b.ServeFile(key, w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+func (h Handler) put(w http.ResponseWriter, r *http.Request, key string) {
+	ctx := r.Context()
+	existed, _ := h.b.Exists(ctx, key)
+
+	srcIp, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		srcIp = r.RemoteAddr
+	}
+
+	_, err = h.b.Put(ctx, key, r.Body, h.o.Expiry, uniuri.NewLen(30), "", srcIp, key, backends.PutOptions{
+		Overwrite: true,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (h Handler) delete(w http.ResponseWriter, r *http.Request, key string) {
+	err := backends.DeleteWithReason(r.Context(), h.b, key, "webdav", webdavUser(r))
+	if errors.Is(err, backends.AuditLogErr) {
+		log.Printf("Deleted %s: %v", key, err)
+	} else if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h Handler) copyMove(w http.ResponseWriter, r *http.Request, key string) {
+	ctx := r.Context()
+
+	dst, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || r.Header.Get("Destination") == "" {
+		http.Error(w, "Missing or invalid Destination header.", http.StatusBadRequest)
+		return
+	}
+	if dst.Host != "" && dst.Host != r.Host {
+		http.Error(w, "Destination is on another server.", http.StatusBadGateway)
+		return
+	}
+	if !strings.HasPrefix(dst.Path, h.o.Prefix) {
+		http.Error(w, "Destination is outside of this collection.", http.StatusForbidden)
+		return
+	}
+
+	dstKey := strings.TrimPrefix(dst.Path, h.o.Prefix)
+	if err := h.validateKey(dstKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dstKey == key {
+		http.Error(w, "Destination is the same as the source.", http.StatusForbidden)
+		return
+	}
+
+	if _, err := h.head(r, key); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Backends refuse to overwrite when copying or renaming, so a file
+	// being overwritten is copied or moved to a temporary key first and
+	// only replaces the destination once that worked
+	target := dstKey
+	existed, _ := h.b.Exists(ctx, dstKey)
+	if existed {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "Destination already exists.", http.StatusPreconditionFailed)
+			return
+		}
+		target = tempKey()
+	}
+
+	if r.Method == "MOVE" {
+		err = h.b.Rename(ctx, key, target)
+	} else {
+		_, err = h.b.Copy(ctx, key, target)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if existed {
+		err := backends.DeleteWithReason(ctx, h.b, dstKey, "overwritten by webdav "+strings.ToLower(r.Method), webdavUser(r))
+		if errors.Is(err, backends.AuditLogErr) {
+			log.Printf("Deleted %s: %v", dstKey, err)
+		} else if err != nil {
+			if r.Method == "MOVE" {
+				h.b.Rename(ctx, target, key)
+			} else {
+				h.b.Delete(ctx, target)
+			}
+			writeError(w, err)
+			return
+		}
+
+		if err := h.b.Rename(ctx, target, dstKey); err != nil {
+			log.Printf("Left %s at %s: %v", dstKey, target, err)
+			writeError(w, err)
+			return
+		}
+	}
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// A key for a file to wait under until it replaces another, meeting the
+// key policy so that backends accept it
+func tempKey() string {
+	p := backends.Limits.KeyPolicy
+	length := max(p.MinLen, 16)
+	if p.MaxLen > 0 {
+		length = min(length, p.MaxLen)
+	}
+	return backends.RandomKeyGenerator{Length: length, Charset: p.Charset}.Generate()
+}
+
+type multistatus struct {
+	XMLName   xml.Name   `xml:"D:multistatus"`
+	Namespace string     `xml:"xmlns:D,attr"`
+	Responses []response `xml:"D:response"`
+}
+
+type response struct {
+	Href     string   `xml:"D:href"`
+	Propstat propstat `xml:"D:propstat"`
+}
+
+type propstat struct {
+	Prop   prop   `xml:"D:prop"`
+	Status string `xml:"D:status"`
+}
+
+type prop struct {
+	DisplayName   string       `xml:"D:displayname,omitempty"`
+	ContentLength string       `xml:"D:getcontentlength,omitempty"`
+	ContentType   string       `xml:"D:getcontenttype,omitempty"`
+	LastModified  string       `xml:"D:getlastmodified,omitempty"`
+	ETag          string       `xml:"D:getetag,omitempty"`
+	ResourceType  resourceType `xml:"D:resourcetype"`
+}
+
+type resourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+func fileResponse(prefix, key string, m backends.Metadata) response {
+	modified := m.ModTime
+	if modified.IsZero() {
+		modified = m.Uploaded
+	}
+
+	p := prop{
+		DisplayName:   key,
+		ContentLength: strconv.FormatInt(m.Size, 10),
+		ContentType:   m.Mimetype,
+		ETag:          m.ETag,
+	}
+	if !modified.IsZero() {
+		p.LastModified = modified.UTC().Format(http.TimeFormat)
+	}
+	return response{prefix + url.PathEscape(key), propstat{p, "HTTP/1.1 200 OK"}}
+}
+
+// Every property is returned whichever ones were asked for, which clients
+// have to accept
+func (h Handler) propfind(w http.ResponseWriter, r *http.Request, key string) {
+	ctx := r.Context()
+	ms := multistatus{Namespace: "DAV:"}
+
+	if key != "" {
+		if err := h.validateKey(key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m, err := h.head(r, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		ms.Responses = append(ms.Responses, fileResponse(h.o.Prefix, key, m))
+	} else {
+		ms.Responses = append(ms.Responses, response{h.o.Prefix, propstat{
+			prop{ResourceType: resourceType{&struct{}{}}},
+			"HTTP/1.1 200 OK",
+		}})
+
+		meta, ok := h.b.(backends.MetaStorageBackend)
+		if h.o.Listing && ok && r.Header.Get("Depth") != "0" {
+			keys, err := meta.List(ctx)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			for _, key := range keys {
+				m, err := h.head(r, key)
+				if err != nil {
+					continue
+				}
+				ms.Responses = append(ms.Responses, fileResponse(h.o.Prefix, key, m))
+			}
+		}
+	}
+
+	out, err := xml.Marshal(ms)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var mimeErr backends.MimeSizeLimitError
+	var malwareErr backends.MalwareDetectedError
+
+	status := http.StatusInternalServerError
+	switch {
+	case err == backends.NotFoundErr:
+		status = http.StatusNotFound
+	case err == backends.RetentionLockedErr:
+		status = http.StatusLocked
+	case err == backends.KeyExistsErr:
+		status = http.StatusPreconditionFailed
+	case err == backends.FileTooLargeError || errors.As(err, &mimeErr):
+		status = http.StatusRequestEntityTooLarge
+	case err == backends.RateLimitedErr:
+		status = http.StatusTooManyRequests
+	case err == backends.TooManyFilesError:
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, backends.StorageFullErr):
+		// Without the path that couldn't be written
+		status, err = http.StatusInsufficientStorage, backends.StorageFullErr
+	case err == backends.FileEmptyError || err == backends.InvalidKeyErr ||
+		err == backends.InvalidExpiryErr || err == backends.ChecksumMismatchError ||
+		errors.As(err, &malwareErr):
+		status = http.StatusBadRequest
+	}
+
+	if status == http.StatusInternalServerError {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// The basic auth user a request was made as, if any
+func webdavUser(r *http.Request) string {
+	user, _, _ := r.BasicAuth()
+	return user
+}
@@ -0,0 +1,179 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+// Keeps files in memory, with only the methods the handler uses
+type memBackend struct {
+	backends.MetaStorageBackend
+	files map[string]string
+	full  bool
+}
+
+func (b *memBackend) Head(ctx context.Context, key string) (backends.Metadata, error) {
+	data, ok := b.files[key]
+	if !ok {
+		return backends.Metadata{}, backends.NotFoundErr
+	}
+	return backends.Metadata{Size: int64(len(data)), Mimetype: "text/plain", Expiry: expiry.NeverExpire}, nil
+}
+
+func (b *memBackend) Exists(ctx context.Context, key string) (bool, error) {
+	_, ok := b.files[key]
+	return ok, nil
+}
+
+func (b *memBackend) Put(ctx context.Context, key string, r io.Reader, expiry time.Duration, deleteKey, accessKey string, srcIp string, originalName string, o backends.PutOptions) (backends.Metadata, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return backends.Metadata{}, err
+	}
+	if int64(len(data)) > 10 {
+		return backends.Metadata{}, backends.FileTooLargeError
+	}
+	b.files[key] = string(data)
+	return b.Head(ctx, key)
+}
+
+func (b *memBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	io.WriteString(w, b.files[key])
+	return nil
+}
+
+func (b *memBackend) Delete(ctx context.Context, key string) error {
+	if _, ok := b.files[key]; !ok {
+		return backends.NotFoundErr
+	}
+	delete(b.files, key)
+	return nil
+}
+
+func (b *memBackend) Copy(ctx context.Context, srcKey, dstKey string) (backends.Metadata, error) {
+	if _, ok := b.files[dstKey]; ok {
+		return backends.Metadata{}, backends.KeyExistsErr
+	}
+	if b.full {
+		return backends.Metadata{}, backends.TooManyFilesError
+	}
+	b.files[dstKey] = b.files[srcKey]
+	return b.Head(ctx, dstKey)
+}
+
+func (b *memBackend) Rename(ctx context.Context, oldKey, newKey string) error {
+	if _, ok := b.files[newKey]; ok {
+		return backends.KeyExistsErr
+	}
+	b.files[newKey] = b.files[oldKey]
+	delete(b.files, oldKey)
+	return nil
+}
+
+func (b *memBackend) List(ctx context.Context) ([]string, error) {
+	var keys []string
+	for key := range b.files {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func TestHandler(t *testing.T) {
+	b := &memBackend{files: map[string]string{}}
+	h := NewHandler(b, Options{Prefix: "/dav", Listing: true})
+
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("PUT", "/dav/a.txt", "hello"); w.Code != http.StatusCreated {
+		t.Fatalf("New file returned %d", w.Code)
+	}
+	if w := do("PUT", "/dav/a.txt", "hi"); w.Code != http.StatusNoContent {
+		t.Fatalf("Overwritten file returned %d", w.Code)
+	}
+	if w := do("PUT", "/dav/big.txt", "far too large"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Too large file returned %d", w.Code)
+	}
+	if w := do("PUT", "/dav/..", "hello"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid key returned %d", w.Code)
+	}
+
+	if w := do("GET", "/dav/a.txt", ""); w.Code != http.StatusOK || w.Body.String() != "hi" {
+		t.Fatalf("GET returned %d, %q", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/dav/missing", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET of missing file returned %d", w.Code)
+	}
+
+	if w := do("COPY", "/dav/a.txt", "", "Destination", "http://example.com/dav/b.txt"); w.Code != http.StatusCreated || b.files["b.txt"] != "hi" {
+		t.Fatalf("COPY returned %d", w.Code)
+	}
+	if w := do("MOVE", "/dav/a.txt", "", "Destination", "/dav/b.txt", "Overwrite", "F"); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("MOVE without overwriting returned %d", w.Code)
+	}
+	if w := do("MOVE", "/dav/a.txt", "", "Destination", "/dav/b.txt"); w.Code != http.StatusNoContent {
+		t.Fatalf("MOVE over a file returned %d", w.Code)
+	}
+	if _, ok := b.files["a.txt"]; ok || b.files["b.txt"] != "hi" {
+		t.Fatalf("MOVE left %v", b.files)
+	}
+	if w := do("MOVE", "/dav/b.txt", "", "Destination", "/elsewhere/b.txt"); w.Code != http.StatusForbidden {
+		t.Fatalf("MOVE outside the collection returned %d", w.Code)
+	}
+
+	w := do("PROPFIND", "/dav/", "", "Depth", "1")
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<D:href>/dav/b.txt</D:href>") {
+		t.Fatalf("PROPFIND returned %d, %s", w.Code, w.Body.String())
+	}
+
+	if w := do("DELETE", "/dav/b.txt", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE returned %d", w.Code)
+	}
+	if w := do("DELETE", "/dav/b.txt", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("DELETE of missing file returned %d", w.Code)
+	}
+}
+
+func TestCopyOverwriteFails(t *testing.T) {
+	b := &memBackend{files: map[string]string{"a.txt": "new", "b.txt": "old"}}
+	h := NewHandler(b, Options{Prefix: "/dav"})
+
+	copyOver := func() int {
+		r := httptest.NewRequest("COPY", "/dav/a.txt", nil)
+		r.Header.Set("Destination", "/dav/b.txt")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	b.full = true
+	if code := copyOver(); code != http.StatusInsufficientStorage {
+		t.Fatalf("COPY with no room left returned %d", code)
+	}
+	if len(b.files) != 2 || b.files["b.txt"] != "old" {
+		t.Fatalf("Failed COPY left %v", b.files)
+	}
+
+	b.full = false
+	if code := copyOver(); code != http.StatusNoContent {
+		t.Fatalf("COPY over a file returned %d", code)
+	}
+	if len(b.files) != 2 || b.files["b.txt"] != "new" {
+		t.Fatalf("COPY over a file left %v", b.files)
+	}
+}